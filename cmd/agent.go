@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
@@ -15,9 +16,9 @@ import (
 
 var agent *taskvault.Agent
 
-const (
-	gracefulTimeout = 3 * time.Hour
-)
+// forceExitGrace is how much longer than the agent stop timeout the
+// command waits for a graceful stop before it exits anyway.
+const forceExitGrace = 5 * time.Second
 
 var agentCmd = &cobra.Command{
 	Use:   "agent",
@@ -55,45 +56,70 @@ func agentRun() error {
 	return nil
 }
 
+// handleReload reads the configuration again and applies what can change
+// without a restart.
+func handleReload() {
+	log.Info("agent: Reloading configuration...")
+
+	newConf, err := readConfig()
+	if err != nil {
+		log.WithError(err).Error("agent: Failed to reload configuration")
+		return
+	}
+	if err := agent.Reload(newConf); err != nil {
+		log.WithError(err).Error("agent: Failed to reload configuration")
+	}
+}
+
 func handleSignals() int {
 	signalCh := make(chan os.Signal, 4)
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 	var sig os.Signal
+WAIT:
 	select {
 	case s := <-signalCh:
 		sig = s
 	case err := <-agent.RetryJoinCh():
+		// Failed attempts are logged by the agent, only giving up is fatal.
+		var attemptErr *taskvault.RetryJoinAttemptError
+		if errors.As(err, &attemptErr) {
+			goto WAIT
+		}
 		fmt.Println("[ERR] agent: Retry join failed: ", err)
 		return 1
 	}
-	fmt.Printf("Caught signal: %v", sig)
+	log.Infof("agent: Caught signal: %v", sig)
+
+	if sig == syscall.SIGHUP {
+		handleReload()
+		goto WAIT
+	}
 
 	if sig != syscall.SIGTERM && sig != os.Interrupt {
 		return 1
 	}
 
 	log.Info("agent: Gracefully shutting down agent...")
+	gracefulCh := make(chan struct{})
+	exitCode := 0
 	go func() {
 		if err := agent.Stop(); err != nil {
-			fmt.Printf("Error: %s", err)
-			log.Error(fmt.Sprintf("Error: %s", err))
-			return
+			log.WithError(err).Error("agent: Error stopping agent")
+			exitCode = 1
 		}
+		close(gracefulCh)
 	}()
 
-	gracefulCh := make(chan struct{})
-
-	time.Sleep(1 * time.Second)
-
-	close(gracefulCh)
-
+	// A second signal or a stop that hangs past its timeout forces the exit.
 	select {
 	case <-signalCh:
+		log.Warn("agent: Caught second signal, forcing exit")
 		return 1
-	case <-time.After(gracefulTimeout):
+	case <-time.After(config.StopTimeout + forceExitGrace):
+		log.Warn("agent: Graceful shutdown timed out, forcing exit")
 		return 1
 	case <-gracefulCh:
-		return 0
+		return exitCode
 	}
 }
@@ -30,6 +30,21 @@ func Execute() {
 	}
 }
 
+// readConfig reads the config file again on top of the defaults, flags and
+// environment already bound to viper.
+func readConfig() (*taskvault.Config, error) {
+	if err := viper.ReadInConfig(); err != nil {
+		logrus.WithError(err).Info("No valid config found: Applying default values.")
+	}
+
+	c := taskvault.DefaultConfig()
+	if err := viper.Unmarshal(c); err != nil {
+		return nil, fmt.Errorf("config: Error unmarshalling config: %s", err)
+	}
+
+	return c, nil
+}
+
 func initConfig() error {
 	if cfgFile != "" {
 		viper.SetConfigFile(cfgFile)
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"github.com/danluki/taskvault/pkg/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Class tells a client what to do about an error returned by a taskvault
+// server.
+type Class int
+
+const (
+	// ClassNone is a nil error.
+	ClassNone Class = iota
+	// ClassRetry errors are transient: no leader, a stopping node, rate
+	// limiting, an overloaded leader or a node behind a continue token. The
+	// call is safe to retry, on another node if need be.
+	ClassRetry
+	// ClassInvalid errors are caused by the request itself, retrying it
+	// unchanged fails again.
+	ClassInvalid
+	// ClassNotFound errors name a key or session that does not exist.
+	ClassNotFound
+	// ClassPrecondition errors are caused by the stored state, for example
+	// incrementing a value that is not an integer.
+	ClassPrecondition
+	// ClassUnknown errors are anything else.
+	ClassUnknown
+)
+
+func (c Class) String() string {
+	switch c {
+	case ClassNone:
+		return "none"
+	case ClassRetry:
+		return "retry"
+	case ClassInvalid:
+		return "invalid"
+	case ClassNotFound:
+		return "not_found"
+	case ClassPrecondition:
+		return "precondition"
+	default:
+		return "unknown"
+	}
+}
+
+// Reason returns the ErrorDetail reason of a gRPC error, REASON_UNSPECIFIED
+// when the server sent none.
+func Reason(err error) types.ErrorReason {
+	st, ok := status.FromError(err)
+	if !ok {
+		return types.ErrorReason_REASON_UNSPECIFIED
+	}
+	for _, d := range st.Details() {
+		if detail, ok := d.(*types.ErrorDetail); ok {
+			return detail.Reason
+		}
+	}
+	return types.ErrorReason_REASON_UNSPECIFIED
+}
+
+// Classify sorts an error returned by a taskvault server. The reason decides
+// when the server sent one, the status code otherwise.
+func Classify(err error) Class {
+	if err == nil {
+		return ClassNone
+	}
+
+	switch Reason(err) {
+	case types.ErrorReason_REASON_NO_LEADER,
+		types.ErrorReason_REASON_NO_SUITABLE_SERVER,
+		types.ErrorReason_REASON_SHUTTING_DOWN,
+		types.ErrorReason_REASON_RATE_LIMITED,
+		types.ErrorReason_REASON_OVERLOADED,
+		types.ErrorReason_REASON_STALE_TOKEN:
+		return ClassRetry
+	case types.ErrorReason_REASON_INVALID_REQUEST,
+		types.ErrorReason_REASON_KEY_TOO_LARGE,
+		types.ErrorReason_REASON_VALUE_TOO_LARGE:
+		return ClassInvalid
+	case types.ErrorReason_REASON_KEY_NOT_FOUND,
+		types.ErrorReason_REASON_SESSION_NOT_FOUND:
+		return ClassNotFound
+	case types.ErrorReason_REASON_NOT_INTEGER,
+		types.ErrorReason_REASON_OVERFLOW:
+		return ClassPrecondition
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+		return ClassRetry
+	case codes.InvalidArgument, codes.OutOfRange, codes.Unauthenticated, codes.PermissionDenied:
+		return ClassInvalid
+	case codes.NotFound:
+		return ClassNotFound
+	case codes.FailedPrecondition, codes.AlreadyExists:
+		return ClassPrecondition
+	default:
+		return ClassUnknown
+	}
+}
+
+// Retryable reports whether the call that returned err is safe to retry.
+func Retryable(err error) bool {
+	return Classify(err) == ClassRetry
+}
@@ -0,0 +1,120 @@
+// Package ring maps keys to cluster members with consistent hashing. Clients
+// that shard keys across a cluster build a Ring from the members the agents
+// report and agree on the owner of every key. When a member joins or leaves
+// only the keys next to its points on the ring move.
+package ring
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"strconv"
+)
+
+// DefaultReplicas is the number of points every member gets on the ring. More
+// points spread the keys more evenly at the cost of memory.
+const DefaultReplicas = 128
+
+// Member is a server on the ring. Only ID decides where it lands, Addr and
+// Tags are carried along for the caller.
+type Member struct {
+	ID   string            `json:"id"`
+	Addr string            `json:"addr"`
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+type point struct {
+	hash   uint64
+	member int
+}
+
+// Ring is an immutable consistent hash ring, rebuild it with New when the
+// member set changes. It is safe for concurrent use.
+type Ring struct {
+	members []Member
+	points  []point
+}
+
+// New builds a ring of members with replicas points each, DefaultReplicas
+// when replicas is not positive. The order of members does not matter, the
+// same set always gives the same ring.
+func New(members []Member, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+
+	r := &Ring{members: slices.Clone(members)}
+	slices.SortFunc(r.members, func(a, b Member) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	r.members = slices.CompactFunc(r.members, func(a, b Member) bool {
+		return a.ID == b.ID
+	})
+
+	r.points = make([]point, 0, len(r.members)*replicas)
+	for i, m := range r.members {
+		for n := 0; n < replicas; n++ {
+			r.points = append(r.points, point{
+				hash:   hash(m.ID + "#" + strconv.Itoa(n)),
+				member: i,
+			})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b point) int {
+		// Colliding points are ordered by member so every client agrees.
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.member, b.member))
+	})
+
+	return r
+}
+
+// Get returns the member that owns key, ok is false on an empty ring.
+func (r *Ring) Get(key string) (Member, bool) {
+	members := r.GetN(key, 1)
+	if len(members) == 0 {
+		return Member{}, false
+	}
+	return members[0], true
+}
+
+// GetN returns up to n distinct members for key, the owner first and then
+// the next members clockwise. It suits keys stored on several members.
+func (r *Ring) GetN(key string, n int) []Member {
+	if len(r.points) == 0 || n <= 0 {
+		return nil
+	}
+	n = min(n, len(r.members))
+
+	h := hash(key)
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p point, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+
+	seen := make(map[int]bool, n)
+	result := make([]Member, 0, n)
+	for j := 0; len(result) < n; j++ {
+		p := r.points[(i+j)%len(r.points)]
+		if seen[p.member] {
+			continue
+		}
+		seen[p.member] = true
+		result = append(result, r.members[p.member])
+	}
+	return result
+}
+
+// Members returns the members of the ring ordered by ID.
+func (r *Ring) Members() []Member {
+	return slices.Clone(r.members)
+}
+
+// Len returns the number of members.
+func (r *Ring) Len() int {
+	return len(r.members)
+}
+
+func hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
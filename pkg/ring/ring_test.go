@@ -0,0 +1,52 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRing(t *testing.T) {
+	empty := New(nil, 0)
+	_, ok := empty.Get("k")
+	assert.False(t, ok)
+
+	members := []Member{{ID: "n3"}, {ID: "n1"}, {ID: "n2"}, {ID: "n1"}}
+	r := New(members, 0)
+	require.Equal(t, 3, r.Len())
+	assert.Equal(t, "n1", r.Members()[0].ID)
+
+	// The order of the input does not change the owners.
+	reversed := New([]Member{{ID: "n2"}, {ID: "n1"}, {ID: "n3"}}, 0)
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		m, ok := r.Get(key)
+		require.True(t, ok)
+		other, _ := reversed.Get(key)
+		require.Equal(t, m.ID, other.ID)
+		owners[key] = m.ID
+		counts[m.ID]++
+	}
+	for id, n := range counts {
+		assert.Greater(t, n, 600, "member %s owns too few keys", id)
+	}
+
+	// Removing a member only moves its own keys.
+	shrunk := New([]Member{{ID: "n1"}, {ID: "n2"}}, 0)
+	for key, owner := range owners {
+		m, _ := shrunk.Get(key)
+		if owner != "n3" {
+			assert.Equal(t, owner, m.ID)
+		}
+	}
+
+	n := r.GetN("key-1", 5)
+	require.Len(t, n, 3)
+	assert.Equal(t, owners["key-1"], n[0].ID)
+	assert.NotEqual(t, n[0].ID, n[1].ID)
+	assert.NotEqual(t, n[1].ID, n[2].ID)
+}
@@ -32,6 +32,40 @@ type TaskvaultClient interface {
 	RaftGetConfiguration(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RaftGetConfigurationResponse, error)
 	RaftRemovePeerByID(ctx context.Context, in *RaftRemovePeerByIDRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
 	GetAllPairs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*GetAllPairsResponse, error)
+	GetPair(ctx context.Context, in *GetPairRequest, opts ...grpc.CallOption) (*GetPairResponse, error)
+	StatPair(ctx context.Context, in *StatPairRequest, opts ...grpc.CallOption) (*PairMeta, error)
+	ListPairs(ctx context.Context, in *ListPairsRequest, opts ...grpc.CallOption) (*ListPairsResponse, error)
+	ListKeys(ctx context.Context, in *ListKeysRequest, opts ...grpc.CallOption) (*ListKeysResponse, error)
+	Count(ctx context.Context, in *CountRequest, opts ...grpc.CallOption) (*CountResponse, error)
+	CompareAndSwap(ctx context.Context, in *CompareAndSwapRequest, opts ...grpc.CallOption) (*CompareAndSwapResponse, error)
+	Increment(ctx context.Context, in *IncrementRequest, opts ...grpc.CallOption) (*IncrementResponse, error)
+	Members(ctx context.Context, in *MembersRequest, opts ...grpc.CallOption) (*MembersResponse, error)
+	NodeStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*NodeStatusResponse, error)
+	LeadershipTransfer(ctx context.Context, in *LeadershipTransferRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Snapshot(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*SnapshotResponse, error)
+	Backup(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (Taskvault_BackupClient, error)
+	Restore(ctx context.Context, opts ...grpc.CallOption) (Taskvault_RestoreClient, error)
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Taskvault_WatchClient, error)
+	WatchLeader(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (Taskvault_WatchLeaderClient, error)
+	Txn(ctx context.Context, in *TxnRequest, opts ...grpc.CallOption) (*TxnResponse, error)
+	ForceLeave(ctx context.Context, in *ForceLeaveRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	RaftStats(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RaftStatsResponse, error)
+	RaftStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RaftStatusResponse, error)
+	GetLeader(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*GetLeaderResponse, error)
+	StoreChecksum(ctx context.Context, in *StoreChecksumRequest, opts ...grpc.CallOption) (*StoreChecksumResponse, error)
+	PlanReconcile(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*PlanReconcileResponse, error)
+	SetTag(ctx context.Context, in *SetTagRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	KeyringList(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*KeyringResponse, error)
+	KeyringInstall(ctx context.Context, in *KeyringRequest, opts ...grpc.CallOption) (*KeyringResponse, error)
+	KeyringUse(ctx context.Context, in *KeyringRequest, opts ...grpc.CallOption) (*KeyringResponse, error)
+	KeyringRemove(ctx context.Context, in *KeyringRequest, opts ...grpc.CallOption) (*KeyringResponse, error)
+	DeleteTag(ctx context.Context, in *DeleteTagRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	SetMaintenance(ctx context.Context, in *SetMaintenanceRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	AcquireLock(ctx context.Context, in *AcquireLockRequest, opts ...grpc.CallOption) (*AcquireLockResponse, error)
+	ReleaseLock(ctx context.Context, in *ReleaseLockRequest, opts ...grpc.CallOption) (*ReleaseLockResponse, error)
+	CreateSession(ctx context.Context, in *CreateSessionRequest, opts ...grpc.CallOption) (*SessionResponse, error)
+	RenewSession(ctx context.Context, in *RenewSessionRequest, opts ...grpc.CallOption) (*SessionResponse, error)
+	DestroySession(ctx context.Context, in *DestroySessionRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
 }
 
 type taskvaultClient struct {
@@ -114,6 +148,406 @@ func (c *taskvaultClient) GetAllPairs(ctx context.Context, in *emptypb.Empty, op
 	return out, nil
 }
 
+func (c *taskvaultClient) GetPair(ctx context.Context, in *GetPairRequest, opts ...grpc.CallOption) (*GetPairResponse, error) {
+	out := new(GetPairResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/GetPair", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) StatPair(ctx context.Context, in *StatPairRequest, opts ...grpc.CallOption) (*PairMeta, error) {
+	out := new(PairMeta)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/StatPair", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) ListPairs(ctx context.Context, in *ListPairsRequest, opts ...grpc.CallOption) (*ListPairsResponse, error) {
+	out := new(ListPairsResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/ListPairs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) ListKeys(ctx context.Context, in *ListKeysRequest, opts ...grpc.CallOption) (*ListKeysResponse, error) {
+	out := new(ListKeysResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/ListKeys", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) Count(ctx context.Context, in *CountRequest, opts ...grpc.CallOption) (*CountResponse, error) {
+	out := new(CountResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/Count", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) CompareAndSwap(ctx context.Context, in *CompareAndSwapRequest, opts ...grpc.CallOption) (*CompareAndSwapResponse, error) {
+	out := new(CompareAndSwapResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/CompareAndSwap", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) Increment(ctx context.Context, in *IncrementRequest, opts ...grpc.CallOption) (*IncrementResponse, error) {
+	out := new(IncrementResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/Increment", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) Members(ctx context.Context, in *MembersRequest, opts ...grpc.CallOption) (*MembersResponse, error) {
+	out := new(MembersResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/Members", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) NodeStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*NodeStatusResponse, error) {
+	out := new(NodeStatusResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/NodeStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) LeadershipTransfer(ctx context.Context, in *LeadershipTransferRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/LeadershipTransfer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) Snapshot(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*SnapshotResponse, error) {
+	out := new(SnapshotResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/Snapshot", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) Backup(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (Taskvault_BackupClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Taskvault_ServiceDesc.Streams[0], "/types.Taskvault/Backup", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &taskvaultBackupClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Taskvault_BackupClient interface {
+	Recv() (*BackupChunk, error)
+	grpc.ClientStream
+}
+
+type taskvaultBackupClient struct {
+	grpc.ClientStream
+}
+
+func (x *taskvaultBackupClient) Recv() (*BackupChunk, error) {
+	m := new(BackupChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *taskvaultClient) Restore(ctx context.Context, opts ...grpc.CallOption) (Taskvault_RestoreClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Taskvault_ServiceDesc.Streams[1], "/types.Taskvault/Restore", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &taskvaultRestoreClient{stream}
+	return x, nil
+}
+
+type Taskvault_RestoreClient interface {
+	Send(*BackupChunk) error
+	CloseAndRecv() (*RestoreResponse, error)
+	grpc.ClientStream
+}
+
+type taskvaultRestoreClient struct {
+	grpc.ClientStream
+}
+
+func (x *taskvaultRestoreClient) Send(m *BackupChunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *taskvaultRestoreClient) CloseAndRecv() (*RestoreResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(RestoreResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *taskvaultClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Taskvault_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Taskvault_ServiceDesc.Streams[2], "/types.Taskvault/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &taskvaultWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Taskvault_WatchClient interface {
+	Recv() (*WatchEvent, error)
+	grpc.ClientStream
+}
+
+type taskvaultWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *taskvaultWatchClient) Recv() (*WatchEvent, error) {
+	m := new(WatchEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *taskvaultClient) WatchLeader(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (Taskvault_WatchLeaderClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Taskvault_ServiceDesc.Streams[3], "/types.Taskvault/WatchLeader", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &taskvaultWatchLeaderClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Taskvault_WatchLeaderClient interface {
+	Recv() (*LeaderEvent, error)
+	grpc.ClientStream
+}
+
+type taskvaultWatchLeaderClient struct {
+	grpc.ClientStream
+}
+
+func (x *taskvaultWatchLeaderClient) Recv() (*LeaderEvent, error) {
+	m := new(LeaderEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *taskvaultClient) Txn(ctx context.Context, in *TxnRequest, opts ...grpc.CallOption) (*TxnResponse, error) {
+	out := new(TxnResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/Txn", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) ForceLeave(ctx context.Context, in *ForceLeaveRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/ForceLeave", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) RaftStats(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RaftStatsResponse, error) {
+	out := new(RaftStatsResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/RaftStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) RaftStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RaftStatusResponse, error) {
+	out := new(RaftStatusResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/RaftStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) GetLeader(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*GetLeaderResponse, error) {
+	out := new(GetLeaderResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/GetLeader", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) StoreChecksum(ctx context.Context, in *StoreChecksumRequest, opts ...grpc.CallOption) (*StoreChecksumResponse, error) {
+	out := new(StoreChecksumResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/StoreChecksum", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) PlanReconcile(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*PlanReconcileResponse, error) {
+	out := new(PlanReconcileResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/PlanReconcile", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) SetTag(ctx context.Context, in *SetTagRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/SetTag", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) KeyringList(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*KeyringResponse, error) {
+	out := new(KeyringResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/KeyringList", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) KeyringInstall(ctx context.Context, in *KeyringRequest, opts ...grpc.CallOption) (*KeyringResponse, error) {
+	out := new(KeyringResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/KeyringInstall", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) KeyringUse(ctx context.Context, in *KeyringRequest, opts ...grpc.CallOption) (*KeyringResponse, error) {
+	out := new(KeyringResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/KeyringUse", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) KeyringRemove(ctx context.Context, in *KeyringRequest, opts ...grpc.CallOption) (*KeyringResponse, error) {
+	out := new(KeyringResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/KeyringRemove", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) DeleteTag(ctx context.Context, in *DeleteTagRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/DeleteTag", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) SetMaintenance(ctx context.Context, in *SetMaintenanceRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/SetMaintenance", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) AcquireLock(ctx context.Context, in *AcquireLockRequest, opts ...grpc.CallOption) (*AcquireLockResponse, error) {
+	out := new(AcquireLockResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/AcquireLock", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) ReleaseLock(ctx context.Context, in *ReleaseLockRequest, opts ...grpc.CallOption) (*ReleaseLockResponse, error) {
+	out := new(ReleaseLockResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/ReleaseLock", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) CreateSession(ctx context.Context, in *CreateSessionRequest, opts ...grpc.CallOption) (*SessionResponse, error) {
+	out := new(SessionResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/CreateSession", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) RenewSession(ctx context.Context, in *RenewSessionRequest, opts ...grpc.CallOption) (*SessionResponse, error) {
+	out := new(SessionResponse)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/RenewSession", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskvaultClient) DestroySession(ctx context.Context, in *DestroySessionRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/types.Taskvault/DestroySession", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TaskvaultServer is the server API for Taskvault service.
 // All implementations must embed UnimplementedTaskvaultServer
 // for forward compatibility
@@ -126,6 +560,40 @@ type TaskvaultServer interface {
 	RaftGetConfiguration(context.Context, *emptypb.Empty) (*RaftGetConfigurationResponse, error)
 	RaftRemovePeerByID(context.Context, *RaftRemovePeerByIDRequest) (*emptypb.Empty, error)
 	GetAllPairs(context.Context, *emptypb.Empty) (*GetAllPairsResponse, error)
+	GetPair(context.Context, *GetPairRequest) (*GetPairResponse, error)
+	StatPair(context.Context, *StatPairRequest) (*PairMeta, error)
+	ListPairs(context.Context, *ListPairsRequest) (*ListPairsResponse, error)
+	ListKeys(context.Context, *ListKeysRequest) (*ListKeysResponse, error)
+	Count(context.Context, *CountRequest) (*CountResponse, error)
+	CompareAndSwap(context.Context, *CompareAndSwapRequest) (*CompareAndSwapResponse, error)
+	Increment(context.Context, *IncrementRequest) (*IncrementResponse, error)
+	Members(context.Context, *MembersRequest) (*MembersResponse, error)
+	NodeStatus(context.Context, *emptypb.Empty) (*NodeStatusResponse, error)
+	LeadershipTransfer(context.Context, *LeadershipTransferRequest) (*emptypb.Empty, error)
+	Snapshot(context.Context, *emptypb.Empty) (*SnapshotResponse, error)
+	Backup(*emptypb.Empty, Taskvault_BackupServer) error
+	Restore(Taskvault_RestoreServer) error
+	Watch(*WatchRequest, Taskvault_WatchServer) error
+	WatchLeader(*emptypb.Empty, Taskvault_WatchLeaderServer) error
+	Txn(context.Context, *TxnRequest) (*TxnResponse, error)
+	ForceLeave(context.Context, *ForceLeaveRequest) (*emptypb.Empty, error)
+	RaftStats(context.Context, *emptypb.Empty) (*RaftStatsResponse, error)
+	RaftStatus(context.Context, *emptypb.Empty) (*RaftStatusResponse, error)
+	GetLeader(context.Context, *emptypb.Empty) (*GetLeaderResponse, error)
+	StoreChecksum(context.Context, *StoreChecksumRequest) (*StoreChecksumResponse, error)
+	PlanReconcile(context.Context, *emptypb.Empty) (*PlanReconcileResponse, error)
+	SetTag(context.Context, *SetTagRequest) (*emptypb.Empty, error)
+	KeyringList(context.Context, *emptypb.Empty) (*KeyringResponse, error)
+	KeyringInstall(context.Context, *KeyringRequest) (*KeyringResponse, error)
+	KeyringUse(context.Context, *KeyringRequest) (*KeyringResponse, error)
+	KeyringRemove(context.Context, *KeyringRequest) (*KeyringResponse, error)
+	DeleteTag(context.Context, *DeleteTagRequest) (*emptypb.Empty, error)
+	SetMaintenance(context.Context, *SetMaintenanceRequest) (*emptypb.Empty, error)
+	AcquireLock(context.Context, *AcquireLockRequest) (*AcquireLockResponse, error)
+	ReleaseLock(context.Context, *ReleaseLockRequest) (*ReleaseLockResponse, error)
+	CreateSession(context.Context, *CreateSessionRequest) (*SessionResponse, error)
+	RenewSession(context.Context, *RenewSessionRequest) (*SessionResponse, error)
+	DestroySession(context.Context, *DestroySessionRequest) (*emptypb.Empty, error)
 	mustEmbedUnimplementedTaskvaultServer()
 }
 
@@ -133,183 +601,914 @@ type TaskvaultServer interface {
 type UnimplementedTaskvaultServer struct {
 }
 
-func (UnimplementedTaskvaultServer) CreateValue(context.Context, *CreateValueRequest) (*CreateValueResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method CreateValue not implemented")
+func (UnimplementedTaskvaultServer) CreateValue(context.Context, *CreateValueRequest) (*CreateValueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateValue not implemented")
+}
+func (UnimplementedTaskvaultServer) GetValue(context.Context, *GetValueRequest) (*GetValueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetValue not implemented")
+}
+func (UnimplementedTaskvaultServer) Leave(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Leave not implemented")
+}
+func (UnimplementedTaskvaultServer) UpdateValue(context.Context, *UpdateValueRequest) (*UpdateValueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateValue not implemented")
+}
+func (UnimplementedTaskvaultServer) DeleteValue(context.Context, *DeleteValueRequest) (*DeleteValueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteValue not implemented")
+}
+func (UnimplementedTaskvaultServer) RaftGetConfiguration(context.Context, *emptypb.Empty) (*RaftGetConfigurationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RaftGetConfiguration not implemented")
+}
+func (UnimplementedTaskvaultServer) RaftRemovePeerByID(context.Context, *RaftRemovePeerByIDRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RaftRemovePeerByID not implemented")
+}
+func (UnimplementedTaskvaultServer) GetAllPairs(context.Context, *emptypb.Empty) (*GetAllPairsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetAllPairs not implemented")
+}
+func (UnimplementedTaskvaultServer) GetPair(context.Context, *GetPairRequest) (*GetPairResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPair not implemented")
+}
+func (UnimplementedTaskvaultServer) StatPair(context.Context, *StatPairRequest) (*PairMeta, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StatPair not implemented")
+}
+func (UnimplementedTaskvaultServer) ListPairs(context.Context, *ListPairsRequest) (*ListPairsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPairs not implemented")
+}
+func (UnimplementedTaskvaultServer) ListKeys(context.Context, *ListKeysRequest) (*ListKeysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListKeys not implemented")
+}
+func (UnimplementedTaskvaultServer) Count(context.Context, *CountRequest) (*CountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Count not implemented")
+}
+func (UnimplementedTaskvaultServer) CompareAndSwap(context.Context, *CompareAndSwapRequest) (*CompareAndSwapResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CompareAndSwap not implemented")
+}
+func (UnimplementedTaskvaultServer) Increment(context.Context, *IncrementRequest) (*IncrementResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Increment not implemented")
+}
+func (UnimplementedTaskvaultServer) Members(context.Context, *MembersRequest) (*MembersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Members not implemented")
+}
+func (UnimplementedTaskvaultServer) NodeStatus(context.Context, *emptypb.Empty) (*NodeStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method NodeStatus not implemented")
+}
+func (UnimplementedTaskvaultServer) LeadershipTransfer(context.Context, *LeadershipTransferRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LeadershipTransfer not implemented")
+}
+func (UnimplementedTaskvaultServer) Snapshot(context.Context, *emptypb.Empty) (*SnapshotResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Snapshot not implemented")
+}
+func (UnimplementedTaskvaultServer) Backup(*emptypb.Empty, Taskvault_BackupServer) error {
+	return status.Errorf(codes.Unimplemented, "method Backup not implemented")
+}
+func (UnimplementedTaskvaultServer) Restore(Taskvault_RestoreServer) error {
+	return status.Errorf(codes.Unimplemented, "method Restore not implemented")
+}
+func (UnimplementedTaskvaultServer) Watch(*WatchRequest, Taskvault_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedTaskvaultServer) WatchLeader(*emptypb.Empty, Taskvault_WatchLeaderServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchLeader not implemented")
+}
+func (UnimplementedTaskvaultServer) Txn(context.Context, *TxnRequest) (*TxnResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Txn not implemented")
+}
+func (UnimplementedTaskvaultServer) ForceLeave(context.Context, *ForceLeaveRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ForceLeave not implemented")
+}
+func (UnimplementedTaskvaultServer) RaftStats(context.Context, *emptypb.Empty) (*RaftStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RaftStats not implemented")
+}
+func (UnimplementedTaskvaultServer) RaftStatus(context.Context, *emptypb.Empty) (*RaftStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RaftStatus not implemented")
+}
+func (UnimplementedTaskvaultServer) GetLeader(context.Context, *emptypb.Empty) (*GetLeaderResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLeader not implemented")
+}
+func (UnimplementedTaskvaultServer) StoreChecksum(context.Context, *StoreChecksumRequest) (*StoreChecksumResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StoreChecksum not implemented")
+}
+func (UnimplementedTaskvaultServer) PlanReconcile(context.Context, *emptypb.Empty) (*PlanReconcileResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PlanReconcile not implemented")
+}
+func (UnimplementedTaskvaultServer) SetTag(context.Context, *SetTagRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetTag not implemented")
+}
+func (UnimplementedTaskvaultServer) KeyringList(context.Context, *emptypb.Empty) (*KeyringResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method KeyringList not implemented")
+}
+func (UnimplementedTaskvaultServer) KeyringInstall(context.Context, *KeyringRequest) (*KeyringResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method KeyringInstall not implemented")
+}
+func (UnimplementedTaskvaultServer) KeyringUse(context.Context, *KeyringRequest) (*KeyringResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method KeyringUse not implemented")
+}
+func (UnimplementedTaskvaultServer) KeyringRemove(context.Context, *KeyringRequest) (*KeyringResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method KeyringRemove not implemented")
+}
+func (UnimplementedTaskvaultServer) DeleteTag(context.Context, *DeleteTagRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteTag not implemented")
+}
+func (UnimplementedTaskvaultServer) SetMaintenance(context.Context, *SetMaintenanceRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetMaintenance not implemented")
+}
+func (UnimplementedTaskvaultServer) AcquireLock(context.Context, *AcquireLockRequest) (*AcquireLockResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AcquireLock not implemented")
+}
+func (UnimplementedTaskvaultServer) ReleaseLock(context.Context, *ReleaseLockRequest) (*ReleaseLockResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReleaseLock not implemented")
+}
+func (UnimplementedTaskvaultServer) CreateSession(context.Context, *CreateSessionRequest) (*SessionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateSession not implemented")
+}
+func (UnimplementedTaskvaultServer) RenewSession(context.Context, *RenewSessionRequest) (*SessionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenewSession not implemented")
+}
+func (UnimplementedTaskvaultServer) DestroySession(context.Context, *DestroySessionRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DestroySession not implemented")
+}
+func (UnimplementedTaskvaultServer) mustEmbedUnimplementedTaskvaultServer() {}
+
+// UnsafeTaskvaultServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TaskvaultServer will
+// result in compilation errors.
+type UnsafeTaskvaultServer interface {
+	mustEmbedUnimplementedTaskvaultServer()
+}
+
+func RegisterTaskvaultServer(s grpc.ServiceRegistrar, srv TaskvaultServer) {
+	s.RegisterService(&Taskvault_ServiceDesc, srv)
+}
+
+func _Taskvault_CreateValue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateValueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).CreateValue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/CreateValue",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).CreateValue(ctx, req.(*CreateValueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_GetValue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetValueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).GetValue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/GetValue",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).GetValue(ctx, req.(*GetValueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_Leave_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).Leave(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/Leave",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).Leave(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_UpdateValue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateValueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).UpdateValue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/UpdateValue",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).UpdateValue(ctx, req.(*UpdateValueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_DeleteValue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteValueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).DeleteValue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/DeleteValue",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).DeleteValue(ctx, req.(*DeleteValueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_RaftGetConfiguration_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).RaftGetConfiguration(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/RaftGetConfiguration",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).RaftGetConfiguration(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_RaftRemovePeerByID_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RaftRemovePeerByIDRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).RaftRemovePeerByID(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/RaftRemovePeerByID",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).RaftRemovePeerByID(ctx, req.(*RaftRemovePeerByIDRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_GetAllPairs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).GetAllPairs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/GetAllPairs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).GetAllPairs(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_GetPair_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPairRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).GetPair(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/GetPair",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).GetPair(ctx, req.(*GetPairRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_StatPair_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatPairRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).StatPair(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/StatPair",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).StatPair(ctx, req.(*StatPairRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_ListPairs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPairsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).ListPairs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/ListPairs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).ListPairs(ctx, req.(*ListPairsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_ListKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListKeysRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).ListKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/ListKeys",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).ListKeys(ctx, req.(*ListKeysRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_Count_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).Count(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/Count",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).Count(ctx, req.(*CountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_CompareAndSwap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CompareAndSwapRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).CompareAndSwap(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/CompareAndSwap",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).CompareAndSwap(ctx, req.(*CompareAndSwapRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_Increment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IncrementRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).Increment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/Increment",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).Increment(ctx, req.(*IncrementRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_Members_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MembersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).Members(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/Members",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).Members(ctx, req.(*MembersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_NodeStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).NodeStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/NodeStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).NodeStatus(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_LeadershipTransfer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeadershipTransferRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).LeadershipTransfer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/LeadershipTransfer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).LeadershipTransfer(ctx, req.(*LeadershipTransferRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_Snapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).Snapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/Snapshot",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).Snapshot(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_Backup_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(emptypb.Empty)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TaskvaultServer).Backup(m, &taskvaultBackupServer{stream})
+}
+
+type Taskvault_BackupServer interface {
+	Send(*BackupChunk) error
+	grpc.ServerStream
+}
+
+type taskvaultBackupServer struct {
+	grpc.ServerStream
+}
+
+func (x *taskvaultBackupServer) Send(m *BackupChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Taskvault_Restore_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TaskvaultServer).Restore(&taskvaultRestoreServer{stream})
+}
+
+type Taskvault_RestoreServer interface {
+	SendAndClose(*RestoreResponse) error
+	Recv() (*BackupChunk, error)
+	grpc.ServerStream
+}
+
+type taskvaultRestoreServer struct {
+	grpc.ServerStream
+}
+
+func (x *taskvaultRestoreServer) SendAndClose(m *RestoreResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *taskvaultRestoreServer) Recv() (*BackupChunk, error) {
+	m := new(BackupChunk)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Taskvault_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TaskvaultServer).Watch(m, &taskvaultWatchServer{stream})
+}
+
+type Taskvault_WatchServer interface {
+	Send(*WatchEvent) error
+	grpc.ServerStream
+}
+
+type taskvaultWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *taskvaultWatchServer) Send(m *WatchEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Taskvault_WatchLeader_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(emptypb.Empty)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TaskvaultServer).WatchLeader(m, &taskvaultWatchLeaderServer{stream})
+}
+
+type Taskvault_WatchLeaderServer interface {
+	Send(*LeaderEvent) error
+	grpc.ServerStream
+}
+
+type taskvaultWatchLeaderServer struct {
+	grpc.ServerStream
+}
+
+func (x *taskvaultWatchLeaderServer) Send(m *LeaderEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Taskvault_Txn_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TxnRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).Txn(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/Txn",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).Txn(ctx, req.(*TxnRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Taskvault_ForceLeave_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ForceLeaveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).ForceLeave(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/ForceLeave",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).ForceLeave(ctx, req.(*ForceLeaveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
 }
-func (UnimplementedTaskvaultServer) GetValue(context.Context, *GetValueRequest) (*GetValueResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method GetValue not implemented")
+
+func _Taskvault_RaftStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).RaftStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/RaftStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).RaftStats(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
 }
-func (UnimplementedTaskvaultServer) Leave(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method Leave not implemented")
+
+func _Taskvault_RaftStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).RaftStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/RaftStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).RaftStatus(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
 }
-func (UnimplementedTaskvaultServer) UpdateValue(context.Context, *UpdateValueRequest) (*UpdateValueResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method UpdateValue not implemented")
+
+func _Taskvault_GetLeader_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).GetLeader(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/GetLeader",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).GetLeader(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
 }
-func (UnimplementedTaskvaultServer) DeleteValue(context.Context, *DeleteValueRequest) (*DeleteValueResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method DeleteValue not implemented")
+
+func _Taskvault_StoreChecksum_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StoreChecksumRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).StoreChecksum(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/StoreChecksum",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).StoreChecksum(ctx, req.(*StoreChecksumRequest))
+	}
+	return interceptor(ctx, in, info, handler)
 }
-func (UnimplementedTaskvaultServer) RaftGetConfiguration(context.Context, *emptypb.Empty) (*RaftGetConfigurationResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method RaftGetConfiguration not implemented")
+
+func _Taskvault_PlanReconcile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).PlanReconcile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/PlanReconcile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).PlanReconcile(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
 }
-func (UnimplementedTaskvaultServer) RaftRemovePeerByID(context.Context, *RaftRemovePeerByIDRequest) (*emptypb.Empty, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method RaftRemovePeerByID not implemented")
+
+func _Taskvault_SetTag_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetTagRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).SetTag(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/SetTag",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).SetTag(ctx, req.(*SetTagRequest))
+	}
+	return interceptor(ctx, in, info, handler)
 }
-func (UnimplementedTaskvaultServer) GetAllPairs(context.Context, *emptypb.Empty) (*GetAllPairsResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method GetAllPairs not implemented")
+
+func _Taskvault_KeyringList_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).KeyringList(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/KeyringList",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).KeyringList(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
 }
-func (UnimplementedTaskvaultServer) mustEmbedUnimplementedTaskvaultServer() {}
 
-// UnsafeTaskvaultServer may be embedded to opt out of forward compatibility for this service.
-// Use of this interface is not recommended, as added methods to TaskvaultServer will
-// result in compilation errors.
-type UnsafeTaskvaultServer interface {
-	mustEmbedUnimplementedTaskvaultServer()
+func _Taskvault_KeyringInstall_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KeyringRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).KeyringInstall(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/KeyringInstall",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).KeyringInstall(ctx, req.(*KeyringRequest))
+	}
+	return interceptor(ctx, in, info, handler)
 }
 
-func RegisterTaskvaultServer(s grpc.ServiceRegistrar, srv TaskvaultServer) {
-	s.RegisterService(&Taskvault_ServiceDesc, srv)
+func _Taskvault_KeyringUse_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KeyringRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskvaultServer).KeyringUse(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/types.Taskvault/KeyringUse",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskvaultServer).KeyringUse(ctx, req.(*KeyringRequest))
+	}
+	return interceptor(ctx, in, info, handler)
 }
 
-func _Taskvault_CreateValue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(CreateValueRequest)
+func _Taskvault_KeyringRemove_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KeyringRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(TaskvaultServer).CreateValue(ctx, in)
+		return srv.(TaskvaultServer).KeyringRemove(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/types.Taskvault/CreateValue",
+		FullMethod: "/types.Taskvault/KeyringRemove",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(TaskvaultServer).CreateValue(ctx, req.(*CreateValueRequest))
+		return srv.(TaskvaultServer).KeyringRemove(ctx, req.(*KeyringRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _Taskvault_GetValue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(GetValueRequest)
+func _Taskvault_DeleteTag_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteTagRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(TaskvaultServer).GetValue(ctx, in)
+		return srv.(TaskvaultServer).DeleteTag(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/types.Taskvault/GetValue",
+		FullMethod: "/types.Taskvault/DeleteTag",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(TaskvaultServer).GetValue(ctx, req.(*GetValueRequest))
+		return srv.(TaskvaultServer).DeleteTag(ctx, req.(*DeleteTagRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _Taskvault_Leave_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(emptypb.Empty)
+func _Taskvault_SetMaintenance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetMaintenanceRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(TaskvaultServer).Leave(ctx, in)
+		return srv.(TaskvaultServer).SetMaintenance(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/types.Taskvault/Leave",
+		FullMethod: "/types.Taskvault/SetMaintenance",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(TaskvaultServer).Leave(ctx, req.(*emptypb.Empty))
+		return srv.(TaskvaultServer).SetMaintenance(ctx, req.(*SetMaintenanceRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _Taskvault_UpdateValue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(UpdateValueRequest)
+func _Taskvault_AcquireLock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AcquireLockRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(TaskvaultServer).UpdateValue(ctx, in)
+		return srv.(TaskvaultServer).AcquireLock(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/types.Taskvault/UpdateValue",
+		FullMethod: "/types.Taskvault/AcquireLock",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(TaskvaultServer).UpdateValue(ctx, req.(*UpdateValueRequest))
+		return srv.(TaskvaultServer).AcquireLock(ctx, req.(*AcquireLockRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _Taskvault_DeleteValue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(DeleteValueRequest)
+func _Taskvault_ReleaseLock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReleaseLockRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(TaskvaultServer).DeleteValue(ctx, in)
+		return srv.(TaskvaultServer).ReleaseLock(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/types.Taskvault/DeleteValue",
+		FullMethod: "/types.Taskvault/ReleaseLock",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(TaskvaultServer).DeleteValue(ctx, req.(*DeleteValueRequest))
+		return srv.(TaskvaultServer).ReleaseLock(ctx, req.(*ReleaseLockRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _Taskvault_RaftGetConfiguration_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(emptypb.Empty)
+func _Taskvault_CreateSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateSessionRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(TaskvaultServer).RaftGetConfiguration(ctx, in)
+		return srv.(TaskvaultServer).CreateSession(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/types.Taskvault/RaftGetConfiguration",
+		FullMethod: "/types.Taskvault/CreateSession",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(TaskvaultServer).RaftGetConfiguration(ctx, req.(*emptypb.Empty))
+		return srv.(TaskvaultServer).CreateSession(ctx, req.(*CreateSessionRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _Taskvault_RaftRemovePeerByID_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(RaftRemovePeerByIDRequest)
+func _Taskvault_RenewSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenewSessionRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(TaskvaultServer).RaftRemovePeerByID(ctx, in)
+		return srv.(TaskvaultServer).RenewSession(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/types.Taskvault/RaftRemovePeerByID",
+		FullMethod: "/types.Taskvault/RenewSession",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(TaskvaultServer).RaftRemovePeerByID(ctx, req.(*RaftRemovePeerByIDRequest))
+		return srv.(TaskvaultServer).RenewSession(ctx, req.(*RenewSessionRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _Taskvault_GetAllPairs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(emptypb.Empty)
+func _Taskvault_DestroySession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DestroySessionRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(TaskvaultServer).GetAllPairs(ctx, in)
+		return srv.(TaskvaultServer).DestroySession(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/types.Taskvault/GetAllPairs",
+		FullMethod: "/types.Taskvault/DestroySession",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(TaskvaultServer).GetAllPairs(ctx, req.(*emptypb.Empty))
+		return srv.(TaskvaultServer).DestroySession(ctx, req.(*DestroySessionRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
@@ -353,7 +1552,148 @@ var Taskvault_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetAllPairs",
 			Handler:    _Taskvault_GetAllPairs_Handler,
 		},
+		{
+			MethodName: "GetPair",
+			Handler:    _Taskvault_GetPair_Handler,
+		},
+		{
+			MethodName: "StatPair",
+			Handler:    _Taskvault_StatPair_Handler,
+		},
+		{
+			MethodName: "ListPairs",
+			Handler:    _Taskvault_ListPairs_Handler,
+		},
+		{
+			MethodName: "ListKeys",
+			Handler:    _Taskvault_ListKeys_Handler,
+		},
+		{
+			MethodName: "Count",
+			Handler:    _Taskvault_Count_Handler,
+		},
+		{
+			MethodName: "CompareAndSwap",
+			Handler:    _Taskvault_CompareAndSwap_Handler,
+		},
+		{
+			MethodName: "Increment",
+			Handler:    _Taskvault_Increment_Handler,
+		},
+		{
+			MethodName: "Members",
+			Handler:    _Taskvault_Members_Handler,
+		},
+		{
+			MethodName: "NodeStatus",
+			Handler:    _Taskvault_NodeStatus_Handler,
+		},
+		{
+			MethodName: "LeadershipTransfer",
+			Handler:    _Taskvault_LeadershipTransfer_Handler,
+		},
+		{
+			MethodName: "Snapshot",
+			Handler:    _Taskvault_Snapshot_Handler,
+		},
+		{
+			MethodName: "Txn",
+			Handler:    _Taskvault_Txn_Handler,
+		},
+		{
+			MethodName: "ForceLeave",
+			Handler:    _Taskvault_ForceLeave_Handler,
+		},
+		{
+			MethodName: "RaftStats",
+			Handler:    _Taskvault_RaftStats_Handler,
+		},
+		{
+			MethodName: "RaftStatus",
+			Handler:    _Taskvault_RaftStatus_Handler,
+		},
+		{
+			MethodName: "GetLeader",
+			Handler:    _Taskvault_GetLeader_Handler,
+		},
+		{
+			MethodName: "StoreChecksum",
+			Handler:    _Taskvault_StoreChecksum_Handler,
+		},
+		{
+			MethodName: "PlanReconcile",
+			Handler:    _Taskvault_PlanReconcile_Handler,
+		},
+		{
+			MethodName: "SetTag",
+			Handler:    _Taskvault_SetTag_Handler,
+		},
+		{
+			MethodName: "KeyringList",
+			Handler:    _Taskvault_KeyringList_Handler,
+		},
+		{
+			MethodName: "KeyringInstall",
+			Handler:    _Taskvault_KeyringInstall_Handler,
+		},
+		{
+			MethodName: "KeyringUse",
+			Handler:    _Taskvault_KeyringUse_Handler,
+		},
+		{
+			MethodName: "KeyringRemove",
+			Handler:    _Taskvault_KeyringRemove_Handler,
+		},
+		{
+			MethodName: "DeleteTag",
+			Handler:    _Taskvault_DeleteTag_Handler,
+		},
+		{
+			MethodName: "SetMaintenance",
+			Handler:    _Taskvault_SetMaintenance_Handler,
+		},
+		{
+			MethodName: "AcquireLock",
+			Handler:    _Taskvault_AcquireLock_Handler,
+		},
+		{
+			MethodName: "ReleaseLock",
+			Handler:    _Taskvault_ReleaseLock_Handler,
+		},
+		{
+			MethodName: "CreateSession",
+			Handler:    _Taskvault_CreateSession_Handler,
+		},
+		{
+			MethodName: "RenewSession",
+			Handler:    _Taskvault_RenewSession_Handler,
+		},
+		{
+			MethodName: "DestroySession",
+			Handler:    _Taskvault_DestroySession_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Backup",
+			Handler:       _Taskvault_Backup_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Restore",
+			Handler:       _Taskvault_Restore_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _Taskvault_Watch_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchLeader",
+			Handler:       _Taskvault_WatchLeader_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "taskvault.proto",
 }
@@ -1,7 +1,9 @@
 package taskvault
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -9,27 +11,67 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/armon/go-metrics"
+	"github.com/boltdb/bolt"
 	"github.com/danluki/taskvault/pkg/types"
 	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb"
 	"github.com/hashicorp/serf/serf"
 	"github.com/soheilhy/cmux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
 	raftTimeout      = 30 * time.Second
 	raftLogCacheSize = 512
-	raftMultiplier   = 1
+	raftDirName      = "raft"
+	storeDirName     = "store"
+	peersFileName    = "peers.json"
+
+	// refreshChSize bounds the member events queued for the leader, events
+	// dropped when it is full are picked up by the next full refresh.
+	refreshChSize = 256
+
+	// serfEventChSize bounds the events serf queues for eventLoop, serf
+	// blocks once it is full. A warning is logged when the backlog reaches
+	// serfEventChWarn and again once it drained below half of it.
+	serfEventChSize = 4096
+	serfEventChWarn = serfEventChSize / 2
+
+	// A read index read polls the applied index with these bounds while the
+	// FSM catches up with the commit index.
+	readIndexPollMin = 100 * time.Microsecond
+	readIndexPollMax = 5 * time.Millisecond
 )
 
 var (
-	ErrLeaderNotFound   = errors.New("no member leader found")
-	ErrNoSuitableServer = errors.New("no suitable server found")
+	ErrLeaderNotFound       = errors.New("no member leader found")
+	ErrNoSuitableServer     = errors.New("no suitable server found")
+	ErrInvalidContinueToken = errors.New("invalid continue token")
+	ErrStaleContinueToken   = errors.New("continue token is ahead of this node, retry later or on another node")
+	ErrTargetNotVoter       = errors.New("leadership target is not a raft voter")
+	ErrTargetInMaintenance  = errors.New("leadership target is in maintenance")
+	ErrNotVoter             = errors.New("local node is not a raft voter")
+	ErrMemberNotFound       = errors.New("member not found")
+	ErrMemberAlive          = errors.New("member is still alive")
+	ErrForceLeaveLeader     = errors.New("can not force the current leader to leave")
+	ErrUnknownServer        = errors.New("no address known for server")
+	ErrPeerNotFound         = errors.New("server not in the raft configuration")
+	ErrKeyTooLarge          = errors.New("key too large")
+	ErrValueTooLarge        = errors.New("value too large")
+	ErrApplyQueueFull       = errors.New("too many writes in flight, retry later")
 )
 
 type Node = serf.Member
@@ -38,8 +80,12 @@ type Agent struct {
 	Store  SyncraStorage
 	config *Config
 
-	serfEventer chan serf.Event
-	shutdowner  chan struct{}
+	serfEventer  chan serf.Event
+	serfBacklog  atomic.Bool
+	tagsLock     sync.Mutex
+	shutdowner   chan struct{}
+	shutdownOnce sync.Once
+	stopping     atomic.Bool
 
 	raftTransport *raft.NetworkTransport
 	raft          *raft.Raft
@@ -48,14 +94,41 @@ type Agent struct {
 	raftStore     RaftStore
 	GRPCClient    TaskvaultGRPCClient
 	raftLayer     *RaftLayer
+	keyPair       *keyPair
 	refreshCh     chan serf.Member
 	GRPCServer    TaskvaultGRPCServer
 	retryJoinCh   chan error
 	leaderCh      <-chan bool
 	serverLookup  *ServerLookup
 	listener      net.Listener
-
-	logger *zap.SugaredLogger
+	raftListener  net.Listener
+	watches       *watchHub
+	sessions      *sessionTable
+	checksums     *checksumLog
+	leaders       *leaderHub
+	heartbeats    heartbeatFailures
+	commands      LogAppliers
+	leaderHooks   leaderHooks
+
+	// applySlots holds a token per command handed to raft and not resolved
+	// yet, nil when ApplyQueueDepth is zero.
+	applySlots chan struct{}
+
+	logger   *zap.SugaredLogger
+	logLevel zap.AtomicLevel
+
+	// stopTracing flushes and stops the span exporter, nil without
+	// TracingEndpoint.
+	stopTracing func(context.Context) error
+
+	// refreshInterval holds the reloadable RefreshInterval, reloadCh makes
+	// the leader loop pick up a new value right away.
+	refreshInterval atomic.Int64
+	reloadCh        chan struct{}
+
+	// leaderReady is set by the leader loop once a barrier committed in the
+	// current term, from then on the commit index can serve read-index reads.
+	leaderReady atomic.Bool
 
 	raftInmemStore *raft.InmemStore
 }
@@ -63,17 +136,41 @@ type Agent struct {
 func NewAgent(config *Config) *Agent {
 	agent := &Agent{
 		config:       config,
+		reloadCh:     make(chan struct{}, 1),
+		refreshCh:    make(chan serf.Member, refreshChSize),
 		retryJoinCh:  make(chan error),
+		shutdowner:   make(chan struct{}),
 		serverLookup: NewServerLookup(),
 	}
 
 	return agent
 }
 
-func (a *Agent) Start() error {
-	a.logger = InitLogger(a.config.LogLevel, a.config.NodeName)
+func (a *Agent) Start() (err error) {
+	if err := a.config.Validate(); err != nil {
+		return fmt.Errorf("agent: invalid configuration:\n%w", err)
+	}
+
+	level, _ := zapcore.ParseLevel(a.config.LogLevel)
+	a.logLevel = zap.NewAtomicLevelAt(level)
+	a.logger = newLogger(a.logLevel, a.config.NodeName, a.config.LogFormat, a.config.LogFile)
+	a.refreshInterval.Store(int64(a.config.RefreshInterval))
+
+	if err := a.setupMetrics(); err != nil {
+		return fmt.Errorf("agent: Can not setup metrics, %s", err)
+	}
+
+	serverStarted := false
+	defer func() {
+		if err != nil {
+			a.abortStart(serverStarted)
+		}
+	}()
+
+	if err := a.setupTracing(); err != nil {
+		return fmt.Errorf("agent: Can not setup tracing, %w", err)
+	}
 
-	var err error
 	if err = a.config.normalizeAddrs(); err != nil {
 		if !errors.Is(err, ErrResolvingHost) {
 			return err
@@ -94,37 +191,98 @@ func (a *Agent) Start() error {
 			).Warn("agent: Can not join")
 		}
 	} else {
-		a.retryJoinLAN()
+		go a.retryJoinLAN()
 	}
 
 	if a.config.AdvertiseRPCPort == 0 {
 		a.config.AdvertiseRPCPort = a.config.RPCPort
 	}
+	if a.config.AdvertiseRaftPort == 0 {
+		a.config.AdvertiseRaftPort = a.config.RaftPort
+	}
+	if a.config.ApplyQueueDepth > 0 {
+		a.applySlots = make(chan struct{}, a.config.ApplyQueueDepth)
+	}
+
+	if a.config.TLSEnabled() {
+		a.keyPair, err = loadKeyPair(a.config.CertFile, a.config.KeyFile)
+		if err != nil {
+			return err
+		}
+	}
 
 	addr := a.bindRPCAddr()
 	a.listener, err = net.Listen("tcp", addr)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("agent: Can not listen for RPC, %s", err)
+	}
+	if a.config.SeparateListeners {
+		a.raftListener, err = net.Listen("tcp", a.bindRaftAddr())
+		if err != nil {
+			return fmt.Errorf("agent: Can not listen for raft, %s", err)
+		}
 	}
 
-	a.StartServer()
+	if err := a.StartServer(); err != nil {
+		return err
+	}
+	serverStarted = true
 
 	if a.GRPCClient == nil {
-		a.GRPCClient = NewGRPCClient(nil, a, a.logger)
+		var dialOpt grpc.DialOption
+		if a.config.TLSEnabled() {
+			tlsConf, err := a.config.outgoingTLSConfig(a.keyPair)
+			if err != nil {
+				return err
+			}
+			dialOpt = grpc.WithTransportCredentials(credentials.NewTLS(tlsConf))
+		}
+		a.GRPCClient = NewGRPCClient(dialOpt, a, a.componentLogger("grpc"))
 	}
 
-	tags := a.serf.LocalMember().Tags
-	tags["rpc_addr"] = a.advertiseRPCAddr()
-	tags["port"] = strconv.Itoa(a.config.AdvertiseRPCPort)
-	if err := a.serf.SetTags(tags); err != nil {
+	err = a.updateTags(func(tags map[string]string) {
+		tags["rpc_addr"] = a.advertiseRPCAddr()
+		tags["raft_addr"] = a.advertiseRaftAddr()
+		tags["port"] = strconv.Itoa(a.config.AdvertiseRPCPort)
+		if addr := a.advertiseHTTPAddr(); addr != "" {
+			tags[httpAddrTag] = addr
+		}
+	})
+	if err != nil {
 		return fmt.Errorf("agent: Error setting tags: %w", err)
 	}
 
 	go a.eventLoop()
+	if os.Getenv("NOTIFY_SOCKET") != "" {
+		go a.notifyReady()
+	}
 
 	return nil
 }
 
+// abortStart releases what a failed Start set up, so that the ports, the data
+// directory and the cluster membership are given back.
+func (a *Agent) abortStart(serverStarted bool) {
+	a.shutdownOnce.Do(func() {
+		close(a.shutdowner)
+	})
+	if serverStarted {
+		a.stopServer()
+	}
+	if a.listener != nil {
+		a.listener.Close()
+	}
+	if a.raftListener != nil {
+		a.raftListener.Close()
+	}
+	if a.serf != nil {
+		_ = a.serf.Shutdown()
+	}
+	if a.stopTracing != nil {
+		_ = a.stopTracing(context.Background())
+	}
+}
+
 func (a *Agent) RetryJoinCh() <-chan error {
 	return a.retryJoinCh
 }
@@ -133,16 +291,68 @@ func (a *Agent) JoinLAN(addrs []string) (int, error) {
 	return a.serf.Join(addrs, true)
 }
 
+// Stop leaves the cluster gracefully within StopTimeout. A leader first hands
+// leadership to another voter so the cluster does not have to wait for an
+// election, then serf leaves before raft shuts down so the other members learn
+// about the departure instead of detecting a failure. In-flight gRPC calls are
+// drained for up to GRPCDrainTimeout while raft still runs, so forwarded
+// writes can complete.
 func (a *Agent) Stop() error {
 	a.logger.Info("agent: Called member stop, now stopping")
+	a.stopping.Store(true)
+	if err := sdNotify("STOPPING=1"); err != nil {
+		a.logger.With(zap.Error(err)).Warn("agent: failed to notify systemd")
+	}
 
-	_ = a.raft.Shutdown()
+	deadline := time.Now().Add(a.config.StopTimeout)
 
-	if err := a.Store.Shutdown(); err != nil {
-		return err
+	if a.raft != nil && a.IsLeader() {
+		a.transferLeadershipBefore(deadline)
 	}
 
 	if err := a.serf.Leave(); err != nil {
+		a.logger.With(zap.Error(err)).Warn("agent: Error leaving serf")
+	}
+
+	if a.GRPCServer != nil {
+		drain := time.Now().Add(a.config.GRPCDrainTimeout)
+		if drain.After(deadline) {
+			drain = deadline
+		}
+		a.GRPCServer.Stop(drain)
+	}
+
+	if a.HTTPTransport != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		if err := a.HTTPTransport.Shutdown(ctx); err != nil {
+			a.logger.With(zap.Error(err)).Warn("agent: Error stopping the HTTP servers")
+		}
+		cancel()
+	}
+
+	a.shutdownOnce.Do(func() {
+		close(a.shutdowner)
+	})
+
+	if a.raft != nil {
+		if err := waitFuture(a.raft.Shutdown(), deadline); err != nil {
+			a.logger.With(zap.Error(err)).Warn("agent: Error shutting down raft")
+		}
+	}
+
+	// Without fsync on append the log is flushed once on a clean stop.
+	if s, ok := a.raftStore.(interface{ Sync() error }); ok && a.config.RaftNoSync {
+		if err := s.Sync(); err != nil {
+			a.logger.With(zap.Error(err)).Warn("agent: Error syncing raft log")
+		}
+	}
+	if a.raftStore != nil {
+		if err := a.raftStore.Close(); err != nil {
+			a.logger.With(zap.Error(err)).Warn("agent: Error closing raft log")
+		}
+	}
+
+	if err := a.Store.Shutdown(); err != nil {
 		return err
 	}
 
@@ -150,17 +360,61 @@ func (a *Agent) Stop() error {
 		return err
 	}
 
+	if a.stopTracing != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := a.stopTracing(ctx); err != nil {
+			a.logger.With(zap.Error(err)).Warn("agent: Error flushing traces")
+		}
+	}
+
 	return nil
 }
 
+// transferLeadershipBefore moves leadership off this node, giving up once the
+// deadline passes so a stuck transfer cannot block the shutdown.
+func (a *Agent) transferLeadershipBefore(deadline time.Time) {
+	a.logger.Info("agent: Transferring leadership before stopping")
+
+	if err := waitFuture(a.raft.LeadershipTransfer(), deadline); err != nil {
+		a.logger.With(zap.Error(err)).Warn("agent: Leadership transfer failed")
+		return
+	}
+
+	for a.IsLeader() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if a.IsLeader() {
+		a.logger.Warn("agent: Still leader after transfer, stopping anyway")
+		return
+	}
+
+	a.logger.Info("agent: Leadership transferred", zap.String("leader", string(a.raft.Leader())))
+}
+
+// waitFuture waits for a raft future but returns once the deadline passes.
+func waitFuture(f raft.Future, deadline time.Time) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- f.Error()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(time.Until(deadline)):
+		return errors.New("timed out waiting for raft")
+	}
+}
+
 func (a *Agent) setupRaft() error {
 	if a.config.BootstrapExpect == 1 {
 		a.config.Bootstrap = true
 	}
 
-	logger := io.Discard
+	var logger io.Writer = io.Discard
 	if a.logger.Level() == zapcore.DebugLevel {
-		logger = os.Stdout
+		logger = &logWriter{logger: a.componentLogger("raft")}
 	}
 
 	transportConfig := &raft.NetworkTransportConfig{
@@ -173,11 +427,7 @@ func (a *Agent) setupRaft() error {
 	a.raftTransport = transport
 
 	config := raft.DefaultConfig()
-
-	raftMultiplier := raftMultiplier
-	config.HeartbeatTimeout = config.HeartbeatTimeout * time.Duration(raftMultiplier)
-	config.ElectionTimeout = config.ElectionTimeout * time.Duration(raftMultiplier)
-	config.LeaderLeaseTimeout = config.LeaderLeaseTimeout * time.Duration(raftMultiplier)
+	a.config.tuneRaft(config)
 
 	config.LogOutput = logger
 	config.LocalID = raft.ServerID(a.config.NodeName)
@@ -192,25 +442,30 @@ func (a *Agent) setupRaft() error {
 		snapshots = raft.NewDiscardSnapshotStore()
 		a.raftInmemStore = store
 	} else {
-		var err error
+		raftPath, snapshotPath := a.config.raftPath(), a.config.snapshotPath()
+		raftDir := raftPath.dir
+		if err := os.MkdirAll(raftDir, 0o700); err != nil {
+			return raftPath.error(err)
+		}
 
-		snapshots, err = raft.NewFileSnapshotStore(
-			filepath.Join(
-				a.config.DataDir, "raft",
-			), 3, logger,
-		)
+		var err error
+		snapshots, err = raft.NewFileSnapshotStore(snapshotPath.dir, a.config.SnapshotRetain, logger)
 		if err != nil {
-			return fmt.Errorf("file snapshot store: %s", err)
+			return snapshotPath.error(err)
 		}
 
 		if a.raftStore == nil {
-			a.raftStore, err = raftboltdb.NewBoltStore(
-				filepath.Join(
-					a.config.DataDir, "raft", "raft.db",
-				),
-			)
+			store, err := raftboltdb.New(raftboltdb.Options{
+				Path:        filepath.Join(raftDir, "raft.db"),
+				NoSync:      a.config.RaftNoSync,
+				BoltOptions: &bolt.Options{Timeout: boltOpenTimeout},
+			})
 			if err != nil {
-				return fmt.Errorf("error creating new raft store: %s", err)
+				return raftPath.error(err)
+			}
+			a.raftStore = store
+			if a.config.RaftNoSync {
+				a.logger.Warn("agent: raft-no-sync is set, recent writes may be lost on a crash")
 			}
 		}
 		stableStore = a.raftStore
@@ -221,9 +476,18 @@ func (a *Agent) setupRaft() error {
 			return err
 		}
 		logStore = cacheStore
+
+		if err := a.recoverRaft(
+			filepath.Join(raftDir, peersFileName), config,
+			logStore, stableStore, snapshots, transport,
+		); err != nil {
+			return err
+		}
 	}
 
-	if a.config.Bootstrap || a.config.DevMode {
+	// With BootstrapExpect the cluster is formed once enough servers
+	// joined, see maybeBootstrap.
+	if a.config.Bootstrap || (a.config.DevMode && a.config.BootstrapExpect == 0) {
 		hasState, err := raft.HasExistingState(logStore, stableStore, snapshots)
 		if err != nil {
 			return err
@@ -246,7 +510,11 @@ func (a *Agent) setupRaft() error {
 		}
 	}
 
-	fsm := newFSM(a.Store, a.logger)
+	fsm := newFSM(a.Store, a.componentLogger("fsm"))
+	fsm.register(a.commands)
+	a.watches = fsm.watches
+	a.sessions = fsm.sessions
+	a.checksums = fsm.checksums
 	rft, err := raft.NewRaft(
 		config, fsm, logStore, stableStore, snapshots, transport,
 	)
@@ -255,7 +523,56 @@ func (a *Agent) setupRaft() error {
 	}
 	a.leaderCh = rft.LeaderCh()
 	a.raft = rft
+	a.leaders = newLeaderHub()
+	go a.observeLeader()
+	go a.observeHeartbeats()
+
+	return nil
+}
+
+// recoverRaft forces the raft configuration listed in peersFile when the
+// file exists, so a cluster that permanently lost its quorum can be restarted.
+// The file is renamed afterwards to not apply it again on the next start.
+func (a *Agent) recoverRaft(
+	peersFile string, config *raft.Config,
+	logs raft.LogStore, stable raft.StableStore,
+	snaps raft.SnapshotStore, trans raft.Transport,
+) error {
+	if _, err := os.Stat(peersFile); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("recovery: %w", err)
+	}
+
+	a.logger.Infof("agent: found %s, recovering the raft configuration", peersFile)
+
+	configuration, err := raft.ReadConfigJSON(peersFile)
+	if err != nil {
+		return fmt.Errorf("recovery: failed to read %s: %w", peersFile, err)
+	}
+
+	// RecoverCluster replays the log into a scratch FSM to write a new
+	// snapshot, the real store is filled later by the running raft.
+	store, err := NewStore(a.logger)
+	if err != nil {
+		return err
+	}
+	defer store.Shutdown()
+
+	fsm := newFSM(store, a.logger)
+	fsm.register(a.commands)
+	if err := raft.RecoverCluster(
+		config, fsm, logs, stable, snaps, trans, configuration,
+	); err != nil {
+		return fmt.Errorf("recovery: failed to recover the raft configuration: %w", err)
+	}
+
+	if err := os.Rename(peersFile, peersFile+".applied"); err != nil {
+		return fmt.Errorf("recovery: configuration recovered but %s could not be renamed, remove it before the next start: %w", peersFile, err)
+	}
 
+	a.logger.Infof("agent: raft configuration recovered with %d servers", len(configuration.Servers))
 	return nil
 }
 
@@ -274,21 +591,32 @@ func (a *Agent) setupSerf() (*serf.Serf, error) {
 		}
 	}
 
-	encryptKey, err := base64.StdEncoding.DecodeString(a.config.EncryptKey)
+	keyring, err := a.config.keyring()
 	if err != nil {
-		return nil, fmt.Errorf("invalid encryption key: %s", err)
+		return nil, err
 	}
 
 	serfConfig := serf.DefaultConfig()
 	serfConfig.Init()
 
+	for k, v := range a.config.Tags {
+		serfConfig.Tags[k] = v
+	}
 	serfConfig.Tags["version"] = Version
+	serfConfig.Tags["dc"] = a.config.Datacenter
+	serfConfig.Tags["started"] = strconv.FormatInt(time.Now().Unix(), 10)
 	if a.config.Bootstrap {
 		serfConfig.Tags["bootstrap"] = "1"
 	}
 	if a.config.BootstrapExpect != 0 {
 		serfConfig.Tags["expect"] = fmt.Sprintf("%d", a.config.BootstrapExpect)
 	}
+	if a.config.nonVoter() {
+		serfConfig.Tags["non_voter"] = "1"
+	}
+	if a.config.ReadOnly {
+		serfConfig.Tags[readOnlyTag] = "1"
+	}
 
 	switch a.config.Profile {
 	case "lan":
@@ -305,26 +633,26 @@ func (a *Agent) setupSerf() (*serf.Serf, error) {
 	serfConfig.MemberlistConfig.BindPort = bindPort
 	serfConfig.MemberlistConfig.AdvertiseAddr = advertiseIP
 	serfConfig.MemberlistConfig.AdvertisePort = advertisePort
-	serfConfig.MemberlistConfig.SecretKey = encryptKey
+	serfConfig.MemberlistConfig.Keyring = keyring
 	serfConfig.NodeName = a.config.NodeName
-	serfConfig.CoalescePeriod = 3 * time.Second
-	serfConfig.QuiescentPeriod = time.Second
-	serfConfig.UserCoalescePeriod = 3 * time.Second
-	serfConfig.UserQuiescentPeriod = time.Second
+	serfConfig.CoalescePeriod = a.config.SerfCoalescePeriod
+	serfConfig.QuiescentPeriod = a.config.SerfQuiescentPeriod
+	serfConfig.UserCoalescePeriod = a.config.SerfUserCoalescePeriod
+	serfConfig.UserQuiescentPeriod = a.config.SerfUserQuiescentPeriod
+	serfConfig.TombstoneTimeout = a.config.SerfTombstoneTimeout
 	serfConfig.ReconnectTimeout, err = time.ParseDuration(a.config.SerfReconnectTimeout)
-
 	if err != nil {
-		a.logger.Fatal(err)
+		return nil, fmt.Errorf("invalid serf-reconnect-timeout: %w", err)
 	}
 
-	a.serfEventer = make(chan serf.Event, 4096)
+	a.serfEventer = make(chan serf.Event, serfEventChSize)
 	serfConfig.EventCh = a.serfEventer
 
 	a.logger.Info("agent: taskvault agent starting")
 
 	if a.logger.Level() == zapcore.DebugLevel {
-		serfConfig.LogOutput = os.Stdout
-		serfConfig.MemberlistConfig.LogOutput = os.Stdout
+		serfConfig.LogOutput = &logWriter{logger: a.componentLogger("serf")}
+		serfConfig.MemberlistConfig.LogOutput = &logWriter{logger: a.componentLogger("memberlist")}
 	} else {
 		serfConfig.LogOutput = io.Discard
 		serfConfig.MemberlistConfig.LogOutput = io.Discard
@@ -338,61 +666,330 @@ func (a *Agent) setupSerf() (*serf.Serf, error) {
 	return serf, nil
 }
 
-func (a *Agent) StartServer() {
-	var err error
+func (a *Agent) StartServer() (err error) {
 	if a.Store == nil {
-		a.Store, err = NewStore(a.logger)
+		a.Store, err = newStorage(a.config, a.componentLogger("store"))
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("agent: Can not open the store, %w", err)
 		}
 	}
+	defer func() {
+		if err != nil {
+			a.stopServer()
+		}
+	}()
 
-	a.HTTPTransport = NewTransport(a, a.logger)
-	a.HTTPTransport.ServeHTTP()
-
-	tcpm := cmux.New(a.listener)
-	var grpcl, raftl net.Listener
+	a.HTTPTransport = NewTransport(a, a.componentLogger("http"))
+	if a.config.EnableHTTP {
+		if err := a.HTTPTransport.ServeHTTP(); err != nil {
+			return err
+		}
+	}
+	if a.config.HealthAddr != "" {
+		if err := a.HTTPTransport.ServeHealth(); err != nil {
+			return err
+		}
+	}
 
-	a.raftLayer = NewRaftLayer(a.logger)
+	a.raftLayer, err = a.config.newRaftLayer(a.componentLogger("raft"), a.keyPair)
+	if err != nil {
+		return fmt.Errorf("agent: Raft layer failed to start, %w", err)
+	}
 
-	grpcl = tcpm.MatchWithWriters(
-		cmux.HTTP2MatchHeaderFieldSendSettings(
-			"content-type", "application/grpc",
-		),
-	)
+	var tcpm cmux.CMux
+	var grpcl, raftl net.Listener
+	if a.config.SeparateListeners {
+		grpcl, raftl = a.listener, a.raftListener
+	} else {
+		tcpm = cmux.New(a.listener)
+		// Connections that never send enough to be matched would otherwise
+		// hold a goroutine of cmux forever.
+		tcpm.SetReadTimeout(a.config.RPCMatchTimeout)
+
+		// HTTP/2 headers are encrypted under TLS, so there the TLS handshake
+		// itself marks a gRPC connection. Raft announces its own TLS with a
+		// leading marker byte and always lands on the catch-all listener.
+		if a.config.TLSEnabled() {
+			grpcl = tcpm.Match(cmux.TLS())
+		} else {
+			grpcl = tcpm.MatchWithWriters(
+				cmux.HTTP2MatchHeaderFieldSendSettings(
+					"content-type", "application/grpc",
+				),
+			)
+		}
 
-	raftl = tcpm.Match(cmux.Any())
+		raftl = tcpm.Match(cmux.Any())
+	}
 
-	a.GRPCServer = NewGRPCServer(a, a.logger)
+	a.GRPCServer = NewGRPCServer(a, a.componentLogger("grpc"))
 	if err := a.GRPCServer.Serve(grpcl); err != nil {
-		a.logger.With(zap.Error(err)).Fatal("agent: RPC server failed to start")
+		return fmt.Errorf("agent: RPC server failed to start, %w", err)
 	}
 
 	a.raftLayer.Open(raftl)
+	if addr, err := net.ResolveTCPAddr("tcp", a.advertiseRaftAddr()); err == nil {
+		a.raftLayer.Advertise(addr)
+	}
 
 	if err := a.setupRaft(); err != nil {
-		a.logger.With(zap.Error(err)).Fatal("agent: Raft layer failed to start")
+		return fmt.Errorf("agent: Raft layer failed to start, %w", err)
 	}
 
-	go func() {
-		if err := tcpm.Serve(); err != nil {
-			a.logger.Fatal(err)
-		}
-	}()
+	if tcpm != nil {
+		go a.serveMux(tcpm)
+	}
 
 	go a.monitorLeadership()
+	go a.emitMetrics()
+	return nil
+}
+
+// stopServer undoes StartServer, in the reverse order, when the agent fails to
+// start.
+func (a *Agent) stopServer() {
+	switch {
+	case a.raft != nil:
+		if err := a.raft.Shutdown().Error(); err != nil {
+			a.logger.With(zap.Error(err)).Warn("agent: Error shutting down raft")
+		}
+	case a.raftTransport != nil:
+		_ = a.raftTransport.Close()
+	case a.raftLayer != nil:
+		_ = a.raftLayer.Close()
+	}
+	if a.raftStore != nil {
+		_ = a.raftStore.Close()
+	}
+
+	if a.GRPCServer != nil {
+		a.GRPCServer.Stop(time.Now())
+	}
+	if a.HTTPTransport != nil {
+		_ = a.HTTPTransport.Shutdown(context.Background())
+	}
+	if err := a.Store.Shutdown(); err != nil {
+		a.logger.With(zap.Error(err)).Warn("agent: Error closing the store")
+	}
+}
+
+// serveMux serves the RPC port shared by gRPC and raft until it is closed.
+func (a *Agent) serveMux(tcpm cmux.CMux) {
+	err := tcpm.Serve()
+	select {
+	case <-a.shutdowner:
+		// Raft closes the shared listener while stopping.
+		return
+	default:
+	}
+	if err == nil || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, cmux.ErrListenerClosed) || errors.Is(err, cmux.ErrServerClosed) {
+		a.logger.Info("agent: RPC listener closed")
+		return
+	}
+	a.logger.With(zap.Error(err)).Fatal("agent: RPC listener failed")
+}
+
+// Leader returns the name and addresses of the raft leader. During an election
+// the response is empty and err is ErrLeaderNotFound.
+func (a *Agent) Leader() (*types.GetLeaderResponse, error) {
+	member, err := a.leaderMember()
+	if err != nil {
+		return &types.GetLeaderResponse{}, err
+	}
+	return &types.GetLeaderResponse{
+		Name:     member.Name,
+		RpcAddr:  member.Tags["rpc_addr"],
+		HttpAddr: member.Tags[httpAddrTag],
+	}, nil
+}
+
+// leaderRPCAddr is the gRPC address of the raft leader.
+func (a *Agent) leaderRPCAddr() (string, error) {
+	addr, id := a.raft.LeaderWithID()
+	if addr == "" {
+		return "", ErrLeaderNotFound
+	}
+	return a.rpcAddr(id, addr), nil
+}
+
+// rpcAddr is the gRPC address of the raft server id at addr. Raft only knows
+// the raft address, which has its own port with separate listeners, so the
+// rpc_addr tag of the member is used when there is one.
+func (a *Agent) rpcAddr(id raft.ServerID, addr raft.ServerAddress) string {
+	if a.serf != nil {
+		for _, m := range a.serf.Members() {
+			if m.Name == string(id) && m.Tags["rpc_addr"] != "" {
+				return m.Tags["rpc_addr"]
+			}
+		}
+	}
+	return string(addr)
 }
 
 func (a *Agent) leaderMember() (*serf.Member, error) {
 	l := a.raft.Leader()
+	if l == "" {
+		return nil, ErrLeaderNotFound
+	}
 	for _, member := range a.serf.Members() {
-		if member.Tags["rpc_addr"] == string(l) {
+		if raftAddr(member) == string(l) {
 			return &member, nil
 		}
 	}
 	return nil, ErrLeaderNotFound
 }
 
+// RaftRemovePeerByID removes the server id from the raft configuration. Only
+// the leader can change it.
+func (a *Agent) RaftRemovePeerByID(id string) error {
+	if !a.IsLeader() {
+		return raft.ErrNotLeader
+	}
+
+	future := a.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	for _, server := range future.Configuration().Servers {
+		if server.ID == raft.ServerID(id) {
+			return a.raft.RemoveServer(server.ID, 0, 0).Error()
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrPeerNotFound, id)
+}
+
+// LeadershipTransfer hands leadership over to another voter. With an empty
+// target raft picks the most up to date follower, unless some voters are in
+// maintenance: then the first voter that is not is picked. A named target
+// must be a voter in the current configuration and not in maintenance.
+func (a *Agent) LeadershipTransfer(target string) error {
+	if !a.IsLeader() {
+		return raft.ErrNotLeader
+	}
+
+	future := a.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	servers := future.Configuration().Servers
+	maintenance := a.maintenanceMembers()
+
+	if target == "" {
+		for _, server := range servers {
+			if server.Suffrage == raft.Voter && maintenance[string(server.ID)] {
+				target = a.transferTarget(servers, maintenance)
+				break
+			}
+		}
+		if target == "" {
+			return a.raft.LeadershipTransfer().Error()
+		}
+	}
+
+	for _, server := range servers {
+		if server.ID != raft.ServerID(target) {
+			continue
+		}
+		if server.Suffrage != raft.Voter {
+			return ErrTargetNotVoter
+		}
+		if maintenance[target] {
+			return fmt.Errorf("%w: %s", ErrTargetInMaintenance, target)
+		}
+
+		a.logger.Info("agent: transferring leadership", zap.String("target", target))
+		return a.raft.LeadershipTransferToServer(server.ID, server.Address).Error()
+	}
+
+	return fmt.Errorf("%w: %s is not in the raft configuration", ErrTargetNotVoter, target)
+}
+
+// transferTarget returns the first other voter that is not in maintenance,
+// or an empty string when there is none.
+func (a *Agent) transferTarget(servers []raft.Server, maintenance map[string]bool) string {
+	for _, server := range servers {
+		id := string(server.ID)
+		if server.Suffrage == raft.Voter && id != a.config.NodeName && !maintenance[id] {
+			return id
+		}
+	}
+	return ""
+}
+
+// ForceLeave evicts a member that is gone for good but was never reaped. It
+// is marked as left in serf and, when run on the leader, removed from the
+// raft configuration.
+func (a *Agent) ForceLeave(name string) error {
+	var member *serf.Member
+	for _, m := range a.serf.Members() {
+		if m.Name == name {
+			member = &m
+			break
+		}
+	}
+	if member == nil {
+		return ErrMemberNotFound
+	}
+
+	if _, id := a.raft.LeaderWithID(); id == raft.ServerID(name) {
+		return ErrForceLeaveLeader
+	}
+	if member.Status == serf.StatusAlive {
+		return ErrMemberAlive
+	}
+
+	if err := a.serf.RemoveFailedNode(name); err != nil {
+		return err
+	}
+	a.logger.Info("agent: forced member to leave", zap.String("member", name))
+
+	if !a.IsLeader() {
+		return nil
+	}
+	parts := toServerPart(*member)
+	if parts == nil {
+		return nil
+	}
+
+	return a.removeRaftPeer(*member, parts)
+}
+
+// Snapshot forces raft to snapshot the FSM and returns the index of the
+// resulting snapshot. Any voter may snapshot its local state.
+func (a *Agent) Snapshot() (uint64, error) {
+	future := a.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return 0, err
+	}
+
+	voter := false
+	for _, server := range future.Configuration().Servers {
+		if server.ID == raft.ServerID(a.config.NodeName) {
+			voter = server.Suffrage == raft.Voter
+			break
+		}
+	}
+	if !voter {
+		return 0, ErrNotVoter
+	}
+
+	if err := a.raft.Snapshot().Error(); err != nil {
+		return 0, err
+	}
+
+	// Dev mode discards snapshots and cannot open them, the stats know the
+	// index either way.
+	index, err := strconv.ParseUint(a.raft.Stats()["last_snapshot_index"], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	a.logger.Info("agent: snapshot taken", zap.Uint64("index", index))
+
+	return index, nil
+}
+
 func (a *Agent) IsLeader() bool {
 	return a.raft.State() == raft.Leader
 }
@@ -408,12 +1005,81 @@ func (a *Agent) Servers() (members []*ServerParts) {
 	return members
 }
 
+// Members describes every serf member together with its role in the raft
+// configuration and whether it is the current leader. A non empty datacenter
+// only returns the members of that datacenter.
+func (a *Agent) Members(datacenter string) ([]*types.ClusterMember, error) {
+	future := a.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	roles := make(map[raft.ServerID]types.RaftRole)
+	for _, server := range future.Configuration().Servers {
+		roles[server.ID] = raftRoleToProto(server.Suffrage)
+	}
+
+	leaderName := ""
+	if leader, err := a.leaderMember(); err == nil {
+		leaderName = leader.Name
+	}
+
+	var members []*types.ClusterMember
+	for _, m := range a.serf.Members() {
+		if datacenter != "" && m.Tags["dc"] != datacenter {
+			continue
+		}
+
+		tags := make(map[string]string, len(m.Tags))
+		for k, v := range m.Tags {
+			tags[k] = v
+		}
+
+		member := &types.ClusterMember{
+			Name:       m.Name,
+			Addr:       net.JoinHostPort(m.Addr.String(), strconv.Itoa(int(m.Port))),
+			Status:     m.Status.String(),
+			Tags:       tags,
+			Leader:     leaderName != "" && m.Name == leaderName,
+			Datacenter: m.Tags["dc"],
+		}
+		member.Maintenance, member.MaintenanceReason = memberMaintenance(m)
+		member.ReadOnly = m.Tags[readOnlyTag] == "1"
+		if parts := toServerPart(m); parts != nil {
+			member.RaftRole = roles[raft.ServerID(parts.ID)]
+			// A non-voter without the non_voter tag is a learner waiting
+			// for its promotion.
+			if member.RaftRole == types.RaftRole_NONVOTER && !parts.NonVoter {
+				member.RaftRole = types.RaftRole_STAGING
+			}
+		}
+
+		members = append(members, member)
+	}
+
+	return members, nil
+}
+
+func raftRoleToProto(s raft.ServerSuffrage) types.RaftRole {
+	switch s {
+	case raft.Voter:
+		return types.RaftRole_VOTER
+	case raft.Nonvoter:
+		return types.RaftRole_NONVOTER
+	case raft.Staging:
+		return types.RaftRole_STAGING
+	default:
+		return types.RaftRole_NO_ROLE
+	}
+}
+
 func (a *Agent) eventLoop() {
 	internalShutdowner := a.serf.ShutdownCh()
 	a.logger.Info("agent: Listen for events")
 	for {
 		select {
 		case e := <-a.serfEventer:
+			a.observeSerfQueue()
 			a.logger.With(zap.String("event", e.String())).Info("agent: Received event")
 
 			if me, ok := e.(serf.MemberEvent); ok {
@@ -429,13 +1095,20 @@ func (a *Agent) eventLoop() {
 				case serf.EventMemberJoin:
 					a.nodeJoin(me, true)
 					a.reapEvent(me)
-				case serf.EventMemberLeave, serf.EventMemberFailed:
-					a.nodeFailed(me)
+				case serf.EventMemberLeave:
+					a.nodeLeave(me)
+					a.reapEvent(me)
+				case serf.EventMemberFailed:
+					// A failed server may come back on the same address,
+					// raft keeps dialing it until the member is reaped.
 					a.reapEvent(me)
 				case serf.EventMemberReap:
+					a.nodeLeave(me)
 					a.reapEvent(me)
 				case serf.EventMemberUpdate:
-					a.nodeJoin(me, false)
+					// Serf may coalesce a join with the following tag
+					// update, so updates can complete the expected set too.
+					a.nodeJoin(me, true)
 					a.reapEvent(me)
 				default:
 					a.logger.Warn("agent: Unhandled serf event", zap.String("event", e.String()))
@@ -448,6 +1121,21 @@ func (a *Agent) eventLoop() {
 	}
 }
 
+// observeSerfQueue publishes the number of serf events waiting for eventLoop
+// and warns when the loop falls behind, before serf itself starts blocking.
+func (a *Agent) observeSerfQueue() {
+	depth := len(a.serfEventer)
+	metrics.SetGauge([]string{"taskvault", "serf", "queue_depth"}, float32(depth))
+
+	switch {
+	case depth >= serfEventChWarn && a.serfBacklog.CompareAndSwap(false, true):
+		a.logger.Warnw("agent: Serf event queue is backing up",
+			"depth", depth, "capacity", cap(a.serfEventer))
+	case depth < serfEventChWarn/2 && a.serfBacklog.CompareAndSwap(true, false):
+		a.logger.Infow("agent: Serf event queue drained", "depth", depth)
+	}
+}
+
 func (a *Agent) join(addrs []string, replay bool) (n int, err error) {
 	a.logger.Infof("agent: joining: %v replay: %v", addrs, replay)
 	n, err = a.serf.Join(addrs, !replay)
@@ -461,28 +1149,428 @@ func (a *Agent) join(addrs []string, replay bool) (n int, err error) {
 	return
 }
 
+// advertiseRPCAddr is the gRPC address other servers dial, and the raft one
+// too unless raft has its own port. It uses the host of advertise-addr, like
+// serf, so the rpc_addr tag and the raft configuration agree with the gossip
+// address.
 func (a *Agent) advertiseRPCAddr() string {
-	bindIP := a.serf.LocalMember().Addr
+	advertiseIP := a.serf.LocalMember().Addr.String()
+	if a.config.AdvertiseAddr != "" {
+		if ip, _, err := a.config.AddrParts(a.config.AdvertiseAddr); err == nil {
+			advertiseIP = ip
+		}
+	}
 	return net.JoinHostPort(
-		bindIP.String(), strconv.Itoa(a.config.AdvertiseRPCPort),
+		advertiseIP, strconv.Itoa(a.config.AdvertiseRPCPort),
 	)
 }
 
+// advertiseHTTPAddr is the address other nodes send HTTP clients to, the
+// advertised IP is used when the API listens on every interface. It is empty
+// when the API is disabled.
+func (a *Agent) advertiseHTTPAddr() string {
+	if !a.config.EnableHTTP {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(a.config.HTTPAddr)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		rpcHost, _, _ := net.SplitHostPort(a.advertiseRPCAddr())
+		host = rpcHost
+	}
+	return net.JoinHostPort(host, port)
+}
+
 func (a *Agent) bindRPCAddr() string {
 	bindIP, _, _ := a.config.AddrParts(a.config.BindAddr)
 	return net.JoinHostPort(bindIP, strconv.Itoa(a.config.RPCPort))
 }
 
-func (a *Agent) applySetPair(pair *types.Pair) error {
-	cmd, err := Encode(AddPairType, pair)
+// advertiseRaftAddr is the address of this server in the raft configuration,
+// published in the raft_addr tag.
+func (a *Agent) advertiseRaftAddr() string {
+	if !a.config.SeparateListeners {
+		return a.advertiseRPCAddr()
+	}
+	host, _, _ := net.SplitHostPort(a.advertiseRPCAddr())
+	return net.JoinHostPort(host, strconv.Itoa(a.config.AdvertiseRaftPort))
+}
+
+func (a *Agent) bindRaftAddr() string {
+	bindIP, _, _ := a.config.AddrParts(a.config.BindAddr)
+	return net.JoinHostPort(bindIP, strconv.Itoa(a.config.RaftPort))
+}
+
+// apply replicates an encoded command through raft and returns the value
+// produced by the FSM for it. Raft can not take a command back once it is
+// queued, so when ctx ends first apply stops waiting and returns ctx.Err()
+// while the command may still be committed.
+func (a *Agent) apply(ctx context.Context, t MessageType, msg any) (_ interface{}, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cmd, err := Encode(t, msg)
+	if err != nil {
+		return nil, err
+	}
+	if key := idempotencyKey(ctx); key != "" {
+		if len(key) > maxIdempotencyKeySize {
+			return nil, fmt.Errorf("%w: longer than %d bytes", ErrInvalidIdempotencyKey, maxIdempotencyKeySize)
+		}
+		payload, err := proto.Marshal(msg.(proto.Message))
+		if err != nil {
+			return nil, err
+		}
+		cmd, err = Encode(IdempotentType, &types.IdempotentCommand{
+			Token:   key,
+			Type:    uint32(t),
+			Command: payload,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	defer metrics.MeasureSinceWithLabels(
+		[]string{"taskvault", "apply"}, time.Now(),
+		[]metrics.Label{{Name: "type", Value: t.String()}},
+	)
+
+	_, span := tracer.Start(ctx, "taskvault.raft.apply",
+		trace.WithAttributes(attribute.String("command", t.String())),
+	)
+	defer func() { endSpan(span, err) }()
+
+	timeout := raftTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+
+	if !a.acquireApplySlot() {
+		err = ErrApplyQueueFull
+		return nil, err
+	}
+	af := a.raft.Apply(cmd, timeout)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- af.Error()
+		// The slot is held until raft is done with the command, even when
+		// the caller stopped waiting.
+		a.releaseApplySlot()
+	}()
+
+	select {
+	case err = <-errCh:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int64("index", int64(af.Index())))
+	return af.Response(), nil
+}
+
+// acquireApplySlot reserves room for one more command in flight, false when
+// ApplyQueueDepth commands already are.
+func (a *Agent) acquireApplySlot() bool {
+	if a.applySlots == nil {
+		return true
+	}
+	select {
+	case a.applySlots <- struct{}{}:
+		return true
+	default:
+		metrics.IncrCounter([]string{"taskvault", "apply", "rejected"}, 1)
+		return false
+	}
+}
+
+func (a *Agent) releaseApplySlot() {
+	if a.applySlots != nil {
+		<-a.applySlots
+	}
+}
+
+func (a *Agent) applySetPair(ctx context.Context, pair *types.Pair) error {
+	if err := a.config.checkPairSize(pair.Key, pair.Value); err != nil {
+		return err
+	}
+	resp, err := a.apply(ctx, AddPairType, pair)
 	if err != nil {
 		return err
 	}
 
-	af := a.raft.Apply(cmd, raftTimeout)
-	if err := af.Error(); err != nil {
+	if err, ok := resp.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// applyCASPair replicates a compare-and-swap of pair against expectedIndex.
+// It returns the stored pair, or ErrCASFailed when the index did not match.
+func (a *Agent) applyCASPair(
+	ctx context.Context, pair *types.Pair, expectedIndex uint64,
+) (*types.Pair, error) {
+	if err := a.config.checkPairSize(pair.Key, pair.Value); err != nil {
+		return nil, err
+	}
+	resp, err := a.apply(ctx, CASPairType, &types.CASPairCommand{
+		Pair:          pair,
+		ExpectedIndex: expectedIndex,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch r := resp.(type) {
+	case error:
+		return nil, r
+	case *types.Pair:
+		return r, nil
+	default:
+		return nil, fmt.Errorf("agent: unexpected CAS response: %v", resp)
+	}
+}
+
+// applyDeletePair replicates the removal of key through raft. ErrKeyNotFound
+// is returned when the key did not exist at the time the command was applied.
+func (a *Agent) applyDeletePair(ctx context.Context, key string) error {
+	resp, err := a.apply(ctx, DeletePairType, &types.DeleteValueRequest{Key: key})
+	if err != nil {
+		return err
+	}
+
+	if err, ok := resp.(error); ok {
 		return err
 	}
 
 	return nil
 }
+
+// applyExpirePair deletes an expired pair through raft, but only if it was not
+// rewritten with a different expiry since the leader observed it.
+func (a *Agent) applyExpirePair(ctx context.Context, pair *types.Pair) error {
+	resp, err := a.apply(ctx, DeletePairType, &types.DeleteValueRequest{
+		Key:       pair.Key,
+		ExpiresAt: pair.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err, ok := resp.(error); ok {
+		return err
+	}
+
+	return nil
+}
+
+// ApplyTxn replicates ops as a single atomic command. It returns the raft
+// index the transaction was committed at, or a *TxnFailedError when one of
+// the ModifyIndex checks failed and nothing was written.
+func (a *Agent) ApplyTxn(ctx context.Context, ops []*types.TxnOp) (uint64, error) {
+	for _, op := range ops {
+		if err := a.config.checkPairSize(op.GetPair().GetKey(), op.GetPair().GetValue()); err != nil {
+			return 0, err
+		}
+	}
+	resp, err := a.apply(ctx, TxnType, &types.TxnRequest{Ops: ops})
+	if err != nil {
+		return 0, err
+	}
+
+	switch r := resp.(type) {
+	case error:
+		return 0, r
+	case uint64:
+		return r, nil
+	default:
+		return 0, fmt.Errorf("agent: unexpected txn response: %v", resp)
+	}
+}
+
+// GetPair reads a pair honoring the requested consistency. Stale reads never
+// touch raft, so they keep working on followers that lost their leader.
+// Linearizable and ReadIndex reads are served by the leader, after a barrier
+// or a read index round respectively; followers forward them to the current
+// leader.
+func (a *Agent) GetPair(key string, opts ReadOptions) (*types.Pair, error) {
+	if opts.Consistency == Stale {
+		return a.Store.GetPair(key, opts)
+	}
+
+	if !a.IsLeader() {
+		leader, err := a.leaderRPCAddr()
+		if err != nil {
+			return nil, err
+		}
+
+		return a.GRPCClient.GetPair(leader, key, opts)
+	}
+
+	if opts.Consistency == ReadIndex {
+		if err := a.readIndex(raftTimeout); err != nil {
+			return nil, err
+		}
+		return a.Store.GetPair(key, opts)
+	}
+
+	if err := a.raft.Barrier(raftTimeout).Error(); err != nil {
+		return nil, err
+	}
+
+	return a.Store.GetPair(key, opts)
+}
+
+// StatPair describes the pair at key without its value, so clients can tell
+// whether it changed before fetching it. It is a stale read of the local
+// store. The ModifyIndex and ModifyTime come from the replicated log and are
+// the same on every node.
+func (a *Agent) StatPair(key string) (*types.PairMeta, error) {
+	pair, err := a.Store.GetPair(key, ReadOptions{Consistency: Stale})
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &types.PairMeta{
+		Key:         pair.Key,
+		ModifyIndex: pair.ModifyIndex,
+		Size:        int64(len(pair.Value)),
+		ExpiresAt:   pair.ExpiresAt,
+		ModifyTime:  pair.ModifyTime,
+		Session:     pair.Session,
+		ContentType: pair.ContentType,
+		Flags:       pair.Flags,
+	}
+	if pair.ExpiresAt != 0 {
+		// Rounded up, a pair with time left never reports a zero TTL.
+		ttl := time.Until(time.Unix(0, pair.ExpiresAt))
+		meta.TtlSeconds = int64((ttl + time.Second - 1) / time.Second)
+	}
+	return meta, nil
+}
+
+// readIndex waits until the local store reflects every write committed before
+// it was called, without appending to the log: the commit index is recorded,
+// a heartbeat round confirms that no other leader was elected meanwhile, and
+// the read waits for the FSM to apply up to the recorded index. Until the
+// leader committed an entry of its own term its commit index may be behind,
+// so a barrier is used instead.
+func (a *Agent) readIndex(timeout time.Duration) error {
+	defer metrics.MeasureSince([]string{"taskvault", "read_index"}, time.Now())
+
+	if !a.leaderReady.Load() {
+		return a.raft.Barrier(timeout).Error()
+	}
+
+	index := a.raft.CommitIndex()
+	if err := a.raft.VerifyLeader().Error(); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	wait := readIndexPollMin
+	for a.raft.AppliedIndex() < index {
+		if time.Now().After(deadline) {
+			return raft.ErrEnqueueTimeout
+		}
+		time.Sleep(wait)
+		wait = min(2*wait, readIndexPollMax)
+	}
+
+	return nil
+}
+
+// ListPairs returns a page of pairs under prefix from the local store. Scans
+// are always stale reads, a cluster wide linearizable scan is too expensive.
+// The returned continue token is empty once the last page was served.
+//
+// The token holds the last key served, not an offset, so it stays valid on
+// any node and across leader changes: the next page starts after that key
+// in whatever the store holds then. It also holds the index the page was
+// read at, a node that has not applied that far yet answers
+// ErrStaleContinueToken rather than a page missing pairs already seen.
+func (a *Agent) ListPairs(
+	prefix string, limit int, token string,
+) ([]*types.Pair, string, error) {
+	tok, err := decodeContinueToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	index := a.appliedIndex()
+	if tok.index > index {
+		return nil, "", ErrStaleContinueToken
+	}
+
+	if limit <= 0 {
+		pairs, err := a.Store.ScanPairs(prefix, tok.after, 0)
+		return pairs, "", err
+	}
+
+	pairs, err := a.Store.ScanPairs(prefix, tok.after, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(pairs) <= limit {
+		return pairs, "", nil
+	}
+
+	pairs = pairs[:limit]
+	return pairs, encodeContinueToken(continueToken{
+		after: pairs[limit-1].Key,
+		index: max(index, tok.index),
+	}), nil
+}
+
+// appliedIndex is the raft index the local store has caught up to.
+func (a *Agent) appliedIndex() uint64 {
+	if a.raft == nil {
+		return 0
+	}
+	return a.raft.AppliedIndex()
+}
+
+// continueTokenPrefix starts a token carrying an index. Tokens of older
+// releases are the bare last key in base64, which never holds a dot, and are
+// read with a zero index.
+const continueTokenPrefix = "v1."
+
+// continueToken is where ListPairs resumes: after the key after, on a node
+// that applied at least index.
+type continueToken struct {
+	after string
+	index uint64
+}
+
+func encodeContinueToken(t continueToken) string {
+	b := binary.AppendUvarint(nil, t.index)
+	return continueTokenPrefix + base64.RawURLEncoding.EncodeToString(append(b, t.after...))
+}
+
+func decodeContinueToken(token string) (continueToken, error) {
+	if token == "" {
+		return continueToken{}, nil
+	}
+
+	encoded, versioned := strings.CutPrefix(token, continueTokenPrefix)
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(b) == 0 {
+		return continueToken{}, ErrInvalidContinueToken
+	}
+	if !versioned {
+		return continueToken{after: string(b)}, nil
+	}
+
+	index, n := binary.Uvarint(b)
+	if n <= 0 || len(b) == n {
+		return continueToken{}, ErrInvalidContinueToken
+	}
+
+	return continueToken{after: string(b[n:]), index: index}, nil
+}
@@ -1,16 +1,26 @@
 package taskvault
 
 import (
+	"context"
+	"encoding/base64"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
-	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
 	"github.com/hashicorp/serf/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 var (
@@ -39,6 +49,23 @@ func TestEncrypt(t *testing.T) {
 	time.Sleep(2 * time.Second)
 
 	assert.True(t, a.serf.EncryptionEnabled())
+
+	// Rotate to a new key.
+	newKey := "5K9OtfP7efFrNKe5WCQvXvnaXJ5cWP0SvXiwe0kkjM4="
+	_, err = a.KeyringInstall(newKey)
+	require.NoError(t, err)
+	_, err = a.KeyringUse(newKey)
+	require.NoError(t, err)
+	_, err = a.KeyringRemove(c.EncryptKey)
+	require.NoError(t, err)
+
+	resp, err := a.KeyringList()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{newKey: 1}, resp.Keys)
+	assert.Equal(t, map[string]int{newKey: 1}, resp.PrimaryKeys)
+
+	_, err = a.KeyringInstall("not base64")
+	assert.ErrorIs(t, err, ErrInvalidEncryptKey)
 	_ = a.Stop()
 }
 
@@ -98,6 +125,8 @@ func Test_bindRPCAddr(t *testing.T) {
 	bindRPCAddr := a.bindRPCAddr()
 	exRPCAddr := a1Addr + ":6868"
 	assert.Equal(t, exRPCAddr, bindRPCAddr)
+
+	_ = a.Stop()
 }
 
 func TestAgentConfig(t *testing.T) {
@@ -214,90 +243,1014 @@ func TestAgentCommand_testElection(t *testing.T) {
 	_ = a3.Stop()
 }
 
-func TestAgents(t *testing.T) {
+// startTestCluster starts n dev mode servers that form a cluster once all
+// of them joined, they are stopped at the end of the test.
+func startTestCluster(t *testing.T, n int) []*Agent {
+	var agents []*Agent
+	var joinAddr string
+	for i := 1; i <= n; i++ {
+		ip, returnFn := testutil.TakeIP()
+		t.Cleanup(returnFn)
+
+		c := DefaultConfig()
+		c.BindAddr = ip.String()
+		c.AdvertiseAddr = ip.String()
+		c.NodeName = "test" + strconv.Itoa(i)
+		c.LogLevel = logLevel
+		c.BootstrapExpect = n
+		c.DevMode = true
+		c.HTTPAddr = ip.String() + ":18080"
+		c.DataDir = t.TempDir()
+		if joinAddr != "" {
+			c.StartJoin = []string{joinAddr}
+		} else {
+			joinAddr = ip.String() + ":8946"
+		}
+
+		a := NewAgent(c)
+		require.NoError(t, a.Start())
+		t.Cleanup(func() { _ = a.Stop() })
+		agents = append(agents, a)
+	}
+	return agents
+}
+
+func findLeader(agents []*Agent) *Agent {
+	for _, a := range agents {
+		if a.IsLeader() {
+			return a
+		}
+	}
+	return nil
+}
+
+// testLeader waits for one of agents to lead.
+func testLeader(t *testing.T, agents []*Agent) *Agent {
+	require.Eventually(t, func() bool { return findLeader(agents) != nil }, 10*time.Second, 50*time.Millisecond)
+	return findLeader(agents)
+}
+
+func TestAgent_StopLeader(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping long-running test in short mode")
 	}
 
-	dir, err := ioutil.TempDir("", "taskvault-test")
-	require.NoError(t, err)
-	defer os.RemoveAll(dir)
+	agents := startTestCluster(t, 3)
+	old := testLeader(t, agents)
+	var rest []*Agent
+	for _, a := range agents {
+		if a != old {
+			rest = append(rest, a)
+		}
+	}
+	require.NoError(t, old.Stop())
+
+	// Leadership was handed over, not lost to an election timeout.
+	require.NotNil(t, findLeader(rest))
+
+	// The stopped node left serf while raft still ran, the others see it
+	// as left rather than failed and the new leader drops it from raft.
+	for _, a := range rest {
+		for _, m := range a.serf.Members() {
+			if m.Name == old.config.NodeName {
+				assert.Equal(t, serf.StatusLeft, m.Status, a.config.NodeName)
+			}
+		}
+	}
+	assert.Eventually(t, func() bool {
+		l := findLeader(rest)
+		if l == nil {
+			return false
+		}
+		future := l.raft.GetConfiguration()
+		if future.Error() != nil {
+			return false
+		}
+		servers := future.Configuration().Servers
+		for _, s := range servers {
+			if s.ID == raft.ServerID(old.config.NodeName) {
+				return false
+			}
+		}
+		return len(servers) == 2
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+func TestAgent_ForceLeave(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long-running test in short mode")
+	}
+
+	agents := startTestCluster(t, 3)
+	leader := testLeader(t, agents)
+	var member *Agent
+	for _, a := range agents {
+		if a != leader {
+			member = a
+			break
+		}
+	}
+	name := member.config.NodeName
+
+	assert.ErrorIs(t, leader.ForceLeave("nobody"), ErrMemberNotFound)
+	assert.ErrorIs(t, leader.ForceLeave(leader.config.NodeName), ErrForceLeaveLeader)
+	assert.ErrorIs(t, leader.ForceLeave(name), ErrMemberAlive)
+
+	// The member crashes, it never leaves and stays failed.
+	require.NoError(t, member.serf.Shutdown())
+	require.NoError(t, member.raft.Shutdown().Error())
+
+	status := func() serf.MemberStatus {
+		for _, m := range leader.serf.Members() {
+			if m.Name == name {
+				return m.Status
+			}
+		}
+		return serf.StatusNone
+	}
+	require.Eventually(t, func() bool { return status() == serf.StatusFailed }, 30*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, leader.ForceLeave(name))
+	assert.Equal(t, serf.StatusLeft, status())
+
+	future := leader.raft.GetConfiguration()
+	require.NoError(t, future.Error())
+	assert.Len(t, future.Configuration().Servers, 2)
+	for _, server := range future.Configuration().Servers {
+		assert.NotEqual(t, raft.ServerID(name), server.ID)
+	}
+}
+
+func TestAgent_RefreshOnJoin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long-running test in short mode")
+	}
 
-	a1Name := "test1"
-	a2Name := "test2"
 	ip1, returnFn1 := testutil.TakeIP()
-	a1Addr := ip1.String()
 	defer returnFn1()
 	ip2, returnFn2 := testutil.TakeIP()
-	a2Addr := ip2.String()
 	defer returnFn2()
 
 	c := DefaultConfig()
-	c.BindAddr = a1Addr
-	c.StartJoin = []string{a2Addr}
-	c.NodeName = a1Name
+	c.BindAddr = ip1.String()
+	c.HTTPAddr = ip1.String() + ":8080"
+	c.NodeName = "test1"
 	c.LogLevel = logLevel
-	c.BootstrapExpect = 3
+	c.Bootstrap = true
 	c.DevMode = true
-	c.HTTPAddr = ":8080"
-	c.DataDir = dir
+	// Only member events can add the second server in time.
+	c.RefreshInterval = time.Hour
 
 	a1 := NewAgent(c)
-	err = a1.Start()
+	require.NoError(t, a1.Start())
+	defer a1.Stop()
+	require.Eventually(t, a1.IsLeader, 10*time.Second, 100*time.Millisecond)
+
+	c = DefaultConfig()
+	c.BindAddr = ip2.String()
+	c.AdvertiseAddr = ip2.String()
+	c.HTTPAddr = ip2.String() + ":8080"
+	c.StartJoin = []string{ip1.String() + ":8946"}
+	c.NodeName = "test2"
+	c.LogLevel = logLevel
+	c.DataDir = t.TempDir()
+
+	a2 := NewAgent(c)
+	require.NoError(t, a2.Start())
+	defer a2.Stop()
+
+	require.Eventually(t, func() bool {
+		future := a1.raft.GetConfiguration()
+		if future.Error() != nil {
+			return false
+		}
+		for _, server := range future.Configuration().Servers {
+			if server.ID == "test2" && server.Suffrage == raft.Voter {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestAgent_ListPairsPagination(t *testing.T) {
+	s, err := NewStore(zap.NewNop().Sugar())
 	require.NoError(t, err)
+	defer s.Shutdown()
 
-	time.Sleep(2 * time.Second)
+	for _, k := range []string{"p/1", "p/2", "p/3", "q/1"} {
+		require.NoError(t, s.SetValue(k, k))
+	}
 
-	if a1.IsLeader() {
-		m, err := a1.leaderMember()
-		if err != nil {
-			t.Fatal(err)
+	a := &Agent{Store: s}
+
+	var keys []string
+	token := ""
+	for {
+		pairs, next, err := a.ListPairs("p/", 2, token)
+		require.NoError(t, err)
+		for _, p := range pairs {
+			keys = append(keys, p.Key)
 		}
-		t.Logf("%s is the current leader", m.Name)
-		assert.Equal(t, a1Name, m.Name)
+		if next == "" {
+			break
+		}
+		token = next
 	}
+	assert.Equal(t, []string{"p/1", "p/2", "p/3"}, keys)
 
-	c = DefaultConfig()
-	c.BindAddr = a2Addr
-	c.StartJoin = []string{a1Addr + ":8946"}
-	c.NodeName = a2Name
-	c.LogLevel = logLevel
-	c.BootstrapExpect = 3
-	c.DevMode = true
-	c.HTTPAddr = ":8081"
-	c.DataDir = dir
+	_, _, err = a.ListPairs("p/", 2, "!!!")
+	assert.ErrorIs(t, err, ErrInvalidContinueToken)
 
-	a2 := NewAgent(c)
-	err = a2.Start()
+	// Tokens of older releases are the bare last key.
+	pairs, _, err := a.ListPairs("p/", 0, base64.RawURLEncoding.EncodeToString([]byte("p/1")))
 	require.NoError(t, err)
+	assert.Len(t, pairs, 2)
 
-	time.Sleep(2 * time.Second)
+	// Even when the key starts with a byte the versioned encoding once used.
+	legacy := base64.RawURLEncoding.EncodeToString([]byte("\x01p/1"))
+	tok, err := decodeContinueToken(legacy)
+	require.NoError(t, err)
+	assert.Equal(t, continueToken{after: "\x01p/1"}, tok)
+	tok, err = decodeContinueToken(encodeContinueToken(continueToken{after: "\x01p/1", index: 7}))
+	require.NoError(t, err)
+	assert.Equal(t, continueToken{after: "\x01p/1", index: 7}, tok)
 
-	c = DefaultConfig()
-	ip3, returnFn3 := testutil.TakeIP()
-	defer returnFn3()
-	c.BindAddr = ip3.String()
-	c.StartJoin = []string{a1Addr + ":8946"}
-	c.NodeName = "test3"
-	c.LogLevel = logLevel
-	c.BootstrapExpect = 3
-	c.HTTPAddr = ":8082"
+	// A node that has not applied up to the page the token came from.
+	_, _, err = a.ListPairs("p/", 2, encodeContinueToken(continueToken{after: "p/1", index: 5}))
+	assert.ErrorIs(t, err, ErrStaleContinueToken)
+}
+
+func TestAgent_StatPair(t *testing.T) {
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+	a := &Agent{Store: s}
+
+	now := time.Now()
+	cmd, err := Encode(AddPairType, &types.Pair{
+		Key:         "foo",
+		Value:       "hello",
+		ExpiresAt:   now.Add(90 * time.Second).UnixNano(),
+		ContentType: "text/plain",
+		Flags:       3,
+	})
+	require.NoError(t, err)
+	require.Nil(t, fsm.Apply(&raft.Log{Index: 7, Data: cmd, AppendedAt: now}))
+
+	meta, err := a.StatPair("foo")
+	require.NoError(t, err)
+	assert.Equal(t, "foo", meta.Key)
+	assert.Equal(t, uint64(7), meta.ModifyIndex)
+	assert.Equal(t, int64(5), meta.Size)
+	assert.Equal(t, now.UnixNano(), meta.ModifyTime)
+	assert.Equal(t, int64(90), meta.TtlSeconds)
+	assert.Equal(t, "text/plain", meta.ContentType)
+	assert.Equal(t, uint64(3), meta.Flags)
+
+	_, err = a.StatPair("missing")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestAgent_BlockingListPairs(t *testing.T) {
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+	a := &Agent{Store: s, watches: fsm.watches}
+
+	cmd, err := Encode(AddPairType, &types.Pair{Key: "p/1", Value: "a"})
+	require.NoError(t, err)
+	fsm.Apply(&raft.Log{Index: 3, Data: cmd})
+
+	// Without a newer change the query times out with the same index.
+	pairs, _, index, err := a.BlockingListPairs(context.Background(), "p/", 0, "", BlockingOptions{
+		WaitIndex: 3,
+		WaitTime:  50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	assert.Len(t, pairs, 1)
+	assert.Equal(t, uint64(3), index)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		for i, key := range []string{"q/1", "p/2"} {
+			cmd, _ := Encode(AddPairType, &types.Pair{Key: key, Value: "b"})
+			fsm.Apply(&raft.Log{Index: uint64(4 + i), Data: cmd})
+		}
+	}()
+
+	pairs, _, index, err = a.BlockingListPairs(context.Background(), "p/", 0, "", BlockingOptions{
+		WaitIndex: 3,
+		WaitTime:  time.Minute,
+	})
+	require.NoError(t, err)
+	assert.Len(t, pairs, 2)
+	assert.Equal(t, uint64(5), index)
+
+	// Deletions leave no pair behind, their index still counts.
+	cmd, err = Encode(DeletePairType, &types.DeleteValueRequest{Key: "p/2"})
+	require.NoError(t, err)
+	fsm.Apply(&raft.Log{Index: 6, Data: cmd})
+
+	pair, index, err := a.BlockingGetPair(context.Background(), "p/2", ReadOptions{}, BlockingOptions{WaitIndex: 5})
+	require.NoError(t, err)
+	assert.Nil(t, pair)
+	assert.Equal(t, uint64(6), index)
+}
+
+func TestAgent_Health(t *testing.T) {
+	a := NewAgent(DefaultConfig())
+	assert.Equal(t, HealthNotReady, a.Health())
+
+	a.stopping.Store(true)
+	assert.Equal(t, HealthShuttingDown, a.Health())
+}
+
+func TestConfig_Validate(t *testing.T) {
+	c := DefaultConfig()
+	c.DataDir = t.TempDir()
+	require.NoError(t, c.Validate())
+
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+
+	for _, tc := range []struct {
+		field  string
+		modify func(c *Config)
+	}{
+		{"node-name", func(c *Config) { c.NodeName = "" }},
+		{"datacenter", func(c *Config) { c.Datacenter = "" }},
+		{"profile", func(c *Config) { c.Profile = "moon" }},
+		{"retry-join", func(c *Config) {
+			c.Bootstrap = true
+			c.RetryJoin = []string{"10.0.0.1"}
+		}},
+		{"encrypt", func(c *Config) { c.EncryptKey = "not base64" }},
+		{"rpc-port", func(c *Config) { c.RPCPort = 70000 }},
+		{"raft-multiplier", func(c *Config) { c.RaftMultiplier = 20 }},
+		{"cors-allowed-origins", func(c *Config) { c.CORSAllowedOrigins = []string{"*", "example.com"} }},
+		{"raft-snapshot-retain", func(c *Config) { c.SnapshotRetain = 0 }},
+		{"grpc-max-recv-msg-size", func(c *Config) { c.GRPCMaxRecvMsgSize = c.MaxValueSize }},
+		{"serf-reconnect-timeout", func(c *Config) { c.SerfReconnectTimeout = "-1h" }},
+		{"serf-tombstone-timeout", func(c *Config) { c.SerfTombstoneTimeout = 0 }},
+		{"quiescent", func(c *Config) { c.SerfUserQuiescentPeriod = 0 }},
+		{"rpc_addr", func(c *Config) { c.Tags = map[string]string{"rpc_addr": "10.0.0.1"} }},
+		{"health-addr", func(c *Config) { c.HealthAddr = "nope" }},
+		{"raft-port", func(c *Config) {
+			c.SeparateListeners = true
+			c.RaftPort = 0
+		}},
+		{"tracing-endpoint", func(c *Config) { c.TracingEndpoint = "localhost:4317" }},
+		{"data-dir", func(c *Config) { c.DataDir = file }},
+	} {
+		t.Run(tc.field, func(t *testing.T) {
+			c := DefaultConfig()
+			c.DataDir = t.TempDir()
+			tc.modify(c)
+			assert.ErrorContains(t, c.Validate(), tc.field)
+		})
+	}
+}
+
+func TestConfig_GRPCKeepalive(t *testing.T) {
+	c := DefaultConfig()
+	c.GRPCKeepaliveTime = time.Minute
+	assert.ErrorContains(t, c.checkGRPC(), "grpc-keepalive-min-time")
+
+	c.GRPCKeepaliveMinTime = 30 * time.Second
+	assert.NoError(t, c.checkGRPC())
+}
+
+func TestConfig_AdvertiseAddr(t *testing.T) {
+	c := DefaultConfig()
+	c.DataDir = t.TempDir()
+
+	c.AdvertiseAddr = "0.0.0.0:8946"
+	assert.ErrorContains(t, c.Validate(), "not routable")
+
+	c.AdvertiseAddr = "127.0.0.1"
+	c.StartJoin = []string{"127.0.0.2:8946"}
+	require.NoError(t, c.Validate())
+	c.RetryJoin = []string{"10.0.0.1"}
+	assert.ErrorContains(t, c.Validate(), "loopback")
+
+	// The advertised port follows the bound one.
 	c.DevMode = true
-	c.DataDir = dir
+	c.AdvertiseAddr = ""
+	c.BindAddr = "127.0.0.1:7000"
+	require.NoError(t, c.normalizeAddrs())
+	assert.Equal(t, "127.0.0.1:7000", c.AdvertiseAddr)
+}
 
-	a3 := NewAgent(c)
-	err = a3.Start()
+func TestAgent_Reload(t *testing.T) {
+	c := DefaultConfig()
+	c.BindAddr = "127.0.0.1:8946"
+	c.AdvertiseAddr = "127.0.0.1:8946"
+	require.NoError(t, c.normalizeAddrs())
+	c.AdvertiseRPCPort = c.RPCPort
+	c.AdvertiseRaftPort = c.RaftPort
+
+	a := NewAgent(c)
+	a.logger = zap.NewNop().Sugar()
+	a.logLevel = zap.NewAtomicLevel()
+
+	nc := *c
+	nc.LogLevel = "debug"
+	nc.RefreshInterval = time.Minute
+	nc.DataDir = "elsewhere"
+	require.NoError(t, a.Reload(&nc))
+
+	assert.Equal(t, zap.DebugLevel, a.logLevel.Level())
+	assert.Equal(t, time.Minute, time.Duration(a.refreshInterval.Load()))
+	assert.Equal(t, []string{"data-dir"}, c.restartRequired(&nc))
+
+	// A certificate that fails to load does not hold back the rest.
+	pki := writeTestPKI(t, t.TempDir())
+	pair, err := loadKeyPair(pki.CertFile, pki.KeyFile)
 	require.NoError(t, err)
+	a.keyPair = pair
+	require.NoError(t, os.WriteFile(pki.KeyFile, []byte("garbage"), 0o600))
+	nc.LogLevel = "warn"
+	require.NoError(t, a.Reload(&nc))
+	assert.Equal(t, zap.WarnLevel, a.logLevel.Level())
 
-	time.Sleep(2 * time.Second)
+	nc.LogLevel = "loud"
+	assert.Error(t, a.Reload(&nc))
+}
 
-	_ = a1.Stop()
+func TestAgent_StartUnwinds(t *testing.T) {
+	ip, returnFn := testutil.TakeIP()
+	defer returnFn()
 
-	time.Sleep(2 * time.Second)
-	assert.True(t, (a2.IsLeader() || a3.IsLeader()))
-	log.Println(a3.IsLeader())
+	c := DefaultConfig()
+	c.BindAddr = ip.String()
+	c.AdvertiseAddr = ip.String()
+	c.NodeName = "test1"
+	c.Bootstrap = true
+	c.DataDir = t.TempDir()
+	c.HTTPAddr = ip.String() + ":18080"
+
+	// The HTTP port is taken, the start fails with serf and the store open.
+	busy, err := net.Listen("tcp", c.HTTPAddr)
+	require.NoError(t, err)
+	require.ErrorContains(t, NewAgent(c).Start(), "listen for HTTP")
+	busy.Close()
+
+	// Ports and the data directory were given back.
+	a := NewAgent(c)
+	require.NoError(t, a.Start())
+	require.NoError(t, a.Stop())
+}
+
+func TestAgent_RecoverRaft(t *testing.T) {
+	ip, returnFn := testutil.TakeIP()
+	defer returnFn()
+
+	c := DefaultConfig()
+	c.BindAddr = ip.String()
+	c.AdvertiseAddr = ip.String()
+	c.NodeName = "test1"
+	c.Bootstrap = true
+	c.DataDir = t.TempDir()
+	c.HTTPAddr = ip.String() + ":18080"
+
+	a := NewAgent(c)
+	require.NoError(t, a.Start())
+	require.Eventually(t, a.IsLeader, 10*time.Second, 50*time.Millisecond)
+	require.NoError(t, a.applySetPair(context.Background(), &types.Pair{Key: "foo", Value: "bar"}))
+	addr := a.raftTransport.LocalAddr()
+	require.NoError(t, a.Stop())
+
+	// A malformed file stops the start before raft runs and is left alone.
+	peersFile := filepath.Join(c.raftPath().dir, peersFileName)
+	require.NoError(t, os.WriteFile(peersFile, []byte("not json"), 0o600))
+	require.ErrorContains(t, NewAgent(c).Start(), "recovery")
+	require.FileExists(t, peersFile)
+
+	// The recovered configuration adds a second voter the node never had.
+	peers := fmt.Sprintf(`[
+		{"id": "test1", "address": %q, "non_voter": false},
+		{"id": "test2", "address": "127.0.0.1:1", "non_voter": false}
+	]`, addr)
+	require.NoError(t, os.WriteFile(peersFile, []byte(peers), 0o600))
+
+	a = NewAgent(c)
+	require.NoError(t, a.Start())
+	defer a.Stop()
+
+	future := a.raft.GetConfiguration()
+	require.NoError(t, future.Error())
+	assert.Equal(t, []raft.Server{
+		{Suffrage: raft.Voter, ID: "test1", Address: addr},
+		{Suffrage: raft.Voter, ID: "test2", Address: "127.0.0.1:1"},
+	}, future.Configuration().Servers)
+
+	assert.NoFileExists(t, peersFile)
+	assert.FileExists(t, peersFile+".applied")
+
+	pair, err := a.Store.GetPair("foo", ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "bar", pair.Value)
+}
+
+func TestAgent_ApplyCanceled(t *testing.T) {
+	a := NewAgent(DefaultConfig())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := a.applySetPair(ctx, &types.Pair{Key: "foo", Value: "bar"})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestAgent_ApplyTooLarge(t *testing.T) {
+	c := DefaultConfig()
+	c.MaxKeySize = 4
+	c.MaxValueSize = 8
+	a := NewAgent(c)
+
+	err := a.applySetPair(context.Background(), &types.Pair{Key: "toolong", Value: "bar"})
+	assert.ErrorIs(t, err, ErrKeyTooLarge)
+
+	_, err = a.applyCASPair(context.Background(), &types.Pair{Key: "foo", Value: "far too long"}, 0)
+	assert.ErrorIs(t, err, ErrValueTooLarge)
+
+	_, err = a.ApplyTxn(context.Background(), []*types.TxnOp{
+		{Type: types.TxnOpType_TXN_SET, Pair: &types.Pair{Key: "foo", Value: "bar"}},
+		{Type: types.TxnOpType_TXN_SET, Pair: &types.Pair{Key: "bar", Value: "far too long"}},
+	})
+	assert.ErrorIs(t, err, ErrValueTooLarge)
+}
+
+// newTestRaft starts a single voter raft named test over store, it elects
+// itself shortly after.
+func newTestRaft(t *testing.T, store SyncraStorage) *raft.Raft {
+	rc := raft.DefaultConfig()
+	rc.LocalID = "test"
+	logs := raft.NewInmemStore()
+	addr, trans := raft.NewInmemTransport("")
+	configuration := raft.Configuration{Servers: []raft.Server{{ID: rc.LocalID, Address: addr}}}
+	require.NoError(t, raft.BootstrapCluster(rc, logs, logs, raft.NewDiscardSnapshotStore(), trans, configuration))
+
+	r, err := raft.NewRaft(rc, newFSM(store, zap.NewNop().Sugar()), logs, logs, raft.NewDiscardSnapshotStore(), trans)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = r.Shutdown().Error() })
+	return r
+}
+
+func TestAgent_ReadIndex(t *testing.T) {
+	s, err := NewStore(zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	r := newTestRaft(t, s)
+	a := &Agent{Store: s, raft: r, config: DefaultConfig()}
+	require.Eventually(t, a.IsLeader, 5*time.Second, 10*time.Millisecond)
+
+	// Without a barrier of its own term the leader falls back to one.
+	require.NoError(t, a.applySetPair(context.Background(), &types.Pair{Key: "foo", Value: "bar"}))
+	pair, err := a.GetPair("foo", ReadOptions{Consistency: ReadIndex})
+	require.NoError(t, err)
+	assert.Equal(t, "bar", pair.Value)
+
+	a.leaderReady.Store(true)
+	require.NoError(t, a.applySetPair(context.Background(), &types.Pair{Key: "foo", Value: "baz"}))
+	pair, err = a.GetPair("foo", ReadOptions{Consistency: ReadIndex})
+	require.NoError(t, err)
+	assert.Equal(t, "baz", pair.Value)
+}
+
+func TestAgent_WatchLeader(t *testing.T) {
+	s, err := NewStore(zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	c := DefaultConfig()
+	c.NodeName = "test"
+	a := &Agent{
+		config:     c,
+		raft:       newTestRaft(t, s),
+		leaders:    newLeaderHub(),
+		shutdowner: make(chan struct{}),
+	}
+	go a.observeLeader()
+
+	events, err := a.WatchLeader(context.Background())
+	require.NoError(t, err)
+	for ev := range events {
+		if ev.IsLeader {
+			assert.Equal(t, "test", ev.LeaderID)
+			break
+		}
+	}
+
+	// Subscriptions end with the agent.
+	close(a.shutdowner)
+	for range events {
+	}
+}
+
+func TestAgent_ObserveSerfQueue(t *testing.T) {
+	a := &Agent{
+		serfEventer: make(chan serf.Event, serfEventChSize),
+		logger:      zap.NewNop().Sugar(),
+	}
+
+	for i := 0; i < serfEventChWarn; i++ {
+		a.serfEventer <- serf.UserEvent{}
+	}
+	a.observeSerfQueue()
+	assert.True(t, a.serfBacklog.Load())
+
+	for len(a.serfEventer) >= serfEventChWarn/2 {
+		<-a.serfEventer
+	}
+	a.observeSerfQueue()
+	assert.False(t, a.serfBacklog.Load())
+}
+
+func TestAgent_PlanMember(t *testing.T) {
+	a := &Agent{config: DefaultConfig(), logger: zap.NewNop().Sugar()}
+	a.config.NodeName = "leader"
+
+	member := func(name, ip string, status serf.MemberStatus) serf.Member {
+		return serf.Member{
+			Name:   name,
+			Addr:   net.ParseIP(ip),
+			Status: status,
+			Tags:   map[string]string{"port": "6868"},
+		}
+	}
+	servers := []raft.Server{
+		{Suffrage: raft.Voter, ID: "n1", Address: "10.0.0.1:6868"},
+		{Suffrage: raft.Nonvoter, ID: "n2", Address: "10.0.0.2:6868"},
+		{Suffrage: raft.Voter, ID: "n3", Address: "10.0.0.3:6868"},
+	}
+
+	var plan []ReconcileOp
+	for _, m := range []serf.Member{
+		member("n2", "10.0.0.2", serf.StatusAlive),
+		member("n4", "10.0.0.3", serf.StatusAlive),
+		member("n1", "10.0.0.1", serf.StatusLeft),
+		member("n5", "10.0.0.5", serf.StatusFailed),
+		// Raft has its own port on n6.
+		{
+			Name:   "n6",
+			Addr:   net.ParseIP("10.0.0.6"),
+			Status: serf.StatusAlive,
+			Tags:   map[string]string{"port": "6868", "raft_addr": "10.0.0.6:6869"},
+		},
+	} {
+		for _, op := range a.planMember(m, toServerPart(m), servers) {
+			servers = simulateReconcile(servers, op)
+			plan = append(plan, op)
+		}
+	}
+
+	assert.Equal(t, []ReconcileOp{
+		{Action: ReconcileAddVoter, Member: "n2", ID: "n2", Address: "10.0.0.2:6868"},
+		{Action: ReconcileRemoveServer, Member: "n4", ID: "n3", Address: "10.0.0.3:6868"},
+		{Action: ReconcileAddVoter, Member: "n4", ID: "n4", Address: "10.0.0.3:6868"},
+		{Action: ReconcileRemoveServer, Member: "n1", ID: "n1", Address: "10.0.0.1:6868"},
+		{Action: ReconcileAddVoter, Member: "n6", ID: "n6", Address: "10.0.0.6:6869"},
+	}, plan)
+	assert.Equal(t, []raft.Server{
+		{Suffrage: raft.Voter, ID: "n2", Address: "10.0.0.2:6868"},
+		{Suffrage: raft.Voter, ID: "n4", Address: "10.0.0.3:6868"},
+		{Suffrage: raft.Voter, ID: "n6", Address: "10.0.0.6:6869"},
+	}, servers)
+}
+
+func TestDeadServers(t *testing.T) {
+	// Pruning is opt in.
+	assert.False(t, DefaultConfig().CleanupDeadServers)
+
+	now := time.Now()
+	timeout := time.Minute
+	member := func(name string, status serf.MemberStatus) serf.Member {
+		return serf.Member{
+			Name:   name,
+			Addr:   net.ParseIP("10.0.0.1"),
+			Status: status,
+			Tags:   map[string]string{"port": "6868"},
+		}
+	}
+
+	cases := []struct {
+		name      string
+		member    serf.Member
+		since     time.Duration // how long ago it was first seen failed, 0 if never
+		wantDead  bool
+		wantSince bool
+	}{
+		{"first seen failed", member("n1", serf.StatusFailed), 0, false, true},
+		{"below the timeout", member("n1", serf.StatusFailed), timeout - time.Second, false, true},
+		{"at the timeout", member("n1", serf.StatusFailed), timeout, true, true},
+		{"recovered", member("n1", serf.StatusAlive), 2 * timeout, false, false},
+		{"left", member("n1", serf.StatusLeft), 2 * timeout, false, false},
+		{"not a server", serf.Member{Name: "n1", Status: serf.StatusFailed}, 2 * timeout, false, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			failedSince := map[string]time.Time{"gone": now.Add(-2 * timeout)}
+			if tc.since > 0 {
+				failedSince["n1"] = now.Add(-tc.since)
+			}
+
+			dead := deadServers([]serf.Member{tc.member}, failedSince, now, timeout)
+			assert.Equal(t, tc.wantDead, dead["n1"])
+			_, ok := failedSince["n1"]
+			assert.Equal(t, tc.wantSince, ok)
+			assert.NotContains(t, failedSince, "gone")
+		})
+	}
+}
+
+func TestPlanPrune(t *testing.T) {
+	voters := func(n int) []raft.Server {
+		var servers []raft.Server
+		for i := 1; i <= n; i++ {
+			id := raft.ServerID("n" + strconv.Itoa(i))
+			servers = append(servers, raft.Server{Suffrage: raft.Voter, ID: id})
+		}
+		return servers
+	}
+	learner := raft.Server{Suffrage: raft.Nonvoter, ID: "l1"}
+
+	cases := []struct {
+		name    string
+		servers []raft.Server
+		dead    []raft.ServerID
+		want    []raft.ServerID
+		wantErr bool
+	}{
+		{"one of three", voters(3), []raft.ServerID{"n1"}, []raft.ServerID{"n1"}, false},
+		{"two of three", voters(3), []raft.ServerID{"n1", "n2"}, nil, true},
+		{"two of five", voters(5), []raft.ServerID{"n1", "n2"}, []raft.ServerID{"n1", "n2"}, false},
+		{"three of five", voters(5), []raft.ServerID{"n1", "n2", "n3"}, nil, true},
+		{"one of two", voters(2), []raft.ServerID{"n1"}, nil, true},
+		{"learner", append(voters(3), learner), []raft.ServerID{"l1"}, []raft.ServerID{"l1"}, false},
+		{"not in raft", voters(3), []raft.ServerID{"n9"}, nil, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dead := make(map[raft.ServerID]bool)
+			for _, id := range tc.dead {
+				dead[id] = true
+			}
+
+			remove, err := planPrune(tc.servers, dead)
+			if tc.wantErr {
+				assert.ErrorContains(t, err, "quorum")
+				assert.Empty(t, remove)
+				return
+			}
+			require.NoError(t, err)
+			var ids []raft.ServerID
+			for _, s := range remove {
+				ids = append(ids, s.ID)
+			}
+			assert.Equal(t, tc.want, ids)
+		})
+	}
+}
+
+func TestAgent_RaftRemovePeerByID(t *testing.T) {
+	s := newTestStore(t)
+	a := &Agent{Store: s, raft: newTestRaft(t, s), config: DefaultConfig()}
+	require.Eventually(t, a.IsLeader, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, a.raft.AddNonvoter("n2", "127.0.0.1:1", 0, 0).Error())
+
+	require.NoError(t, a.RaftRemovePeerByID("n2"))
+	future := a.raft.GetConfiguration()
+	require.NoError(t, future.Error())
+	assert.Len(t, future.Configuration().Servers, 1)
+
+	assert.ErrorIs(t, a.RaftRemovePeerByID("n2"), ErrPeerNotFound)
+}
+
+func TestAgent_ReapEvent(t *testing.T) {
+	s, err := NewStore(zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	a := &Agent{
+		Store:     s,
+		raft:      newTestRaft(t, s),
+		config:    DefaultConfig(),
+		logger:    zap.NewNop().Sugar(),
+		refreshCh: make(chan serf.Member, refreshChSize),
+	}
+	require.Eventually(t, a.IsLeader, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, a.raft.AddNonvoter("n2", "127.0.0.1:1", 0, 0).Error())
+
+	a.reapEvent(serf.MemberEvent{
+		Type: serf.EventMemberReap,
+		Members: []serf.Member{{
+			Name:   "n2",
+			Addr:   net.ParseIP("127.0.0.1"),
+			Status: serf.StatusFailed,
+			Tags:   map[string]string{"port": "1"},
+		}},
+	})
+	member := <-a.refreshCh
+	assert.Equal(t, StatusReap, member.Status)
+	require.NoError(t, a.RefreshMember(member))
+
+	future := a.raft.GetConfiguration()
+	require.NoError(t, future.Error())
+	for _, server := range future.Configuration().Servers {
+		assert.NotEqual(t, raft.ServerID("n2"), server.ID)
+	}
+}
+
+// statsClient reports a fixed raft log index for every server.
+type statsClient struct {
+	TaskvaultGRPCClient
+	index uint64
+}
+
+func (c *statsClient) RaftStats(context.Context, string) (map[string]string, error) {
+	return map[string]string{"last_log_index": strconv.FormatUint(c.index, 10)}, nil
+}
+
+func TestAgent_PlanLearner(t *testing.T) {
+	s, err := NewStore(zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	client := &statsClient{}
+	a := &Agent{
+		Store:      s,
+		raft:       newTestRaft(t, s),
+		config:     DefaultConfig(),
+		logger:     zap.NewNop().Sugar(),
+		GRPCClient: client,
+	}
+	a.config.RaftPromotionLag = 1
+	require.Eventually(t, a.IsLeader, 5*time.Second, 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, a.raft.Barrier(time.Second).Error())
+	}
+
+	m := serf.Member{Name: "n2", Addr: net.ParseIP("10.0.0.2"), Status: serf.StatusAlive, Tags: map[string]string{"port": "6868"}}
+	learner := ReconcileOp{Action: ReconcileAddNonvoter, Member: "n2", ID: "n2", Address: "10.0.0.2:6868"}
+	assert.Equal(t, []ReconcileOp{learner}, a.planMember(m, toServerPart(m), nil))
+
+	// The learner stays one until its log caught up.
+	servers := simulateReconcile(nil, learner)
+	assert.Empty(t, a.planMember(m, toServerPart(m), servers))
+
+	client.index = a.raft.LastIndex()
+	assert.Equal(t, []ReconcileOp{
+		{Action: ReconcileAddVoter, Member: "n2", ID: "n2", Address: "10.0.0.2:6868"},
+	}, a.planMember(m, toServerPart(m), servers))
+}
+
+func TestAgent_WaitBarrierStopped(t *testing.T) {
+	s, err := NewStore(zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	a := &Agent{Store: s, raft: newTestRaft(t, s), config: DefaultConfig(), shutdowner: make(chan struct{})}
+	require.Eventually(t, a.IsLeader, 5*time.Second, 10*time.Millisecond)
+
+	// An unreachable voter leaves no quorum, the barrier can not commit.
+	a.raft.AddVoter("n2", "unreachable", 0, 0)
+	stopCh := make(chan struct{})
+	close(stopCh)
+
+	start := time.Now()
+	stopped, err := a.waitBarrier(stopCh)
+	assert.True(t, stopped)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestAgent_ApplyQueueFull(t *testing.T) {
+	s, err := NewStore(zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	r := newTestRaft(t, s)
+	a := &Agent{Store: s, raft: r, config: DefaultConfig(), applySlots: make(chan struct{}, 1)}
+	require.Eventually(t, a.IsLeader, 5*time.Second, 10*time.Millisecond)
+
+	// Another write holds the only slot.
+	require.True(t, a.acquireApplySlot())
+	err = a.applySetPair(context.Background(), &types.Pair{Key: "foo", Value: "bar"})
+	assert.ErrorIs(t, err, ErrApplyQueueFull)
+
+	a.releaseApplySlot()
+	require.NoError(t, a.applySetPair(context.Background(), &types.Pair{Key: "foo", Value: "bar"}))
+	assert.Eventually(t, func() bool { return len(a.applySlots) == 0 }, time.Second, time.Millisecond)
+}
+
+func TestSdNotify(t *testing.T) {
+	require.NoError(t, sdNotify("READY=1"))
+
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	require.NoError(t, sdNotify("STOPPING=1"))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "STOPPING=1", string(buf[:n]))
+}
+
+func TestConfig_TuneRaft(t *testing.T) {
+	c := DefaultConfig()
+	c.RaftMultiplier = 5
+	c.CommitTimeout = 200 * time.Millisecond
+
+	rc := raft.DefaultConfig()
+	c.tuneRaft(rc)
+	assert.Equal(t, 5*time.Second, rc.HeartbeatTimeout)
+	assert.Equal(t, 5*time.Second, rc.ElectionTimeout)
+	assert.Equal(t, 200*time.Millisecond, rc.CommitTimeout)
+	assert.Equal(t, raft.DefaultConfig().SnapshotThreshold, rc.SnapshotThreshold)
+
+	c.SnapshotInterval = time.Minute
+	c.SnapshotThreshold = 1024
+	rc = raft.DefaultConfig()
+	c.tuneRaft(rc)
+	assert.Equal(t, time.Minute, rc.SnapshotInterval)
+	assert.Equal(t, uint64(1024), rc.SnapshotThreshold)
+
+	c.HeartbeatTimeout = 2 * time.Second
+	c.ElectionTimeout = time.Second
+	assert.ErrorContains(t, c.Validate(), "shorter than the heartbeat timeout")
+}
+
+func TestETag(t *testing.T) {
+	assert.Equal(t, `"42"`, etag(42))
+	assert.True(t, etagMatch(`"7", W/"42"`, 42))
+	assert.True(t, etagMatch("*", 42))
+	assert.False(t, etagMatch(`"4"`, 42))
+
+	index, err := parseETag(` "42" `)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), index)
+	for _, tag := range []string{`42`, `W/"42"`, `"4x"`, `"1", "2"`} {
+		_, err := parseETag(tag)
+		assert.Error(t, err, tag)
+	}
+}
+
+func TestAgent_QuorumStatus(t *testing.T) {
+	s, err := NewStore(zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	a := &Agent{Store: s, raft: newTestRaft(t, s), config: DefaultConfig()}
+	require.Eventually(t, a.IsLeader, 5*time.Second, 10*time.Millisecond)
+
+	status := a.QuorumStatus()
+	assert.False(t, status.Healthy)
+	assert.Equal(t, 1, status.Voters)
+
+	a.leaderReady.Store(true)
+	status = a.QuorumStatus()
+	assert.True(t, status.Healthy)
+	assert.Equal(t, 1, status.Reachable)
+
+	a.heartbeats.set("test", time.Now())
+	assert.False(t, a.QuorumHealthy())
+	a.heartbeats.clear("test")
+	assert.True(t, a.QuorumHealthy())
+}
+
+func TestAgent_LeaderHooks(t *testing.T) {
+	a := &Agent{}
+
+	var events []string
+	var lock sync.Mutex
+	record := func(ev string) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, ev)
+	}
+
+	started := make(chan struct{})
+	a.OnLeaderAcquired(func(ctx context.Context) {
+		record("acquired")
+		close(started)
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		record("cancelled")
+	})
+	a.OnLeaderLost(func() { record("lost") })
+
+	run := a.leaderHooks.start()
+	<-started
+	run.stop()
+
+	assert.Equal(t, []string{"acquired", "cancelled", "lost"}, events)
 
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
-	<-sig
+	// A term that never started its callbacks does not report a loss.
+	var none *leaderHookRun
+	none.stop()
+	assert.Len(t, events, 3)
 }
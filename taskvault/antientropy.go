@@ -0,0 +1,223 @@
+package taskvault
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// checksumLogSize is how many checksums every node keeps. The leader asks
+	// for a checksum right after committing it, so a few are enough.
+	checksumLogSize = 16
+
+	// antiEntropyPeerTimeout bounds how long the leader waits for a peer to
+	// apply the checksum command and report its result.
+	antiEntropyPeerTimeout = 10 * time.Second
+)
+
+// ErrChecksumUnavailable is returned for a checksum a node did not compute,
+// because it installed a snapshot past it or it fell out of the log.
+var ErrChecksumUnavailable = errors.New("checksum not available on this node")
+
+// storeChecksum is the hash of the store as it was after applying the log
+// entry at index.
+type storeChecksum struct {
+	index    uint64
+	checksum string
+	keys     uint64
+}
+
+// checksumLog keeps the latest checksums computed by the FSM.
+type checksumLog struct {
+	mu      sync.Mutex
+	entries []storeChecksum
+	notify  chan struct{}
+}
+
+func newChecksumLog() *checksumLog {
+	return &checksumLog{notify: make(chan struct{})}
+}
+
+func (c *checksumLog) add(sum storeChecksum) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = append(c.entries, sum)
+	if len(c.entries) > checksumLogSize {
+		c.entries = c.entries[1:]
+	}
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// wait returns the checksum computed at index, waiting for the FSM to apply
+// it when it did not yet.
+func (c *checksumLog) wait(ctx context.Context, index uint64) (storeChecksum, error) {
+	for {
+		c.mu.Lock()
+		for _, sum := range c.entries {
+			if sum.index == index {
+				c.mu.Unlock()
+				return sum, nil
+			}
+		}
+		if n := len(c.entries); n > 0 && c.entries[n-1].index > index {
+			c.mu.Unlock()
+			return storeChecksum{}, ErrChecksumUnavailable
+		}
+		notify := c.notify
+		c.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return storeChecksum{}, ctx.Err()
+		}
+	}
+}
+
+// checksumStore hashes every pair of the store in key order, expired pairs
+// not swept yet included as they are still part of the replicated state.
+func checksumStore(store SyncraStorage) (string, uint64, error) {
+	pairs, err := store.AllPairs()
+	if err != nil {
+		return "", 0, err
+	}
+
+	h := sha256.New()
+	opts := proto.MarshalOptions{Deterministic: true}
+	var buf []byte
+	for _, pair := range pairs {
+		b, err := opts.Marshal(pair)
+		if err != nil {
+			return "", 0, err
+		}
+		buf = binary.AppendUvarint(buf[:0], uint64(len(b)))
+		h.Write(buf)
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)), uint64(len(pairs)), nil
+}
+
+// applyChecksum hashes the store at the index of the command, every node
+// does so at the same point of the log so the results must be equal.
+func (d *taskvaultFSM) applyChecksum(_ []byte, l *raft.Log) interface{} {
+	defer metrics.MeasureSince([]string{"taskvault", "fsm", "checksum"}, time.Now())
+
+	sum, keys, err := checksumStore(d.store)
+	if err != nil {
+		return err
+	}
+	c := storeChecksum{index: l.Index, checksum: sum, keys: keys}
+	d.checksums.add(c)
+	return c
+}
+
+// StoreChecksum returns the checksum this node computed at index, waiting
+// until ctx ends for it to be applied.
+func (a *Agent) StoreChecksum(ctx context.Context, index uint64) (*types.StoreChecksumResponse, error) {
+	sum, err := a.checksums.wait(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+	return &types.StoreChecksumResponse{
+		Index:    sum.index,
+		Checksum: sum.checksum,
+		Keys:     sum.keys,
+	}, nil
+}
+
+// antiEntropyLoop verifies the stores every AntiEntropyInterval while this
+// node leads.
+func (a *Agent) antiEntropyLoop(stopCh chan struct{}) {
+	ticker := time.NewTicker(a.config.AntiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-a.shutdowner:
+			return
+		case <-ticker.C:
+			if a.leaderReady.Load() {
+				a.verifyChecksums()
+			}
+		}
+	}
+}
+
+// verifyChecksums commits a checksum command and compares the checksum of
+// every peer with the leader's. A mismatch means the FSM of the peer drifted
+// from the log, it is logged and counted but not repaired: restoring a
+// snapshot of the leader on the peer does that.
+func (a *Agent) verifyChecksums() {
+	defer metrics.MeasureSince([]string{"taskvault", "leader", "anti_entropy"}, time.Now())
+
+	resp, err := a.apply(context.Background(), ChecksumType, &types.StoreChecksumRequest{})
+	if err == nil {
+		err, _ = resp.(error)
+	}
+	if err != nil {
+		a.logger.Error("taskvault: failed to checksum the store", zap.Error(err))
+		return
+	}
+	local := resp.(storeChecksum)
+
+	future := a.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		a.logger.Error("taskvault: failed to get raft configuration", zap.Error(err))
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range future.Configuration().Servers {
+		if server.ID == raft.ServerID(a.config.NodeName) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), antiEntropyPeerTimeout)
+			defer cancel()
+
+			logger := a.logger.With(
+				zap.String("peer", string(server.ID)),
+				zap.Uint64("index", local.index),
+			)
+			remote, err := a.GRPCClient.StoreChecksum(ctx, a.rpcAddr(server.ID, server.Address), local.index)
+			if err != nil {
+				logger.Warn("taskvault: failed to verify peer checksum", zap.Error(err))
+				return
+			}
+			if remote.Checksum != local.checksum {
+				metrics.IncrCounterWithLabels(
+					[]string{"taskvault", "anti_entropy", "mismatch"}, 1,
+					[]metrics.Label{{Name: "peer", Value: string(server.ID)}},
+				)
+				logger.Error("taskvault: store of peer diverged from the leader, restore it from a snapshot",
+					zap.String("checksum", remote.Checksum),
+					zap.Uint64("keys", remote.Keys),
+					zap.String("leader_checksum", local.checksum),
+					zap.Uint64("leader_keys", local.keys),
+				)
+				return
+			}
+			logger.Debug("taskvault: peer checksum matches")
+		}()
+	}
+	wg.Wait()
+}
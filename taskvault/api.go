@@ -1,32 +1,61 @@
 package taskvault
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/danluki/taskvault/pkg/types"
 	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/raft"
 	"go.uber.org/zap"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	pretty        = "pretty"
 	apiPathPrefix = "v1"
+
+	// indexHeader carries the index of a blocking query.
+	indexHeader = "X-Taskvault-Index"
+
+	// leaderHeader carries the HTTP address of the leader. Writes to any node
+	// are forwarded to it, clients may cache it to skip the extra hop.
+	leaderHeader = "X-Taskvault-Leader"
+
+	// httpAddrTag is the serf tag with the advertised HTTP address of a node.
+	httpAddrTag = "http_addr"
+
+	// contentTypeHeader and flagsHeader carry the ValueMeta of a pair. The
+	// Content-Type of a request describes its encoding, not the value.
+	contentTypeHeader = "X-Taskvault-Content-Type"
+	flagsHeader       = "X-Taskvault-Flags"
 )
 
 type Transport interface {
-	ServeHTTP()
+	ServeHTTP() error
+	ServeHealth() error
+	Shutdown(ctx context.Context) error
 }
 
 type HTTPTransport struct {
 	Engine *gin.Engine
 
-	agent  *Agent
-	logger *zap.SugaredLogger
+	agent     *Agent
+	logger    *zap.SugaredLogger
+	servers   []*http.Server
+	listeners []net.Listener
 }
 
 func NewTransport(a *Agent, log *zap.SugaredLogger) *HTTPTransport {
@@ -36,65 +65,145 @@ func NewTransport(a *Agent, log *zap.SugaredLogger) *HTTPTransport {
 	}
 }
 
-func (h *HTTPTransport) ServeHTTP() {
+func (h *HTTPTransport) ServeHTTP() error {
 	h.Engine = gin.Default()
 
-	rootPath := h.Engine.Group("/")
-
-	config := cors.DefaultConfig()
-	config.AllowAllOrigins = true
-	config.AllowMethods = []string{"*"}
-	config.AllowHeaders = []string{"*"}
-	config.ExposeHeaders = []string{"*"}
+	// CORS runs on the engine rather than a group so preflight OPTIONS
+	// requests, which match no route, are answered as well.
+	if len(h.agent.config.CORSAllowedOrigins) > 0 {
+		h.Engine.Use(corsMiddleware(h.agent.config.CORSAllowedOrigins))
+	}
 
-	rootPath.Use(cors.New(config))
+	rootPath := h.Engine.Group("/")
 
 	h.APIRoutes(rootPath)
 	if h.agent.config.UI {
 		h.UI(rootPath)
 	}
 
-	h.logger.Info("api: Running HTTP server", zap.String("address", h.agent.config.HTTPAddr))
+	return h.serve("HTTP", h.agent.config.HTTPAddr, h.Engine.Handler())
+}
+
+// ServeHealth serves /health and /metrics alone on HealthAddr, so probes and
+// scrapes reach a node whose API is disabled or not exposed.
+func (h *HTTPTransport) ServeHealth() error {
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+	h.healthRoutes(engine)
+
+	return h.serve("health", h.agent.config.HealthAddr, engine.Handler())
+}
+
+// serve listens on addr before returning, so a port in use fails the start,
+// and serves handler until Shutdown.
+func (h *HTTPTransport) serve(name, addr string, handler http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("api: Can not listen for %s, %w", name, err)
+	}
+	srv := &http.Server{Handler: handler}
+	h.servers = append(h.servers, srv)
+	h.listeners = append(h.listeners, ln)
+
+	h.logger.Info("api: Running "+name+" server", zap.String("address", addr))
 
 	go func() {
-		if err := h.Engine.Run(h.agent.config.HTTPAddr); err != nil {
-			panic(err)
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			h.logger.With(zap.Error(err)).Errorf("api: %s server failed", name)
 		}
 	}()
+	return nil
 }
 
-func (h *HTTPTransport) APIRoutes(
-	r *gin.RouterGroup, middleware ...gin.HandlerFunc,
-) {
-	h.Engine.GET(
-		"/health", func(c *gin.Context) {
-			c.JSON(
-				http.StatusOK, gin.H{
-					"status": "healthy",
-				},
-			)
-		},
-	)
+// Shutdown stops the servers once their requests completed, requests still
+// running when ctx is done are cut off.
+func (h *HTTPTransport) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, srv := range h.servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			_ = srv.Close()
+			errs = append(errs, err)
+		}
+	}
+	// A server stopped before its goroutine ran Serve would hold the port
+	// until it does, a restart right after a failed start needs it back.
+	for _, ln := range h.listeners {
+		_ = ln.Close()
+	}
+	h.servers, h.listeners = nil, nil
+	return errors.Join(errs...)
+}
 
+func (h *HTTPTransport) healthRoutes(e *gin.Engine) {
+	e.GET("/health", h.healthHandler)
 	if h.agent.config.EnablePrometheus {
-		r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+		e.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	}
+}
+
+func (h *HTTPTransport) APIRoutes(
+	r *gin.RouterGroup, middleware ...gin.HandlerFunc,
+) {
+	h.healthRoutes(h.Engine)
 
 	r.GET("/v1", h.indexHandler)
 	v1 := r.Group("/v1")
 	v1.Use(middleware...)
 	v1.GET("/", h.indexHandler)
 	v1.GET("/members", h.membersHandler)
+	v1.GET("/members/status", h.nodeStatusHandler)
+	v1.GET("/members/ring", h.ringMembersHandler)
+	v1.POST("/members/:name/force-leave", h.requireToken, h.rejectReadOnly, h.forceLeaveHandler)
 	v1.GET("/leader", h.leaderHandler)
+	v1.GET("/status/leader", h.statusLeaderHandler)
+	v1.GET("/status/quorum", h.quorumHandler)
 	v1.GET("/isleader", h.isLeaderHandler)
-	v1.POST("/leave", h.leaveHandler)
+	v1.POST("/leader/transfer", h.requireToken, h.rejectReadOnly, h.leadershipTransferHandler)
+	v1.POST("/leave", h.requireToken, h.leaveHandler)
+	v1.PUT("/maintenance", h.requireToken, h.maintenanceHandler)
+	v1.POST("/snapshot", h.requireToken, h.snapshotHandler)
+	v1.GET("/raft/status", h.requireToken, h.raftStatusHandler)
+	if h.agent.config.DevMode {
+		v1.GET("/debug/dump", h.debugDumpHandler)
+	}
+
+	// Writes are sent on with the token of this node, so they must carry a
+	// token of their own.
+	v1.GET("/kv", h.requireReadToken, h.kvListHandler)
+	v1.POST("/kv/import", h.requireToken, h.rejectReadOnly, h.kvImportHandler)
+	v1.GET("/kv/*key", h.requireReadToken, h.kvGetHandler)
+	v1.PUT("/kv/*key", h.requireToken, h.rejectReadOnly, h.setLeaderHeader, h.kvPutHandler)
+	v1.DELETE("/kv/*key", h.requireToken, h.rejectReadOnly, h.setLeaderHeader, h.kvDeleteHandler)
 
 	pairs := v1.Group("/storage")
-	pairs.GET("", h.pairsHandler)
-	pairs.GET("/:key", h.pairGetHandler)
-	pairs.POST("", h.pairPostHandler)
-	pairs.DELETE("/:key", h.pairDeleteHandler)
-	pairs.PATCH("/", h.pairDeleteHandler)
+	pairs.GET("", h.requireReadToken, h.pairsHandler)
+	pairs.GET("/:key", h.requireReadToken, h.pairGetHandler)
+	pairs.POST("", h.requireToken, h.rejectReadOnly, h.setLeaderHeader, h.pairPostHandler)
+	pairs.DELETE("/:key", h.requireToken, h.rejectReadOnly, h.setLeaderHeader, h.pairDeleteHandler)
+	pairs.PATCH("/", h.requireToken, h.rejectReadOnly, h.setLeaderHeader, h.pairDeleteHandler)
+}
+
+func corsMiddleware(origins []string) gin.HandlerFunc {
+	config := cors.DefaultConfig()
+	if len(origins) == 1 && origins[0] == "*" {
+		config.AllowAllOrigins = true
+	} else {
+		config.AllowOrigins = origins
+	}
+	config.AllowMethods = []string{
+		http.MethodGet, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodHead,
+	}
+	config.AllowHeaders = []string{
+		"Origin", "Content-Type", "Authorization", "If-Match", "If-None-Match",
+		contentTypeHeader, flagsHeader,
+	}
+	config.ExposeHeaders = []string{
+		"X-Total-Count", "ETag", indexHeader, leaderHeader, contentTypeHeader, flagsHeader,
+	}
+	config.MaxAge = 12 * time.Hour
+
+	return cors.New(config)
 }
 
 func renderJSON(c *gin.Context, status int, v interface{}) {
@@ -105,9 +214,68 @@ func renderJSON(c *gin.Context, status int, v interface{}) {
 	}
 }
 
+// setLeaderHeader tells the client of a write where the leader is, when it
+// is known.
+func (h *HTTPTransport) setLeaderHeader(c *gin.Context) {
+	if member, err := h.agent.leaderMember(); err == nil && member.Tags[httpAddrTag] != "" {
+		c.Header(leaderHeader, member.Tags[httpAddrTag])
+	}
+}
+
+// writeFailed answers a write that could not be applied. Without a leader,
+// during an election, the client is asked to retry instead of seeing a 500.
+func (h *HTTPTransport) writeFailed(c *gin.Context, err error) {
+	if errors.Is(err, ErrApplyQueueFull) || status.Code(err) == codes.ResourceExhausted {
+		c.Header("Retry-After", "1")
+		_ = c.AbortWithError(http.StatusTooManyRequests, err)
+		return
+	}
+	if retryable(err) || errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+		c.Header("Retry-After", "1")
+		_ = c.AbortWithError(http.StatusServiceUnavailable, err)
+		return
+	}
+	h.logger.Error(err)
+	_ = c.AbortWithError(http.StatusInternalServerError, err)
+}
+
+// healthHandler answers load balancer probes with 200 only while the node
+// can serve requests, the body tells starting and stopping nodes apart.
+func (h *HTTPTransport) healthHandler(c *gin.Context) {
+	health := h.agent.Health()
+
+	code := http.StatusOK
+	if health != HealthServing {
+		code = http.StatusServiceUnavailable
+	}
+
+	c.JSON(code, gin.H{
+		"status": health.String(),
+		"quorum": h.agent.QuorumHealthy(),
+	})
+}
+
+// quorumHandler answers 200 only while writes through this node can be
+// committed, a load balancer steers writes away from a partitioned minority
+// with it.
+func (h *HTTPTransport) quorumHandler(c *gin.Context) {
+	quorum := h.agent.QuorumStatus()
+
+	code := http.StatusOK
+	if !quorum.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	renderJSON(c, code, quorum)
+}
+
+// membersHandler lists the serf members, ?dc= keeps those of one datacenter.
 func (h *HTTPTransport) membersHandler(c *gin.Context) {
+	dc := c.Query("dc")
 	mems := []*types.Member{}
 	for _, m := range h.agent.serf.Members() {
+		if dc != "" && m.Tags["dc"] != dc {
+			continue
+		}
 		id, _ := uuid.GenerateUUID()
 		mid := &types.Member{m, id, m.Status.String()}
 		mems = append(mems, mid)
@@ -116,6 +284,44 @@ func (h *HTTPTransport) membersHandler(c *gin.Context) {
 	renderJSON(c, http.StatusOK, mems)
 }
 
+// ringMembersHandler lists the alive servers in the stable order clients
+// build their consistent hash ring from.
+func (h *HTTPTransport) ringMembersHandler(c *gin.Context) {
+	renderJSON(c, http.StatusOK, h.agent.RingMembers())
+}
+
+// nodeStatusHandler reports the health of every member as seen by the
+// leader.
+func (h *HTTPTransport) nodeStatusHandler(c *gin.Context) {
+	members, err := h.agent.GRPCClient.NodeStatus(c.Request.Context())
+	if err != nil {
+		code := http.StatusInternalServerError
+		if status.Code(err) == codes.Unavailable {
+			code = http.StatusServiceUnavailable
+		}
+		_ = c.AbortWithError(code, err)
+		return
+	}
+
+	renderJSON(c, http.StatusOK, members)
+}
+
+func (h *HTTPTransport) forceLeaveHandler(c *gin.Context) {
+	if err := h.agent.GRPCClient.ForceLeave(c.Param("name")); err != nil {
+		switch status.Code(err) {
+		case codes.NotFound:
+			_ = c.AbortWithError(http.StatusNotFound, err)
+		case codes.FailedPrecondition:
+			_ = c.AbortWithError(http.StatusConflict, err)
+		default:
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
 func (h *HTTPTransport) leaderHandler(c *gin.Context) {
 	member, err := h.agent.leaderMember()
 	if err != nil {
@@ -127,6 +333,17 @@ func (h *HTTPTransport) leaderHandler(c *gin.Context) {
 	renderJSON(c, http.StatusOK, member)
 }
 
+// statusLeaderHandler answers with the leader's addresses, an empty object
+// during an election.
+func (h *HTTPTransport) statusLeaderHandler(c *gin.Context) {
+	leader, err := h.agent.Leader()
+	if err != nil && !errors.Is(err, ErrLeaderNotFound) {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(c, http.StatusOK, leader)
+}
+
 func (h *HTTPTransport) isLeaderHandler(c *gin.Context) {
 	isleader := h.agent.IsLeader()
 	if isleader {
@@ -137,6 +354,100 @@ func (h *HTTPTransport) isLeaderHandler(c *gin.Context) {
 	renderJSON(c, http.StatusNotFound, "follower")
 }
 
+func (h *HTTPTransport) leadershipTransferHandler(c *gin.Context) {
+	if err := h.agent.LeadershipTransfer(c.Query("target")); err != nil {
+		switch {
+		case errors.Is(err, raft.ErrNotLeader):
+			_ = c.AbortWithError(http.StatusConflict, err)
+		case errors.Is(err, ErrTargetNotVoter), errors.Is(err, ErrTargetInMaintenance):
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+		default:
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (h *HTTPTransport) snapshotHandler(c *gin.Context) {
+	index, err := h.agent.Snapshot()
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNotVoter), errors.Is(err, raft.ErrNothingNewToSnapshot):
+			_ = c.AbortWithError(http.StatusConflict, err)
+		default:
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	renderJSON(c, http.StatusOK, gin.H{
+		"index": index,
+	})
+}
+
+func (h *HTTPTransport) raftStatusHandler(c *gin.Context) {
+	status, err := h.agent.RaftStatus(c.Request.Context())
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	renderJSON(c, http.StatusOK, status)
+}
+
+type debugDumpResponse struct {
+	Raft     map[string]string `json:"raft"`
+	Pairs    []*types.Pair     `json:"pairs"`
+	Sessions []*types.Session  `json:"sessions"`
+}
+
+// debugDumpHandler returns the whole local store, expired pairs that were not
+// swept yet included, with the raft stats and indexes. It is only routed in
+// dev mode. The parts are read one after the other, a write in between may
+// show up in some of them only.
+func (h *HTTPTransport) debugDumpHandler(c *gin.Context) {
+	pairs, err := h.agent.Store.AllPairs()
+	if err != nil {
+		h.logger.Error(err)
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if pairs == nil {
+		pairs = []*types.Pair{}
+	}
+
+	sessions := h.agent.sessions.all()
+	if sessions == nil {
+		sessions = []*types.Session{}
+	}
+
+	renderJSON(c, http.StatusOK, debugDumpResponse{
+		Raft:     h.agent.RaftStats(),
+		Pairs:    pairs,
+		Sessions: sessions,
+	})
+}
+
+// maintenanceHandler puts this node in maintenance with enable=true and an
+// optional reason, enable=false takes it out.
+func (h *HTTPTransport) maintenanceHandler(c *gin.Context) {
+	enable, err := strconv.ParseBool(c.Query("enable"))
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid enable: %q", c.Query("enable")))
+		return
+	}
+
+	if err := h.agent.SetMaintenance(enable, c.Query("reason")); err != nil {
+		h.logger.Error(err)
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
 func (h *HTTPTransport) leaveHandler(c *gin.Context) {
 	if err := h.agent.Stop(); err != nil {
 		_ = c.AbortWithError(http.StatusInternalServerError, err)
@@ -204,27 +515,369 @@ func (h *HTTPTransport) pairDeleteHandler(c *gin.Context) {
 
 	err := h.agent.GRPCClient.DeleteValue(keyName)
 	if err != nil {
-		_ = c.AbortWithError(http.StatusNotFound, err)
+		if status.Code(err) == codes.NotFound {
+			_ = c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+		h.writeFailed(c, err)
 		return
 	}
 
 	c.Status(http.StatusOK)
 }
 
+type listPairsResponse struct {
+	Pairs         []*types.Pair `json:"pairs"`
+	ContinueToken string        `json:"continue_token,omitempty"`
+}
+
+// kvListHandler serves a stale, paginated prefix scan. Pass the returned
+// continue_token back as the continue query parameter to get the next page,
+// a node that is behind the token answers 503. Like kvGetHandler it blocks
+// when index is passed.
+func (h *HTTPTransport) kvListHandler(c *gin.Context) {
+	limit := 0
+	if l, ok := c.GetQuery("limit"); ok {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			_ = c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid limit: %q", l))
+			return
+		}
+	}
+
+	wait, err := blockingOptions(c)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	pairs, token, index, err := h.agent.BlockingListPairs(
+		c.Request.Context(), c.Query("prefix"), limit, c.Query("continue"), wait,
+	)
+	if err != nil {
+		if errors.Is(err, ErrInvalidContinueToken) {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		if errors.Is(err, ErrStaleContinueToken) {
+			c.Header("Retry-After", "1")
+			_ = c.AbortWithError(http.StatusServiceUnavailable, err)
+			return
+		}
+		h.logger.Error(err)
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if pairs == nil {
+		pairs = []*types.Pair{}
+	}
+	c.Header(indexHeader, strconv.FormatUint(index, 10))
+
+	renderJSON(c, http.StatusOK, listPairsResponse{
+		Pairs:         pairs,
+		ContinueToken: token,
+	})
+}
+
+type pairRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// TTL is an optional Go duration string such as "30s" or "1h".
+	TTL         string `json:"ttl"`
+	ContentType string `json:"content_type"`
+	Flags       uint64 `json:"flags"`
+}
+
 func (h *HTTPTransport) pairPostHandler(c *gin.Context) {
-	pair := &Pair{}
+	pair := &pairRequest{}
 	if err := c.ShouldBindJSON(pair); err != nil {
 		h.logger.Error(err)
 		_ = c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
 
+	if err := h.agent.config.checkPairSize(pair.Key, pair.Value); err != nil {
+		_ = c.AbortWithError(http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	var ttl time.Duration
+	if pair.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(pair.TTL)
+		if err != nil || ttl < 0 {
+			_ = c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid ttl: %q", pair.TTL))
+			return
+		}
+	}
+
 	if _, err := h.agent.GRPCClient.CreateValue(
-		pair.Key, pair.Value,
+		pair.Key, pair.Value, ttl, ValueMeta{ContentType: pair.ContentType, Flags: pair.Flags},
 	); err != nil {
-		h.logger.Error(err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		h.writeFailed(c, err)
+		return
 	}
 
 	c.Status(http.StatusCreated)
 }
+
+// valueMetaHeaders describes the value of pair in the response headers.
+func valueMetaHeaders(c *gin.Context, pair *types.Pair) {
+	if pair.ContentType != "" {
+		c.Header(contentTypeHeader, pair.ContentType)
+	}
+	if pair.Flags != 0 {
+		c.Header(flagsHeader, strconv.FormatUint(pair.Flags, 10))
+	}
+}
+
+// kvKey returns the key of a /v1/kv/*key route, keys may contain slashes.
+func kvKey(c *gin.Context) (string, error) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if key == "" {
+		return "", errors.New("key is required")
+	}
+	return key, nil
+}
+
+// blockingOptions reads the index and wait query parameters of a blocking
+// HTTP query.
+func blockingOptions(c *gin.Context) (BlockingOptions, error) {
+	var opts BlockingOptions
+	if i, ok := c.GetQuery("index"); ok {
+		index, err := strconv.ParseUint(i, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid index: %q", i)
+		}
+		opts.WaitIndex = index
+	}
+	if w, ok := c.GetQuery("wait"); ok {
+		wait, err := time.ParseDuration(w)
+		if err != nil || wait < 0 {
+			return opts, fmt.Errorf("invalid wait: %q", w)
+		}
+		opts.WaitTime = wait
+	}
+	return opts, nil
+}
+
+// etag is the entity tag of the pair version with the given ModifyIndex. The
+// index is assigned through raft, every node hands out the same tag.
+func etag(index uint64) string {
+	return `"` + strconv.FormatUint(index, 10) + `"`
+}
+
+// etagMatch reports whether an If-None-Match header lists the tag of index,
+// weak tags compare equal to strong ones.
+func etagMatch(header string, index uint64) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag(index) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseETag reads the ModifyIndex back from a single strong tag.
+func parseETag(tag string) (uint64, error) {
+	tag = strings.TrimSpace(tag)
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, fmt.Errorf("invalid entity tag: %q", tag)
+	}
+	index, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid entity tag: %q", tag)
+	}
+	return index, nil
+}
+
+// putPrecondition turns the cas parameter, If-Match or If-None-Match: * into
+// the index a PUT has to find, with the status answered when it does not.
+func putPrecondition(c *gin.Context) (index uint64, code int, err error) {
+	cas, hasCAS := c.GetQuery("cas")
+	ifMatch := c.GetHeader("If-Match")
+	ifNoneMatch := c.GetHeader("If-None-Match")
+
+	switch {
+	case hasCAS && (ifMatch != "" || ifNoneMatch != ""), ifMatch != "" && ifNoneMatch != "":
+		return 0, 0, errors.New("only one of cas, If-Match and If-None-Match can be used")
+	case hasCAS:
+		index, err = strconv.ParseUint(cas, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid cas index: %q", cas)
+		}
+		return index, http.StatusConflict, nil
+	case ifMatch != "":
+		index, err = parseETag(ifMatch)
+		if err != nil {
+			return 0, 0, err
+		}
+		return index, http.StatusPreconditionFailed, nil
+	case ifNoneMatch != "":
+		if strings.TrimSpace(ifNoneMatch) != "*" {
+			return 0, 0, errors.New("If-None-Match only supports *")
+		}
+		return 0, http.StatusPreconditionFailed, nil
+	}
+	return 0, 0, nil
+}
+
+// kvGetHandler reads a single key. Reads are linearizable and served through
+// the leader unless stale=true is passed, read_index=true skips the barrier.
+// With index=<X-Taskvault-Index> the read blocks until the key changes, at
+// most for wait. The ETag is the ModifyIndex of the pair, a matching
+// If-None-Match is answered with 304.
+func (h *HTTPTransport) kvGetHandler(c *gin.Context) {
+	key, err := kvKey(c)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	// gin can not route a static path next to the *key catch-all, the
+	// export mirrors POST /v1/kv/import.
+	if key == "export" {
+		h.kvExportHandler(c)
+		return
+	}
+
+	opts := ReadOptions{Consistency: Linearizable}
+	if readIndex, _ := strconv.ParseBool(c.Query("read_index")); readIndex {
+		opts.Consistency = ReadIndex
+	}
+	if stale, _ := strconv.ParseBool(c.Query("stale")); stale {
+		opts.Consistency = Stale
+	}
+
+	wait, err := blockingOptions(c)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	pair, index, err := h.agent.BlockingGetPair(c.Request.Context(), key, opts, wait)
+	if err == nil && pair == nil {
+		err = ErrKeyNotFound
+	}
+	c.Header(indexHeader, strconv.FormatUint(index, 10))
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrKeyNotFound), status.Code(err) == codes.NotFound:
+			_ = c.AbortWithError(http.StatusNotFound, err)
+		case errors.Is(err, ErrLeaderNotFound):
+			_ = c.AbortWithError(http.StatusServiceUnavailable, err)
+		default:
+			h.logger.Error(err)
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	c.Header("ETag", etag(pair.ModifyIndex))
+	valueMetaHeaders(c, pair)
+	if inm := c.GetHeader("If-None-Match"); inm != "" && etagMatch(inm, pair.ModifyIndex) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	renderJSON(c, http.StatusOK, pair)
+}
+
+// kvPutHandler stores the request body as the value of key. The write is
+// sent to the leader, pass cas=<modify index> to only replace the value when
+// it was not changed since that index, cas=0 only creates the key. If-Match
+// with an ETag does the same and answers 412 instead of 409 on a mismatch,
+// If-None-Match: * only creates the key.
+func (h *HTTPTransport) kvPutHandler(c *gin.Context) {
+	key, err := kvKey(c)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	var ttl time.Duration
+	if t, ok := c.GetQuery("ttl"); ok {
+		ttl, err = time.ParseDuration(t)
+		if err != nil || ttl < 0 {
+			_ = c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid ttl: %q", t))
+			return
+		}
+	}
+
+	body := c.Request.Body
+	if limit := h.agent.config.MaxValueSize; limit > 0 {
+		body = http.MaxBytesReader(c.Writer, body, int64(limit))
+	}
+	value, err := io.ReadAll(body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			err = fmt.Errorf("%w: the limit is %d bytes", ErrValueTooLarge, maxErr.Limit)
+			_ = c.AbortWithError(http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if err := h.agent.config.checkPairSize(key, ""); err != nil {
+		_ = c.AbortWithError(http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	meta := ValueMeta{ContentType: c.GetHeader(contentTypeHeader)}
+	if f := c.GetHeader(flagsHeader); f != "" {
+		meta.Flags, err = strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid %s: %q", flagsHeader, f))
+			return
+		}
+	}
+
+	index, code, err := putPrecondition(c)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if code == 0 {
+		if _, err := h.agent.GRPCClient.CreateValue(key, string(value), ttl, meta); err != nil {
+			h.writeFailed(c, err)
+			return
+		}
+		c.Status(http.StatusOK)
+		return
+	}
+
+	success, pair, err := h.agent.GRPCClient.CompareAndSwap(key, string(value), index, ttl, meta)
+	if err != nil {
+		h.writeFailed(c, err)
+		return
+	}
+	if !success {
+		_ = c.AbortWithError(code, ErrCASFailed)
+		return
+	}
+
+	c.Header("ETag", etag(pair.ModifyIndex))
+	valueMetaHeaders(c, pair)
+	renderJSON(c, http.StatusOK, pair)
+}
+
+func (h *HTTPTransport) kvDeleteHandler(c *gin.Context) {
+	key, err := kvKey(c)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.agent.GRPCClient.DeleteValue(key); err != nil {
+		if status.Code(err) == codes.NotFound {
+			_ = c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+		h.writeFailed(c, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
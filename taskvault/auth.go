@@ -0,0 +1,170 @@
+package taskvault
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	authMetadataKey = "authorization"
+	bearerPrefix    = "Bearer "
+)
+
+// readMethods are the RPCs that may be served anonymously when
+// ACLAnonymousReads is set. Everything else requires a token, including the
+// Raft internals and the reconcile plan.
+var readMethods = map[string]bool{
+	"/types.Taskvault/GetValue":             true,
+	"/types.Taskvault/GetPair":              true,
+	"/types.Taskvault/StatPair":             true,
+	"/types.Taskvault/GetAllPairs":          true,
+	"/types.Taskvault/ListPairs":            true,
+	"/types.Taskvault/ListKeys":             true,
+	"/types.Taskvault/Count":                true,
+	"/types.Taskvault/Members":              true,
+	"/types.Taskvault/NodeStatus":           true,
+	"/types.Taskvault/RaftGetConfiguration": true,
+	"/types.Taskvault/Watch":                true,
+	"/types.Taskvault/WatchLeader":          true,
+	"/types.Taskvault/GetLeader":            true,
+}
+
+// clientToken is the token this node presents when calling its peers.
+func (c *Config) clientToken() string {
+	if c.ACLToken != "" {
+		return c.ACLToken
+	}
+	if len(c.ACLTokens) > 0 {
+		return c.ACLTokens[0]
+	}
+	return ""
+}
+
+func (grpcs *GRPCServer) authorize(ctx context.Context, method string) error {
+	config := grpcs.agent.config
+	if len(config.ACLTokens) == 0 {
+		return nil
+	}
+	// Probes from orchestrators carry no token.
+	if strings.HasPrefix(method, "/grpc.health.v1.Health/") {
+		return nil
+	}
+	if config.ACLAnonymousReads && readMethods[method] {
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(authMetadataKey) {
+		if config.validToken(v) {
+			return nil
+		}
+		if _, ok := config.tokenNamespace(v); ok {
+			if !namespacedMethods[method] {
+				return status.Error(codes.PermissionDenied, "not allowed for a namespace token")
+			}
+			return nil
+		}
+	}
+
+	return status.Error(codes.Unauthenticated, "missing or invalid token")
+}
+
+// validToken reports whether an authorization header value carries one of
+// the configured bearer tokens.
+func (c *Config) validToken(header string) bool {
+	token, ok := strings.CutPrefix(header, bearerPrefix)
+	if !ok {
+		return false
+	}
+	for _, t := range c.ACLTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// requireToken guards operator HTTP endpoints with the RPC bearer tokens.
+func (h *HTTPTransport) requireToken(c *gin.Context) {
+	config := h.agent.config
+	if len(config.ACLTokens) == 0 || config.validToken(c.GetHeader("Authorization")) {
+		c.Next()
+		return
+	}
+
+	_ = c.AbortWithError(http.StatusUnauthorized, errors.New("missing or invalid token"))
+}
+
+// requireReadToken guards the HTTP reads of pairs like requireToken, unless
+// ACLAnonymousReads lets them through.
+func (h *HTTPTransport) requireReadToken(c *gin.Context) {
+	if h.agent.config.ACLAnonymousReads {
+		c.Next()
+		return
+	}
+	h.requireToken(c)
+}
+
+func (grpcs *GRPCServer) unaryAuthInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if err := grpcs.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (grpcs *GRPCServer) streamAuthInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if err := grpcs.authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// tokenDialOptions attach the bearer token to every outgoing call. Without
+// TLS the token travels in cleartext.
+func tokenDialOptions(token string) []grpc.DialOption {
+	withToken := func(ctx context.Context) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, authMetadataKey, bearerPrefix+token)
+	}
+
+	return []grpc.DialOption{
+		grpc.WithUnaryInterceptor(func(
+			ctx context.Context,
+			method string,
+			req, reply interface{},
+			cc *grpc.ClientConn,
+			invoker grpc.UnaryInvoker,
+			opts ...grpc.CallOption,
+		) error {
+			return invoker(withToken(ctx), method, req, reply, cc, opts...)
+		}),
+		grpc.WithStreamInterceptor(func(
+			ctx context.Context,
+			desc *grpc.StreamDesc,
+			cc *grpc.ClientConn,
+			method string,
+			streamer grpc.Streamer,
+			opts ...grpc.CallOption,
+		) (grpc.ClientStream, error) {
+			return streamer(withToken(ctx), desc, cc, method, opts...)
+		}),
+	}
+}
@@ -0,0 +1,152 @@
+package taskvault
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCServer_Authorize(t *testing.T) {
+	c := DefaultConfig()
+	c.ACLTokens = []string{"secret"}
+	g := &GRPCServer{agent: &Agent{config: c}}
+
+	withToken := func(token string) context.Context {
+		return metadata.NewIncomingContext(context.Background(),
+			metadata.Pairs(authMetadataKey, bearerPrefix+token))
+	}
+
+	err := g.authorize(context.Background(), "/types.Taskvault/CreateValue")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	err = g.authorize(withToken("wrong"), "/types.Taskvault/CreateValue")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	require.NoError(t, g.authorize(withToken("secret"), "/types.Taskvault/CreateValue"))
+
+	err = g.authorize(context.Background(), "/types.Taskvault/GetPair")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	c.ACLAnonymousReads = true
+	require.NoError(t, g.authorize(context.Background(), "/types.Taskvault/GetPair"))
+	for _, method := range []string{"DeleteValue", "RaftStats", "RaftStatus", "PlanReconcile", "ForceLeave"} {
+		err = g.authorize(context.Background(), "/types.Taskvault/"+method)
+		require.Equal(t, codes.Unauthenticated, status.Code(err), method)
+	}
+}
+
+func TestHTTPTransport_RequireToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c := DefaultConfig()
+	c.ACLTokens = []string{"secret"}
+	h := &HTTPTransport{agent: &Agent{config: c}, Engine: gin.New()}
+	h.APIRoutes(h.Engine.Group("/"))
+
+	code := func(method, path string) int {
+		w := httptest.NewRecorder()
+		h.Engine.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w.Code
+	}
+
+	writes := [][2]string{
+		{http.MethodPut, "/v1/kv/foo"},
+		{http.MethodDelete, "/v1/kv/foo"},
+		{http.MethodPost, "/v1/storage"},
+		{http.MethodDelete, "/v1/storage/foo"},
+		{http.MethodPatch, "/v1/storage/"},
+		{http.MethodPost, "/v1/kv/import"},
+		{http.MethodPost, "/v1/leave"},
+		{http.MethodPost, "/v1/snapshot"},
+		{http.MethodPost, "/v1/leader/transfer"},
+		{http.MethodPost, "/v1/members/foo/force-leave"},
+		// Not a write, but the raft internals are never anonymous.
+		{http.MethodGet, "/v1/raft/status"},
+	}
+	reads := [][2]string{
+		{http.MethodGet, "/v1/kv"},
+		{http.MethodGet, "/v1/kv/foo"},
+		{http.MethodGet, "/v1/kv/export"},
+		{http.MethodGet, "/v1/storage"},
+		{http.MethodGet, "/v1/storage/foo"},
+	}
+	for _, r := range append(writes, reads...) {
+		assert.Equal(t, http.StatusUnauthorized, code(r[0], r[1]), r)
+	}
+
+	// Namespace tokens only reach their keys over gRPC.
+	c.ACLNamespaceTokens = []string{"tenant-a=tenant"}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v1/kv/foo", nil)
+	req.Header.Set("Authorization", bearerPrefix+"tenant")
+	h.Engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	c.ACLAnonymousReads = true
+	for _, r := range writes {
+		assert.Equal(t, http.StatusUnauthorized, code(r[0], r[1]), r)
+	}
+}
+
+func TestGRPCServer_Namespace(t *testing.T) {
+	c := DefaultConfig()
+	c.ACLTokens = []string{"secret"}
+	c.ACLNamespaceTokens = []string{"a=tenant-a"}
+	g := &GRPCServer{agent: &Agent{config: c}}
+
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(authMetadataKey, bearerPrefix+"tenant-a"))
+
+	require.NoError(t, g.authorize(ctx, "/types.Taskvault/GetPair"))
+	err := g.authorize(ctx, "/types.Taskvault/GetAllPairs")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Equal(t, "a", g.callNamespace(ctx))
+
+	var seen *types.GetPairRequest
+	resp, err := g.unaryNamespaceInterceptor(ctx,
+		&types.GetPairRequest{Key: "foo"},
+		&grpc.UnaryServerInfo{FullMethod: "/types.Taskvault/GetPair"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			seen = req.(*types.GetPairRequest)
+			return &types.GetPairResponse{Pair: &types.Pair{Key: seen.Key}}, nil
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, "_ns/a/foo", seen.Key)
+	require.Equal(t, "foo", resp.(*types.GetPairResponse).Pair.Key)
+
+	_, err = g.unaryNamespaceInterceptor(ctx,
+		&types.CreateValueRequest{},
+		&grpc.UnaryServerInfo{FullMethod: "/types.Taskvault/CreateValue"},
+		func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil },
+	)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Cluster-wide tokens see the qualified keys.
+	ctx = metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(authMetadataKey, bearerPrefix+"secret"))
+	require.Equal(t, "", g.callNamespace(ctx))
+}
+
+func TestGRPCServer_ReadOnly(t *testing.T) {
+	c := DefaultConfig()
+	g := &GRPCServer{agent: &Agent{config: c}}
+	require.NoError(t, g.checkReadOnly("/types.Taskvault/CreateValue"))
+
+	c.ReadOnly = true
+	err := g.checkReadOnly("/types.Taskvault/CreateValue")
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	err = g.checkReadOnly("/types.Taskvault/Txn")
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.NoError(t, g.checkReadOnly("/types.Taskvault/GetPair"))
+	require.NoError(t, g.checkReadOnly("/types.Taskvault/Watch"))
+}
@@ -0,0 +1,111 @@
+package taskvault
+
+import (
+	"bufio"
+	"io"
+	"time"
+
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// restoreWindow bounds how many restore writes are in flight in raft.
+const restoreWindow = 256
+
+// Backup writes every live pair to w in the snapshot format. It is served
+// from the local store, run it on the leader for an up to date copy.
+func (a *Agent) Backup(w io.Writer) error {
+	pairs, err := a.Store.ListPairs("")
+	if err != nil {
+		return err
+	}
+
+	return writeSnapshot(w, pairs)
+}
+
+// Restore imports a backup written by Backup by replicating every pair as an
+// AddPairType command. The whole stream is decoded before the first write,
+// so a truncated or corrupt backup leaves the keyspace untouched. It returns
+// how many pairs were applied, which is only partial when raft fails midway.
+func (a *Agent) Restore(r io.Reader) (int, error) {
+	if !a.IsLeader() {
+		return 0, raft.ErrNotLeader
+	}
+
+	var pairs []*types.Pair
+	now := time.Now()
+	err := readSnapshot(bufio.NewReader(r), func(pair *types.Pair) error {
+		if pairExpired(pair, now) {
+			return nil
+		}
+		pair.ModifyIndex = 0
+		pairs = append(pairs, pair)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for start := 0; start < len(pairs); start += restoreWindow {
+		end := min(start+restoreWindow, len(pairs))
+
+		futures := make([]raft.ApplyFuture, 0, end-start)
+		for _, pair := range pairs[start:end] {
+			cmd, err := Encode(AddPairType, pair)
+			if err != nil {
+				return applied, err
+			}
+			futures = append(futures, a.raft.Apply(cmd, raftTimeout))
+		}
+
+		for _, f := range futures {
+			if err := f.Error(); err != nil {
+				return applied, err
+			}
+			if err, ok := f.Response().(error); ok {
+				return applied, err
+			}
+			applied++
+		}
+	}
+
+	a.logger.Info("agent: backup restored", zap.Int("pairs", applied))
+
+	return applied, nil
+}
+
+// chunkWriter sends everything written to it as BackupChunk messages.
+type chunkWriter struct {
+	send func(*types.BackupChunk) error
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	data := make([]byte, len(p))
+	copy(data, p)
+	if err := w.send(&types.BackupChunk{Data: data}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// chunkReader reads the data of BackupChunk messages until the stream ends.
+type chunkReader struct {
+	recv func() (*types.BackupChunk, error)
+	buf  []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		chunk, err := r.recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = chunk.Data
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,159 @@
+package taskvault
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/danluki/taskvault/pkg/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultWaitTime is how long a blocking query waits without WaitTime,
+	// MaxWaitTime caps the WaitTime a client asks for.
+	DefaultWaitTime = 5 * time.Minute
+	MaxWaitTime     = 10 * time.Minute
+)
+
+// BlockingOptions turn a read into a blocking query: while the index of the
+// result is not above WaitIndex the read waits for a matching change, at
+// most WaitTime. A zero WaitIndex does not block.
+type BlockingOptions struct {
+	WaitIndex uint64
+	WaitTime  time.Duration
+}
+
+func (o BlockingOptions) waitTime() time.Duration {
+	switch {
+	case o.WaitTime <= 0:
+		return DefaultWaitTime
+	case o.WaitTime > MaxWaitTime:
+		return MaxWaitTime
+	default:
+		return o.WaitTime
+	}
+}
+
+// blockingQuery runs read, which returns the index of its result, and runs
+// it again once a key under prefix accepted by match changes past WaitIndex.
+// On timeout the first result stands. The returned index is what the client
+// passes as WaitIndex to wait for the next change.
+func (a *Agent) blockingQuery(
+	ctx context.Context,
+	prefix string,
+	match func(key string) bool,
+	opts BlockingOptions,
+	read func() (uint64, error),
+) (uint64, error) {
+	if opts.WaitIndex == 0 || a.watches == nil {
+		return read()
+	}
+	defer metrics.MeasureSince([]string{"taskvault", "blocking_query"}, time.Now())
+
+	waitCtx, cancel := context.WithTimeout(ctx, opts.waitTime())
+	defer cancel()
+	// Subscribe first, a change between the read and the subscription
+	// would be missed otherwise.
+	events := a.watches.subscribe(waitCtx, prefix)
+
+	index, err := read()
+	if err != nil || index > opts.WaitIndex {
+		return index, err
+	}
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if ok && ev.Type != EventResync && (!match(ev.Key) || ev.ModifyIndex <= opts.WaitIndex) {
+				continue
+			}
+			if !ok && waitCtx.Err() != nil {
+				return a.blockingTimeout(ctx, index, opts)
+			}
+			// A change, or the subscription fell behind and the state has
+			// to be read again anyway.
+			index, err = read()
+			return max(index, ev.ModifyIndex), err
+
+		case <-waitCtx.Done():
+			return a.blockingTimeout(ctx, index, opts)
+		}
+	}
+}
+
+func (a *Agent) deleteIndex() uint64 {
+	if a.watches == nil {
+		return 0
+	}
+	return a.watches.deleteIndex.Load()
+}
+
+func (a *Agent) blockingTimeout(ctx context.Context, index uint64, opts BlockingOptions) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return max(index, opts.WaitIndex), nil
+}
+
+// BlockingGetPair reads key like GetPair, blocking as described by
+// BlockingOptions. A missing key is not an error but a nil pair, clients
+// block on keys that do not exist yet. Its index is that of the last
+// deletion, the key may have been one of them.
+func (a *Agent) BlockingGetPair(
+	ctx context.Context, key string, opts ReadOptions, wait BlockingOptions,
+) (*types.Pair, uint64, error) {
+	var pair *types.Pair
+	index, err := a.blockingQuery(ctx, key,
+		func(k string) bool { return k == key },
+		wait,
+		func() (uint64, error) {
+			var err error
+			pair, err = a.GetPair(key, opts)
+			if errors.Is(err, ErrKeyNotFound) || status.Code(err) == codes.NotFound {
+				pair = nil
+				return a.deleteIndex(), nil
+			}
+			if err != nil {
+				return 0, err
+			}
+			return pair.ModifyIndex, nil
+		},
+	)
+
+	return pair, index, err
+}
+
+// BlockingListPairs lists pairs like ListPairs, blocking as described by
+// BlockingOptions. The index of a list is the highest ModifyIndex in it, or
+// the index of the last deletion when that is higher.
+func (a *Agent) BlockingListPairs(
+	ctx context.Context, prefix string, limit int, continueToken string, wait BlockingOptions,
+) ([]*types.Pair, string, uint64, error) {
+	var (
+		pairs []*types.Pair
+		token string
+	)
+	index, err := a.blockingQuery(ctx, prefix,
+		func(k string) bool { return strings.HasPrefix(k, prefix) },
+		wait,
+		func() (uint64, error) {
+			var err error
+			pairs, token, err = a.ListPairs(prefix, limit, continueToken)
+			if err != nil {
+				return 0, err
+			}
+
+			index := a.deleteIndex()
+			for _, p := range pairs {
+				index = max(index, p.ModifyIndex)
+			}
+			return index, nil
+		},
+	)
+
+	return pairs, token, index, err
+}
@@ -0,0 +1,376 @@
+package taskvault
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+var pairsBucket = []byte("pairs")
+
+// boltInitialMmapSize reserves address space up front. Bolt can not grow its
+// mmap while a snapshot holds a read transaction, writes would wait for it.
+const boltInitialMmapSize = 1 << 30
+
+// boltOpenTimeout is how long opening a bolt file waits for the lock held by
+// another process.
+const boltOpenTimeout = time.Second
+
+// BoltStore keeps the pairs in a BoltDB file, so the keyspace does not have to
+// fit in memory. Like Store it holds the FSM state only: raft rebuilds it from
+// the snapshot and the log on every start, so the file is emptied on open and
+// is not synced to disk on every write.
+type BoltStore struct {
+	db *bolt.DB
+
+	logger *zap.SugaredLogger
+}
+
+var _ SyncraStorage = (*BoltStore)(nil)
+
+func NewBoltStore(path string, logger *zap.SugaredLogger) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{
+		Timeout:         boltOpenTimeout,
+		InitialMmapSize: boltInitialMmapSize,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("store: open %s: %w", path, err)
+	}
+	db.NoSync = true
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(pairsBucket); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		_, err := tx.CreateBucket(pairsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{
+		db:     db,
+		logger: logger,
+	}, nil
+}
+
+func (s *BoltStore) GetValue(key string) (string, error) {
+	pair, err := s.GetPair(key, ReadOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	return pair.Value, nil
+}
+
+func (s *BoltStore) GetPair(key string, opts ReadOptions) (*types.Pair, error) {
+	var pair *types.Pair
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(pairsBucket).Get([]byte(key))
+		if v == nil {
+			return ErrKeyNotFound
+		}
+
+		var err error
+		pair, err = decodePair(key, string(v))
+		if err != nil {
+			return err
+		}
+
+		if !opts.IncludeExpired && pairExpired(pair, time.Now()) {
+			pair = nil
+			return ErrKeyNotFound
+		}
+
+		return nil
+	})
+
+	return pair, err
+}
+
+func (s *BoltStore) UpdateValue(key string, value string) error {
+	return s.SetValue(key, value)
+}
+
+func (s *BoltStore) SetValue(key string, value string) error {
+	return s.SetPair(&types.Pair{
+		Key:   key,
+		Value: value,
+	})
+}
+
+func (s *BoltStore) SetPair(pair *types.Pair) error {
+	v, err := encodePair(pair)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pairsBucket).Put([]byte(pair.Key), []byte(v))
+	})
+}
+
+func (s *BoltStore) DeletePair(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pairsBucket)
+		if b.Get([]byte(key)) == nil {
+			return ErrKeyNotFound
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// Txn applies the operations in order within a single bolt transaction.
+func (s *BoltStore) Txn(ops []*types.TxnOp) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pairsBucket)
+		for _, op := range ops {
+			switch op.Type {
+			case types.TxnOpType_TXN_SET:
+				v, err := encodePair(op.Pair)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(op.Pair.Key), []byte(v)); err != nil {
+					return err
+				}
+			case types.TxnOpType_TXN_DELETE:
+				if err := b.Delete([]byte(op.Pair.Key)); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("store: unknown txn op %d", op.Type)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) GetAllValues() ([]Pair, error) {
+	var pairs []Pair
+	err := s.ascendLive("", "", func(pair *types.Pair) bool {
+		pairs = append(pairs, Pair{
+			Key:   pair.Key,
+			Value: pair.Value,
+		})
+		return true
+	})
+
+	return pairs, err
+}
+
+func (s *BoltStore) ListPairs(prefix string) ([]*types.Pair, error) {
+	return s.ScanPairs(prefix, "", 0)
+}
+
+func (s *BoltStore) ScanPairs(prefix, after string, limit int) ([]*types.Pair, error) {
+	var pairs []*types.Pair
+	err := s.ascendLive(prefix, after, func(pair *types.Pair) bool {
+		pairs = append(pairs, pair)
+		return limit <= 0 || len(pairs) < limit
+	})
+
+	return pairs, err
+}
+
+func (s *BoltStore) ListKeys(prefix string) ([]string, error) {
+	var keys []string
+	err := s.ascendLive(prefix, "", func(pair *types.Pair) bool {
+		keys = append(keys, pair.Key)
+		return true
+	})
+
+	return keys, err
+}
+
+func (s *BoltStore) Count(prefix string) (int, error) {
+	n := 0
+	err := s.ascendLive(prefix, "", func(*types.Pair) bool {
+		n++
+		return true
+	})
+
+	return n, err
+}
+
+// ascendLive calls fn in key order with every pair under prefix that did not
+// expire and sorts after the given key, until fn returns false.
+func (s *BoltStore) ascendLive(prefix, after string, fn func(*types.Pair) bool) error {
+	now := time.Now()
+
+	pivot := prefix
+	if after > pivot {
+		pivot = after
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(pairsBucket).Cursor()
+		for k, v := c.Seek([]byte(pivot)); k != nil; k, v = c.Next() {
+			key := string(k)
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			if after != "" && key <= after {
+				continue
+			}
+
+			pair, err := decodePair(key, string(v))
+			if err != nil {
+				return err
+			}
+			if pairExpired(pair, now) {
+				continue
+			}
+
+			if !fn(pair) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// each calls fn with every stored pair in key order, expired ones included.
+func (s *BoltStore) each(tx *bolt.Tx, fn func(*types.Pair) error) error {
+	return tx.Bucket(pairsBucket).ForEach(func(k, v []byte) error {
+		pair, err := decodePair(string(k), string(v))
+		if err != nil {
+			return err
+		}
+		return fn(pair)
+	})
+}
+
+func (s *BoltStore) AllPairs() ([]*types.Pair, error) {
+	var pairs []*types.Pair
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return s.each(tx, func(pair *types.Pair) error {
+			pairs = append(pairs, pair)
+			return nil
+		})
+	})
+
+	return pairs, err
+}
+
+func (s *BoltStore) ExpiredPairs(now time.Time) ([]*types.Pair, error) {
+	var pairs []*types.Pair
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return s.each(tx, func(pair *types.Pair) error {
+			if pairExpired(pair, now) {
+				pairs = append(pairs, pair)
+			}
+			return nil
+		})
+	})
+
+	return pairs, err
+}
+
+func (s *BoltStore) Len() (int, error) {
+	var n int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(pairsBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+func (s *BoltStore) Shutdown() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Snapshot(w io.WriteCloser) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		_, err := streamSnapshot(w, func(emit func(*types.Pair) error) error {
+			return s.each(tx, emit)
+		})
+		return err
+	})
+}
+
+// Restore replaces the content of the store with the snapshot read from r.
+// Only snapshots in the engine independent format are accepted.
+func (s *BoltStore) Restore(r io.ReadCloser) error {
+	br := bufio.NewReaderSize(r, snapshotBufferSize)
+	head, err := br.Peek(len(snapshotMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if !bytes.Equal(head, snapshotMagic) {
+		return fmt.Errorf("%w: the bolt store can not load legacy buntdb snapshots", ErrInvalidSnapshot)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(pairsBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(pairsBucket)
+		if err != nil {
+			return err
+		}
+		// Snapshots list the pairs in key order, pages can be filled up
+		// instead of being split in half on every insert.
+		b.FillPercent = 1.0
+
+		return readSnapshot(br, func(pair *types.Pair) error {
+			v, err := encodePair(pair)
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(pair.Key), []byte(v))
+		})
+	})
+}
+
+// FSMSnapshot holds a bolt read transaction as a point in time view of the
+// pairs, so raft persists them without copying the keyspace in memory first.
+// Writes go on meanwhile, unless the file outgrows boltInitialMmapSize before
+// the view is released.
+func (s *BoltStore) FSMSnapshot() (raft.FSMSnapshot, error) {
+	tx, err := s.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltSnapshot{store: s, tx: tx}, nil
+}
+
+type boltSnapshot struct {
+	store *BoltStore
+	tx    *bolt.Tx
+	keys  int
+}
+
+func (b *boltSnapshot) Persist(sink raft.SnapshotSink) error {
+	var err error
+	b.keys, err = streamSnapshot(sink, func(emit func(*types.Pair) error) error {
+		return b.store.each(b.tx, emit)
+	})
+	if err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (b *boltSnapshot) persistedKeys() int {
+	return b.keys
+}
+
+func (b *boltSnapshot) Release() {
+	_ = b.tx.Rollback()
+}
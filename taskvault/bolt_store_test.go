@@ -0,0 +1,102 @@
+package taskvault
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestBoltStore(t *testing.T, path string) *BoltStore {
+	s, err := NewBoltStore(path, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Shutdown() })
+	return s
+}
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	s := newTestBoltStore(t, path)
+
+	_, err := s.GetPair("missing", ReadOptions{})
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.ErrorIs(t, s.DeletePair("missing"), ErrKeyNotFound)
+
+	for _, k := range []string{"a", "config/b", "config/a", "d"} {
+		require.NoError(t, s.SetValue(k, k))
+	}
+	past := time.Now().Add(-time.Minute).UnixNano()
+	require.NoError(t, s.SetPair(&types.Pair{Key: "config/old", Value: "v", ExpiresAt: past}))
+
+	keys, err := s.ListKeys("config/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"config/a", "config/b"}, keys)
+
+	pairs, err := s.ScanPairs("config/", "config/a", 1)
+	require.NoError(t, err)
+	require.Len(t, pairs, 1)
+	assert.Equal(t, "config/b", pairs[0].Key)
+
+	expired, err := s.ExpiredPairs(time.Now())
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+	assert.Equal(t, "config/old", expired[0].Key)
+
+	require.NoError(t, s.Txn([]*types.TxnOp{
+		{Type: types.TxnOpType_TXN_SET, Pair: &types.Pair{Key: "e", Value: "e"}},
+		{Type: types.TxnOpType_TXN_DELETE, Pair: &types.Pair{Key: "a"}},
+		{Type: types.TxnOpType_TXN_DELETE, Pair: &types.Pair{Key: "missing"}},
+	}))
+	n, err := s.Len()
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	// The native snapshot is readable by the in-memory store.
+	snaps := raft.NewInmemSnapshotStore()
+	snap, err := newFSM(s, zap.NewNop().Sugar()).Snapshot()
+	require.NoError(t, err)
+	sink, err := snaps.Create(raft.SnapshotVersionMax, 1, 1, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.SetValue("after", "snapshot"))
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+
+	_, rc, err := snaps.Open(sink.ID())
+	require.NoError(t, err)
+	mem := newTestStore(t)
+	require.NoError(t, mem.Restore(rc))
+	all, err := mem.AllPairs()
+	require.NoError(t, err)
+	assert.Len(t, all, 5)
+
+	_, rc, err = snaps.Open(sink.ID())
+	require.NoError(t, err)
+	require.NoError(t, s.Restore(rc))
+	_, err = s.GetPair("after", ReadOptions{})
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// Raft replays the state on start, so a reopened store is empty.
+	require.NoError(t, s.Shutdown())
+	s = newTestBoltStore(t, path)
+	n, err = s.Len()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestBoltStore_Locked(t *testing.T) {
+	c := DefaultConfig()
+	c.StoreBackend = StoreBackendBolt
+	c.DataDir = t.TempDir()
+	require.NoError(t, os.MkdirAll(c.storePath().dir, 0o700))
+	newTestBoltStore(t, filepath.Join(c.storePath().dir, "store.db"))
+
+	_, err := newStorage(c, zap.NewNop().Sugar())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "locked by another process")
+}
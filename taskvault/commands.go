@@ -0,0 +1,46 @@
+package taskvault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var ErrInvalidCommandType = errors.New("invalid command type")
+
+// RegisterCommand adds a custom command to the FSM of the agent. Types from
+// CustomTypeStart on are free for embedders, every node of the cluster must
+// register the same commands before Start, a node that does not know a type
+// skips its entries. fn runs on every node in log order and must be
+// deterministic.
+func (a *Agent) RegisterCommand(t MessageType, fn LogApplier) error {
+	if t < CustomTypeStart || t == MessageType(commandMagic) {
+		return fmt.Errorf("%w: %d is reserved", ErrInvalidCommandType, t)
+	}
+	if fn == nil {
+		return fmt.Errorf("%w: %s has no applier", ErrInvalidCommandType, t)
+	}
+	if a.raft != nil {
+		return fmt.Errorf("%w: %s registered after start", ErrInvalidCommandType, t)
+	}
+	if _, ok := a.commands[t]; ok {
+		return fmt.Errorf("%w: %s already registered", ErrInvalidCommandType, t)
+	}
+
+	if a.commands == nil {
+		a.commands = make(LogAppliers)
+	}
+	a.commands[t] = fn
+	return nil
+}
+
+// ApplyCommand replicates a custom command and returns the value its applier
+// returned. It must run on the leader.
+func (a *Agent) ApplyCommand(ctx context.Context, t MessageType, msg proto.Message) (interface{}, error) {
+	if _, ok := a.commands[t]; !ok {
+		return nil, fmt.Errorf("%w: %s is not registered", ErrInvalidCommandType, t)
+	}
+	return a.apply(ctx, t, msg)
+}
@@ -3,15 +3,23 @@ package taskvault
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/hashicorp/go-sockaddr/template"
+	"github.com/hashicorp/raft"
 	flag "github.com/spf13/pflag"
+	"go.uber.org/zap/zapcore"
 )
 
 type Config struct {
@@ -21,48 +29,291 @@ type Config struct {
 
 	HTTPAddr string `mapstructure:"http-addr"`
 
+	// EnableHTTP serves the HTTP API and UI on HTTPAddr. A gRPC only node
+	// can still answer probes and scrapes on HealthAddr.
+	EnableHTTP bool `mapstructure:"enable-http"`
+
+	// HealthAddr serves only /health and /metrics, e.g. on an internal
+	// interface. Empty disables it.
+	HealthAddr string `mapstructure:"health-addr"`
+
+	// CORSAllowedOrigins lists the origins browsers may call the HTTP API
+	// from, "*" allows any origin and an empty list disables CORS.
+	CORSAllowedOrigins []string `mapstructure:"cors-allowed-origins"`
+
 	// Profile for serf: wan, lan, local
 	Profile string
 
 	AdvertiseAddr string `mapstructure:"advertise-addr"`
 
+	// Datacenter is gossiped in the dc tag so members can be reported and
+	// filtered per datacenter. Raft still spans every datacenter.
+	Datacenter string `mapstructure:"datacenter"`
+
+	// Tags are custom serf tags set on start, next to the ones the agent
+	// sets itself. They can be changed at runtime with SetTag.
+	Tags map[string]string `mapstructure:"tags"`
+
 	EncryptKey string `mapstructure:"encrypt"`
 
+	// EncryptKeys are secondary gossip keys, accepted on incoming messages
+	// next to EncryptKey during a key rotation.
+	EncryptKeys []string `mapstructure:"encrypt-keys"`
+
 	StartJoin []string `mapstructure:"join"`
 
 	RetryJoin []string `mapstructure:"retry-join"`
 
+	// RetryJoinMaxAttempts bounds the join attempts, zero retries until the
+	// join succeeds. The wait between attempts starts at RetryJoinInterval
+	// and doubles, with jitter, up to RetryJoinMaxInterval.
 	RetryJoinMaxAttempts int `mapstructure:"retry-max"`
 
 	RetryJoinInterval time.Duration `mapstructure:"retry-interval"`
 
+	RetryJoinMaxInterval time.Duration `mapstructure:"retry-max-interval"`
+
+	// RPCRetryMax and RPCRetryBackoff bound how often a write is retried
+	// against a new leader. The backoff doubles on every attempt.
+	RPCRetryMax int `mapstructure:"rpc-retry-max"`
+
+	RPCRetryBackoff time.Duration `mapstructure:"rpc-retry-backoff"`
+
 	RPCPort int `mapstructure:"rpc-port"`
 
 	AdvertiseRPCPort int `mapstructure:"advertise-rpc-port"`
 
+	// SeparateListeners serves raft on RaftPort instead of sharing RPCPort
+	// with gRPC, for firewalls that want a port per protocol.
+	SeparateListeners bool `mapstructure:"separate-listeners"`
+	RaftPort          int  `mapstructure:"raft-port"`
+	AdvertiseRaftPort int  `mapstructure:"advertise-raft-port"`
+
+	// RPCMatchTimeout bounds how long a connection to the RPC port may take
+	// to send the bytes that tell gRPC and raft apart, 0 waits forever.
+	RPCMatchTimeout time.Duration `mapstructure:"rpc-match-timeout"`
+
 	LogLevel string `mapstructure:"log-level"`
 
+	// LogFormat is console or json, LogFile is where logs go instead of
+	// stdout.
+	LogFormat string `mapstructure:"log-format"`
+
+	LogFile string `mapstructure:"log-file"`
+
 	Bootstrap bool
 
 	BootstrapExpect int `mapstructure:"bootstrap-expect"`
 
+	// NonVoter joins raft as a read replica: it replicates the log and
+	// serves stale reads but never votes or becomes leader.
+	NonVoter bool `mapstructure:"non-voter"`
+
+	// ReadOnly makes the node a standby replica: a non-voter that rejects
+	// every write, including the ones it would forward to the leader.
+	ReadOnly bool `mapstructure:"read-only"`
+
 	DataDir string `mapstructure:"data-dir"`
 
+	// RaftDir, StoreDir and SnapshotDir move the raft log, the bolt store and
+	// the raft snapshots off DataDir, e.g. the log onto a fast disk. Empty
+	// ones default to raft, store and snapshots under DataDir. Snapshots are
+	// written to a snapshots directory inside SnapshotDir.
+	RaftDir     string `mapstructure:"raft-dir"`
+	StoreDir    string `mapstructure:"store-dir"`
+	SnapshotDir string `mapstructure:"snapshot-dir"`
+
+	// StoreBackend selects where the FSM keeps the pairs: "memory" or
+	// "bolt" for a file under DataDir when the keyspace does not fit in RAM.
+	StoreBackend string `mapstructure:"store-backend"`
+
+	// RaftMultiplier scales the raft default timeouts, raise it on slow or
+	// high latency networks. Timeouts set explicitly are not scaled.
+	RaftMultiplier int `mapstructure:"raft-multiplier"`
+
+	HeartbeatTimeout time.Duration `mapstructure:"raft-heartbeat-timeout"`
+
+	ElectionTimeout time.Duration `mapstructure:"raft-election-timeout"`
+
+	CommitTimeout time.Duration `mapstructure:"raft-commit-timeout"`
+
+	// SnapshotRetain is how many raft snapshots are kept on disk.
+	SnapshotRetain int `mapstructure:"raft-snapshot-retain"`
+
+	// SnapshotInterval and SnapshotThreshold override how often raft checks
+	// for a snapshot and how many log entries it needs to take one. Zero
+	// keeps the raft default.
+	SnapshotInterval time.Duration `mapstructure:"raft-snapshot-interval"`
+
+	SnapshotThreshold uint64 `mapstructure:"raft-snapshot-threshold"`
+
+	// RaftBarrierTimeout bounds how long a new leader waits to enqueue the
+	// barrier that applies the log of earlier terms before it serves.
+	RaftBarrierTimeout time.Duration `mapstructure:"raft-barrier-timeout"`
+
+	// RaftPromotionLag makes new servers join raft as non-voters. The leader
+	// promotes such a learner to voter on a refresh once its log is at most
+	// RaftPromotionLag entries behind the leader's, so a server still
+	// catching up never counts towards quorum. Zero adds voters right away.
+	RaftPromotionLag uint64 `mapstructure:"raft-promotion-lag"`
+
+	// RaftNoSync stops the raft log store from fsyncing every append. Writes
+	// become much faster, but entries acknowledged in the last moments before
+	// a machine crash or power loss may be lost from this node's log. With a
+	// majority of nodes on other machines they survive on the others; if all
+	// of them fail at once they are gone. Off by default.
+	RaftNoSync bool `mapstructure:"raft-no-sync"`
+
 	DevMode bool
 
-	RefreshInterval time.Duration
+	// RefreshInterval is how often the leader reconciles serf members with
+	// raft. It can be changed with a reload.
+	RefreshInterval time.Duration `mapstructure:"refresh-interval"`
+
+	// ExpiryInterval is how often the leader sweeps pairs whose TTL passed.
+	ExpiryInterval time.Duration `mapstructure:"expiry-interval"`
+
+	// AntiEntropyInterval is how often the leader checks that the store of
+	// every peer matches its own, 0 disables the check.
+	AntiEntropyInterval time.Duration `mapstructure:"anti-entropy-interval"`
+
+	// SerfReconnectTimeout is how long serf keeps trying to reconnect to a
+	// failed member before reaping it, SerfTombstoneTimeout how long a member
+	// that left is remembered.
+	SerfReconnectTimeout string        `mapstructure:"serf-reconnect-timeout"`
+	SerfTombstoneTimeout time.Duration `mapstructure:"serf-tombstone-timeout"`
+
+	// The serf coalesce and quiescent periods batch member and user events
+	// before they reach the agent.
+	SerfCoalescePeriod      time.Duration `mapstructure:"serf-coalesce-period"`
+	SerfQuiescentPeriod     time.Duration `mapstructure:"serf-quiescent-period"`
+	SerfUserCoalescePeriod  time.Duration `mapstructure:"serf-user-coalesce-period"`
+	SerfUserQuiescentPeriod time.Duration `mapstructure:"serf-user-quiescent-period"`
+
+	// StopTimeout bounds the whole graceful stop: leadership transfer, serf
+	// leave and raft shutdown.
+	StopTimeout time.Duration `mapstructure:"stop-timeout"`
+
+	// CleanupDeadServers lets the leader remove servers from raft once they
+	// were failed in serf for longer than DeadServerTimeout.
+	CleanupDeadServers bool `mapstructure:"cleanup-dead-servers"`
 
-	SerfReconnectTimeout string `mapstructure:"serf-reconnect-timeout"`
+	DeadServerTimeout time.Duration `mapstructure:"dead-server-timeout"`
+
+	// MaxKeySize and MaxValueSize bound the pairs accepted for writing, in
+	// bytes. Zero disables the limit.
+	MaxKeySize int `mapstructure:"max-key-size"`
+
+	MaxValueSize int `mapstructure:"max-value-size"`
+
+	// GRPCMaxRecvMsgSize and GRPCMaxSendMsgSize bound the messages of the
+	// gRPC server and client in bytes, a write of the largest pair has to
+	// fit in them.
+	GRPCMaxRecvMsgSize int `mapstructure:"grpc-max-recv-msg-size"`
+
+	GRPCMaxSendMsgSize int `mapstructure:"grpc-max-send-msg-size"`
+
+	// GRPCKeepaliveTime is how long a connection stays idle before it is
+	// pinged, the peer is dropped when the ping is not answered within
+	// GRPCKeepaliveTimeout. The server refuses clients pinging more often
+	// than GRPCKeepaliveMinTime.
+	GRPCKeepaliveTime time.Duration `mapstructure:"grpc-keepalive-time"`
+
+	GRPCKeepaliveTimeout time.Duration `mapstructure:"grpc-keepalive-timeout"`
+
+	GRPCKeepaliveMinTime time.Duration `mapstructure:"grpc-keepalive-min-time"`
+
+	// GRPCDrainTimeout is how long a stopping node waits for in-flight gRPC
+	// calls before it closes the remaining connections. It is bounded by
+	// StopTimeout.
+	GRPCDrainTimeout time.Duration `mapstructure:"grpc-drain-timeout"`
+
+	// GRPCCompression makes the client gzip its calls, the server answers
+	// compressed calls in kind. Raft traffic is never compressed.
+	GRPCCompression bool `mapstructure:"grpc-compression"`
 
 	EnablePrometheus bool `mapstructure:"enable-prometheus"`
 
+	// TracingEndpoint is the URL of an OTLP collector spans are exported to
+	// over gRPC, http:// for plaintext and https:// for TLS. Exporting needs
+	// a binary built with the tracing_otlp tag.
+	TracingEndpoint string `mapstructure:"tracing-endpoint"`
+
+	// EnableReflection registers gRPC server reflection for tools like
+	// grpcurl. It exposes the API schema, so it is off by default.
+	EnableReflection bool `mapstructure:"enable-reflection"`
+
+	// CertFile and KeyFile enable TLS on the gRPC server and client. With
+	// CAFile set as well, peers must present a certificate signed by that CA.
+	CertFile string `mapstructure:"cert-file"`
+
+	KeyFile string `mapstructure:"key-file"`
+
+	CAFile string `mapstructure:"ca-file"`
+
+	// RaftTLS makes outgoing raft connections use TLS. Incoming TLS is
+	// accepted whenever a certificate is configured, so clusters can enable
+	// it node by node and finally set RaftTLSStrict to refuse plaintext.
+	RaftTLS bool `mapstructure:"raft-tls"`
+
+	RaftTLSStrict bool `mapstructure:"raft-tls-strict"`
+
+	// ACLTokens are the bearer tokens accepted by the gRPC server. Auth is
+	// disabled while the list is empty. ACLToken is presented to peers and
+	// defaults to the first accepted token.
+	ACLTokens []string `mapstructure:"acl-tokens"`
+
+	ACLToken string `mapstructure:"acl-token"`
+
+	// ACLAnonymousReads lets read-only RPCs through without a token.
+	ACLAnonymousReads bool `mapstructure:"acl-anonymous-reads"`
+
+	// ACLNamespaceTokens are namespace=token entries. A namespace token
+	// only reaches the keys of its namespace, see namespace.go.
+	ACLNamespaceTokens []string `mapstructure:"acl-namespace-tokens"`
+
+	// RateLimitReads and RateLimitWrites are the gRPC calls per second a
+	// client, known by its token or else its IP, may make, with bursts of up
+	// to the matching burst size. Zero disables the limit. Reads are the
+	// calls anonymous reads allow, every other call counts as a write.
+	RateLimitReads float64 `mapstructure:"rate-limit-reads"`
+
+	RateLimitReadsBurst int `mapstructure:"rate-limit-reads-burst"`
+
+	RateLimitWrites float64 `mapstructure:"rate-limit-writes"`
+
+	RateLimitWritesBurst int `mapstructure:"rate-limit-writes-burst"`
+
+	// ApplyQueueDepth bounds the commands the leader has handed to raft and
+	// not seen committed yet. Writes beyond it fail at once with
+	// ResourceExhausted instead of queueing up. Zero disables the bound.
+	ApplyQueueDepth int `mapstructure:"apply-queue-depth"`
+
 	UI bool
 }
 
 const (
-	DefaultBindPort      int           = 8946
-	DefaultRPCPort       int           = 6868
-	DefaultRetryInterval time.Duration = 15 * time.Second
+	DefaultBindPort         int           = 8946
+	DefaultRPCPort          int           = 6868
+	DefaultRaftPort         int           = 6869
+	DefaultRPCMatchTimeout  time.Duration = 10 * time.Second
+	DefaultRetryInterval    time.Duration = 15 * time.Second
+	DefaultRetryMaxInterval time.Duration = 5 * time.Minute
+	DefaultMaxKeySize       int           = 1024
+	DefaultMaxValueSize     int           = 512 * 1024
+	DefaultSnapshotRetain   int           = 3
+	DefaultDatacenter       string        = "dc1"
+
+	DefaultRaftBarrierTimeout time.Duration = 2 * time.Minute
+	DefaultApplyQueueDepth    int           = 4096
+
+	// The gRPC defaults.
+	DefaultGRPCMaxRecvMsgSize   int           = 4 * 1024 * 1024
+	DefaultGRPCMaxSendMsgSize   int           = math.MaxInt32
+	DefaultGRPCKeepaliveTime    time.Duration = 2 * time.Hour
+	DefaultGRPCKeepaliveTimeout time.Duration = 20 * time.Second
+	DefaultGRPCKeepaliveMinTime time.Duration = 5 * time.Minute
+	DefaultGRPCDrainTimeout     time.Duration = 10 * time.Second
 )
 
 var ErrResolvingHost = errors.New("error resolving hostname")
@@ -74,18 +325,50 @@ func DefaultConfig() *Config {
 	}
 
 	return &Config{
-		NodeName: hostname,
+		NodeName:   hostname,
+		Datacenter: DefaultDatacenter,
 		BindAddr: fmt.Sprintf(
 			"{{ GetPrivateIP }}:%d", DefaultBindPort,
 		),
-		HTTPAddr:             ":8080",
-		Profile:              "lan",
-		LogLevel:             "info",
-		RPCPort:              DefaultRPCPort,
-		DataDir:              "taskvault.data",
-		RefreshInterval:      10 * time.Second,
-		SerfReconnectTimeout: "24h",
-		UI:                   true,
+		HTTPAddr:                ":8080",
+		EnableHTTP:              true,
+		CORSAllowedOrigins:      []string{"*"},
+		Profile:                 "lan",
+		LogLevel:                "info",
+		LogFormat:               LogFormatConsole,
+		RPCPort:                 DefaultRPCPort,
+		RaftPort:                DefaultRaftPort,
+		RPCMatchTimeout:         DefaultRPCMatchTimeout,
+		DataDir:                 "taskvault.data",
+		StoreBackend:            StoreBackendMemory,
+		RaftMultiplier:          1,
+		SnapshotRetain:          DefaultSnapshotRetain,
+		RefreshInterval:         10 * time.Second,
+		ExpiryInterval:          5 * time.Second,
+		RetryJoinInterval:       DefaultRetryInterval,
+		RetryJoinMaxInterval:    DefaultRetryMaxInterval,
+		RPCRetryMax:             DefaultRPCRetryMax,
+		RPCRetryBackoff:         DefaultRPCRetryBackoff,
+		RaftBarrierTimeout:      DefaultRaftBarrierTimeout,
+		ApplyQueueDepth:         DefaultApplyQueueDepth,
+		SerfReconnectTimeout:    "24h",
+		SerfTombstoneTimeout:    24 * time.Hour,
+		SerfCoalescePeriod:      3 * time.Second,
+		SerfQuiescentPeriod:     time.Second,
+		SerfUserCoalescePeriod:  3 * time.Second,
+		SerfUserQuiescentPeriod: time.Second,
+		StopTimeout:             30 * time.Second,
+		DeadServerTimeout:       5 * time.Minute,
+		MaxKeySize:              DefaultMaxKeySize,
+		MaxValueSize:            DefaultMaxValueSize,
+		GRPCMaxRecvMsgSize:      DefaultGRPCMaxRecvMsgSize,
+		GRPCMaxSendMsgSize:      DefaultGRPCMaxSendMsgSize,
+		GRPCKeepaliveTime:       DefaultGRPCKeepaliveTime,
+		GRPCKeepaliveTimeout:    DefaultGRPCKeepaliveTimeout,
+		GRPCKeepaliveMinTime:    DefaultGRPCKeepaliveMinTime,
+		GRPCDrainTimeout:        DefaultGRPCDrainTimeout,
+		EnablePrometheus:        true,
+		UI:                      true,
 	}
 }
 
@@ -108,7 +391,27 @@ func ConfigFlagSet() *flag.FlagSet {
 	)
 	cmdFlags.String(
 		"http-addr", c.HTTPAddr,
-		``,
+		"Address the HTTP API and UI listen on",
+	)
+	cmdFlags.Bool(
+		"enable-http", c.EnableHTTP,
+		"Serve the HTTP API and UI, disable for a gRPC only node",
+	)
+	cmdFlags.String(
+		"health-addr", "",
+		"Address serving only /health and /metrics, empty disables it",
+	)
+	cmdFlags.StringSlice(
+		"cors-allowed-origins", c.CORSAllowedOrigins,
+		"Origins allowed to call the HTTP API from a browser, * allows any",
+	)
+	cmdFlags.String(
+		"datacenter", c.Datacenter,
+		"Datacenter this node runs in",
+	)
+	cmdFlags.StringToString(
+		"tags", nil,
+		"Custom serf tags for this node, as key=value pairs",
 	)
 	cmdFlags.String(
 		"profile", c.Profile,
@@ -120,24 +423,48 @@ func ConfigFlagSet() *flag.FlagSet {
 	)
 	cmdFlags.StringSlice(
 		"retry-join", []string{},
-		``,
+		`Address to join with retries, or a discovery string such as "provider=dns name=_syncra._tcp.example.com"`,
 	)
 	cmdFlags.Int(
 		"retry-max", 0,
-		``,
+		"Number of join attempts before giving up, 0 retries forever",
 	)
 	cmdFlags.String(
 		"retry-interval", DefaultRetryInterval.String(),
-		"",
+		"Wait after the first failed join attempt, it doubles after every failure",
+	)
+	cmdFlags.String(
+		"retry-max-interval", DefaultRetryMaxInterval.String(),
+		"Upper bound of the wait between join attempts",
+	)
+	cmdFlags.Int(
+		"rpc-retry-max", c.RPCRetryMax,
+		"How many times a write is retried when the leader changes",
+	)
+	cmdFlags.String(
+		"rpc-retry-backoff", c.RPCRetryBackoff.String(),
+		"Initial wait between write retries, doubled on each attempt",
 	)
 	cmdFlags.String(
 		"encrypt", "",
 		"16 bytes value",
 	)
+	cmdFlags.StringSlice(
+		"encrypt-keys", []string{},
+		"Secondary gossip encryption keys still accepted during a key rotation",
+	)
 	cmdFlags.String(
 		"log-level", c.LogLevel,
 		"Log level (debug|info|warn|error|fatal|panic)",
 	)
+	cmdFlags.String(
+		"log-format", c.LogFormat,
+		"Log format (console|json)",
+	)
+	cmdFlags.String(
+		"log-file", "",
+		"File to write logs to instead of stdout",
+	)
 	cmdFlags.Int(
 		"rpc-port", c.RPCPort,
 		``,
@@ -146,6 +473,22 @@ func ConfigFlagSet() *flag.FlagSet {
 		"advertise-rpc-port", 0,
 		"Use the value of rpc-port by default",
 	)
+	cmdFlags.Bool(
+		"separate-listeners", false,
+		"Serve raft on raft-port instead of sharing rpc-port with gRPC",
+	)
+	cmdFlags.Int(
+		"raft-port", c.RaftPort,
+		"Port raft listens on with separate-listeners",
+	)
+	cmdFlags.Int(
+		"advertise-raft-port", 0,
+		"Use the value of raft-port by default",
+	)
+	cmdFlags.Duration(
+		"rpc-match-timeout", c.RPCMatchTimeout,
+		"Time a new RPC connection has to identify itself as gRPC or raft before it is dropped, 0 disables it",
+	)
 	cmdFlags.Int(
 		"bootstrap-expect", 0,
 		``,
@@ -154,26 +497,637 @@ func ConfigFlagSet() *flag.FlagSet {
 		"data-dir", c.DataDir,
 		``,
 	)
+	cmdFlags.String(
+		"raft-dir", "",
+		"Directory of the raft log, raft under data-dir by default",
+	)
+	cmdFlags.String(
+		"store-dir", "",
+		"Directory of the bolt store, store under data-dir by default",
+	)
+	cmdFlags.String(
+		"snapshot-dir", "",
+		"Directory whose snapshots subdirectory holds the raft snapshots, data-dir by default",
+	)
+	cmdFlags.String(
+		"store-backend", c.StoreBackend,
+		"Where pairs are kept: memory or bolt",
+	)
+	cmdFlags.Int(
+		"raft-multiplier", c.RaftMultiplier,
+		"Scale raft timeouts for slow networks, between 1 and 10",
+	)
+	cmdFlags.String(
+		"raft-heartbeat-timeout", c.HeartbeatTimeout.String(),
+		"Raft heartbeat timeout, overrides the scaled default",
+	)
+	cmdFlags.String(
+		"raft-election-timeout", c.ElectionTimeout.String(),
+		"Raft election timeout, overrides the scaled default",
+	)
+	cmdFlags.String(
+		"raft-commit-timeout", c.CommitTimeout.String(),
+		"Raft commit timeout, overrides the default",
+	)
+	cmdFlags.Int(
+		"raft-snapshot-retain", c.SnapshotRetain,
+		"Number of raft snapshots kept on disk",
+	)
+	cmdFlags.String(
+		"raft-snapshot-interval", c.SnapshotInterval.String(),
+		"How often raft checks whether to snapshot, overrides the default",
+	)
+	cmdFlags.Uint64(
+		"raft-snapshot-threshold", c.SnapshotThreshold,
+		"Log entries written since the last snapshot before raft takes a new one, overrides the default",
+	)
 	cmdFlags.String(
 		"serf-reconnect-timeout", c.SerfReconnectTimeout,
-		``,
+		"How long serf tries to reconnect to a failed member before reaping it",
+	)
+	cmdFlags.String(
+		"serf-tombstone-timeout", c.SerfTombstoneTimeout.String(),
+		"How long serf remembers a member that left the cluster",
+	)
+	cmdFlags.String(
+		"serf-coalesce-period", c.SerfCoalescePeriod.String(),
+		"How long serf coalesces member events before delivering them",
+	)
+	cmdFlags.String(
+		"serf-quiescent-period", c.SerfQuiescentPeriod.String(),
+		"Quiet time after which coalesced member events are delivered early",
+	)
+	cmdFlags.String(
+		"serf-user-coalesce-period", c.SerfUserCoalescePeriod.String(),
+		"How long serf coalesces user events before delivering them",
+	)
+	cmdFlags.String(
+		"serf-user-quiescent-period", c.SerfUserQuiescentPeriod.String(),
+		"Quiet time after which coalesced user events are delivered early",
+	)
+	cmdFlags.String(
+		"stop-timeout", c.StopTimeout.String(),
+		"Time budget for a graceful stop",
+	)
+	cmdFlags.Bool(
+		"cleanup-dead-servers", false,
+		"Remove servers that stay failed longer than dead-server-timeout from raft",
+	)
+	cmdFlags.String(
+		"dead-server-timeout", c.DeadServerTimeout.String(),
+		"How long a server must be failed before it is removed",
+	)
+	cmdFlags.String(
+		"refresh-interval", c.RefreshInterval.String(),
+		"How often the leader reconciles members with raft",
+	)
+	cmdFlags.String(
+		"expiry-interval", c.ExpiryInterval.String(),
+		"How often the leader removes expired keys",
+	)
+	cmdFlags.Duration(
+		"anti-entropy-interval", c.AntiEntropyInterval,
+		"How often the leader compares the store checksums of all servers, 0 disables it",
+	)
+	cmdFlags.String(
+		"cert-file", "",
+		"PEM certificate used for gRPC TLS",
+	)
+	cmdFlags.String(
+		"key-file", "",
+		"PEM private key matching cert-file",
+	)
+	cmdFlags.String(
+		"ca-file", "",
+		"PEM CA bundle, enables mutual TLS when set",
+	)
+	cmdFlags.Bool(
+		"raft-tls", false,
+		"Dial raft peers over TLS",
+	)
+	cmdFlags.Duration(
+		"raft-barrier-timeout", c.RaftBarrierTimeout,
+		"Time a new leader waits to enqueue its first barrier",
+	)
+	cmdFlags.Uint64(
+		"raft-promotion-lag", c.RaftPromotionLag,
+		"Join new servers as non-voters and promote them once their log is this close to the leader's, 0 adds voters at once",
+	)
+	cmdFlags.Bool(
+		"raft-no-sync", false,
+		"Do not fsync the raft log on every append, faster but recent writes may be lost on a crash",
+	)
+	cmdFlags.Bool(
+		"raft-tls-strict", false,
+		"Reject raft peers that do not use TLS",
+	)
+	cmdFlags.StringSlice(
+		"acl-tokens", []string{},
+		"Bearer tokens accepted by the RPC server",
+	)
+	cmdFlags.String(
+		"acl-token", "",
+		"Bearer token sent to other nodes, defaults to the first acl-tokens entry",
+	)
+	cmdFlags.Bool(
+		"acl-anonymous-reads", false,
+		"Allow read RPCs without a token",
+	)
+	cmdFlags.StringSlice(
+		"acl-namespace-tokens", []string{},
+		"namespace=token entries, a namespace token only reaches the keys of its namespace",
+	)
+	cmdFlags.Float64(
+		"rate-limit-reads", 0,
+		"Read RPCs per second allowed per client, 0 for no limit",
+	)
+	cmdFlags.Int(
+		"rate-limit-reads-burst", 0,
+		"Read RPCs a client may make at once",
+	)
+	cmdFlags.Float64(
+		"rate-limit-writes", 0,
+		"Write RPCs per second allowed per client, 0 for no limit",
+	)
+	cmdFlags.Int(
+		"rate-limit-writes-burst", 0,
+		"Write RPCs a client may make at once",
+	)
+	cmdFlags.Int(
+		"apply-queue-depth", c.ApplyQueueDepth,
+		"Writes the leader has in flight through raft before it rejects new ones, 0 for no limit",
 	)
 	cmdFlags.Bool(
 		"bootstrap", false,
 		"Bootstrap the cluster.",
 	)
+	cmdFlags.Bool(
+		"non-voter", false,
+		"Join raft as a non-voting read replica",
+	)
+	cmdFlags.Bool(
+		"read-only", false,
+		"Run as a standby replica that joins raft as a non-voter and rejects all writes",
+	)
 	cmdFlags.Bool(
 		"ui", true,
 		"",
 	)
 
 	cmdFlags.Bool(
-		"enable-prometheus", true, "",
+		"enable-prometheus", c.EnablePrometheus,
+		"Serve metrics for Prometheus on /metrics, metrics are discarded otherwise",
+	)
+	cmdFlags.String(
+		"tracing-endpoint", "",
+		"OTLP gRPC collector URL to export traces to, e.g. http://localhost:4317",
+	)
+	cmdFlags.Int(
+		"max-key-size", c.MaxKeySize,
+		"Largest key accepted in bytes, 0 disables the limit",
+	)
+	cmdFlags.Int(
+		"max-value-size", c.MaxValueSize,
+		"Largest value accepted in bytes, 0 disables the limit",
+	)
+	cmdFlags.Int(
+		"grpc-max-recv-msg-size", c.GRPCMaxRecvMsgSize,
+		"Largest gRPC message received in bytes",
+	)
+	cmdFlags.Int(
+		"grpc-max-send-msg-size", c.GRPCMaxSendMsgSize,
+		"Largest gRPC message sent in bytes",
+	)
+	cmdFlags.Duration(
+		"grpc-keepalive-time", c.GRPCKeepaliveTime,
+		"Idle time after which a gRPC connection is pinged",
+	)
+	cmdFlags.Duration(
+		"grpc-keepalive-timeout", c.GRPCKeepaliveTimeout,
+		"Time to wait for a keepalive ping to be answered before closing the connection",
+	)
+	cmdFlags.Duration(
+		"grpc-keepalive-min-time", c.GRPCKeepaliveMinTime,
+		"Shortest keepalive interval the gRPC server allows clients",
+	)
+	cmdFlags.Duration(
+		"grpc-drain-timeout", c.GRPCDrainTimeout,
+		"Time a stopping node waits for in-flight gRPC calls to finish",
+	)
+	cmdFlags.Bool(
+		"grpc-compression", false,
+		"Compress gRPC calls made by this node with gzip",
+	)
+	cmdFlags.Bool(
+		"enable-reflection", false,
+		"Register gRPC server reflection",
 	)
 
 	return cmdFlags
 }
 
+// Validate checks the configuration before the agent starts and reports
+// every problem found at once.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.NodeName == "" {
+		errs = append(errs, errors.New("node-name must not be empty"))
+	}
+	if c.Datacenter == "" {
+		errs = append(errs, errors.New("datacenter must not be empty"))
+	}
+
+	switch c.Profile {
+	case "lan", "wan", "local":
+	default:
+		errs = append(errs, fmt.Errorf("unknown profile %q, use lan, wan or local", c.Profile))
+	}
+
+	if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log-level %q", c.LogLevel))
+	}
+	if c.RateLimitReads < 0 || c.RateLimitWrites < 0 || c.RateLimitReadsBurst < 0 || c.RateLimitWritesBurst < 0 {
+		errs = append(errs, errors.New("rate-limit settings must not be negative"))
+	}
+	if c.ApplyQueueDepth < 0 {
+		errs = append(errs, errors.New("apply-queue-depth must not be negative"))
+	}
+	switch c.LogFormat {
+	case LogFormatConsole, LogFormatJSON:
+	default:
+		errs = append(errs, fmt.Errorf("unknown log-format %q, use console or json", c.LogFormat))
+	}
+	if c.TracingEndpoint != "" {
+		if err := validateTracingEndpoint(c.TracingEndpoint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(c.ACLNamespaceTokens) > 0 {
+		if len(c.ACLTokens) == 0 {
+			errs = append(errs, errors.New("acl-namespace-tokens require acl-tokens"))
+		}
+		if c.ACLAnonymousReads {
+			errs = append(errs, errors.New("acl-anonymous-reads would expose every namespace"))
+		}
+	}
+	for _, entry := range c.ACLNamespaceTokens {
+		if _, _, err := parseNamespaceToken(entry); err != nil {
+			errs = append(errs, fmt.Errorf("acl-namespace-tokens: %w", err))
+		}
+	}
+
+	if c.Bootstrap && len(c.RetryJoin) > 0 {
+		errs = append(errs, errors.New("bootstrap and retry-join are mutually exclusive"))
+	}
+	if c.RetryJoinMaxAttempts < 0 {
+		errs = append(errs, errors.New("retry-max must not be negative"))
+	}
+	if c.RetryJoinInterval <= 0 || c.RetryJoinMaxInterval < c.RetryJoinInterval {
+		errs = append(errs, errors.New("retry-interval must be positive and at most retry-max-interval"))
+	}
+	for _, addr := range c.RetryJoin {
+		if !strings.Contains(addr, "provider=") {
+			continue
+		}
+		if _, _, err := discoverProvider(addr); err != nil {
+			errs = append(errs, fmt.Errorf("retry-join: %w", err))
+		}
+	}
+	if c.Bootstrap && c.BootstrapExpect > 1 {
+		errs = append(errs, errors.New("bootstrap and bootstrap-expect are mutually exclusive"))
+	}
+	if c.BootstrapExpect < 0 {
+		errs = append(errs, errors.New("bootstrap-expect must not be negative"))
+	}
+	if c.nonVoter() && (c.Bootstrap || c.DevMode) {
+		errs = append(errs, errors.New("a non-voter can not bootstrap the cluster"))
+	}
+
+	if c.RaftMultiplier < 1 || c.RaftMultiplier > 10 {
+		errs = append(errs, fmt.Errorf("raft-multiplier must be between 1 and 10, got %d", c.RaftMultiplier))
+	}
+	if c.SnapshotRetain < 1 {
+		errs = append(errs, fmt.Errorf("raft-snapshot-retain must be at least 1, got %d", c.SnapshotRetain))
+	}
+	if c.SnapshotInterval < 0 {
+		errs = append(errs, errors.New("raft-snapshot-interval must not be negative"))
+	}
+
+	if c.RaftBarrierTimeout <= 0 {
+		errs = append(errs, errors.New("raft-barrier-timeout must be positive"))
+	}
+
+	if c.AntiEntropyInterval < 0 {
+		errs = append(errs, errors.New("anti-entropy-interval can not be negative"))
+	}
+
+	if c.HeartbeatTimeout < 0 || c.ElectionTimeout < 0 || c.CommitTimeout < 0 {
+		errs = append(errs, errors.New("raft timeouts must not be negative"))
+	} else if c.RaftMultiplier > 0 {
+		rc := raft.DefaultConfig()
+		c.tuneRaft(rc)
+		if rc.ElectionTimeout < rc.HeartbeatTimeout {
+			errs = append(errs, fmt.Errorf(
+				"raft election timeout %s is shorter than the heartbeat timeout %s",
+				rc.ElectionTimeout, rc.HeartbeatTimeout,
+			))
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(c.HTTPAddr); c.EnableHTTP && err != nil {
+		errs = append(errs, fmt.Errorf("invalid http-addr %q: %w", c.HTTPAddr, err))
+	}
+	if c.HealthAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HealthAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid health-addr %q: %w", c.HealthAddr, err))
+		} else if c.EnableHTTP && c.HealthAddr == c.HTTPAddr {
+			errs = append(errs, fmt.Errorf("health-addr %q is also the http-addr", c.HealthAddr))
+		}
+	}
+	if err := checkCORSOrigins(c.CORSAllowedOrigins); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch c.StoreBackend {
+	case StoreBackendMemory:
+	case StoreBackendBolt:
+		if c.DevMode {
+			errs = append(errs, errors.New("store-backend bolt needs a data-dir and can not be used in dev mode"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown store-backend %q, use memory or bolt", c.StoreBackend))
+	}
+
+	if c.MaxKeySize < 0 || c.MaxValueSize < 0 {
+		errs = append(errs, errors.New("max-key-size and max-value-size must not be negative"))
+	}
+
+	if err := c.checkGRPC(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.checkAdvertiseAddr(); err != nil {
+		errs = append(errs, err)
+	}
+	for k := range c.Tags {
+		if err := checkTagKey(k); err != nil {
+			errs = append(errs, fmt.Errorf("invalid tags: %w", err))
+		}
+	}
+
+	if c.RPCPort <= 0 || c.RPCPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid rpc-port %d", c.RPCPort))
+	}
+	if c.AdvertiseRPCPort < 0 || c.AdvertiseRPCPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid advertise-rpc-port %d", c.AdvertiseRPCPort))
+	}
+	if c.RPCMatchTimeout < 0 {
+		errs = append(errs, errors.New("rpc-match-timeout can not be negative"))
+	}
+	if c.SeparateListeners {
+		if c.RaftPort <= 0 || c.RaftPort > 65535 {
+			errs = append(errs, fmt.Errorf("invalid raft-port %d", c.RaftPort))
+		} else if c.RaftPort == c.RPCPort {
+			errs = append(errs, fmt.Errorf("raft-port %d is also the rpc-port, it needs its own with separate-listeners", c.RaftPort))
+		}
+		if c.AdvertiseRaftPort < 0 || c.AdvertiseRaftPort > 65535 {
+			errs = append(errs, fmt.Errorf("invalid advertise-raft-port %d", c.AdvertiseRaftPort))
+		}
+	}
+
+	if c.EncryptKey != "" {
+		if _, err := decodeEncryptKey(c.EncryptKey); err != nil {
+			errs = append(errs, fmt.Errorf("encrypt: %w", err))
+		}
+	} else if len(c.EncryptKeys) > 0 {
+		errs = append(errs, errors.New("encrypt-keys requires encrypt"))
+	}
+	for _, k := range c.EncryptKeys {
+		if _, err := decodeEncryptKey(k); err != nil {
+			errs = append(errs, fmt.Errorf("encrypt-keys: %w", err))
+		}
+	}
+
+	if d, err := time.ParseDuration(c.SerfReconnectTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("invalid serf-reconnect-timeout: %w", err))
+	} else if d <= 0 {
+		errs = append(errs, errors.New("serf-reconnect-timeout must be positive"))
+	}
+
+	if c.SerfTombstoneTimeout <= 0 {
+		errs = append(errs, errors.New("serf-tombstone-timeout must be positive"))
+	}
+
+	if c.SerfCoalescePeriod <= 0 || c.SerfQuiescentPeriod <= 0 ||
+		c.SerfUserCoalescePeriod <= 0 || c.SerfUserQuiescentPeriod <= 0 {
+		errs = append(errs, errors.New("serf coalesce and quiescent periods must be positive"))
+	}
+
+	if !c.DevMode {
+		paths := []dataPath{c.raftPath(), c.snapshotPath()}
+		if c.StoreBackend == StoreBackendBolt {
+			paths = append(paths, c.storePath())
+		}
+		for _, p := range paths {
+			if err := checkWritableDir(p.dir); err != nil {
+				errs = append(errs, p.error(err))
+			}
+		}
+	}
+
+	if err := c.checkTLS(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// tuneRaft applies RaftMultiplier and the explicit timeouts to config.
+func (c *Config) tuneRaft(config *raft.Config) {
+	multiplier := time.Duration(c.RaftMultiplier)
+	config.HeartbeatTimeout *= multiplier
+	config.ElectionTimeout *= multiplier
+	config.LeaderLeaseTimeout *= multiplier
+
+	if c.HeartbeatTimeout > 0 {
+		config.HeartbeatTimeout = c.HeartbeatTimeout
+	}
+	if c.ElectionTimeout > 0 {
+		config.ElectionTimeout = c.ElectionTimeout
+	}
+	if c.CommitTimeout > 0 {
+		config.CommitTimeout = c.CommitTimeout
+	}
+	if c.SnapshotInterval > 0 {
+		config.SnapshotInterval = c.SnapshotInterval
+	}
+	if c.SnapshotThreshold > 0 {
+		config.SnapshotThreshold = c.SnapshotThreshold
+	}
+
+	// Raft refuses a lease longer than the heartbeat timeout.
+	config.LeaderLeaseTimeout = min(config.LeaderLeaseTimeout, config.HeartbeatTimeout)
+}
+
+// checkPairSize returns ErrKeyTooLarge or ErrValueTooLarge when a pair
+// exceeds the configured limits.
+func (c *Config) checkPairSize(key, value string) error {
+	if c.MaxKeySize > 0 && len(key) > c.MaxKeySize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLarge, len(key), c.MaxKeySize)
+	}
+	if c.MaxValueSize > 0 && len(value) > c.MaxValueSize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrValueTooLarge, len(value), c.MaxValueSize)
+	}
+	return nil
+}
+
+// checkCORSOrigins rejects origins the CORS middleware would refuse at
+// startup.
+func checkCORSOrigins(origins []string) error {
+	for _, origin := range origins {
+		if origin == "*" {
+			if len(origins) > 1 {
+				return errors.New("cors-allowed-origins: * must be the only origin")
+			}
+			continue
+		}
+		if !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("cors-allowed-origins: origin %q must start with http:// or https://", origin)
+		}
+	}
+	return nil
+}
+
+// checkAdvertiseAddr rejects advertise addresses other nodes can not dial
+// back: the unspecified address, and loopback when joining remote nodes.
+// Templates are only known once resolved and are not checked.
+func (c *Config) checkAdvertiseAddr() error {
+	host := c.AdvertiseAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	if ip.IsUnspecified() {
+		return fmt.Errorf("advertise-addr %q is not routable, set the address other nodes reach this one on", c.AdvertiseAddr)
+	}
+	if ip.IsLoopback() {
+		for _, addr := range slices.Concat(c.StartJoin, c.RetryJoin) {
+			if h, _, err := net.SplitHostPort(addr); err == nil {
+				addr = h
+			}
+			if join := net.ParseIP(addr); join != nil && !join.IsLoopback() {
+				return fmt.Errorf("advertise-addr %q is a loopback address, %s can not reach it", c.AdvertiseAddr, addr)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkGRPC rejects message sizes too small for the largest pair and
+// keepalive settings the server would refuse from its own peers.
+func (c *Config) checkGRPC() error {
+	if c.GRPCMaxRecvMsgSize <= 0 || c.GRPCMaxSendMsgSize <= 0 {
+		return errors.New("grpc-max-recv-msg-size and grpc-max-send-msg-size must be positive")
+	}
+	if c.MaxValueSize > 0 {
+		pair := c.MaxKeySize + c.MaxValueSize
+		if c.GRPCMaxRecvMsgSize <= pair || c.GRPCMaxSendMsgSize <= pair {
+			return fmt.Errorf(
+				"grpc-max-recv-msg-size and grpc-max-send-msg-size must be larger than max-key-size + max-value-size (%d)", pair,
+			)
+		}
+	}
+
+	if c.GRPCKeepaliveTime <= 0 || c.GRPCKeepaliveTimeout <= 0 || c.GRPCKeepaliveMinTime < 0 {
+		return errors.New("grpc-keepalive-time and grpc-keepalive-timeout must be positive")
+	}
+	if c.GRPCDrainTimeout < 0 {
+		return errors.New("grpc-drain-timeout must not be negative")
+	}
+	// Nodes dial each other with the same settings.
+	if c.GRPCKeepaliveMinTime > c.GRPCKeepaliveTime {
+		return fmt.Errorf("grpc-keepalive-min-time %s must not exceed grpc-keepalive-time %s", c.GRPCKeepaliveMinTime, c.GRPCKeepaliveTime)
+	}
+
+	return nil
+}
+
+// checkWritableDir creates dir if needed and probes it with a temporary file.
+func checkWritableDir(dir string) error {
+	if dir == "" {
+		return errors.New("empty path")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// dataPath is a directory the agent keeps data in, flag is the setting it
+// comes from.
+type dataPath struct {
+	flag string
+	dir  string
+}
+
+func (c *Config) raftPath() dataPath {
+	if c.RaftDir != "" {
+		return dataPath{"raft-dir", c.RaftDir}
+	}
+	return dataPath{"data-dir", filepath.Join(c.DataDir, raftDirName)}
+}
+
+func (c *Config) storePath() dataPath {
+	if c.StoreDir != "" {
+		return dataPath{"store-dir", c.StoreDir}
+	}
+	return dataPath{"data-dir", filepath.Join(c.DataDir, storeDirName)}
+}
+
+// snapshotPath is the base directory of the raft file snapshot store, which
+// keeps the snapshots in a snapshots directory inside it. Older releases
+// kept them under the raft directory, a node that already has snapshots
+// there goes on using it.
+func (c *Config) snapshotPath() dataPath {
+	if c.SnapshotDir != "" {
+		return dataPath{"snapshot-dir", c.SnapshotDir}
+	}
+	legacy := c.raftPath()
+	if entries, err := os.ReadDir(filepath.Join(legacy.dir, "snapshots")); err == nil && len(entries) > 0 {
+		return legacy
+	}
+	return dataPath{"data-dir", c.DataDir}
+}
+
+// error explains why the data can not be stored under the path.
+func (p dataPath) error(err error) error {
+	switch {
+	case errors.Is(err, bolt.ErrTimeout):
+		// Bolt files are locked with flock, which the kernel releases when
+		// the holder exits: the lock is never stale, a process still runs.
+		return fmt.Errorf("%s %q is locked by another process, stop it or set %s to another path: %w", p.flag, p.dir, p.flag, err)
+	case errors.Is(err, syscall.EROFS):
+		return fmt.Errorf("%s %q is on a read-only filesystem, set %s to a writable path: %w", p.flag, p.dir, p.flag, err)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("%s %q is not writable by this user, fix its permissions or set %s to another path: %w", p.flag, p.dir, p.flag, err)
+	default:
+		return fmt.Errorf("%s %q is not usable: %w", p.flag, p.dir, err)
+	}
+}
+
 func (c *Config) normalizeAddrs() error {
 	if c.BindAddr != "" {
 		ipStr, err := ParseSingleIPTemplate(c.BindAddr)
@@ -191,15 +1145,33 @@ func (c *Config) normalizeAddrs() error {
 		c.HTTPAddr = ipStr
 	}
 
+	if c.HealthAddr != "" {
+		ipStr, err := ParseSingleIPTemplate(c.HealthAddr)
+		if err != nil {
+			return fmt.Errorf("health address resolution failed: %v", err)
+		}
+		c.HealthAddr = ipStr
+	}
+
+	// The advertised gossip port defaults to the bound one, so a node bound
+	// to 0.0.0.0:7946 advertises its detected address on port 7946 too.
+	bindHost, bindPort := c.BindAddr, DefaultBindPort
+	if h, p, err := net.SplitHostPort(c.BindAddr); err == nil {
+		bindHost = h
+		if port, err := strconv.Atoi(p); err == nil {
+			bindPort = port
+		}
+	}
+
 	addr, err := normalizeAdvertise(
-		c.AdvertiseAddr, c.BindAddr, DefaultBindPort, c.DevMode,
+		c.AdvertiseAddr, bindHost, bindPort, c.DevMode,
 	)
 	if err != nil {
 		return fmt.Errorf(
 			"failed to parse advertise address (%v, %v, %v, %v): %w",
 			c.AdvertiseAddr,
 			c.BindAddr,
-			DefaultBindPort,
+			bindPort,
 			c.DevMode,
 			err,
 		)
@@ -0,0 +1,32 @@
+package taskvault
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_DataPaths(t *testing.T) {
+	c := DefaultConfig()
+	c.DataDir = t.TempDir()
+	assert.Equal(t, filepath.Join(c.DataDir, "raft"), c.raftPath().dir)
+	assert.Equal(t, filepath.Join(c.DataDir, "store"), c.storePath().dir)
+	assert.Equal(t, c.DataDir, c.snapshotPath().dir)
+
+	// Snapshots of an older release stay where they are.
+	legacy := filepath.Join(c.DataDir, "raft", "snapshots", "2-10-1700000000000")
+	require.NoError(t, os.MkdirAll(legacy, 0o700))
+	assert.Equal(t, c.raftPath(), c.snapshotPath())
+
+	c.RaftDir = filepath.Join(t.TempDir(), "nvme")
+	c.SnapshotDir = filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(c.SnapshotDir, nil, 0o600))
+	err := c.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "snapshot-dir")
+	assert.NotContains(t, err.Error(), "raft-dir")
+	assert.DirExists(t, c.RaftDir)
+}
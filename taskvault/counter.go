@@ -0,0 +1,93 @@
+package taskvault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/danluki/taskvault/pkg/types"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// ErrNotInteger is returned when incrementing a key whose value is not a
+	// base 10 int64.
+	ErrNotInteger = errors.New("value is not an integer")
+
+	ErrIncrementOverflow = errors.New("increment overflows int64")
+)
+
+// applyIncrement adds the delta to the integer value of a key within a single
+// apply, a missing or expired key counts as zero. The rest of an existing
+// pair, its expiry, session and value metadata, is kept.
+func (d *taskvaultFSM) applyIncrement(buf []byte, index uint64, appendedAt time.Time) interface{} {
+	var cmd types.IncrementRequest
+	if err := proto.Unmarshal(buf, &cmd); err != nil {
+		return err
+	}
+
+	var current int64
+	pair := &types.Pair{Key: cmd.Key}
+	existing, err := d.store.GetPair(cmd.Key, ReadOptions{IncludeExpired: true})
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+	case err != nil:
+		return err
+	case !pairExpired(existing, appendedAt):
+		current, err = strconv.ParseInt(existing.Value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %q", ErrNotInteger, cmd.Key)
+		}
+		pair = existing
+	}
+
+	if (cmd.Delta > 0 && current > math.MaxInt64-cmd.Delta) ||
+		(cmd.Delta < 0 && current < math.MinInt64-cmd.Delta) {
+		return fmt.Errorf("%w: %q", ErrIncrementOverflow, cmd.Key)
+	}
+
+	pair.Value = strconv.FormatInt(current+cmd.Delta, 10)
+	pair.ModifyIndex = index
+	pair.ModifyTime = modifyTime(appendedAt)
+	observeValueSize(IncrementType, pair.Value)
+	if err := d.store.SetPair(pair); err != nil {
+		return err
+	}
+	d.watches.publish(putEvent(pair, index))
+
+	return pair
+}
+
+// Increment atomically adds delta to the integer stored at key and returns
+// the new value, a missing key starts at zero. It fails with ErrNotInteger
+// when the value is not an integer.
+func (a *Agent) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	pair, err := a.increment(ctx, key, delta)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(pair.Value, 10, 64)
+}
+
+func (a *Agent) increment(ctx context.Context, key string, delta int64) (*types.Pair, error) {
+	if err := a.config.checkPairSize(key, ""); err != nil {
+		return nil, err
+	}
+
+	resp, err := a.apply(ctx, IncrementType, &types.IncrementRequest{Key: key, Delta: delta})
+	if err != nil {
+		return nil, err
+	}
+
+	switch r := resp.(type) {
+	case error:
+		return nil, r
+	case *types.Pair:
+		return r, nil
+	default:
+		return nil, fmt.Errorf("agent: unexpected increment response: %v", resp)
+	}
+}
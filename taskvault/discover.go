@@ -0,0 +1,129 @@
+package taskvault
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DiscoverProvider finds the addresses of agents to join. It has the method
+// set of the go-discover providers, which register as they are.
+type DiscoverProvider interface {
+	Addrs(args map[string]string, l *log.Logger) ([]string, error)
+	Help() string
+}
+
+// Only the dns and k8s providers are built by default, the cloud providers
+// pull in their SDKs and are built with the discover_<name> tags, or all of
+// them with discover_all.
+var (
+	discoverLock      sync.RWMutex
+	discoverProviders = map[string]DiscoverProvider{
+		"dns": &dnsProvider{},
+	}
+)
+
+// RegisterDiscoverProvider makes p usable in retry-join as provider=name,
+// replacing the provider registered under that name.
+func RegisterDiscoverProvider(name string, p DiscoverProvider) {
+	discoverLock.Lock()
+	defer discoverLock.Unlock()
+
+	discoverProviders[name] = p
+}
+
+// DiscoverProviderNames returns the names of the registered providers.
+func DiscoverProviderNames() []string {
+	discoverLock.RLock()
+	defer discoverLock.RUnlock()
+
+	names := make([]string, 0, len(discoverProviders))
+	for name := range discoverProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func discoverProvider(cfg string) (DiscoverProvider, map[string]string, error) {
+	args, err := parseDiscoverConfig(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discover: %w", err)
+	}
+	name := args["provider"]
+	if name == "" {
+		return nil, nil, errors.New("discover: no provider")
+	}
+
+	discoverLock.RLock()
+	p, ok := discoverProviders[name]
+	discoverLock.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf(
+			"discover: unknown provider %q, the agent is built with %s",
+			name, strings.Join(DiscoverProviderNames(), ", "),
+		)
+	}
+	return p, args, nil
+}
+
+// discoverAddrs resolves a "provider=<name> key=value ..." string to the
+// addresses of agents to join.
+func discoverAddrs(cfg string, l *log.Logger) ([]string, error) {
+	p, args, err := discoverProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := p.(interface{ SetUserAgent(string) }); ok {
+		p.SetUserAgent(UserAgent())
+	}
+	return p.Addrs(args, l)
+}
+
+// parseDiscoverConfig splits space separated key=value pairs. Values holding
+// spaces or quotes are double quoted, with Go escapes.
+func parseDiscoverConfig(cfg string) (map[string]string, error) {
+	args := make(map[string]string)
+	s := strings.TrimSpace(cfg)
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || strings.ContainsAny(s[:eq], " \t") {
+			return nil, fmt.Errorf("expected key=value at %q", s)
+		}
+		key := s[:eq]
+		if _, ok := args[key]; ok {
+			return nil, fmt.Errorf("%s: duplicate key", key)
+		}
+		s = s[eq+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			quoted, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: unterminated quoted value", key)
+			}
+			value, _ = strconv.Unquote(quoted)
+			s = s[len(quoted):]
+			if s != "" && s[0] != ' ' && s[0] != '\t' {
+				return nil, fmt.Errorf("%s: expected a space after the quoted value", key)
+			}
+		} else {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+		}
+		if value == "" {
+			return nil, fmt.Errorf("%s: missing value", key)
+		}
+
+		args[key] = value
+		s = strings.TrimLeft(s, " \t")
+	}
+	return args, nil
+}
@@ -0,0 +1,9 @@
+//go:build discover_aliyun || discover_all
+
+package taskvault
+
+import discoveraliyun "github.com/hashicorp/go-discover/provider/aliyun"
+
+func init() {
+	RegisterDiscoverProvider("aliyun", &discoveraliyun.Provider{})
+}
@@ -0,0 +1,9 @@
+//go:build discover_aws || discover_all
+
+package taskvault
+
+import discoveraws "github.com/hashicorp/go-discover/provider/aws"
+
+func init() {
+	RegisterDiscoverProvider("aws", &discoveraws.Provider{})
+}
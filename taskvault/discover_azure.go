@@ -0,0 +1,9 @@
+//go:build discover_azure || discover_all
+
+package taskvault
+
+import discoverazure "github.com/hashicorp/go-discover/provider/azure"
+
+func init() {
+	RegisterDiscoverProvider("azure", &discoverazure.Provider{})
+}
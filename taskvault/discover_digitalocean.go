@@ -0,0 +1,9 @@
+//go:build discover_digitalocean || discover_all
+
+package taskvault
+
+import discoverdigitalocean "github.com/hashicorp/go-discover/provider/digitalocean"
+
+func init() {
+	RegisterDiscoverProvider("digitalocean", &discoverdigitalocean.Provider{})
+}
@@ -0,0 +1,94 @@
+package taskvault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+)
+
+// dnsResolver is the part of *net.Resolver the dns provider uses.
+type dnsResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// dnsProvider is a DiscoverProvider that finds servers through DNS, for
+// instance behind a Kubernetes headless service. It runs on every join
+// attempt, so records that change between retries are picked up.
+type dnsProvider struct {
+	resolver dnsResolver
+}
+
+func (p *dnsProvider) Help() string {
+	return `DNS:
+
+    provider:  "dns"
+    name:      The name to resolve, e.g. "_syncra._tcp.example.com".
+    port:      The port to join on when name has no SRV records (defaults
+               to 8946).
+
+    SRV records are looked up first, every target is resolved to its
+    addresses and joined on the port of its record. Without SRV records
+    the A and AAAA records of name are joined on port.
+`
+}
+
+func (p *dnsProvider) Addrs(args map[string]string, l *log.Logger) ([]string, error) {
+	name := args["name"]
+	if name == "" {
+		return nil, errors.New("discover-dns: name is required")
+	}
+
+	port := DefaultBindPort
+	if s, ok := args["port"]; ok {
+		var err error
+		if port, err = strconv.Atoi(s); err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("discover-dns: invalid port %q", s)
+		}
+	}
+
+	resolver := p.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx := context.Background()
+
+	_, srvs, err := resolver.LookupSRV(ctx, "", "", name)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		l.Printf("[DEBUG] discover-dns: SRV lookup of %s failed: %v", name, err)
+	}
+	if len(srvs) == 0 {
+		hosts, err := resolver.LookupHost(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("discover-dns: %w", err)
+		}
+		return joinHostsPort(hosts, port), nil
+	}
+
+	var addrs []string
+	for _, srv := range srvs {
+		hosts, err := resolver.LookupHost(ctx, srv.Target)
+		if err != nil {
+			l.Printf("[WARN] discover-dns: failed to resolve %s: %v", srv.Target, err)
+			continue
+		}
+		addrs = append(addrs, joinHostsPort(hosts, int(srv.Port))...)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("discover-dns: no SRV target of %s resolved", name)
+	}
+
+	return addrs, nil
+}
+
+func joinHostsPort(hosts []string, port int) []string {
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	return addrs
+}
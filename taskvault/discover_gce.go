@@ -0,0 +1,9 @@
+//go:build discover_gce || discover_all
+
+package taskvault
+
+import discovergce "github.com/hashicorp/go-discover/provider/gce"
+
+func init() {
+	RegisterDiscoverProvider("gce", &discovergce.Provider{})
+}
@@ -0,0 +1,9 @@
+//go:build !no_discover_k8s
+
+package taskvault
+
+import discoverk8s "github.com/hashicorp/go-discover/provider/k8s"
+
+func init() {
+	RegisterDiscoverProvider("k8s", &discoverk8s.Provider{})
+}
@@ -0,0 +1,9 @@
+//go:build discover_linode || discover_all
+
+package taskvault
+
+import discoverlinode "github.com/hashicorp/go-discover/provider/linode"
+
+func init() {
+	RegisterDiscoverProvider("linode", &discoverlinode.Provider{})
+}
@@ -0,0 +1,9 @@
+//go:build discover_mdns || discover_all
+
+package taskvault
+
+import discovermdns "github.com/hashicorp/go-discover/provider/mdns"
+
+func init() {
+	RegisterDiscoverProvider("mdns", &discovermdns.Provider{})
+}
@@ -0,0 +1,9 @@
+//go:build discover_os || discover_all
+
+package taskvault
+
+import discoveros "github.com/hashicorp/go-discover/provider/os"
+
+func init() {
+	RegisterDiscoverProvider("os", &discoveros.Provider{})
+}
@@ -0,0 +1,9 @@
+//go:build discover_packet || discover_all
+
+package taskvault
+
+import discoverpacket "github.com/hashicorp/go-discover/provider/packet"
+
+func init() {
+	RegisterDiscoverProvider("packet", &discoverpacket.Provider{})
+}
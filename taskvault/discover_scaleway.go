@@ -0,0 +1,9 @@
+//go:build discover_scaleway || discover_all
+
+package taskvault
+
+import discoverscaleway "github.com/hashicorp/go-discover/provider/scaleway"
+
+func init() {
+	RegisterDiscoverProvider("scaleway", &discoverscaleway.Provider{})
+}
@@ -0,0 +1,9 @@
+//go:build discover_softlayer || discover_all
+
+package taskvault
+
+import discoversoftlayer "github.com/hashicorp/go-discover/provider/softlayer"
+
+func init() {
+	RegisterDiscoverProvider("softlayer", &discoversoftlayer.Provider{})
+}
@@ -0,0 +1,9 @@
+//go:build discover_tencentcloud || discover_all
+
+package taskvault
+
+import discovertencentcloud "github.com/hashicorp/go-discover/provider/tencentcloud"
+
+func init() {
+	RegisterDiscoverProvider("tencentcloud", &discovertencentcloud.Provider{})
+}
@@ -0,0 +1,90 @@
+package taskvault
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver struct {
+	srvs  map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	srvs, ok := r.srvs[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, srvs, nil
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	hosts, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return hosts, nil
+}
+
+func TestDNSProvider_Addrs(t *testing.T) {
+	p := &dnsProvider{resolver: &fakeResolver{
+		srvs: map[string][]*net.SRV{
+			"_syncra._tcp.example.com": {
+				{Target: "node1.example.com.", Port: 7946},
+				{Target: "node2.example.com.", Port: 7947},
+				{Target: "gone.example.com.", Port: 7946},
+			},
+		},
+		hosts: map[string][]string{
+			"node1.example.com.": {"10.0.0.1"},
+			"node2.example.com.": {"10.0.0.2", "fd00::2"},
+			"example.com":        {"10.0.0.3"},
+		},
+	}}
+	l := log.New(io.Discard, "", 0)
+
+	addrs, err := p.Addrs(map[string]string{"name": "_syncra._tcp.example.com"}, l)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:7946", "10.0.0.2:7947", "[fd00::2]:7947"}, addrs)
+
+	// Without SRV records the A records are joined on the given port.
+	addrs, err = p.Addrs(map[string]string{"name": "example.com", "port": "9000"}, l)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.3:9000"}, addrs)
+
+	_, err = p.Addrs(map[string]string{"name": "missing.example.com"}, l)
+	assert.Error(t, err)
+	_, err = p.Addrs(map[string]string{"name": "example.com", "port": "x"}, l)
+	assert.Error(t, err)
+}
+
+func TestParseDiscoverConfig(t *testing.T) {
+	args, err := parseDiscoverConfig(`provider=aws  tag_key=role tag_value="syncra server" addr_type="a\"b"`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"provider":  "aws",
+		"tag_key":   "role",
+		"tag_value": "syncra server",
+		"addr_type": `a"b`,
+	}, args)
+
+	for _, cfg := range []string{
+		"provider",
+		"provider=",
+		"provider=aws provider=gce",
+		`provider="aws`,
+		`provider="aws"x`,
+	} {
+		_, err := parseDiscoverConfig(cfg)
+		assert.Error(t, err, cfg)
+	}
+
+	_, _, err = discoverProvider("provider=nope")
+	assert.ErrorContains(t, err, "unknown provider")
+}
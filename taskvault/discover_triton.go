@@ -0,0 +1,9 @@
+//go:build discover_triton || discover_all
+
+package taskvault
+
+import discovertriton "github.com/hashicorp/go-discover/provider/triton"
+
+func init() {
+	RegisterDiscoverProvider("triton", &discovertriton.Provider{})
+}
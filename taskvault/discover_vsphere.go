@@ -0,0 +1,9 @@
+//go:build discover_vsphere || discover_all
+
+package taskvault
+
+import discovervsphere "github.com/hashicorp/go-discover/provider/vsphere"
+
+func init() {
+	RegisterDiscoverProvider("vsphere", &discovervsphere.Provider{})
+}
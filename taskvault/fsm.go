@@ -1,11 +1,18 @@
 package taskvault
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/danluki/taskvault/pkg/types"
 	"github.com/hashicorp/raft"
 	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protodelim"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -15,106 +22,614 @@ const (
 	AddPairType MessageType = iota
 	DeletePairType
 	UpdatePairType
+	CASPairType
+	TxnType
+	// IdempotentType wraps another command with the token of the client
+	// request, see applyIdempotent.
+	IdempotentType
+	LockAcquireType
+	LockReleaseType
+	SessionCreateType
+	SessionRenewType
+	SessionDestroyType
+	IncrementType
+	// ChecksumType hashes the store, see applyChecksum.
+	ChecksumType
+
+	// CustomTypeStart is the first type embedders can register their own
+	// commands under with Agent.RegisterCommand.
+	CustomTypeStart MessageType = 64
 )
 
+func (t MessageType) String() string {
+	switch t {
+	case AddPairType:
+		return "add_pair"
+	case DeletePairType:
+		return "delete_pair"
+	case UpdatePairType:
+		return "update_pair"
+	case CASPairType:
+		return "cas_pair"
+	case TxnType:
+		return "txn"
+	case IdempotentType:
+		return "idempotent"
+	case LockAcquireType:
+		return "lock_acquire"
+	case LockReleaseType:
+		return "lock_release"
+	case SessionCreateType:
+		return "session_create"
+	case SessionRenewType:
+		return "session_renew"
+	case SessionDestroyType:
+		return "session_destroy"
+	case IncrementType:
+		return "increment"
+	case ChecksumType:
+		return "checksum"
+	}
+	if t >= CustomTypeStart {
+		return fmt.Sprintf("custom_%d", uint8(t))
+	}
+	return "unknown"
+}
+
+// ErrCASFailed is returned when a compare-and-swap found a different
+// ModifyIndex than the one the client expected.
+var ErrCASFailed = errors.New("compare-and-swap failed: modify index mismatch")
+
+// TxnFailedError reports the transaction operation whose ModifyIndex check
+// failed. It wraps ErrCASFailed.
+type TxnFailedError struct {
+	Op  int
+	Key string
+}
+
+func (e *TxnFailedError) Error() string {
+	return fmt.Sprintf("txn op %d on %q: %s", e.Op, e.Key, ErrCASFailed)
+}
+
+func (e *TxnFailedError) Unwrap() error {
+	return ErrCASFailed
+}
+
 type Pair struct {
 	Key   string
 	Value string
 }
 
-type LogApplier func(buf []byte, index uint64) interface{}
+// LogApplier applies a command of the raft log, buf is the command without
+// its header. The result is returned to the Apply caller on the leader.
+type LogApplier func(buf []byte, l *raft.Log) interface{}
 
 type LogAppliers map[MessageType]LogApplier
 
 type taskvaultFSM struct {
-	store SyncraStorage
+	store       SyncraStorage
+	watches     *watchHub
+	idempotency *idempotencyCache
+	sessions    *sessionTable
+	checksums   *checksumLog
+	appliers    LogAppliers
 
 	logger *zap.SugaredLogger
 }
 
 func newFSM(store SyncraStorage, logger *zap.SugaredLogger) *taskvaultFSM {
-	return &taskvaultFSM{
-		store:  store,
-		logger: logger,
+	d := &taskvaultFSM{
+		store:       store,
+		watches:     newWatchHub(),
+		idempotency: newIdempotencyCache(),
+		sessions:    newSessionTable(),
+		checksums:   newChecksumLog(),
+		logger:      logger,
 	}
+	d.appliers = d.builtinAppliers()
+	return d
 }
 
 func (d *taskvaultFSM) Apply(l *raft.Log) interface{} {
-	buf := l.Data
-	msgType := MessageType(buf[0])
+	if s, ok := d.store.(restoredExpirer); ok && !l.AppendedAt.IsZero() {
+		if err := s.expireRestored(l.AppendedAt); err != nil {
+			d.logger.With(zap.Error(err)).Error("fsm: failed to expire restored pairs")
+		}
+	}
 
-	d.logger.Debug("fsm: received command", zap.Int8("command", int8(msgType)))
+	version, msgType, buf, err := decodeCommand(l.Data)
+	if err != nil {
+		d.logger.With(
+			zap.Error(err),
+			zap.Uint8("version", version),
+			zap.Uint64("index", l.Index),
+		).Warn("fsm: skipping undecodable command")
+		metrics.IncrCounterWithLabels(
+			[]string{"taskvault", "fsm", "apply"}, 1,
+			[]metrics.Label{
+				{Name: "type", Value: "unknown"},
+				{Name: "result", Value: "ignored"},
+			},
+		)
+		return err
+	}
 
-	switch msgType {
-	case AddPairType:
-		return d.applyAddPair(buf[1:])
-	case DeletePairType:
-		return d.applyDeletePair(buf[1:])
-	case UpdatePairType:
-		return d.applyUpdatePair(buf[1:])
+	d.logger.Debug("fsm: received command",
+		zap.Int8("command", int8(msgType)),
+		zap.Uint8("version", version),
+	)
+
+	resp := d.apply(msgType, buf, l)
+
+	// A failed CAS, deleting a missing key or a busy lock is an answer to
+	// the client, only unexpected errors count as failed applies.
+	result := "success"
+	if _, ok := d.appliers[msgType]; !ok {
+		result = "ignored"
+	} else if err, ok := resp.(error); ok && !isClientError(err) {
+		result = "failure"
+		d.logger.With(
+			zap.Error(err),
+			zap.Stringer("command", msgType),
+			zap.Uint64("index", l.Index),
+		).Error("fsm: failed to apply command")
 	}
+	metrics.IncrCounterWithLabels(
+		[]string{"taskvault", "fsm", "apply"}, 1,
+		[]metrics.Label{
+			{Name: "type", Value: msgType.String()},
+			{Name: "result", Value: result},
+		},
+	)
 
-	return nil
+	return resp
+}
+
+func isClientError(err error) bool {
+	return errors.Is(err, ErrCASFailed) ||
+		errors.Is(err, ErrKeyNotFound) ||
+		errors.Is(err, ErrLockHeld) ||
+		errors.Is(err, ErrLockNotHeld) ||
+		errors.Is(err, ErrSessionNotFound) ||
+		errors.Is(err, ErrNotInteger) ||
+		errors.Is(err, ErrIncrementOverflow)
+}
+
+// builtinAppliers maps the command types of the agent to their handlers.
+func (d *taskvaultFSM) builtinAppliers() LogAppliers {
+	return LogAppliers{
+		AddPairType: func(buf []byte, l *raft.Log) interface{} {
+			return d.applyAddPair(buf, l.Index, l.AppendedAt)
+		},
+		DeletePairType: func(buf []byte, l *raft.Log) interface{} {
+			return d.applyDeletePair(buf, l.Index)
+		},
+		UpdatePairType: func(buf []byte, l *raft.Log) interface{} {
+			return d.applyUpdatePair(buf, l.Index)
+		},
+		CASPairType: func(buf []byte, l *raft.Log) interface{} {
+			return d.applyCASPair(buf, l.Index, l.AppendedAt)
+		},
+		TxnType: func(buf []byte, l *raft.Log) interface{} {
+			return d.applyTxn(buf, l.Index, l.AppendedAt)
+		},
+		IdempotentType: d.applyIdempotent,
+		LockAcquireType: func(buf []byte, l *raft.Log) interface{} {
+			return d.applyLockAcquire(buf, l.Index, l.AppendedAt)
+		},
+		LockReleaseType: func(buf []byte, l *raft.Log) interface{} {
+			return d.applyLockRelease(buf, l.Index, l.AppendedAt)
+		},
+		SessionCreateType: func(buf []byte, l *raft.Log) interface{} {
+			return d.applySessionCreate(buf, l.Index, l.AppendedAt)
+		},
+		SessionRenewType: func(buf []byte, l *raft.Log) interface{} {
+			return d.applySessionRenew(buf, l.AppendedAt)
+		},
+		SessionDestroyType: func(buf []byte, l *raft.Log) interface{} {
+			return d.applySessionDestroy(buf, l.Index)
+		},
+		IncrementType: func(buf []byte, l *raft.Log) interface{} {
+			return d.applyIncrement(buf, l.Index, l.AppendedAt)
+		},
+		ChecksumType: d.applyChecksum,
+	}
+}
+
+// register adds the handlers of custom command types.
+func (d *taskvaultFSM) register(appliers LogAppliers) {
+	for t, fn := range appliers {
+		d.appliers[t] = fn
+	}
 }
 
-func (d *taskvaultFSM) applyAddPair(buf []byte) interface{} {
-	var cvr types.CreateValueRequest
-	if err := proto.Unmarshal(buf, &cvr); err != nil {
+func (d *taskvaultFSM) apply(msgType MessageType, buf []byte, l *raft.Log) interface{} {
+	applier, ok := d.appliers[msgType]
+	if !ok {
+		// A node that was already upgraded may replicate commands this one
+		// does not know, they are skipped rather than stopping the node in
+		// the middle of a rolling upgrade.
+		d.logger.With(
+			zap.Stringer("command", msgType),
+			zap.Uint64("index", l.Index),
+		).Warn("fsm: ignoring unknown command type")
+		return nil
+	}
+	return applier(buf, l)
+}
+
+// observeValueSize samples the size of values written by a command.
+func observeValueSize(t MessageType, value string) {
+	metrics.AddSampleWithLabels(
+		[]string{"taskvault", "fsm", "value_size"}, float32(len(value)),
+		[]metrics.Label{{Name: "type", Value: t.String()}},
+	)
+}
+
+// modifyTime is the ModifyTime of pairs written by an entry the leader
+// appended at appendedAt, zero for entries that do not carry the time.
+func modifyTime(appendedAt time.Time) int64 {
+	if appendedAt.IsZero() {
+		return 0
+	}
+	return appendedAt.UnixNano()
+}
+
+func (d *taskvaultFSM) applyAddPair(buf []byte, index uint64, appendedAt time.Time) interface{} {
+	var pair types.Pair
+	if err := proto.Unmarshal(buf, &pair); err != nil {
 		return err
 	}
+	if err := d.sessions.check(pair.Session, appendedAt); err != nil {
+		return err
+	}
+	pair.ModifyIndex = index
+	pair.ModifyTime = modifyTime(appendedAt)
+	observeValueSize(AddPairType, pair.Value)
 
-	err := d.store.SetValue(cvr.Key, cvr.Value)
+	err := d.store.SetPair(&pair)
 	if err != nil {
 		return err
 	}
+	d.watches.publish(putEvent(&pair, index))
 
 	return nil
 }
 
-func (d *taskvaultFSM) applyDeletePair(buf []byte) interface{} {
+func (d *taskvaultFSM) applyDeletePair(buf []byte, index uint64) interface{} {
 	var dpr types.DeleteValueRequest
 
 	if err := proto.Unmarshal(buf, &dpr); err != nil {
 		return err
 	}
 
-	err := d.store.DeleteValue(dpr.Key)
+	// Expiry sweeps only remove the pair if it still carries the expiry the
+	// leader observed, so a key rewritten in the meantime survives.
+	if dpr.ExpiresAt != 0 {
+		pair, err := d.store.GetPair(dpr.Key, ReadOptions{IncludeExpired: true})
+		if err != nil {
+			return err
+		}
+		if pair.ExpiresAt != dpr.ExpiresAt {
+			return nil
+		}
+	}
+
+	err := d.store.DeletePair(dpr.Key)
 	if err != nil {
 		return err
 	}
+	d.watches.publish(Event{Type: EventDelete, Key: dpr.Key, ModifyIndex: index})
 
 	return nil
 }
 
-func (d *taskvaultFSM) applyUpdatePair(buf []byte) interface{} {
+// applyCASPair stores the pair only if the current ModifyIndex equals the
+// expected one, an expected index of zero means the key must not exist. The
+// check runs inside the FSM so it is linearized through raft. Expiry is judged
+// against the time the leader appended the entry, which every replica shares.
+func (d *taskvaultFSM) applyCASPair(buf []byte, index uint64, appendedAt time.Time) interface{} {
+	var cmd types.CASPairCommand
+	if err := proto.Unmarshal(buf, &cmd); err != nil {
+		return err
+	}
+	if cmd.Pair == nil {
+		return errors.New("fsm: CAS command without pair")
+	}
+	if err := d.sessions.check(cmd.Pair.Session, appendedAt); err != nil {
+		return err
+	}
+
+	var current uint64
+	existing, err := d.store.GetPair(cmd.Pair.Key, ReadOptions{IncludeExpired: true})
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+	case err != nil:
+		return err
+	case !pairExpired(existing, appendedAt):
+		current = existing.ModifyIndex
+	}
+
+	if current != cmd.ExpectedIndex {
+		return ErrCASFailed
+	}
+
+	cmd.Pair.ModifyIndex = index
+	cmd.Pair.ModifyTime = modifyTime(appendedAt)
+	observeValueSize(CASPairType, cmd.Pair.Value)
+	if err := d.store.SetPair(cmd.Pair); err != nil {
+		return err
+	}
+	d.watches.publish(putEvent(cmd.Pair, index))
+
+	return cmd.Pair
+}
+
+// applyTxn checks every precondition against the state before the
+// transaction and only then writes all operations at once. On success it
+// returns the index the transaction was committed at.
+func (d *taskvaultFSM) applyTxn(buf []byte, index uint64, appendedAt time.Time) interface{} {
+	var txn types.TxnRequest
+	if err := proto.Unmarshal(buf, &txn); err != nil {
+		return err
+	}
+
+	existed := make([]bool, len(txn.Ops))
+	for i, op := range txn.Ops {
+		if op.Pair == nil {
+			return fmt.Errorf("fsm: txn op %d without pair", i)
+		}
+		if op.Type == types.TxnOpType_TXN_SET {
+			if err := d.sessions.check(op.Pair.Session, appendedAt); err != nil {
+				return err
+			}
+		}
+
+		var current uint64
+		existing, err := d.store.GetPair(op.Pair.Key, ReadOptions{IncludeExpired: true})
+		switch {
+		case errors.Is(err, ErrKeyNotFound):
+		case err != nil:
+			return err
+		default:
+			existed[i] = true
+			if !pairExpired(existing, appendedAt) {
+				current = existing.ModifyIndex
+			}
+		}
+
+		if op.CheckIndex && current != op.ExpectedIndex {
+			return &TxnFailedError{Op: i, Key: op.Pair.Key}
+		}
+
+		if op.Type == types.TxnOpType_TXN_SET {
+			op.Pair.ModifyIndex = index
+			op.Pair.ModifyTime = modifyTime(appendedAt)
+			observeValueSize(TxnType, op.Pair.Value)
+		}
+	}
+
+	if err := d.store.Txn(txn.Ops); err != nil {
+		return err
+	}
+
+	for i, op := range txn.Ops {
+		switch {
+		case op.Type == types.TxnOpType_TXN_SET:
+			d.watches.publish(putEvent(op.Pair, index))
+		case existed[i]:
+			d.watches.publish(Event{Type: EventDelete, Key: op.Pair.Key, ModifyIndex: index})
+		}
+	}
+
+	return index
+}
+
+func (d *taskvaultFSM) applyUpdatePair(buf []byte, index uint64) interface{} {
 	var uvr types.UpdateValueRequest
 	if err := proto.Unmarshal(buf, &uvr); err != nil {
 		return err
 	}
 
+	observeValueSize(UpdatePairType, uvr.Value)
 	err := d.store.UpdateValue(uvr.Key, uvr.Value)
 	if err != nil {
 		return err
 	}
+	d.watches.publish(Event{Type: EventPut, Key: uvr.Key, Value: uvr.Value, ModifyIndex: index})
 
 	return nil
 }
 
+// Snapshot captures the pairs right away. Raft runs it on the FSM goroutine
+// but persists the result concurrently with later applies.
 func (d *taskvaultFSM) Snapshot() (raft.FSMSnapshot, error) {
-	return &taskvaultSnapshot{store: d.store}, nil
+	defer metrics.MeasureSince([]string{"taskvault", "fsm", "snapshot"}, time.Now())
+
+	snap, err := d.storeSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &types.FSMState{
+		Results:     d.idempotency.results(),
+		Sessions:    d.sessions.all(),
+		DeleteIndex: d.watches.deleteIndex.Load(),
+	}
+	if len(state.Results) == 0 && len(state.Sessions) == 0 && state.DeleteIndex == 0 {
+		return &meteredSnapshot{FSMSnapshot: snap}, nil
+	}
+	return &meteredSnapshot{FSMSnapshot: &stateSnapshot{state: state, store: snap}}, nil
 }
 
+func (d *taskvaultFSM) storeSnapshot() (raft.FSMSnapshot, error) {
+	if s, ok := d.store.(fsmSnapshotter); ok {
+		return s.FSMSnapshot()
+	}
+
+	pairs, err := d.store.AllPairs()
+	if err != nil {
+		return nil, err
+	}
+
+	return &taskvaultSnapshot{pairs: pairs}, nil
+}
+
+// Restore replaces the state with a snapshot, either the local one on start
+// or one the leader sent because this node lagged behind its log. The pairs
+// are streamed into the store one at a time.
 func (d *taskvaultFSM) Restore(r io.ReadCloser) error {
 	defer r.Close()
-	return d.store.Restore(r)
+	// Watchers cannot be told what a snapshot changed, they start over.
+	defer d.watches.resync()
+	defer metrics.MeasureSince([]string{"taskvault", "fsm", "restore"}, time.Now())
+
+	start := time.Now()
+	cr := &countingReader{r: r}
+	br := bufio.NewReaderSize(cr, snapshotBufferSize)
+	state, err := readFSMState(br)
+	if err != nil {
+		return err
+	}
+	d.idempotency.restore(state.Results)
+	d.sessions.restore(state.Sessions)
+	d.watches.deleteIndex.Store(state.DeleteIndex)
+
+	if err := d.store.Restore(io.NopCloser(br)); err != nil {
+		return err
+	}
+
+	keys, _ := d.store.Len()
+	metrics.SetGauge([]string{"taskvault", "fsm", "restore", "bytes"}, float32(cr.n))
+	metrics.SetGauge([]string{"taskvault", "fsm", "restore", "keys"}, float32(keys))
+	d.logger.With(
+		zap.Int("keys", keys),
+		zap.Int64("bytes", cr.n),
+		zap.Duration("duration", time.Since(start)),
+	).Info("fsm: restored snapshot")
+	return nil
+}
+
+// meteredSnapshot reports the size of the snapshots raft persists, to keep
+// an eye on their growth and on how often they are taken.
+type meteredSnapshot struct {
+	raft.FSMSnapshot
+}
+
+func (m *meteredSnapshot) Persist(sink raft.SnapshotSink) error {
+	start := time.Now()
+	ms := &meteredSink{SnapshotSink: sink}
+	if err := m.FSMSnapshot.Persist(ms); err != nil {
+		metrics.IncrCounter([]string{"taskvault", "fsm", "snapshot", "failed"}, 1)
+		return err
+	}
+
+	metrics.MeasureSince([]string{"taskvault", "fsm", "snapshot", "persist"}, start)
+	metrics.SetGauge([]string{"taskvault", "fsm", "snapshot", "bytes"}, float32(ms.bytes))
+	if kc, ok := m.FSMSnapshot.(keyCounter); ok {
+		metrics.SetGauge([]string{"taskvault", "fsm", "snapshot", "keys"}, float32(kc.persistedKeys()))
+	}
+	return nil
+}
+
+// keyCounter is implemented by the snapshots that know how many pairs they
+// persisted.
+type keyCounter interface {
+	persistedKeys() int
+}
+
+// meteredSink counts the bytes written to the sink.
+type meteredSink struct {
+	raft.SnapshotSink
+	bytes int64
+}
+
+func (s *meteredSink) Write(p []byte) (int, error) {
+	n, err := s.SnapshotSink.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// stateMagic starts snapshots that carry FSM state besides the pairs: the
+// idempotency cache, the sessions and the index of the last deletion. It is
+// followed by a length delimited types.FSMState and the snapshot of the
+// store, so snapshots without it still restore.
+var stateMagic = []byte("TVSTATE1\n")
+
+// stateSnapshot writes the FSM state ahead of the store snapshot.
+type stateSnapshot struct {
+	state *types.FSMState
+	store raft.FSMSnapshot
+}
+
+func (s *stateSnapshot) Persist(sink raft.SnapshotSink) error {
+	bw := bufio.NewWriter(sink)
+	_, err := bw.Write(stateMagic)
+	if err == nil {
+		_, err = protodelim.MarshalTo(bw, s.state)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+
+	return s.store.Persist(sink)
+}
+
+func (s *stateSnapshot) persistedKeys() int {
+	if kc, ok := s.store.(keyCounter); ok {
+		return kc.persistedKeys()
+	}
+	return 0
+}
+
+func (s *stateSnapshot) Release() {
+	s.store.Release()
+}
+
+// readFSMState consumes the FSM state from the head of a snapshot, if it
+// carries one. The rest of br is the store snapshot.
+func readFSMState(br *bufio.Reader) (*types.FSMState, error) {
+	state := &types.FSMState{}
+
+	head, err := br.Peek(len(stateMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if !bytes.Equal(head, stateMagic) {
+		return state, nil
+	}
+
+	if _, err := br.Discard(len(stateMagic)); err != nil {
+		return nil, err
+	}
+	if err := snapshotUnmarshal.UnmarshalFrom(br, state); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+
+	return state, nil
 }
 
 type taskvaultSnapshot struct {
-	store SyncraStorage
+	pairs []*types.Pair
 }
 
 func (d *taskvaultSnapshot) Persist(sink raft.SnapshotSink) error {
-	if err := d.store.Snapshot(sink); err != nil {
+	if err := writeSnapshot(sink, d.pairs); err != nil {
 		_ = sink.Cancel()
 		return err
 	}
@@ -126,4 +641,8 @@ func (d *taskvaultSnapshot) Persist(sink raft.SnapshotSink) error {
 	return nil
 }
 
+func (d *taskvaultSnapshot) persistedKeys() int {
+	return len(d.pairs)
+}
+
 func (d *taskvaultSnapshot) Release() {}
@@ -0,0 +1,601 @@
+package taskvault
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+func applyCommand(t *testing.T, fsm *taskvaultFSM, mt MessageType, msg any) interface{} {
+	cmd, err := Encode(mt, msg)
+	require.NoError(t, err)
+	return fsm.Apply(&raft.Log{Data: cmd})
+}
+
+func TestFSM_DeletePair(t *testing.T) {
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+
+	resp := applyCommand(t, fsm, AddPairType, &types.Pair{Key: "foo", Value: "bar"})
+	assert.Nil(t, resp)
+
+	resp = applyCommand(t, fsm, DeletePairType, &types.DeleteValueRequest{Key: "foo"})
+	assert.Nil(t, resp)
+
+	_, err := s.GetPair("foo", ReadOptions{})
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	resp = applyCommand(t, fsm, DeletePairType, &types.DeleteValueRequest{Key: "foo"})
+	assert.ErrorIs(t, resp.(error), ErrKeyNotFound)
+}
+
+func TestFSM_ExpireOnlyMatchingPair(t *testing.T) {
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+
+	first := time.Now().Add(-time.Minute).UnixNano()
+	second := time.Now().Add(time.Hour).UnixNano()
+
+	applyCommand(t, fsm, AddPairType, &types.Pair{Key: "foo", Value: "a", ExpiresAt: first})
+	applyCommand(t, fsm, AddPairType, &types.Pair{Key: "foo", Value: "b", ExpiresAt: second})
+
+	resp := applyCommand(t, fsm, DeletePairType, &types.DeleteValueRequest{Key: "foo", ExpiresAt: first})
+	assert.Nil(t, resp)
+
+	pair, err := s.GetPair("foo", ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "b", pair.Value)
+
+	resp = applyCommand(t, fsm, DeletePairType, &types.DeleteValueRequest{Key: "foo", ExpiresAt: second})
+	assert.Nil(t, resp)
+
+	_, err = s.GetPair("foo", ReadOptions{IncludeExpired: true})
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestFSM_CASPair(t *testing.T) {
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+
+	cas := func(index uint64, value string, expected uint64) interface{} {
+		cmd, err := Encode(CASPairType, &types.CASPairCommand{
+			Pair:          &types.Pair{Key: "lock", Value: value},
+			ExpectedIndex: expected,
+		})
+		require.NoError(t, err)
+		return fsm.Apply(&raft.Log{Index: index, Data: cmd})
+	}
+
+	resp := cas(5, "a", 0)
+	require.IsType(t, &types.Pair{}, resp)
+	assert.Equal(t, uint64(5), resp.(*types.Pair).ModifyIndex)
+
+	assert.ErrorIs(t, cas(6, "b", 0).(error), ErrCASFailed)
+	assert.ErrorIs(t, cas(7, "b", 4).(error), ErrCASFailed)
+
+	resp = cas(8, "b", 5)
+	require.IsType(t, &types.Pair{}, resp)
+
+	pair, err := s.GetPair("lock", ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "b", pair.Value)
+	assert.Equal(t, uint64(8), pair.ModifyIndex)
+}
+
+func TestFSM_ApplyMetrics(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	_, err := metrics.NewGlobal(conf, sink)
+	require.NoError(t, err)
+
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+
+	applyCommand(t, fsm, AddPairType, &types.Pair{Key: "foo", Value: "bar"})
+	applyCommand(t, fsm, DeletePairType, &types.DeleteValueRequest{Key: "missing"})
+	resp := fsm.Apply(&raft.Log{Data: []byte{byte(AddPairType), 0xff}})
+	assert.Error(t, resp.(error))
+
+	counters := sink.Data()[0].Counters
+	assert.Equal(t, 1, counters["taskvault.fsm.apply;type=add_pair;result=success"].Count)
+	assert.Equal(t, 1, counters["taskvault.fsm.apply;type=delete_pair;result=success"].Count)
+	assert.Equal(t, 1, counters["taskvault.fsm.apply;type=add_pair;result=failure"].Count)
+
+	samples := sink.Data()[0].Samples
+	assert.Equal(t, float64(3), samples["taskvault.fsm.value_size;type=add_pair"].Sum)
+}
+
+func TestFSM_SnapshotMetrics(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	_, err := metrics.NewGlobal(conf, sink)
+	require.NoError(t, err)
+
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+	applyCommand(t, fsm, AddPairType, &types.Pair{Key: "a", Value: "1"})
+	applyCommand(t, fsm, AddPairType, &types.Pair{Key: "b", Value: "2"})
+
+	snap, err := fsm.Snapshot()
+	require.NoError(t, err)
+	snapSink := &testSnapshotSink{}
+	require.NoError(t, snap.Persist(snapSink))
+	snap.Release()
+
+	gauges := sink.Data()[0].Gauges
+	assert.Equal(t, float32(snapSink.Len()), gauges["taskvault.fsm.snapshot.bytes"].Value)
+	assert.Equal(t, float32(2), gauges["taskvault.fsm.snapshot.keys"].Value)
+	assert.Equal(t, 1, sink.Data()[0].Samples["taskvault.fsm.snapshot.persist"].Count)
+
+	restored := newFSM(newTestStore(t), zap.NewNop().Sugar())
+	require.NoError(t, restored.Restore(io.NopCloser(bytes.NewReader(snapSink.Bytes()))))
+
+	gauges = sink.Data()[0].Gauges
+	assert.Equal(t, float32(snapSink.Len()), gauges["taskvault.fsm.restore.bytes"].Value)
+	assert.Equal(t, float32(2), gauges["taskvault.fsm.restore.keys"].Value)
+}
+
+type testSnapshotSink struct {
+	bytes.Buffer
+	cancelled bool
+}
+
+func (s *testSnapshotSink) ID() string    { return "test" }
+func (s *testSnapshotSink) Cancel() error { s.cancelled = true; return nil }
+func (s *testSnapshotSink) Close() error  { return nil }
+
+func TestFSM_SnapshotRestore(t *testing.T) {
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+
+	expires := time.Now().Add(time.Hour).UnixNano()
+	expired := time.Now().Add(-time.Hour).UnixNano()
+	applyCommand(t, fsm, AddPairType, &types.Pair{Key: "a", Value: "1"})
+	applyCommand(t, fsm, AddPairType, &types.Pair{Key: "b", Value: "2", ExpiresAt: expires})
+	applyCommand(t, fsm, AddPairType, &types.Pair{Key: "c", Value: "3", ExpiresAt: expired})
+	before, err := s.AllPairs()
+	require.NoError(t, err)
+
+	snap, err := fsm.Snapshot()
+	require.NoError(t, err)
+
+	// Writes after Snapshot returned must not leak into the snapshot.
+	applyCommand(t, fsm, AddPairType, &types.Pair{Key: "d", Value: "4"})
+
+	sink := &testSnapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+	assert.False(t, sink.cancelled)
+
+	require.NoError(t, fsm.Restore(io.NopCloser(&sink.Buffer)))
+
+	after, err := s.AllPairs()
+	require.NoError(t, err)
+	require.Len(t, after, len(before))
+	for i := range before {
+		assert.True(t, proto.Equal(before[i], after[i]), "pair %s differs", before[i].Key)
+	}
+
+	_, err = s.GetPair("d", ReadOptions{})
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestFSM_Watch(t *testing.T) {
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := fsm.watches.subscribe(ctx, "foo/")
+
+	applyCommand(t, fsm, AddPairType, &types.Pair{Key: "bar", Value: "skipped"})
+	cmd, err := Encode(AddPairType, &types.Pair{Key: "foo/a", Value: "1"})
+	require.NoError(t, err)
+	fsm.Apply(&raft.Log{Index: 7, Data: cmd})
+	applyCommand(t, fsm, DeletePairType, &types.DeleteValueRequest{Key: "foo/a"})
+
+	assert.Equal(t, Event{Type: EventPut, Key: "foo/a", Value: "1", ModifyIndex: 7}, <-events)
+	assert.Equal(t, Event{Type: EventDelete, Key: "foo/a"}, <-events)
+
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+
+	// A subscriber that falls behind is dropped with a resync.
+	events = fsm.watches.subscribe(context.Background(), "")
+	for i := 0; i <= watchBuffer; i++ {
+		applyCommand(t, fsm, AddPairType, &types.Pair{Key: "k", Value: "v"})
+	}
+
+	var last Event
+	n := 0
+	for ev := range events {
+		last = ev
+		n++
+	}
+	assert.Equal(t, watchBuffer+1, n)
+	assert.Equal(t, EventResync, last.Type)
+}
+
+func TestFSM_Txn(t *testing.T) {
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+
+	txn := func(index uint64, ops ...*types.TxnOp) interface{} {
+		cmd, err := Encode(TxnType, &types.TxnRequest{Ops: ops})
+		require.NoError(t, err)
+		return fsm.Apply(&raft.Log{Index: index, Data: cmd})
+	}
+	set := func(key, value string) *types.TxnOp {
+		return &types.TxnOp{Pair: &types.Pair{Key: key, Value: value}}
+	}
+
+	assert.Equal(t, uint64(5), txn(5, set("a", "1"), set("b", "2")))
+
+	// A failed check aborts the whole batch.
+	del := &types.TxnOp{Type: types.TxnOpType_TXN_DELETE, Pair: &types.Pair{Key: "a"}}
+	check := set("b", "3")
+	check.CheckIndex = true
+	check.ExpectedIndex = 4
+	resp := txn(6, del, check)
+	var failed *TxnFailedError
+	require.ErrorAs(t, resp.(error), &failed)
+	assert.Equal(t, 1, failed.Op)
+
+	_, err := s.GetPair("a", ReadOptions{})
+	require.NoError(t, err)
+
+	check.ExpectedIndex = 5
+	assert.Equal(t, uint64(7), txn(7, del, check))
+
+	_, err = s.GetPair("a", ReadOptions{})
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	pair, err := s.GetPair("b", ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "3", pair.Value)
+	assert.Equal(t, uint64(7), pair.ModifyIndex)
+}
+
+func TestFSM_Idempotent(t *testing.T) {
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+
+	now := time.Now()
+	cas := func(index uint64, token, value string, at time.Time) interface{} {
+		inner, err := proto.Marshal(&types.CASPairCommand{
+			Pair: &types.Pair{Key: "lock", Value: value},
+		})
+		require.NoError(t, err)
+		cmd, err := Encode(IdempotentType, &types.IdempotentCommand{
+			Token:   token,
+			Type:    uint32(CASPairType),
+			Command: inner,
+		})
+		require.NoError(t, err)
+		return fsm.Apply(&raft.Log{Index: index, Data: cmd, AppendedAt: at})
+	}
+
+	first := cas(5, "t1", "a", now)
+	require.IsType(t, &types.Pair{}, first)
+
+	// A retry gets the original pair back instead of failing the CAS.
+	retry := cas(6, "t1", "a", now.Add(time.Second))
+	assert.True(t, proto.Equal(first.(*types.Pair), retry.(*types.Pair)))
+
+	pair, err := s.GetPair("lock", ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), pair.ModifyIndex)
+
+	resp := cas(7, "t2", "b", now.Add(time.Second))
+	assert.ErrorIs(t, resp.(error), ErrCASFailed)
+
+	// The cache survives a snapshot.
+	snap, err := fsm.Snapshot()
+	require.NoError(t, err)
+	sink := &testSnapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+
+	restored := newFSM(newTestStore(t), zap.NewNop().Sugar())
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+	fsm = restored
+
+	retry = cas(8, "t1", "a", now.Add(2*time.Second))
+	assert.True(t, proto.Equal(first.(*types.Pair), retry.(*types.Pair)))
+	resp = cas(9, "t2", "b", now.Add(2*time.Second))
+	assert.ErrorIs(t, resp.(error), ErrCASFailed)
+
+	// Past the window the token is forgotten and the command applies again.
+	resp = cas(10, "t1", "a", now.Add(idempotencyWindow+time.Minute))
+	assert.ErrorIs(t, resp.(error), ErrCASFailed)
+}
+
+func TestFSM_Lock(t *testing.T) {
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+
+	now := time.Now()
+	lock := func(mt MessageType, index uint64, holder string, at time.Time) interface{} {
+		cmd, err := Encode(mt, &types.LockCommand{Key: "leader", Holder: holder, TtlSeconds: 10})
+		require.NoError(t, err)
+		return fsm.Apply(&raft.Log{Index: index, Data: cmd, AppendedAt: at})
+	}
+
+	resp := lock(LockAcquireType, 5, "a", now)
+	require.IsType(t, &types.Pair{}, resp)
+	assert.Equal(t, "a", resp.(*types.Pair).Value)
+	assert.Equal(t, now.Add(10*time.Second).UnixNano(), resp.(*types.Pair).ExpiresAt)
+
+	resp = lock(LockAcquireType, 6, "b", now.Add(time.Second))
+	var held *LockHeldError
+	require.ErrorAs(t, resp.(error), &held)
+	assert.Equal(t, "a", held.Holder)
+
+	// The holder renews its lease.
+	resp = lock(LockAcquireType, 7, "a", now.Add(5*time.Second))
+	require.IsType(t, &types.Pair{}, resp)
+	assert.Equal(t, uint64(7), resp.(*types.Pair).ModifyIndex)
+
+	resp = lock(LockReleaseType, 8, "b", now.Add(6*time.Second))
+	assert.ErrorIs(t, resp.(error), ErrLockNotHeld)
+	assert.Nil(t, lock(LockReleaseType, 9, "a", now.Add(6*time.Second)))
+
+	// A lease that was not renewed expires.
+	lock(LockAcquireType, 10, "a", now.Add(7*time.Second))
+	resp = lock(LockAcquireType, 11, "b", now.Add(20*time.Second))
+	require.IsType(t, &types.Pair{}, resp)
+	assert.Equal(t, "b", resp.(*types.Pair).Value)
+	resp = lock(LockReleaseType, 12, "a", now.Add(20*time.Second))
+	assert.ErrorIs(t, resp.(error), ErrLockNotHeld)
+}
+
+func TestFSM_Session(t *testing.T) {
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+
+	now := time.Now()
+	apply := func(mt MessageType, index uint64, msg any, at time.Time) interface{} {
+		cmd, err := Encode(mt, msg)
+		require.NoError(t, err)
+		return fsm.Apply(&raft.Log{Index: index, Data: cmd, AppendedAt: at})
+	}
+
+	resp := apply(SessionCreateType, 3, &types.Session{Id: "s1", TtlSeconds: 10}, now)
+	require.IsType(t, &types.Session{}, resp)
+	session := resp.(*types.Session)
+	assert.Equal(t, uint64(3), session.CreateIndex)
+
+	assert.Nil(t, apply(AddPairType, 4, &types.Pair{Key: "svc/a", Value: "1", Session: "s1"}, now))
+	assert.Nil(t, apply(AddPairType, 5, &types.Pair{Key: "svc/b", Value: "2"}, now))
+	resp = apply(AddPairType, 6, &types.Pair{Key: "svc/c", Value: "3", Session: "nope"}, now)
+	assert.ErrorIs(t, resp.(error), ErrSessionNotFound)
+
+	resp = apply(SessionRenewType, 7, &types.RenewSessionRequest{Id: "s1"}, now.Add(5*time.Second))
+	require.IsType(t, &types.Session{}, resp)
+	assert.Equal(t, now.Add(15*time.Second).UnixNano(), resp.(*types.Session).ExpiresAt)
+
+	// The session survives a snapshot.
+	snap, err := fsm.Snapshot()
+	require.NoError(t, err)
+	sink := &testSnapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+	require.NoError(t, fsm.Restore(io.NopCloser(&sink.Buffer)))
+	assert.Len(t, fsm.sessions.expired(now.Add(15*time.Second)), 1)
+
+	// A sweep that saw the expiry before the renewal does nothing.
+	assert.Nil(t, apply(SessionDestroyType, 8, &types.DestroySessionRequest{Id: "s1", ExpiresAt: session.ExpiresAt}, now.Add(11*time.Second)))
+	_, err = s.GetPair("svc/a", ReadOptions{})
+	require.NoError(t, err)
+
+	resp = apply(SessionRenewType, 9, &types.RenewSessionRequest{Id: "s1"}, now.Add(16*time.Second))
+	assert.ErrorIs(t, resp.(error), ErrSessionNotFound)
+
+	assert.Nil(t, apply(SessionDestroyType, 10, &types.DestroySessionRequest{Id: "s1"}, now.Add(16*time.Second)))
+	_, err = s.GetPair("svc/a", ReadOptions{})
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = s.GetPair("svc/b", ReadOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, fsm.sessions.all())
+}
+
+func TestFSM_CustomCommand(t *testing.T) {
+	fsm := newFSM(newTestStore(t), zap.NewNop().Sugar())
+
+	custom := CustomTypeStart + 1
+	fsm.register(LogAppliers{
+		custom: func(buf []byte, l *raft.Log) interface{} {
+			var pair types.Pair
+			if err := proto.Unmarshal(buf, &pair); err != nil {
+				return err
+			}
+			return pair.Key
+		},
+	})
+
+	resp := applyCommand(t, fsm, custom, &types.Pair{Key: "foo"})
+	assert.Equal(t, "foo", resp)
+
+	// Unknown types are skipped, not failed.
+	resp = applyCommand(t, fsm, CustomTypeStart+2, &types.Pair{Key: "foo"})
+	assert.Nil(t, resp)
+}
+
+func TestFSM_CommandVersions(t *testing.T) {
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+
+	payload, err := proto.Marshal(&types.Pair{Key: "foo", Value: "v1"})
+	require.NoError(t, err)
+
+	// Commands logged before versions existed carry only their type.
+	v1 := append([]byte{byte(AddPairType)}, payload...)
+	assert.Nil(t, fsm.Apply(&raft.Log{Index: 1, Data: v1}))
+
+	pair, err := s.GetPair("foo", ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "v1", pair.Value)
+
+	v2, err := Encode(AddPairType, &types.Pair{Key: "foo", Value: "v2"})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{commandMagic, CommandVersion2, byte(AddPairType)}, v2[:3])
+	assert.Nil(t, fsm.Apply(&raft.Log{Index: 2, Data: v2}))
+
+	// A command of a newer agent is skipped, not misread.
+	v3 := append([]byte{commandMagic, CommandVersion + 1, byte(AddPairType)}, payload...)
+	resp := fsm.Apply(&raft.Log{Index: 3, Data: v3})
+	assert.ErrorIs(t, resp.(error), ErrUnsupportedCommandVersion)
+
+	pair, err = s.GetPair("foo", ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "v2", pair.Value)
+}
+
+func TestFSM_Increment(t *testing.T) {
+	s := newTestStore(t)
+	fsm := newFSM(s, zap.NewNop().Sugar())
+
+	resp := applyCommand(t, fsm, IncrementType, &types.IncrementRequest{Key: "id", Delta: 5})
+	require.IsType(t, &types.Pair{}, resp)
+	assert.Equal(t, "5", resp.(*types.Pair).Value)
+
+	applyCommand(t, fsm, AddPairType, &types.Pair{Key: "id", Value: "41", ContentType: "text/plain"})
+	resp = applyCommand(t, fsm, IncrementType, &types.IncrementRequest{Key: "id", Delta: 1})
+	assert.Equal(t, "42", resp.(*types.Pair).Value)
+	assert.Equal(t, "text/plain", resp.(*types.Pair).ContentType)
+
+	resp = applyCommand(t, fsm, IncrementType, &types.IncrementRequest{Key: "id", Delta: -50})
+	assert.Equal(t, "-8", resp.(*types.Pair).Value)
+
+	applyCommand(t, fsm, AddPairType, &types.Pair{Key: "name", Value: "foo"})
+	resp = applyCommand(t, fsm, IncrementType, &types.IncrementRequest{Key: "name", Delta: 1})
+	assert.ErrorIs(t, resp.(error), ErrNotInteger)
+
+	applyCommand(t, fsm, AddPairType, &types.Pair{Key: "max", Value: "9223372036854775807"})
+	resp = applyCommand(t, fsm, IncrementType, &types.IncrementRequest{Key: "max", Delta: 1})
+	assert.ErrorIs(t, resp.(error), ErrIncrementOverflow)
+
+	pair, err := s.GetPair("max", ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "9223372036854775807", pair.Value)
+}
+
+func TestFSM_Checksum(t *testing.T) {
+	checksum := func(fsm *taskvaultFSM, index uint64) storeChecksum {
+		cmd, err := Encode(ChecksumType, &types.StoreChecksumRequest{})
+		require.NoError(t, err)
+		return fsm.Apply(&raft.Log{Index: index, Data: cmd}).(storeChecksum)
+	}
+
+	leader := newFSM(newTestStore(t), zap.NewNop().Sugar())
+	follower := newFSM(newTestStore(t), zap.NewNop().Sugar())
+	for _, fsm := range []*taskvaultFSM{leader, follower} {
+		applyCommand(t, fsm, AddPairType, &types.Pair{Key: "foo", Value: "bar"})
+		applyCommand(t, fsm, AddPairType, &types.Pair{Key: "baz", Value: "qux"})
+	}
+
+	want := checksum(leader, 3)
+	assert.Equal(t, uint64(2), want.keys)
+	assert.Equal(t, want, checksum(follower, 3))
+
+	// A store that drifted from the log no longer matches.
+	require.NoError(t, follower.store.SetValue("foo", "corrupt"))
+	got := checksum(follower, 4)
+	assert.NotEqual(t, want.checksum, got.checksum)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sum, err := follower.checksums.wait(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, want, sum)
+	_, err = follower.checksums.wait(ctx, 2)
+	assert.ErrorIs(t, err, ErrChecksumUnavailable)
+
+	go checksum(follower, 5)
+	sum, err = follower.checksums.wait(ctx, 5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), sum.index)
+}
+
+// countingFSM counts the log entries and snapshots a node applied.
+type countingFSM struct {
+	*taskvaultFSM
+	applied  atomic.Int64
+	restored atomic.Int64
+}
+
+func (f *countingFSM) Apply(l *raft.Log) interface{} {
+	f.applied.Add(1)
+	return f.taskvaultFSM.Apply(l)
+}
+
+func (f *countingFSM) Restore(r io.ReadCloser) error {
+	f.restored.Add(1)
+	return f.taskvaultFSM.Restore(r)
+}
+
+func TestFSM_InstallSnapshot(t *testing.T) {
+	const keys = 20000
+
+	newNode := func(id string, trans *raft.InmemTransport) (*raft.Raft, *countingFSM, *Store) {
+		rc := raft.DefaultConfig()
+		rc.LocalID = raft.ServerID(id)
+		rc.TrailingLogs = 10
+		s := newTestStore(t)
+		fsm := &countingFSM{taskvaultFSM: newFSM(s, zap.NewNop().Sugar())}
+		logs := raft.NewInmemStore()
+		r, err := raft.NewRaft(rc, fsm, logs, logs, raft.NewInmemSnapshotStore(), trans)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = r.Shutdown().Error() })
+		return r, fsm, s
+	}
+
+	leaderAddr, leaderTrans := raft.NewInmemTransport("")
+	followerAddr, followerTrans := raft.NewInmemTransport("")
+	leaderTrans.Connect(followerAddr, followerTrans)
+	followerTrans.Connect(leaderAddr, leaderTrans)
+
+	leader, _, _ := newNode("leader", leaderTrans)
+	require.NoError(t, leader.BootstrapCluster(raft.Configuration{
+		Servers: []raft.Server{{ID: "leader", Address: leaderAddr}},
+	}).Error())
+	require.Eventually(t, func() bool { return leader.State() == raft.Leader },
+		5*time.Second, 10*time.Millisecond)
+
+	var last raft.ApplyFuture
+	for i := 0; i < keys; i++ {
+		cmd, err := Encode(AddPairType, &types.Pair{Key: fmt.Sprintf("key/%05d", i), Value: "value"})
+		require.NoError(t, err)
+		last = leader.Apply(cmd, 0)
+	}
+	require.NoError(t, last.Error())
+	require.NoError(t, leader.Snapshot().Error())
+
+	follower, fsm, store := newNode("follower", followerTrans)
+	require.NoError(t, leader.AddVoter("follower", followerAddr, 0, 0).Error())
+
+	require.Eventually(t, func() bool {
+		return follower.AppliedIndex() >= last.Index()
+	}, 30*time.Second, 50*time.Millisecond)
+
+	n, err := store.Len()
+	require.NoError(t, err)
+	assert.Equal(t, keys, n)
+	assert.Equal(t, int64(1), fsm.restored.Load())
+	assert.Less(t, fsm.applied.Load(), int64(keys/100))
+}
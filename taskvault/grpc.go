@@ -1,18 +1,31 @@
 package taskvault
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/armon/go-metrics"
 	types2 "github.com/danluki/taskvault/pkg/types"
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
@@ -20,33 +33,111 @@ import (
 type TaskvaultGRPCServer interface {
 	types2.TaskvaultServer
 	Serve(net.Listener) error
+	Stop(deadline time.Time)
 }
 
 type GRPCServer struct {
 	types2.TaskvaultServer
-	agent  *Agent
-	logger *zap.SugaredLogger
+	agent   *Agent
+	logger  *zap.SugaredLogger
+	limiter *rateLimiter
+	server  *grpc.Server
+
+	// draining is closed when Stop starts, it ends the watch streams.
+	draining  chan struct{}
+	drainOnce sync.Once
 }
 
 func NewGRPCServer(agent *Agent, logger *zap.SugaredLogger) TaskvaultGRPCServer {
 	return &GRPCServer{
-		agent:  agent,
-		logger: logger,
+		agent:    agent,
+		logger:   logger,
+		limiter:  newRateLimiter(agent.config),
+		draining: make(chan struct{}),
 	}
 }
 
 func (grpcs *GRPCServer) Serve(lis net.Listener) error {
-	grpcServer := grpc.NewServer()
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			unaryTracingInterceptor,
+			grpcs.unaryLoggingInterceptor,
+			grpcs.unaryAuthInterceptor,
+			grpcs.unaryRateLimitInterceptor,
+			grpcs.unaryReadOnlyInterceptor,
+			grpcs.unaryNamespaceInterceptor,
+		),
+		grpc.ChainStreamInterceptor(
+			streamTracingInterceptor,
+			grpcs.streamAuthInterceptor,
+			grpcs.streamRateLimitInterceptor,
+			grpcs.streamReadOnlyInterceptor,
+			grpcs.streamNamespaceInterceptor,
+		),
+	}
+	opts = append(opts, grpcs.agent.config.grpcServerOptions()...)
+	if grpcs.agent.config.TLSEnabled() {
+		tlsConf, err := grpcs.agent.config.incomingTLSConfig(grpcs.agent.keyPair)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConf)))
+	}
+
+	grpcServer := grpc.NewServer(opts...)
+	grpcs.server = grpcServer
 	types2.RegisterTaskvaultServer(grpcServer, grpcs)
+	grpc_health_v1.RegisterHealthServer(grpcServer, &healthServer{agent: grpcs.agent})
+	if grpcs.agent.config.EnableReflection {
+		reflection.Register(grpcServer)
+	}
 
-	go grpcServer.Serve(lis)
+	go grpcServer.Serve(newSharedListener(lis))
 
 	return nil
 }
 
+// unaryLoggingInterceptor logs every call with its duration and status code
+// at debug level.
+func (grpcs *GRPCServer) unaryLoggingInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	grpcs.logger.Debugw("grpc: Handled request",
+		"method", info.FullMethod,
+		"duration", time.Since(start).String(),
+		"code", status.Code(err).String(),
+	)
+
+	return resp, err
+}
+
+const (
+	// commandMagic starts a versioned command: magic, version, type and the
+	// protobuf payload. Commands written before versions existed start with
+	// their type, which is always lower, and are read as version 1.
+	commandMagic byte = 0xff
+
+	CommandVersion1 uint8 = 1
+	CommandVersion2 uint8 = 2
+
+	// CommandVersion is the version this agent writes and the highest one
+	// it can read.
+	CommandVersion = CommandVersion2
+)
+
+// ErrUnsupportedCommandVersion is returned for a command written by a newer
+// agent, it is not applied rather than misread.
+var ErrUnsupportedCommandVersion = errors.New("unsupported command version")
+
 func Encode(t MessageType, msg any) ([]byte, error) {
 	var buf bytes.Buffer
-	buf.WriteByte(uint8(t))
+	buf.Write([]byte{commandMagic, CommandVersion, uint8(t)})
 	m, err := proto.Marshal(msg.(proto.Message))
 	if err != nil {
 		return nil, err
@@ -55,24 +146,166 @@ func Encode(t MessageType, msg any) ([]byte, error) {
 	return buf.Bytes(), err
 }
 
+// decodeCommand splits a command into its version, type and payload.
+func decodeCommand(data []byte) (uint8, MessageType, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, errors.New("empty command")
+	}
+	if data[0] != commandMagic {
+		return CommandVersion1, MessageType(data[0]), data[1:], nil
+	}
+	if len(data) < 3 {
+		return 0, 0, nil, errors.New("truncated command header")
+	}
+
+	version := data[1]
+	if version < CommandVersion2 || version > CommandVersion {
+		return version, 0, nil, fmt.Errorf("%w: %d", ErrUnsupportedCommandVersion, version)
+	}
+	return version, MessageType(data[2]), data[3:], nil
+}
+
+// forwardedMetadataKey marks a write a follower already forwarded, so a node
+// that lost leadership in the meantime fails it instead of bouncing it on.
+const forwardedMetadataKey = "x-taskvault-forwarded"
+
+// forward hands the call to the current leader when this node is a follower.
+// It reports false when the request must be served locally.
+func (g *GRPCServer) forward(
+	ctx context.Context, fn func(context.Context, types2.TaskvaultClient) error,
+) (bool, error) {
+	if g.agent.IsLeader() {
+		return false, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if len(md.Get(forwardedMetadataKey)) > 0 {
+		return true, applyError(raft.ErrNotLeader)
+	}
+
+	leader, err := g.agent.leaderRPCAddr()
+	if err != nil {
+		return true, applyError(err)
+	}
+
+	ctx, span := tracer.Start(ctx, "taskvault.forward",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("leader", leader)),
+	)
+	defer func() { endSpan(span, err) }()
+
+	conn, err := g.agent.GRPCClient.Connect(leader)
+	if err != nil {
+		g.logger.With(
+			zap.Error(err),
+			zap.String("leader", leader),
+		).Error("grpc: Failed to reach leader")
+		return true, status.Error(codes.Unavailable, err.Error())
+	}
+	defer conn.Close()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, forwardedMetadataKey, "1")
+	if key := md.Get(idempotencyMetadataKey); len(key) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, idempotencyMetadataKey, key[0])
+	}
+	err = fn(ctx, types2.NewTaskvaultClient(conn))
+	return true, err
+}
+
+func (c *Config) grpcServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(c.GRPCMaxRecvMsgSize),
+		grpc.MaxSendMsgSize(c.GRPCMaxSendMsgSize),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    c.GRPCKeepaliveTime,
+			Timeout: c.GRPCKeepaliveTimeout,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime: c.GRPCKeepaliveMinTime,
+		}),
+	}
+}
+
+// errorReasons maps the errors clients may branch on to a status code and
+// the reason sent along as ErrorDetail. Unavailable means the call is safe to
+// retry, on another node if need be.
+var errorReasons = []struct {
+	err    error
+	code   codes.Code
+	reason types2.ErrorReason
+}{
+	{raft.ErrNotLeader, codes.Unavailable, types2.ErrorReason_REASON_NO_LEADER},
+	{raft.ErrLeadershipLost, codes.Unavailable, types2.ErrorReason_REASON_NO_LEADER},
+	{ErrLeaderNotFound, codes.Unavailable, types2.ErrorReason_REASON_NO_LEADER},
+	{ErrNoSuitableServer, codes.Unavailable, types2.ErrorReason_REASON_NO_SUITABLE_SERVER},
+	{ErrApplyQueueFull, codes.ResourceExhausted, types2.ErrorReason_REASON_OVERLOADED},
+	{ErrStaleContinueToken, codes.Unavailable, types2.ErrorReason_REASON_STALE_TOKEN},
+	{ErrKeyTooLarge, codes.InvalidArgument, types2.ErrorReason_REASON_KEY_TOO_LARGE},
+	{ErrValueTooLarge, codes.InvalidArgument, types2.ErrorReason_REASON_VALUE_TOO_LARGE},
+	{ErrInvalidIdempotencyKey, codes.InvalidArgument, types2.ErrorReason_REASON_INVALID_REQUEST},
+	{ErrInvalidLock, codes.InvalidArgument, types2.ErrorReason_REASON_INVALID_REQUEST},
+	{ErrInvalidSession, codes.InvalidArgument, types2.ErrorReason_REASON_INVALID_REQUEST},
+	{ErrKeyNotFound, codes.NotFound, types2.ErrorReason_REASON_KEY_NOT_FOUND},
+	{ErrSessionNotFound, codes.NotFound, types2.ErrorReason_REASON_SESSION_NOT_FOUND},
+	{ErrNotInteger, codes.FailedPrecondition, types2.ErrorReason_REASON_NOT_INTEGER},
+	{ErrIncrementOverflow, codes.FailedPrecondition, types2.ErrorReason_REASON_OVERFLOW},
+}
+
+// reasonError returns a status error with reason attached as ErrorDetail.
+func reasonError(code codes.Code, reason types2.ErrorReason, msg string) error {
+	st := status.New(code, msg)
+	if detailed, err := st.WithDetails(&types2.ErrorDetail{Reason: reason}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// applyError turns the errors of errorReasons into their status, and reports
+// a caller that gave up with its own context code.
+func applyError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	for _, r := range errorReasons {
+		if errors.Is(err, r.err) {
+			return reasonError(r.code, r.reason, err.Error())
+		}
+	}
+	return err
+}
+
 func (g *GRPCServer) CreateValue(
 	ctx context.Context,
 	req *types2.CreateValueRequest,
 ) (*types2.CreateValueResponse, error) {
 	defer metrics.MeasureSince([]string{"grpc", "create_value"}, time.Now())
 
-	if err := g.agent.applySetPair(
-		&types2.Pair{
-			Key:   req.Key,
-			Value: req.Value,
-		},
-	); err != nil {
-		return nil, err
+	if err := g.agent.config.checkPairSize(req.Key, req.Value); err != nil {
+		return nil, applyError(err)
 	}
 
-	err := g.agent.Store.SetValue(req.Key, req.Value)
-	if err != nil {
-		return nil, err
+	var resp *types2.CreateValueResponse
+	if ok, err := g.forward(ctx, func(ctx context.Context, c types2.TaskvaultClient) (err error) {
+		resp, err = c.CreateValue(ctx, req)
+		return err
+	}); ok {
+		return resp, err
+	}
+
+	pair := &types2.Pair{
+		Key:         req.Key,
+		Value:       req.Value,
+		Session:     req.Session,
+		ContentType: req.ContentType,
+		Flags:       req.Flags,
+	}
+	if req.TtlSeconds > 0 {
+		ttl := time.Duration(req.TtlSeconds) * time.Second
+		pair.ExpiresAt = time.Now().Add(ttl).UnixNano()
+	}
+
+	if err := g.agent.applySetPair(ctx, pair); err != nil {
+		return nil, applyError(err)
 	}
 
 	return &types2.CreateValueResponse{
@@ -81,36 +314,285 @@ func (g *GRPCServer) CreateValue(
 	}, nil
 }
 
-func (g *GRPCServer) DeleteValue(
+func (g *GRPCServer) CompareAndSwap(
 	ctx context.Context,
-	req *types2.DeleteValueRequest,
-) (*types2.DeleteValueResponse, error) {
-	defer metrics.MeasureSince([]string{"grpc", "delete_value"}, time.Now())
+	req *types2.CompareAndSwapRequest,
+) (*types2.CompareAndSwapResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "compare_and_swap"}, time.Now())
+
+	if err := g.agent.config.checkPairSize(req.Key, req.Value); err != nil {
+		return nil, applyError(err)
+	}
+
+	var resp *types2.CompareAndSwapResponse
+	if ok, err := g.forward(ctx, func(ctx context.Context, c types2.TaskvaultClient) (err error) {
+		resp, err = c.CompareAndSwap(ctx, req)
+		return err
+	}); ok {
+		return resp, err
+	}
+
+	pair := &types2.Pair{
+		Key:         req.Key,
+		Value:       req.Value,
+		Session:     req.Session,
+		ContentType: req.ContentType,
+		Flags:       req.Flags,
+	}
+	if req.TtlSeconds > 0 {
+		ttl := time.Duration(req.TtlSeconds) * time.Second
+		pair.ExpiresAt = time.Now().Add(ttl).UnixNano()
+	}
 
-	cmd, err := Encode(DeletePairType, &req)
+	stored, err := g.agent.applyCASPair(ctx, pair, req.ModifyIndex)
 	if err != nil {
-		return nil, err
+		if errors.Is(err, ErrCASFailed) {
+			return &types2.CompareAndSwapResponse{Success: false}, nil
+		}
+		return nil, applyError(err)
 	}
 
-	af := g.agent.raft.Apply(cmd, raftTimeout)
-	if err := af.Error(); err != nil {
-		return nil, err
+	return &types2.CompareAndSwapResponse{
+		Success: true,
+		Pair:    stored,
+	}, nil
+}
+
+// Increment adds the delta to the integer value of a key on the leader.
+func (g *GRPCServer) Increment(
+	ctx context.Context,
+	req *types2.IncrementRequest,
+) (*types2.IncrementResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "increment"}, time.Now())
+
+	var resp *types2.IncrementResponse
+	if ok, err := g.forward(ctx, func(ctx context.Context, c types2.TaskvaultClient) (err error) {
+		resp, err = c.Increment(ctx, req)
+		return err
+	}); ok {
+		return resp, err
+	}
+
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is required")
 	}
 
-	err = g.agent.Store.DeleteValue(req.Key)
+	pair, err := g.agent.increment(ctx, req.Key, req.Delta)
+	if err != nil {
+		return nil, applyError(err)
+	}
+	value, err := strconv.ParseInt(pair.Value, 10, 64)
 	if err != nil {
 		return nil, err
 	}
 
-	res := af.Response()
-	resm, ok := res.(*types2.DeleteValueResponse)
-	if !ok {
-		return nil, fmt.Errorf(
-			"grpc: Error wrong response from apply in DeleteValue: %v", res,
-		)
+	return &types2.IncrementResponse{Value: value, Pair: pair}, nil
+}
+
+// AcquireLock takes or renews a lock lease. A lock held by someone else is
+// reported through Acquired and Holder, not as an error.
+func (g *GRPCServer) AcquireLock(
+	ctx context.Context,
+	req *types2.AcquireLockRequest,
+) (*types2.AcquireLockResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "acquire_lock"}, time.Now())
+
+	var resp *types2.AcquireLockResponse
+	if ok, err := g.forward(ctx, func(ctx context.Context, c types2.TaskvaultClient) (err error) {
+		resp, err = c.AcquireLock(ctx, req)
+		return err
+	}); ok {
+		return resp, err
+	}
+
+	ttl := time.Duration(req.TtlSeconds) * time.Second
+	pair, err := g.agent.AcquireLock(ctx, req.Key, req.Holder, ttl)
+	if err != nil {
+		var held *LockHeldError
+		if errors.As(err, &held) {
+			return &types2.AcquireLockResponse{
+				Acquired: false,
+				Holder:   held.Holder,
+			}, nil
+		}
+		return nil, applyError(err)
+	}
+
+	return &types2.AcquireLockResponse{
+		Acquired: true,
+		Pair:     pair,
+		Holder:   req.Holder,
+	}, nil
+}
+
+func (g *GRPCServer) ReleaseLock(
+	ctx context.Context,
+	req *types2.ReleaseLockRequest,
+) (*types2.ReleaseLockResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "release_lock"}, time.Now())
+
+	var resp *types2.ReleaseLockResponse
+	if ok, err := g.forward(ctx, func(ctx context.Context, c types2.TaskvaultClient) (err error) {
+		resp, err = c.ReleaseLock(ctx, req)
+		return err
+	}); ok {
+		return resp, err
+	}
+
+	if err := g.agent.ReleaseLock(ctx, req.Key, req.Holder); err != nil {
+		if errors.Is(err, ErrLockNotHeld) {
+			return &types2.ReleaseLockResponse{Released: false}, nil
+		}
+		return nil, applyError(err)
+	}
+
+	return &types2.ReleaseLockResponse{Released: true}, nil
+}
+
+func (g *GRPCServer) CreateSession(
+	ctx context.Context,
+	req *types2.CreateSessionRequest,
+) (*types2.SessionResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "create_session"}, time.Now())
+
+	var resp *types2.SessionResponse
+	if ok, err := g.forward(ctx, func(ctx context.Context, c types2.TaskvaultClient) (err error) {
+		resp, err = c.CreateSession(ctx, req)
+		return err
+	}); ok {
+		return resp, err
+	}
+
+	session, err := g.agent.CreateSession(ctx, time.Duration(req.TtlSeconds)*time.Second)
+	if err != nil {
+		return nil, applyError(err)
+	}
+
+	return &types2.SessionResponse{Session: session}, nil
+}
+
+func (g *GRPCServer) RenewSession(
+	ctx context.Context,
+	req *types2.RenewSessionRequest,
+) (*types2.SessionResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "renew_session"}, time.Now())
+
+	var resp *types2.SessionResponse
+	if ok, err := g.forward(ctx, func(ctx context.Context, c types2.TaskvaultClient) (err error) {
+		resp, err = c.RenewSession(ctx, req)
+		return err
+	}); ok {
+		return resp, err
+	}
+
+	session, err := g.agent.RenewSession(ctx, req.Id)
+	if err != nil {
+		return nil, applyError(err)
+	}
+
+	return &types2.SessionResponse{Session: session}, nil
+}
+
+func (g *GRPCServer) DestroySession(
+	ctx context.Context,
+	req *types2.DestroySessionRequest,
+) (*emptypb.Empty, error) {
+	defer metrics.MeasureSince([]string{"grpc", "destroy_session"}, time.Now())
+
+	if ok, err := g.forward(ctx, func(ctx context.Context, c types2.TaskvaultClient) error {
+		_, err := c.DestroySession(ctx, req)
+		return err
+	}); ok {
+		if err != nil {
+			return nil, err
+		}
+		return &emptypb.Empty{}, nil
+	}
+
+	if err := g.agent.DestroySession(ctx, req.Id); err != nil {
+		return nil, applyError(err)
 	}
 
-	return resm, nil
+	return &emptypb.Empty{}, nil
+}
+
+// Txn applies a batch of sets and deletes atomically. A failed ModifyIndex
+// check is reported through Success and FailedOp, not as an error.
+func (g *GRPCServer) Txn(
+	ctx context.Context,
+	req *types2.TxnRequest,
+) (*types2.TxnResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "txn"}, time.Now())
+
+	for _, op := range req.Ops {
+		if err := g.agent.config.checkPairSize(op.GetPair().GetKey(), op.GetPair().GetValue()); err != nil {
+			return nil, applyError(err)
+		}
+	}
+
+	var resp *types2.TxnResponse
+	if ok, err := g.forward(ctx, func(ctx context.Context, c types2.TaskvaultClient) (err error) {
+		resp, err = c.Txn(ctx, req)
+		return err
+	}); ok {
+		return resp, err
+	}
+
+	if len(req.Ops) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "txn without operations")
+	}
+	now := time.Now()
+	for i, op := range req.Ops {
+		if op.Pair == nil || op.Pair.Key == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "txn op %d without key", i)
+		}
+		op.Pair.ModifyIndex = 0
+		op.Pair.ExpiresAt = 0
+		if op.TtlSeconds > 0 {
+			ttl := time.Duration(op.TtlSeconds) * time.Second
+			op.Pair.ExpiresAt = now.Add(ttl).UnixNano()
+		}
+	}
+
+	index, err := g.agent.ApplyTxn(ctx, req.Ops)
+	if err != nil {
+		var failed *TxnFailedError
+		if errors.As(err, &failed) {
+			return &types2.TxnResponse{
+				Success:  false,
+				FailedOp: int32(failed.Op),
+			}, nil
+		}
+		return nil, applyError(err)
+	}
+
+	return &types2.TxnResponse{
+		Success:     true,
+		ModifyIndex: index,
+	}, nil
+}
+
+func (g *GRPCServer) DeleteValue(
+	ctx context.Context,
+	req *types2.DeleteValueRequest,
+) (*types2.DeleteValueResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "delete_value"}, time.Now())
+
+	var resp *types2.DeleteValueResponse
+	if ok, err := g.forward(ctx, func(ctx context.Context, c types2.TaskvaultClient) (err error) {
+		resp, err = c.DeleteValue(ctx, req)
+		return err
+	}); ok {
+		return resp, err
+	}
+
+	if err := g.agent.applyDeletePair(ctx, req.Key); err != nil {
+		return nil, applyError(err)
+	}
+
+	return &types2.DeleteValueResponse{
+		Key: req.Key,
+	}, nil
 }
 
 func (g *GRPCServer) GetAllPairs(
@@ -154,10 +636,564 @@ func (g *GRPCServer) GetValue(
 	}, nil
 }
 
+func (g *GRPCServer) GetPair(
+	ctx context.Context,
+	req *types2.GetPairRequest,
+) (*types2.GetPairResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "get_pair"}, time.Now())
+
+	opts := ReadOptions{
+		Consistency: consistencyFromProto(req.Consistency),
+	}
+	if req.WaitIndex == 0 {
+		pair, err := g.agent.GetPair(req.Key, opts)
+		if err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				return nil, applyError(err)
+			}
+			return nil, err
+		}
+
+		return &types2.GetPairResponse{
+			Pair:  pair,
+			Index: pair.ModifyIndex,
+		}, nil
+	}
+
+	// A blocking read answers a missing key without an error, the index is
+	// needed to wait for it to appear.
+	pair, index, err := g.agent.BlockingGetPair(ctx, req.Key, opts, BlockingOptions{
+		WaitIndex: req.WaitIndex,
+		WaitTime:  time.Duration(req.WaitTimeMs) * time.Millisecond,
+	})
+	if err != nil {
+		return nil, applyError(err)
+	}
+
+	return &types2.GetPairResponse{
+		Pair:  pair,
+		Index: index,
+	}, nil
+}
+
+func (g *GRPCServer) StatPair(
+	ctx context.Context,
+	req *types2.StatPairRequest,
+) (*types2.PairMeta, error) {
+	defer metrics.MeasureSince([]string{"grpc", "stat_pair"}, time.Now())
+
+	meta, err := g.agent.StatPair(req.Key)
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil, applyError(err)
+		}
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+func (g *GRPCServer) ListPairs(
+	ctx context.Context,
+	req *types2.ListPairsRequest,
+) (*types2.ListPairsResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "list_pairs"}, time.Now())
+
+	pairs, token, index, err := g.agent.BlockingListPairs(
+		ctx, req.Prefix, int(req.Limit), req.ContinueToken, BlockingOptions{
+			WaitIndex: req.WaitIndex,
+			WaitTime:  time.Duration(req.WaitTimeMs) * time.Millisecond,
+		},
+	)
+	if err != nil {
+		if errors.Is(err, ErrInvalidContinueToken) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, applyError(err)
+	}
+
+	return &types2.ListPairsResponse{
+		Pairs:         pairs,
+		ContinueToken: token,
+		Index:         index,
+	}, nil
+}
+
+// ListKeys returns the keys under a prefix without their values. Like
+// ListPairs it is a stale read of the local store.
+func (g *GRPCServer) ListKeys(
+	ctx context.Context,
+	req *types2.ListKeysRequest,
+) (*types2.ListKeysResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "list_keys"}, time.Now())
+
+	keys, err := g.agent.Store.ListKeys(req.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types2.ListKeysResponse{
+		Keys: keys,
+	}, nil
+}
+
+func (g *GRPCServer) Count(
+	ctx context.Context,
+	req *types2.CountRequest,
+) (*types2.CountResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "count"}, time.Now())
+
+	n, err := g.agent.Store.Count(req.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types2.CountResponse{
+		Count: int64(n),
+	}, nil
+}
+
+func consistencyFromProto(c types2.Consistency) Consistency {
+	switch c {
+	case types2.Consistency_LINEARIZABLE:
+		return Linearizable
+	case types2.Consistency_READ_INDEX:
+		return ReadIndex
+	default:
+		return Stale
+	}
+}
+
+func consistencyToProto(c Consistency) types2.Consistency {
+	switch c {
+	case Linearizable:
+		return types2.Consistency_LINEARIZABLE
+	case ReadIndex:
+		return types2.Consistency_READ_INDEX
+	default:
+		return types2.Consistency_STALE
+	}
+}
+
+// Leave stops the agent in the background. Stop drains this server, a call
+// waiting for it would wait for itself.
 func (g *GRPCServer) Leave(
 	ctx context.Context, req *emptypb.Empty,
 ) (*emptypb.Empty, error) {
-	return req, g.agent.Stop()
+	go func() {
+		if err := g.agent.Stop(); err != nil {
+			g.logger.With(zap.Error(err)).Error("grpc: Error stopping agent")
+		}
+	}()
+	return req, nil
+}
+
+func (g *GRPCServer) RaftStats(
+	ctx context.Context,
+	req *emptypb.Empty,
+) (*types2.RaftStatsResponse, error) {
+	return &types2.RaftStatsResponse{
+		Stats: g.agent.RaftStats(),
+	}, nil
+}
+
+// GetLeader answers with an empty response while there is no leader, clients
+// retry instead of handling an error.
+func (g *GRPCServer) GetLeader(
+	ctx context.Context,
+	req *emptypb.Empty,
+) (*types2.GetLeaderResponse, error) {
+	resp, err := g.agent.Leader()
+	if err != nil && !errors.Is(err, ErrLeaderNotFound) {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (g *GRPCServer) StoreChecksum(
+	ctx context.Context,
+	req *types2.StoreChecksumRequest,
+) (*types2.StoreChecksumResponse, error) {
+	resp, err := g.agent.StoreChecksum(ctx, req.Index)
+	if errors.Is(err, ErrChecksumUnavailable) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return resp, applyError(err)
+}
+
+func (g *GRPCServer) RaftStatus(
+	ctx context.Context,
+	req *emptypb.Empty,
+) (*types2.RaftStatusResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "raft_status"}, time.Now())
+
+	return g.agent.RaftStatus(ctx)
+}
+
+// PlanReconcile previews the raft configuration changes the leader would make
+// on its next refresh.
+func (g *GRPCServer) PlanReconcile(
+	ctx context.Context,
+	req *emptypb.Empty,
+) (*types2.PlanReconcileResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "plan_reconcile"}, time.Now())
+
+	plan, err := g.agent.PlanReconcile()
+	if err != nil {
+		if errors.Is(err, raft.ErrNotLeader) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, err
+	}
+
+	resp := &types2.PlanReconcileResponse{
+		Ops: make([]*types2.ReconcileOp, len(plan)),
+	}
+	for i, op := range plan {
+		resp.Ops[i] = &types2.ReconcileOp{
+			Action:  types2.ReconcileAction(op.Action),
+			Member:  op.Member,
+			Id:      string(op.ID),
+			Address: string(op.Address),
+		}
+	}
+
+	return resp, nil
+}
+
+// SetTag sets a custom serf tag on the serving node.
+func (g *GRPCServer) SetTag(
+	ctx context.Context,
+	req *types2.SetTagRequest,
+) (*emptypb.Empty, error) {
+	defer metrics.MeasureSince([]string{"grpc", "set_tag"}, time.Now())
+
+	if err := g.agent.SetTag(req.Key, req.Value); err != nil {
+		return nil, tagError(err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// DeleteTag removes a custom serf tag from the serving node.
+func (g *GRPCServer) DeleteTag(
+	ctx context.Context,
+	req *types2.DeleteTagRequest,
+) (*emptypb.Empty, error) {
+	defer metrics.MeasureSince([]string{"grpc", "delete_tag"}, time.Now())
+
+	if err := g.agent.DeleteTag(req.Key); err != nil {
+		return nil, tagError(err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// SetMaintenance puts the serving node in maintenance, or takes it out.
+func (g *GRPCServer) SetMaintenance(
+	ctx context.Context,
+	req *types2.SetMaintenanceRequest,
+) (*emptypb.Empty, error) {
+	defer metrics.MeasureSince([]string{"grpc", "set_maintenance"}, time.Now())
+
+	if err := g.agent.SetMaintenance(req.Enabled, req.Reason); err != nil {
+		return nil, err
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (g *GRPCServer) KeyringList(
+	ctx context.Context,
+	req *emptypb.Empty,
+) (*types2.KeyringResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "keyring_list"}, time.Now())
+
+	return keyringResponse(g.agent.KeyringList())
+}
+
+func (g *GRPCServer) KeyringInstall(
+	ctx context.Context,
+	req *types2.KeyringRequest,
+) (*types2.KeyringResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "keyring_install"}, time.Now())
+
+	return keyringResponse(g.agent.KeyringInstall(req.Key))
+}
+
+func (g *GRPCServer) KeyringUse(
+	ctx context.Context,
+	req *types2.KeyringRequest,
+) (*types2.KeyringResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "keyring_use"}, time.Now())
+
+	return keyringResponse(g.agent.KeyringUse(req.Key))
+}
+
+func (g *GRPCServer) KeyringRemove(
+	ctx context.Context,
+	req *types2.KeyringRequest,
+) (*types2.KeyringResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "keyring_remove"}, time.Now())
+
+	return keyringResponse(g.agent.KeyringRemove(req.Key))
+}
+
+// keyringResponse converts the answer of a keyring operation. When some
+// members failed it, the response is still returned with NumErr and their
+// messages set, the caller decides whether to retry.
+func keyringResponse(resp *serf.KeyResponse, err error) (*types2.KeyringResponse, error) {
+	switch {
+	case errors.Is(err, ErrInvalidEncryptKey):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrEncryptionDisabled):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case resp == nil:
+		return nil, err
+	}
+
+	counts := func(m map[string]int) map[string]int32 {
+		out := make(map[string]int32, len(m))
+		for k, v := range m {
+			out[k] = int32(v)
+		}
+		return out
+	}
+	return &types2.KeyringResponse{
+		Keys:        counts(resp.Keys),
+		PrimaryKeys: counts(resp.PrimaryKeys),
+		NumNodes:    int32(resp.NumNodes),
+		NumResp:     int32(resp.NumResp),
+		NumErr:      int32(resp.NumErr),
+		Messages:    resp.Messages,
+	}, nil
+}
+
+func tagError(err error) error {
+	if errors.Is(err, ErrInvalidTag) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return err
+}
+
+func (g *GRPCServer) Members(
+	ctx context.Context,
+	req *types2.MembersRequest,
+) (*types2.MembersResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "members"}, time.Now())
+
+	members, err := g.agent.Members(req.Datacenter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types2.MembersResponse{
+		Members: members,
+	}, nil
+}
+
+// NodeStatus is answered by the leader, whose view of the followers is the
+// one that matters.
+func (g *GRPCServer) NodeStatus(
+	ctx context.Context,
+	req *emptypb.Empty,
+) (*types2.NodeStatusResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "node_status"}, time.Now())
+
+	var resp *types2.NodeStatusResponse
+	if ok, err := g.forward(ctx, func(ctx context.Context, c types2.TaskvaultClient) (err error) {
+		resp, err = c.NodeStatus(ctx, req)
+		return err
+	}); ok {
+		return resp, err
+	}
+
+	members, err := g.agent.NodeStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types2.NodeStatusResponse{
+		Members: members,
+	}, nil
+}
+
+func (g *GRPCServer) LeadershipTransfer(
+	ctx context.Context,
+	req *types2.LeadershipTransferRequest,
+) (*emptypb.Empty, error) {
+	if err := g.agent.LeadershipTransfer(req.Target); err != nil {
+		switch {
+		case errors.Is(err, raft.ErrNotLeader):
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		case errors.Is(err, ErrTargetNotVoter):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		case errors.Is(err, ErrTargetInMaintenance):
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, err
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// ForceLeave runs on the leader, so the member also leaves the raft
+// configuration.
+func (g *GRPCServer) ForceLeave(
+	ctx context.Context,
+	req *types2.ForceLeaveRequest,
+) (*emptypb.Empty, error) {
+	if ok, err := g.forward(ctx, func(ctx context.Context, c types2.TaskvaultClient) error {
+		_, err := c.ForceLeave(ctx, req)
+		return err
+	}); ok {
+		if err != nil {
+			return nil, err
+		}
+		return &emptypb.Empty{}, nil
+	}
+
+	if err := g.agent.ForceLeave(req.Name); err != nil {
+		switch {
+		case errors.Is(err, ErrMemberNotFound):
+			return nil, status.Error(codes.NotFound, err.Error())
+		case errors.Is(err, ErrMemberAlive), errors.Is(err, ErrForceLeaveLeader):
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, applyError(err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (g *GRPCServer) Snapshot(
+	ctx context.Context,
+	req *emptypb.Empty,
+) (*types2.SnapshotResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "snapshot"}, time.Now())
+
+	index, err := g.agent.Snapshot()
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNotVoter), errors.Is(err, raft.ErrNothingNewToSnapshot):
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, err
+	}
+
+	return &types2.SnapshotResponse{
+		Index: index,
+	}, nil
+}
+
+// backupChunkSize is the size of the messages a backup is streamed in.
+const backupChunkSize = 64 << 10
+
+func (g *GRPCServer) Backup(
+	req *emptypb.Empty,
+	stream types2.Taskvault_BackupServer,
+) error {
+	defer metrics.MeasureSince([]string{"grpc", "backup"}, time.Now())
+
+	w := bufio.NewWriterSize(&chunkWriter{send: stream.Send}, backupChunkSize)
+	if err := g.agent.Backup(w); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func (g *GRPCServer) Restore(stream types2.Taskvault_RestoreServer) error {
+	defer metrics.MeasureSince([]string{"grpc", "restore"}, time.Now())
+
+	applied, err := g.agent.Restore(&chunkReader{recv: stream.Recv})
+	if err != nil {
+		switch {
+		case errors.Is(err, raft.ErrNotLeader):
+			return status.Error(codes.FailedPrecondition, err.Error())
+		case errors.Is(err, ErrInvalidSnapshot):
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		return status.Errorf(codes.Aborted, "restore stopped after %d pairs: %v", applied, err)
+	}
+
+	return stream.SendAndClose(&types2.RestoreResponse{
+		Applied: uint64(applied),
+	})
+}
+
+// Watch streams changes under the requested prefix as this node applies them.
+// A RESYNC event ends the stream, the client must re-read and watch again.
+func (g *GRPCServer) Watch(
+	req *types2.WatchRequest,
+	stream types2.Taskvault_WatchServer,
+) error {
+	events, err := g.agent.Watch(stream.Context(), req.Prefix)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	for {
+		var ev Event
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return stream.Context().Err()
+			}
+			ev = e
+		case <-g.draining:
+			return errDraining
+		}
+
+		err := stream.Send(&types2.WatchEvent{
+			Type:        types2.WatchEventType(ev.Type),
+			Key:         ev.Key,
+			Value:       ev.Value,
+			ModifyIndex: ev.ModifyIndex,
+			ContentType: ev.ContentType,
+			Flags:       ev.Flags,
+		})
+		if err != nil {
+			return err
+		}
+		if ev.Type == EventResync {
+			return nil
+		}
+	}
+}
+
+// WatchLeader streams the leader known to this node, starting with the
+// current one. is_leader tells whether the serving node leads.
+func (g *GRPCServer) WatchLeader(
+	req *emptypb.Empty,
+	stream types2.Taskvault_WatchLeaderServer,
+) error {
+	events, err := g.agent.WatchLeader(stream.Context())
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	for {
+		var ev LeaderEvent
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return stream.Context().Err()
+			}
+			ev = e
+		case <-g.draining:
+			return errDraining
+		}
+
+		err := stream.Send(&types2.LeaderEvent{
+			LeaderId:      ev.LeaderID,
+			LeaderAddress: ev.LeaderAddr,
+			IsLeader:      ev.IsLeader,
+		})
+		if err != nil {
+			return err
+		}
+	}
 }
 
 func (g *GRPCServer) RaftGetConfiguration(
@@ -176,8 +1212,7 @@ func (g *GRPCServer) RaftGetConfiguration(
 			continue
 		}
 
-		addr := (&net.TCPAddr{IP: member.Addr, Port: parts.Port}).String()
-		serverMap[raft.ServerAddress(addr)] = member
+		serverMap[raft.ServerAddress(parts.RaftAddr.String())] = member
 	}
 
 	leader := g.agent.raft.Leader()
@@ -210,7 +1245,22 @@ func (g *GRPCServer) RaftRemovePeerByID(
 	ctx context.Context,
 	req *types2.RaftRemovePeerByIDRequest,
 ) (*emptypb.Empty, error) {
-	panic("unimplemeneted")
+	defer metrics.MeasureSince([]string{"grpc", "raft_remove_peer"}, time.Now())
+
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+	if err := g.agent.RaftRemovePeerByID(req.Id); err != nil {
+		switch {
+		case errors.Is(err, raft.ErrNotLeader):
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		case errors.Is(err, ErrPeerNotFound):
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return nil, err
+	}
+
+	return &emptypb.Empty{}, nil
 }
 
 func (g *GRPCServer) UpdateValue(
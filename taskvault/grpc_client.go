@@ -2,24 +2,44 @@ package taskvault
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"time"
 
+	"github.com/armon/go-metrics"
 	types2 "github.com/danluki/taskvault/pkg/types"
-	metrics "github.com/hashicorp/go-metrics"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	// Importing gzip registers the compressor, the server accepts gzipped
+	// calls from then on.
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 type TaskvaultGRPCClient interface {
 	Connect(string) (*grpc.ClientConn, error)
-	CreateValue(string, string) (*Pair, error)
+	CreateValue(string, string, time.Duration, ValueMeta) (*Pair, error)
 	UpdateValue(string, string) (*Pair, error)
+	CompareAndSwap(string, string, uint64, time.Duration, ValueMeta) (bool, *types2.Pair, error)
+	Txn([]*types2.TxnOp) (*types2.TxnResponse, error)
+	Increment(string, int64) (int64, error)
+	AcquireLock(string, string, time.Duration) (bool, *types2.AcquireLockResponse, error)
+	ReleaseLock(string, string) (bool, error)
 	GetValue(string, string) (*Pair, error)
+	GetPair(string, string, ReadOptions) (*types2.Pair, error)
+	StatPair(string, string) (*types2.PairMeta, error)
 	GetAllValues() ([]Pair, error)
 	DeleteValue(string) error
 	Leave(string) error
+	ForceLeave(string) error
 	RaftGetConfiguration(string) (*types2.RaftGetConfigurationResponse, error)
+	RaftStats(context.Context, string) (map[string]string, error)
+	StoreChecksum(context.Context, string, uint64) (*types2.StoreChecksumResponse, error)
+	Members(context.Context, string) ([]*types2.ClusterMember, error)
+	NodeStatus(context.Context) ([]*types2.MemberStatus, error)
 	RaftRemovePeerByID(string, string) error
 }
 
@@ -27,23 +47,91 @@ type GRPCClient struct {
 	dialOpt []grpc.DialOption
 	agent   *Agent
 	logger  *zap.SugaredLogger
+
+	// servers are asked for the leader, in order, when there is no local
+	// agent to consult. The discovered leader is cached until a call fails.
+	servers []string
+	leader  string
+	lock    sync.Mutex
+
+	retryMax     int
+	retryBackoff time.Duration
 }
 
+const (
+	DefaultRPCRetryMax     = 3
+	DefaultRPCRetryBackoff = 250 * time.Millisecond
+)
+
 func NewGRPCClient(
 	dialOpt grpc.DialOption,
 	agent *Agent,
 	logger *zap.SugaredLogger,
 ) TaskvaultGRPCClient {
+	grpcc := newGRPCClient(dialOpt, logger)
+	grpcc.agent = agent
+	if agent != nil {
+		grpcc.retryMax = agent.config.RPCRetryMax
+		grpcc.retryBackoff = agent.config.RPCRetryBackoff
+		grpcc.dialOpt = append(grpcc.dialOpt, agent.config.grpcDialOptions()...)
+		if token := agent.config.clientToken(); token != "" {
+			grpcc.dialOpt = append(grpcc.dialOpt, tokenDialOptions(token)...)
+		}
+	}
+
+	return grpcc
+}
+
+// NewServersGRPCClient returns a client that is not backed by a local agent.
+// Writes are routed to the leader found by asking servers for the member
+// list and retried up to retryMax times when the leader moves.
+func NewServersGRPCClient(
+	servers []string,
+	retryMax int,
+	retryBackoff time.Duration,
+	dialOpt grpc.DialOption,
+	logger *zap.SugaredLogger,
+) TaskvaultGRPCClient {
+	grpcc := newGRPCClient(dialOpt, logger)
+	grpcc.servers = servers
+	grpcc.retryMax = retryMax
+	grpcc.retryBackoff = retryBackoff
+
+	return grpcc
+}
+
+func newGRPCClient(dialOpt grpc.DialOption, logger *zap.SugaredLogger) *GRPCClient {
 	if dialOpt == nil {
 		dialOpt = grpc.WithInsecure()
 	}
 	return &GRPCClient{
-		dialOpt: []grpc.DialOption{
+		dialOpt: append([]grpc.DialOption{
 			dialOpt,
 			grpc.WithBlock(),
-		},
-		agent:  agent,
-		logger: logger,
+		}, tracingDialOptions()...),
+		logger:       logger,
+		retryMax:     DefaultRPCRetryMax,
+		retryBackoff: DefaultRPCRetryBackoff,
+	}
+}
+
+// grpcDialOptions mirror grpcServerOptions, so nodes accept what they send
+// each other.
+func (c *Config) grpcDialOptions() []grpc.DialOption {
+	callOpts := []grpc.CallOption{
+		grpc.MaxCallRecvMsgSize(c.GRPCMaxRecvMsgSize),
+		grpc.MaxCallSendMsgSize(c.GRPCMaxSendMsgSize),
+	}
+	if c.GRPCCompression {
+		callOpts = append(callOpts, grpc.UseCompressor(gzip.Name))
+	}
+
+	return []grpc.DialOption{
+		grpc.WithDefaultCallOptions(callOpts...),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    c.GRPCKeepaliveTime,
+			Timeout: c.GRPCKeepaliveTimeout,
+		}),
 	}
 }
 
@@ -57,33 +145,127 @@ func (grpcc *GRPCClient) Connect(addr string) (*grpc.ClientConn, error) {
 	return conn, nil
 }
 
-func (grpcc *GRPCClient) CreateValue(key string, value string) (*Pair, error) {
-	defer metrics.MeasureSince([]string{"grpc", "create_value"}, time.Now())
-	var conn *grpc.ClientConn
+// leaderAddr returns the address writes should be sent to.
+func (grpcc *GRPCClient) leaderAddr() (string, error) {
+	if grpcc.agent != nil {
+		return grpcc.agent.leaderRPCAddr()
+	}
 
-	addr := grpcc.agent.raft.Leader()
+	grpcc.lock.Lock()
+	defer grpcc.lock.Unlock()
+	if grpcc.leader != "" {
+		return grpcc.leader, nil
+	}
 
-	conn, err := grpcc.Connect(string(addr))
-	if err != nil {
-		grpcc.logger.Error("grpc: error dialing",
-			zap.Error(err),
-			zap.String("method", "CreateValue"),
-		)
-		return nil, err
+	for _, server := range grpcc.servers {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		members, err := grpcc.Members(ctx, server)
+		cancel()
+		if err != nil {
+			grpcc.logger.With(
+				zap.Error(err),
+				zap.String("server", server),
+			).Debug("grpc: Server did not answer leader lookup")
+			continue
+		}
+
+		for _, m := range members {
+			if m.Leader && m.Tags["rpc_addr"] != "" {
+				grpcc.leader = m.Tags["rpc_addr"]
+				return grpcc.leader, nil
+			}
+		}
 	}
-	defer conn.Close()
 
-	d := types2.NewTaskvaultClient(conn)
-	resp, err := d.CreateValue(
-		context.Background(), &types2.CreateValueRequest{
-			Key:   key,
-			Value: value,
-		},
-	)
+	return "", ErrLeaderNotFound
+}
+
+func (grpcc *GRPCClient) forgetLeader(addr string) {
+	grpcc.lock.Lock()
+	defer grpcc.lock.Unlock()
+	if grpcc.leader == addr {
+		grpcc.leader = ""
+	}
+}
+
+// retryable reports whether a failed write may be sent again after
+// resolving the leader anew.
+func retryable(err error) bool {
+	return errors.Is(err, ErrLeaderNotFound) || status.Code(err) == codes.Unavailable
+}
+
+// withLeader runs fn against the leader, re-resolving it and backing off
+// exponentially while the failure is retryable.
+func (grpcc *GRPCClient) withLeader(
+	method string, fn func(types2.TaskvaultClient) error,
+) error {
+	var err error
+	for attempt := 0; attempt <= grpcc.retryMax; attempt++ {
+		if attempt > 0 {
+			time.Sleep(grpcc.retryBackoff << (attempt - 1))
+		}
+
+		var addr string
+		addr, err = grpcc.leaderAddr()
+		if err != nil {
+			continue
+		}
+
+		var conn *grpc.ClientConn
+		conn, err = grpcc.Connect(addr)
+		if err != nil {
+			grpcc.logger.Error("grpc: error dialing",
+				zap.Error(err),
+				zap.String("method", method),
+			)
+			grpcc.forgetLeader(addr)
+			err = status.Error(codes.Unavailable, err.Error())
+			continue
+		}
+
+		err = fn(types2.NewTaskvaultClient(conn))
+		conn.Close()
+		if err == nil || !retryable(err) {
+			return err
+		}
+		grpcc.forgetLeader(addr)
+	}
+
+	return err
+}
+
+// ValueMeta describes a value to its readers, it is stored with the pair but
+// not interpreted.
+type ValueMeta struct {
+	ContentType string
+	Flags       uint64
+}
+
+func (grpcc *GRPCClient) CreateValue(
+	key string, value string, ttl time.Duration, meta ValueMeta,
+) (*Pair, error) {
+	defer metrics.MeasureSince([]string{"grpc", "create_value"}, time.Now())
+
+	// Retries against a new leader reuse the key, so the write is applied once.
+	ctx := newIdempotentContext()
+
+	var resp *types2.CreateValueResponse
+	err := grpcc.withLeader("CreateValue", func(d types2.TaskvaultClient) (err error) {
+		resp, err = d.CreateValue(
+			ctx, &types2.CreateValueRequest{
+				Key:         key,
+				Value:       value,
+				TtlSeconds:  int64(ttl / time.Second),
+				ContentType: meta.ContentType,
+				Flags:       meta.Flags,
+			},
+		)
+		return err
+	})
 	if err != nil {
 		grpcc.logger.Error("grpc: error calling",
 			zap.Error(err),
-			zap.String("method", "GetValue"),
+			zap.String("method", "CreateValue"),
 		)
 		return nil, err
 	}
@@ -94,8 +276,142 @@ func (grpcc *GRPCClient) CreateValue(key string, value string) (*Pair, error) {
 	}, nil
 }
 
-func (grpcc *GRPCClient) DeleteValue(string) error {
-	panic("unimplemented")
+// CompareAndSwap sends a CAS write to the leader. The boolean result is false
+// when the stored ModifyIndex did not match index.
+func (grpcc *GRPCClient) CompareAndSwap(
+	key, value string, index uint64, ttl time.Duration, meta ValueMeta,
+) (bool, *types2.Pair, error) {
+	defer metrics.MeasureSince([]string{"grpc", "compare_and_swap"}, time.Now())
+
+	ctx := newIdempotentContext()
+
+	var resp *types2.CompareAndSwapResponse
+	err := grpcc.withLeader("CompareAndSwap", func(d types2.TaskvaultClient) (err error) {
+		resp, err = d.CompareAndSwap(
+			ctx, &types2.CompareAndSwapRequest{
+				Key:         key,
+				Value:       value,
+				ModifyIndex: index,
+				TtlSeconds:  int64(ttl / time.Second),
+				ContentType: meta.ContentType,
+				Flags:       meta.Flags,
+			},
+		)
+		return err
+	})
+	if err != nil {
+		return false, nil, err
+	}
+
+	return resp.Success, resp.Pair, nil
+}
+
+// Increment adds delta to the integer value of key on the leader and returns
+// the new value.
+func (grpcc *GRPCClient) Increment(key string, delta int64) (int64, error) {
+	defer metrics.MeasureSince([]string{"grpc", "increment"}, time.Now())
+
+	// A retried increment must not be counted twice.
+	ctx := newIdempotentContext()
+
+	var resp *types2.IncrementResponse
+	err := grpcc.withLeader("Increment", func(d types2.TaskvaultClient) (err error) {
+		resp, err = d.Increment(ctx, &types2.IncrementRequest{Key: key, Delta: delta})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.Value, nil
+}
+
+// Txn sends a batch of operations to the leader to be applied atomically.
+func (grpcc *GRPCClient) Txn(ops []*types2.TxnOp) (*types2.TxnResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "txn"}, time.Now())
+
+	ctx := newIdempotentContext()
+
+	var resp *types2.TxnResponse
+	err := grpcc.withLeader("Txn", func(d types2.TaskvaultClient) (err error) {
+		resp, err = d.Txn(
+			ctx, &types2.TxnRequest{
+				Ops: ops,
+			},
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// AcquireLock asks the leader for the lock on key. The boolean result is
+// false when another holder has it, the response names that holder.
+func (grpcc *GRPCClient) AcquireLock(
+	key, holder string, ttl time.Duration,
+) (bool, *types2.AcquireLockResponse, error) {
+	defer metrics.MeasureSince([]string{"grpc", "acquire_lock"}, time.Now())
+
+	ctx := newIdempotentContext()
+
+	var resp *types2.AcquireLockResponse
+	err := grpcc.withLeader("AcquireLock", func(d types2.TaskvaultClient) (err error) {
+		resp, err = d.AcquireLock(
+			ctx, &types2.AcquireLockRequest{
+				Key:        key,
+				Holder:     holder,
+				TtlSeconds: int64(ttl / time.Second),
+			},
+		)
+		return err
+	})
+	if err != nil {
+		return false, nil, err
+	}
+
+	return resp.Acquired, resp, nil
+}
+
+// ReleaseLock releases the lock on key. The boolean result is false when
+// holder did not have it.
+func (grpcc *GRPCClient) ReleaseLock(key, holder string) (bool, error) {
+	defer metrics.MeasureSince([]string{"grpc", "release_lock"}, time.Now())
+
+	ctx := newIdempotentContext()
+
+	var resp *types2.ReleaseLockResponse
+	err := grpcc.withLeader("ReleaseLock", func(d types2.TaskvaultClient) (err error) {
+		resp, err = d.ReleaseLock(
+			ctx, &types2.ReleaseLockRequest{
+				Key:    key,
+				Holder: holder,
+			},
+		)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Released, nil
+}
+
+func (grpcc *GRPCClient) DeleteValue(key string) error {
+	defer metrics.MeasureSince([]string{"grpc", "delete_value"}, time.Now())
+
+	ctx := newIdempotentContext()
+
+	return grpcc.withLeader("DeleteValue", func(d types2.TaskvaultClient) error {
+		_, err := d.DeleteValue(
+			ctx, &types2.DeleteValueRequest{
+				Key: key,
+			},
+		)
+		return err
+	})
 }
 
 func (grpcc *GRPCClient) GetAllValues() ([]Pair, error) {
@@ -128,6 +444,47 @@ func (grpcc *GRPCClient) GetValue(addr, key string) (*Pair, error) {
 	}, nil
 }
 
+func (grpcc *GRPCClient) GetPair(
+	addr, key string, opts ReadOptions,
+) (*types2.Pair, error) {
+	defer metrics.MeasureSince([]string{"grpc", "get_pair"}, time.Now())
+	var conn *grpc.ClientConn
+
+	conn, err := grpcc.Connect(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	d := types2.NewTaskvaultClient(conn)
+	resp, err := d.GetPair(
+		context.Background(), &types2.GetPairRequest{
+			Key:         key,
+			Consistency: consistencyToProto(opts.Consistency),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Pair, nil
+}
+
+// StatPair returns the metadata of the pair at key as stored on the server at
+// addr, without its value.
+func (grpcc *GRPCClient) StatPair(addr, key string) (*types2.PairMeta, error) {
+	defer metrics.MeasureSince([]string{"grpc", "stat_pair"}, time.Now())
+
+	conn, err := grpcc.Connect(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	d := types2.NewTaskvaultClient(conn)
+	return d.StatPair(context.Background(), &types2.StatPairRequest{Key: key})
+}
+
 func (grpcc *GRPCClient) Leave(addr string) error {
 	var conn *grpc.ClientConn
 
@@ -146,6 +503,32 @@ func (grpcc *GRPCClient) Leave(addr string) error {
 	return nil
 }
 
+// ForceLeave asks the leader to evict a failed member from serf and raft.
+func (grpcc *GRPCClient) ForceLeave(name string) error {
+	return grpcc.withLeader("ForceLeave", func(d types2.TaskvaultClient) error {
+		_, err := d.ForceLeave(
+			context.Background(), &types2.ForceLeaveRequest{
+				Name: name,
+			},
+		)
+		return err
+	})
+}
+
+// NodeStatus returns the health of every member as seen by the leader.
+func (grpcc *GRPCClient) NodeStatus(ctx context.Context) ([]*types2.MemberStatus, error) {
+	var resp *types2.NodeStatusResponse
+	err := grpcc.withLeader("NodeStatus", func(d types2.TaskvaultClient) (err error) {
+		resp, err = d.NodeStatus(ctx, &emptypb.Empty{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Members, nil
+}
+
 func (grpcc *GRPCClient) RaftRemovePeerByID(addr string, peerID string) error {
 	var conn *grpc.ClientConn
 
@@ -190,3 +573,58 @@ func (g *GRPCClient) RaftGetConfiguration(
 
 	return res, nil
 }
+
+// RaftStats returns the local raft statistics of the server at addr.
+func (g *GRPCClient) RaftStats(
+	ctx context.Context, addr string,
+) (map[string]string, error) {
+	conn, err := g.Connect(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	d := types2.NewTaskvaultClient(conn)
+	res, err := d.RaftStats(ctx, &emptypb.Empty{})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Stats, nil
+}
+
+// StoreChecksum returns the checksum the server at addr computed at index.
+func (g *GRPCClient) StoreChecksum(
+	ctx context.Context, addr string, index uint64,
+) (*types2.StoreChecksumResponse, error) {
+	conn, err := g.Connect(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	d := types2.NewTaskvaultClient(conn)
+	return d.StoreChecksum(ctx, &types2.StoreChecksumRequest{Index: index})
+}
+
+// Members lists the cluster as seen by the server at addr, including which
+// member is the raft leader.
+func (g *GRPCClient) Members(
+	ctx context.Context, addr string,
+) ([]*types2.ClusterMember, error) {
+	var conn *grpc.ClientConn
+
+	conn, err := g.Connect(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	d := types2.NewTaskvaultClient(conn)
+	res, err := d.Members(ctx, &types2.MembersRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Members, nil
+}
@@ -0,0 +1,101 @@
+package taskvault
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/danluki/taskvault/pkg/types"
+	"google.golang.org/grpc/codes"
+)
+
+// errDraining ends watch streams of a stopping node, clients reconnect to
+// another one.
+var errDraining = reasonError(
+	codes.Unavailable, types.ErrorReason_REASON_SHUTTING_DOWN, "taskvault: server is shutting down",
+)
+
+// Stop drains the server: new connections are refused, watch streams end
+// with Unavailable and in-flight calls may finish until the deadline. Calls
+// still running then are cut off.
+func (grpcs *GRPCServer) Stop(deadline time.Time) {
+	if grpcs.server == nil {
+		return
+	}
+	grpcs.drainOnce.Do(func() {
+		close(grpcs.draining)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		grpcs.server.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		grpcs.logger.Info("grpc: Server drained")
+	case <-time.After(time.Until(deadline)):
+		grpcs.logger.Warn("grpc: Drain timed out, closing remaining connections")
+		grpcs.server.Stop()
+		<-done
+	}
+}
+
+// sharedListener is the gRPC side of the port shared with raft through
+// cmux. Closing it must not close the port: it keeps accepting the gRPC
+// connections cmux hands over and closes them right away, so new clients
+// fail fast and go elsewhere while raft keeps running.
+type sharedListener struct {
+	net.Listener
+	conns  chan net.Conn
+	closed chan struct{}
+	done   chan struct{}
+	err    error
+	once   sync.Once
+}
+
+func newSharedListener(l net.Listener) *sharedListener {
+	sl := &sharedListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go sl.accept()
+	return sl
+}
+
+func (l *sharedListener) accept() {
+	defer close(l.done)
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			return
+		}
+		select {
+		case l.conns <- conn:
+		case <-l.closed:
+			conn.Close()
+		}
+	}
+}
+
+func (l *sharedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *sharedListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
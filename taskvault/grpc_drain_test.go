@@ -0,0 +1,39 @@
+package taskvault
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	sl := newSharedListener(ln)
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := sl.Accept()
+	require.NoError(t, err)
+	conn.Close()
+
+	require.NoError(t, sl.Close())
+	_, err = sl.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	// The shared listener stays open, new connections are closed at once.
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
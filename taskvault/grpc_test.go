@@ -0,0 +1,188 @@
+package taskvault
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/danluki/taskvault/pkg/client"
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestApplyError_Reason(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		code   codes.Code
+		reason types.ErrorReason
+		class  client.Class
+	}{
+		{fmt.Errorf("apply: %w", raft.ErrNotLeader), codes.Unavailable, types.ErrorReason_REASON_NO_LEADER, client.ClassRetry},
+		{ErrValueTooLarge, codes.InvalidArgument, types.ErrorReason_REASON_VALUE_TOO_LARGE, client.ClassInvalid},
+		{ErrKeyNotFound, codes.NotFound, types.ErrorReason_REASON_KEY_NOT_FOUND, client.ClassNotFound},
+		{ErrNotInteger, codes.FailedPrecondition, types.ErrorReason_REASON_NOT_INTEGER, client.ClassPrecondition},
+		{errDraining, codes.Unavailable, types.ErrorReason_REASON_SHUTTING_DOWN, client.ClassRetry},
+		{ErrApplyQueueFull, codes.ResourceExhausted, types.ErrorReason_REASON_OVERLOADED, client.ClassRetry},
+	} {
+		err := applyError(tc.err)
+		assert.Equal(t, tc.code, status.Code(err), tc.err)
+		assert.Equal(t, tc.reason, client.Reason(err), tc.err)
+		assert.Equal(t, tc.class, client.Classify(err), tc.err)
+	}
+
+	// Without a reason the code decides.
+	assert.Equal(t, client.ClassRetry, client.Classify(status.Error(codes.Unavailable, "down")))
+	assert.Equal(t, client.ClassUnknown, client.Classify(errors.New("boom")))
+	assert.Equal(t, client.ClassNone, client.Classify(nil))
+}
+
+// newTestLeader returns an agent leading a single node raft over an
+// in-memory store.
+func newTestLeader(t *testing.T) *Agent {
+	s := newTestStore(t)
+	a := &Agent{Store: s, raft: newTestRaft(t, s), config: DefaultConfig(), logger: zap.NewNop().Sugar()}
+	require.Eventually(t, a.IsLeader, 5*time.Second, 10*time.Millisecond)
+	return a
+}
+
+// serveTestGRPC serves the gRPC API of a over an in-memory connection.
+func serveTestGRPC(t *testing.T, a *Agent) types.TaskvaultClient {
+	lis := bufconn.Listen(1 << 20)
+	grpcs := NewGRPCServer(a, zap.NewNop().Sugar())
+	require.NoError(t, grpcs.Serve(lis))
+	t.Cleanup(func() { grpcs.Stop(time.Now()) })
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return types.NewTaskvaultClient(conn)
+}
+
+func TestGRPCServer_BackupRestore(t *testing.T) {
+	ctx := context.Background()
+	src := newTestLeader(t)
+	future := time.Now().Add(time.Hour).UnixNano()
+	require.NoError(t, src.applySetPair(ctx, &types.Pair{Key: "a", Value: "1"}))
+	require.NoError(t, src.applySetPair(ctx, &types.Pair{Key: "b", Value: "2", ExpiresAt: future}))
+
+	stream, err := serveTestGRPC(t, src).Backup(ctx, &emptypb.Empty{})
+	require.NoError(t, err)
+	var backup []byte
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		backup = append(backup, chunk.Data...)
+	}
+
+	// The backup carries the pairs as they are on the source.
+	backedUp := map[string]*types.Pair{}
+	require.NoError(t, readSnapshot(bufio.NewReader(bytes.NewReader(backup)), func(p *types.Pair) error {
+		backedUp[p.Key] = p
+		return nil
+	}))
+	for _, key := range []string{"a", "b"} {
+		pair, err := src.GetPair(key, ReadOptions{Consistency: Stale})
+		require.NoError(t, err)
+		assert.Equal(t, pair.ModifyIndex, backedUp[key].ModifyIndex, key)
+		assert.Equal(t, pair.ExpiresAt, backedUp[key].ExpiresAt, key)
+	}
+
+	dst := newTestLeader(t)
+	client := serveTestGRPC(t, dst)
+	restore := func(data ...[]byte) (*types.RestoreResponse, error) {
+		stream, err := client.Restore(ctx)
+		require.NoError(t, err)
+		for _, d := range data {
+			require.NoError(t, stream.Send(&types.BackupChunk{Data: d}))
+		}
+		return stream.CloseAndRecv()
+	}
+
+	// Garbage and truncated backups are refused before anything is written.
+	_, err = restore([]byte("not a backup"))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = restore(backup[:len(backup)-3])
+	assert.Error(t, err)
+	n, err := dst.Store.Len()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	resp, err := restore(backup[:10], backup[10:])
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), resp.Applied)
+
+	a, err := dst.GetPair("a", ReadOptions{Consistency: Stale})
+	require.NoError(t, err)
+	assert.Equal(t, "1", a.Value)
+	assert.Zero(t, a.ExpiresAt)
+	b, err := dst.GetPair("b", ReadOptions{Consistency: Stale})
+	require.NoError(t, err)
+	assert.Equal(t, "2", b.Value)
+	assert.Equal(t, future, b.ExpiresAt)
+
+	// Restored pairs are new writes of the destination log.
+	assert.NotZero(t, a.ModifyIndex)
+	assert.Greater(t, b.ModifyIndex, a.ModifyIndex)
+	assert.LessOrEqual(t, b.ModifyIndex, dst.raft.LastIndex())
+}
+
+func TestGRPCServer_Forward(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long-running test in short mode")
+	}
+
+	agents := startTestCluster(t, 3)
+	leader := testLeader(t, agents)
+	var follower *Agent
+	for _, a := range agents {
+		if a != leader {
+			follower = a
+			break
+		}
+	}
+
+	conn, err := grpc.NewClient(follower.advertiseRPCAddr(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	c := types.NewTaskvaultClient(conn)
+
+	// A write through the follower lands on the leader.
+	_, err = c.CreateValue(context.Background(), &types.CreateValueRequest{Key: "foo", Value: "bar"})
+	require.NoError(t, err)
+	pair, err := leader.Store.GetPair("foo", ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "bar", pair.Value)
+
+	// A write that was already forwarded once is not sent on again.
+	ctx := metadata.AppendToOutgoingContext(context.Background(), forwardedMetadataKey, "1")
+	_, err = c.CreateValue(ctx, &types.CreateValueRequest{Key: "baz", Value: "bar"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.ErrorContains(t, err, raft.ErrNotLeader.Error())
+	_, err = leader.Store.GetPair("baz", ReadOptions{})
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
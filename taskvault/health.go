@@ -0,0 +1,119 @@
+package taskvault
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type HealthStatus int
+
+const (
+	HealthServing HealthStatus = iota
+	// HealthNotReady means the node is still starting: not joined to serf,
+	// no raft leader known yet or the store is missing.
+	HealthNotReady
+	// HealthShuttingDown means Stop was called and the node is leaving.
+	HealthShuttingDown
+	// HealthMaintenance means the node was put in maintenance, it keeps
+	// replicating but should not get client traffic.
+	HealthMaintenance
+)
+
+func (s HealthStatus) String() string {
+	switch s {
+	case HealthServing:
+		return "serving"
+	case HealthShuttingDown:
+		return "shutting_down"
+	case HealthMaintenance:
+		return "maintenance"
+	default:
+		return "not_ready"
+	}
+}
+
+// Health reports whether the node can serve requests.
+func (a *Agent) Health() HealthStatus {
+	if a.stopping.Load() {
+		return HealthShuttingDown
+	}
+
+	if a.serf == nil || a.raft == nil || a.Store == nil {
+		return HealthNotReady
+	}
+
+	switch a.serf.State() {
+	case serf.SerfAlive:
+	case serf.SerfLeaving, serf.SerfLeft, serf.SerfShutdown:
+		return HealthShuttingDown
+	default:
+		return HealthNotReady
+	}
+
+	if a.raft.Leader() == "" {
+		return HealthNotReady
+	}
+
+	if a.InMaintenance() {
+		return HealthMaintenance
+	}
+
+	return HealthServing
+}
+
+const healthWatchInterval = time.Second
+
+// QuorumHealthService is the health service name that is only serving while
+// the node also sees a quorum, see Agent.QuorumHealthy.
+const QuorumHealthService = "taskvault.quorum"
+
+// healthServer implements grpc.health.v1.Health on top of Agent.Health. Any
+// other service name than QuorumHealthService is answered with the status
+// of the whole node.
+type healthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	agent *Agent
+}
+
+func (h *healthServer) status(service string) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	if h.agent.Health() != HealthServing {
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	if service == QuorumHealthService && !h.agent.QuorumHealthy() {
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	return grpc_health_v1.HealthCheckResponse_SERVING
+}
+
+func (h *healthServer) Check(
+	ctx context.Context, req *grpc_health_v1.HealthCheckRequest,
+) (*grpc_health_v1.HealthCheckResponse, error) {
+	return &grpc_health_v1.HealthCheckResponse{Status: h.status(req.GetService())}, nil
+}
+
+func (h *healthServer) Watch(
+	req *grpc_health_v1.HealthCheckRequest,
+	stream grpc_health_v1.Health_WatchServer,
+) error {
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+
+	last := grpc_health_v1.HealthCheckResponse_UNKNOWN
+	for {
+		if s := h.status(req.GetService()); s != last {
+			if err := stream.Send(&grpc_health_v1.HealthCheckResponse{Status: s}); err != nil {
+				return err
+			}
+			last = s
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package taskvault
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// idempotencyMetadataKey carries the idempotency key of a gRPC write.
+	idempotencyMetadataKey = "x-taskvault-idempotency-key"
+
+	// A replayed command is answered from the cache when it comes back within
+	// idempotencyWindow of the original, as long as no more than
+	// idempotencyCacheSize newer commands pushed it out. Both are constants:
+	// every replica has to evict the same entries.
+	idempotencyWindow    = 10 * time.Minute
+	idempotencyCacheSize = 8192
+
+	maxIdempotencyKeySize = 256
+)
+
+var ErrInvalidIdempotencyKey = errors.New("invalid idempotency key")
+
+type idempotencyKeyCtx struct{}
+
+// WithIdempotencyKey marks the writes made with ctx as retries of each other:
+// the first one that commits is applied, the later ones get its result back.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtx{}, key)
+}
+
+// idempotencyKey returns the key set with WithIdempotencyKey or, for gRPC
+// requests, the one sent in the request metadata.
+func idempotencyKey(ctx context.Context) string {
+	if key, ok := ctx.Value(idempotencyKeyCtx{}).(string); ok {
+		return key
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(idempotencyMetadataKey); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// newIdempotentContext returns an outgoing context with a fresh idempotency
+// key, so retries of the same call are applied once.
+func newIdempotentContext() context.Context {
+	key, err := uuid.GenerateUUID()
+	if err != nil {
+		return context.Background()
+	}
+	return metadata.AppendToOutgoingContext(context.Background(), idempotencyMetadataKey, key)
+}
+
+// idempotencyCache remembers the result of recent idempotent commands, oldest
+// first. It is part of the FSM state and only changes while applying logs.
+type idempotencyCache struct {
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *idempotencyCache) get(token string) (*types.IdempotentResult, bool) {
+	e, ok := c.entries[token]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*types.IdempotentResult), true
+}
+
+func (c *idempotencyCache) put(r *types.IdempotentResult) {
+	c.entries[r.Token] = c.order.PushBack(r)
+	for c.order.Len() > idempotencyCacheSize {
+		c.remove(c.order.Front())
+	}
+}
+
+// expire drops the results older than the window, now is the append time of
+// the log being applied so every replica expires the same entries.
+func (c *idempotencyCache) expire(now time.Time) {
+	if now.IsZero() {
+		return
+	}
+	cutoff := now.Add(-idempotencyWindow).UnixNano()
+	for e := c.order.Front(); e != nil && e.Value.(*types.IdempotentResult).AppliedAt < cutoff; e = c.order.Front() {
+		c.remove(e)
+	}
+}
+
+func (c *idempotencyCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*types.IdempotentResult).Token)
+}
+
+func (c *idempotencyCache) results() []*types.IdempotentResult {
+	results := make([]*types.IdempotentResult, 0, c.order.Len())
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		results = append(results, e.Value.(*types.IdempotentResult))
+	}
+	return results
+}
+
+func (c *idempotencyCache) restore(results []*types.IdempotentResult) {
+	clear(c.entries)
+	c.order.Init()
+	for _, r := range results {
+		c.put(r)
+	}
+}
+
+// encodeResult records the response of a command. Unexpected errors are not
+// recorded, a retry may well succeed.
+func encodeResult(resp interface{}) (*types.IdempotentResult, bool) {
+	var txnErr *TxnFailedError
+	switch r := resp.(type) {
+	case nil:
+		return &types.IdempotentResult{}, true
+	case *types.Pair:
+		return &types.IdempotentResult{Pair: r}, true
+	case *types.Session:
+		return &types.IdempotentResult{Session: r}, true
+	case uint64:
+		return &types.IdempotentResult{Index: r}, true
+	case error:
+		switch {
+		case errors.As(r, &txnErr):
+			return &types.IdempotentResult{
+				Outcome: types.IdempotentOutcome_OUTCOME_TXN_FAILED,
+				TxnOp:   int32(txnErr.Op),
+				TxnKey:  txnErr.Key,
+			}, true
+		case errors.Is(r, ErrCASFailed):
+			return &types.IdempotentResult{Outcome: types.IdempotentOutcome_OUTCOME_CAS_FAILED}, true
+		case errors.Is(r, ErrKeyNotFound):
+			return &types.IdempotentResult{Outcome: types.IdempotentOutcome_OUTCOME_KEY_NOT_FOUND}, true
+		case errors.Is(r, ErrNotInteger):
+			return &types.IdempotentResult{Outcome: types.IdempotentOutcome_OUTCOME_NOT_INTEGER}, true
+		case errors.Is(r, ErrIncrementOverflow):
+			return &types.IdempotentResult{Outcome: types.IdempotentOutcome_OUTCOME_OVERFLOW}, true
+		}
+	}
+	return nil, false
+}
+
+// decodeResult turns a recorded result back into the response of the command
+// type that produced it.
+func decodeResult(t MessageType, r *types.IdempotentResult) interface{} {
+	switch r.Outcome {
+	case types.IdempotentOutcome_OUTCOME_CAS_FAILED:
+		return ErrCASFailed
+	case types.IdempotentOutcome_OUTCOME_TXN_FAILED:
+		return &TxnFailedError{Op: int(r.TxnOp), Key: r.TxnKey}
+	case types.IdempotentOutcome_OUTCOME_KEY_NOT_FOUND:
+		return ErrKeyNotFound
+	case types.IdempotentOutcome_OUTCOME_NOT_INTEGER:
+		return ErrNotInteger
+	case types.IdempotentOutcome_OUTCOME_OVERFLOW:
+		return ErrIncrementOverflow
+	}
+
+	switch t {
+	case CASPairType, LockAcquireType, IncrementType:
+		return r.Pair
+	case SessionCreateType, SessionRenewType:
+		return r.Session
+	case TxnType:
+		return r.Index
+	default:
+		return nil
+	}
+}
+
+// applyIdempotent applies the wrapped command unless a command with the same
+// token was applied within the window, in which case its result is returned.
+func (d *taskvaultFSM) applyIdempotent(buf []byte, l *raft.Log) interface{} {
+	var cmd types.IdempotentCommand
+	if err := proto.Unmarshal(buf, &cmd); err != nil {
+		return err
+	}
+	t := MessageType(cmd.Type)
+	if t == IdempotentType {
+		return errors.New("fsm: nested idempotent command")
+	}
+
+	d.idempotency.expire(l.AppendedAt)
+	if r, ok := d.idempotency.get(cmd.Token); ok {
+		metrics.IncrCounter([]string{"taskvault", "fsm", "idempotent_replay"}, 1)
+		return decodeResult(t, r)
+	}
+
+	resp := d.apply(t, cmd.Command, l)
+	if r, ok := encodeResult(resp); ok {
+		r.Token = cmd.Token
+		r.AppliedAt = l.AppendedAt.UnixNano()
+		d.idempotency.put(r)
+	}
+
+	return resp
+}
@@ -0,0 +1,90 @@
+package taskvault
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+)
+
+var (
+	ErrInvalidEncryptKey  = errors.New("invalid encryption key")
+	ErrEncryptionDisabled = errors.New("gossip encryption is not enabled")
+)
+
+// decodeEncryptKey decodes a base64 gossip key, memberlist takes AES-128,
+// AES-192 or AES-256 keys.
+func decodeEncryptKey(key string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: not valid base64: %v", ErrInvalidEncryptKey, err)
+	}
+	if len(b) != 16 && len(b) != 24 && len(b) != 32 {
+		return nil, fmt.Errorf("%w: must be 16, 24 or 32 bytes, got %d", ErrInvalidEncryptKey, len(b))
+	}
+	return b, nil
+}
+
+// keyring returns the gossip keyring, nil without encryption. EncryptKey
+// encrypts outgoing messages, EncryptKeys are still accepted on incoming ones
+// while a rotation is under way.
+func (c *Config) keyring() (*memberlist.Keyring, error) {
+	if c.EncryptKey == "" {
+		return nil, nil
+	}
+
+	primary, err := decodeEncryptKey(c.EncryptKey)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, 0, len(c.EncryptKeys))
+	for _, k := range c.EncryptKeys {
+		key, err := decodeEncryptKey(k)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return memberlist.NewKeyring(keys, primary)
+}
+
+// KeyringList asks every member for its gossip keys.
+func (a *Agent) KeyringList() (*serf.KeyResponse, error) {
+	if !a.serf.EncryptionEnabled() {
+		return nil, ErrEncryptionDisabled
+	}
+	return a.serf.KeyManager().ListKeys()
+}
+
+// KeyringInstall adds key to the keyring of every member. It is accepted on
+// incoming messages right away but only used for outgoing ones after
+// KeyringUse.
+func (a *Agent) KeyringInstall(key string) (*serf.KeyResponse, error) {
+	return a.keyringOp(key, a.serf.KeyManager().InstallKey)
+}
+
+// KeyringUse makes the installed key the primary one on every member.
+func (a *Agent) KeyringUse(key string) (*serf.KeyResponse, error) {
+	return a.keyringOp(key, a.serf.KeyManager().UseKey)
+}
+
+// KeyringRemove drops key from every member, the primary key can not be
+// removed.
+func (a *Agent) KeyringRemove(key string) (*serf.KeyResponse, error) {
+	return a.keyringOp(key, a.serf.KeyManager().RemoveKey)
+}
+
+// keyringOp runs a cluster wide keyring change. Members that failed it are
+// listed in the Messages of the response next to the returned error.
+func (a *Agent) keyringOp(key string, op func(string) (*serf.KeyResponse, error)) (*serf.KeyResponse, error) {
+	if !a.serf.EncryptionEnabled() {
+		return nil, ErrEncryptionDisabled
+	}
+	if _, err := decodeEncryptKey(key); err != nil {
+		return nil, err
+	}
+	return op(key)
+}
@@ -0,0 +1,76 @@
+package taskvault
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+
+	// exportPageSize is how many pairs the export reads from the store at a
+	// time.
+	exportPageSize = 512
+)
+
+// kvExportHandler streams the pairs under prefix as a JSON array, or as one
+// JSON object per line with format=ndjson, in the format the import reads
+// back. It is a stale read of the local store, on a follower it may lag
+// behind the leader. The status is sent before the first pair: an export
+// that fails half way is cut short, which leaves a JSON array unterminated.
+func (h *HTTPTransport) kvExportHandler(c *gin.Context) {
+	prefix := c.Query("prefix")
+	ndjson := c.Query("format") == "ndjson"
+
+	if ndjson {
+		c.Header("Content-Type", ndjsonContentType)
+	} else {
+		c.Header("Content-Type", "application/json; charset=utf-8")
+	}
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	enc.SetEscapeHTML(false)
+
+	write := func(b string) bool {
+		_, err := c.Writer.WriteString(b)
+		return err == nil
+	}
+
+	if !ndjson && !write("[") {
+		return
+	}
+
+	after, first := "", true
+	for {
+		pairs, err := h.agent.Store.ScanPairs(prefix, after, exportPageSize)
+		if err != nil {
+			h.logger.Error(err)
+			return
+		}
+
+		for _, p := range pairs {
+			if !ndjson && !first && !write(",") {
+				return
+			}
+			first = false
+			// Encode ends every pair with a newline, in an array it is
+			// just whitespace.
+			if err := enc.Encode(newExportedPair(p)); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+
+		if len(pairs) < exportPageSize {
+			break
+		}
+		after = pairs[len(pairs)-1].Key
+	}
+
+	if !ndjson {
+		write("]")
+	}
+}
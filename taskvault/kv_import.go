@@ -0,0 +1,317 @@
+package taskvault
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// An import is applied in transactions of at most importBatchOps pairs or
+// importBatchBytes of keys and values, whichever is reached first, so a large
+// import does not turn into a single huge raft entry.
+const (
+	importBatchOps   = 512
+	importBatchBytes = 1 << 20
+)
+
+// importEntryError rejects a single pair of an import, the rest of the input
+// is still imported.
+type importEntryError struct {
+	key string
+	err error
+}
+
+func (e *importEntryError) Error() string {
+	return fmt.Sprintf("%s: %v", e.key, e.err)
+}
+
+type importError struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+type importResponse struct {
+	Imported int           `json:"imported"`
+	Errors   []importError `json:"errors"`
+	// Error is set when the import stopped before the end of the input.
+	Error string `json:"error,omitempty"`
+}
+
+// importPair is a pair read from an import. TTL is zero for a pair that does
+// not expire.
+type importPair struct {
+	key   string
+	value string
+	ttl   time.Duration
+	meta  ValueMeta
+}
+
+// importReader yields the pairs of an import one at a time, io.EOF ends the
+// input and an *importEntryError skips a pair.
+type importReader interface {
+	next() (importPair, error)
+}
+
+// exportedPair is a pair as written by the export, the modify index is
+// informational and ignored on import.
+type exportedPair struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ExpiresAt   int64  `json:"expires_at,omitempty"`
+	ModifyIndex uint64 `json:"modify_index"`
+	ContentType string `json:"content_type,omitempty"`
+	Flags       uint64 `json:"flags,omitempty"`
+}
+
+func newExportedPair(p *types.Pair) exportedPair {
+	return exportedPair{
+		Key:         p.Key,
+		Value:       p.Value,
+		ExpiresAt:   p.ExpiresAt,
+		ModifyIndex: p.ModifyIndex,
+		ContentType: p.ContentType,
+		Flags:       p.Flags,
+	}
+}
+
+// importPair turns an exported pair back into a write, its expiry is kept as
+// the remaining time to live.
+func (p exportedPair) importPair(now time.Time) (importPair, error) {
+	pair := importPair{
+		key:   p.Key,
+		value: p.Value,
+		meta:  ValueMeta{ContentType: p.ContentType, Flags: p.Flags},
+	}
+	if p.ExpiresAt == 0 {
+		return pair, nil
+	}
+
+	ttl := time.Unix(0, p.ExpiresAt).Sub(now)
+	if ttl <= 0 {
+		return importPair{}, &importEntryError{key: p.Key, err: errors.New("the pair has expired")}
+	}
+	// TTLs are whole seconds, round up rather than drop the last second.
+	pair.ttl = ttl.Truncate(time.Second) + time.Second
+	return pair, nil
+}
+
+// jsonImportReader reads either a JSON object of string values or a JSON
+// array of exported pairs, token by token: the input is never held in memory
+// as a whole.
+type jsonImportReader struct {
+	dec     *json.Decoder
+	started bool
+	array   bool
+}
+
+func newJSONImportReader(r io.Reader) *jsonImportReader {
+	return &jsonImportReader{dec: json.NewDecoder(r)}
+}
+
+func (r *jsonImportReader) next() (importPair, error) {
+	if !r.started {
+		r.started = true
+		tok, err := r.dec.Token()
+		if err != nil {
+			return importPair{}, err
+		}
+		switch tok {
+		case json.Delim('{'):
+		case json.Delim('['):
+			r.array = true
+		default:
+			return importPair{}, errors.New("import: expected a JSON object or array")
+		}
+	}
+
+	if !r.dec.More() {
+		if _, err := r.dec.Token(); err != nil {
+			return importPair{}, err
+		}
+		return importPair{}, io.EOF
+	}
+
+	if r.array {
+		var p exportedPair
+		if err := r.dec.Decode(&p); err != nil {
+			return importPair{}, err
+		}
+		return p.importPair(time.Now())
+	}
+
+	tok, err := r.dec.Token()
+	if err != nil {
+		return importPair{}, err
+	}
+	key := tok.(string)
+
+	var raw json.RawMessage
+	if err := r.dec.Decode(&raw); err != nil {
+		return importPair{}, err
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return importPair{}, &importEntryError{key: key, err: errors.New("the value must be a string")}
+	}
+
+	return importPair{key: key, value: value}, nil
+}
+
+// ndjsonImportReader reads exported pairs, one JSON object per line.
+type ndjsonImportReader struct {
+	dec *json.Decoder
+}
+
+func newNDJSONImportReader(r io.Reader) *ndjsonImportReader {
+	return &ndjsonImportReader{dec: json.NewDecoder(r)}
+}
+
+func (r *ndjsonImportReader) next() (importPair, error) {
+	var p exportedPair
+	if err := r.dec.Decode(&p); err != nil {
+		return importPair{}, err
+	}
+	return p.importPair(time.Now())
+}
+
+// csvImportReader reads key,value records. A leading key,value header is
+// skipped.
+type csvImportReader struct {
+	r    *csv.Reader
+	line int
+}
+
+func newCSVImportReader(r io.Reader) *csvImportReader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	return &csvImportReader{r: cr}
+}
+
+func (r *csvImportReader) next() (importPair, error) {
+	for {
+		record, err := r.r.Read()
+		if err != nil {
+			return importPair{}, err
+		}
+		r.line++
+
+		if len(record) != 2 {
+			return importPair{}, &importEntryError{
+				key: record[0],
+				err: fmt.Errorf("line %d: expected 2 fields, got %d", r.line, len(record)),
+			}
+		}
+		if r.line == 1 && record[0] == "key" && record[1] == "value" {
+			continue
+		}
+		return importPair{key: record[0], value: record[1]}, nil
+	}
+}
+
+// kvImportHandler writes the pairs of a JSON object, of an export, or of a CSV
+// file when the body is sent as text/csv, through the leader in batched
+// transactions. Pairs
+// that can not be written are reported by key, the import stops at the first
+// batch the leader fails to apply and the batches before it stay written.
+func (h *HTTPTransport) kvImportHandler(c *gin.Context) {
+	var reader importReader
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	switch {
+	case mediaType == "text/csv" || c.Query("format") == "csv":
+		reader = newCSVImportReader(c.Request.Body)
+	case mediaType == ndjsonContentType || c.Query("format") == "ndjson":
+		reader = newNDJSONImportReader(c.Request.Body)
+	default:
+		reader = newJSONImportReader(c.Request.Body)
+	}
+
+	resp := &importResponse{Errors: []importError{}}
+	var (
+		ops  []*types.TxnOp
+		size int
+	)
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		if _, err := h.agent.GRPCClient.Txn(ops); err != nil {
+			return err
+		}
+		resp.Imported += len(ops)
+		ops, size = nil, 0
+		return nil
+	}
+
+	for {
+		pair, err := reader.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var entryErr *importEntryError
+		if errors.As(err, &entryErr) {
+			resp.Errors = append(resp.Errors, importError{Key: entryErr.key, Error: entryErr.err.Error()})
+			continue
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			renderJSON(c, http.StatusBadRequest, resp)
+			return
+		}
+
+		if pair.key == "" {
+			resp.Errors = append(resp.Errors, importError{Error: "key is required"})
+			continue
+		}
+		if err := h.agent.config.checkPairSize(pair.key, pair.value); err != nil {
+			resp.Errors = append(resp.Errors, importError{Key: pair.key, Error: err.Error()})
+			continue
+		}
+
+		ops = append(ops, &types.TxnOp{
+			Type: types.TxnOpType_TXN_SET,
+			Pair: &types.Pair{
+				Key:         pair.key,
+				Value:       pair.value,
+				ContentType: pair.meta.ContentType,
+				Flags:       pair.meta.Flags,
+			},
+			TtlSeconds: int64(pair.ttl / time.Second),
+		})
+		size += len(pair.key) + len(pair.value)
+		if len(ops) >= importBatchOps || size >= importBatchBytes {
+			if err := flush(); err != nil {
+				h.importFailed(c, resp, err)
+				return
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		h.importFailed(c, resp, err)
+		return
+	}
+
+	renderJSON(c, http.StatusOK, resp)
+}
+
+func (h *HTTPTransport) importFailed(c *gin.Context, resp *importResponse, err error) {
+	h.logger.Error(err)
+	resp.Error = err.Error()
+
+	code := http.StatusInternalServerError
+	if status.Code(err) == codes.Unavailable {
+		code = http.StatusServiceUnavailable
+	}
+	renderJSON(c, code, resp)
+}
@@ -0,0 +1,109 @@
+package taskvault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readImport(t *testing.T, r importReader) (map[string]importPair, []string) {
+	pairs := make(map[string]importPair)
+	var skipped []string
+	for {
+		pair, err := r.next()
+		if errors.Is(err, io.EOF) {
+			return pairs, skipped
+		}
+		var entryErr *importEntryError
+		if errors.As(err, &entryErr) {
+			skipped = append(skipped, entryErr.key)
+			continue
+		}
+		require.NoError(t, err)
+		pairs[pair.key] = pair
+	}
+}
+
+func TestImportReader(t *testing.T) {
+	pairs, skipped := readImport(t, newJSONImportReader(strings.NewReader(
+		`{"a": "1", "b/c": "2", "n": 3, "d": ""}`,
+	)))
+	assert.Equal(t, map[string]importPair{
+		"a":   {key: "a", value: "1"},
+		"b/c": {key: "b/c", value: "2"},
+		"d":   {key: "d"},
+	}, pairs)
+	assert.Equal(t, []string{"n"}, skipped)
+
+	pairs, skipped = readImport(t, newCSVImportReader(strings.NewReader(
+		"key,value\na,1\n\"b,c\",\"2\n3\"\nbad\n",
+	)))
+	assert.Equal(t, map[string]importPair{
+		"a":   {key: "a", value: "1"},
+		"b,c": {key: "b,c", value: "2\n3"},
+	}, pairs)
+	assert.Equal(t, []string{"bad"}, skipped)
+
+	_, err := newJSONImportReader(strings.NewReader(`"a"`)).next()
+	assert.Error(t, err)
+}
+
+func TestImportReader_Export(t *testing.T) {
+	now := time.Now()
+	exported := []exportedPair{
+		{Key: "a", Value: "1", ModifyIndex: 4},
+		{Key: "b", Value: "2", ModifyIndex: 5, ExpiresAt: now.Add(time.Minute).UnixNano()},
+		{Key: "c", Value: "3", ModifyIndex: 6, ExpiresAt: now.Add(-time.Minute).UnixNano()},
+	}
+	var array, lines strings.Builder
+	array.WriteString("[")
+	for i, p := range exported {
+		if i > 0 {
+			array.WriteString(",")
+		}
+		fmt.Fprintf(&array, `{"key":%q,"value":%q,"expires_at":%d,"modify_index":%d}`, p.Key, p.Value, p.ExpiresAt, p.ModifyIndex)
+		fmt.Fprintf(&lines, "{\"key\":%q,\"value\":%q,\"expires_at\":%d,\"modify_index\":%d}\n", p.Key, p.Value, p.ExpiresAt, p.ModifyIndex)
+	}
+	array.WriteString("]")
+
+	for _, r := range []importReader{
+		newJSONImportReader(strings.NewReader(array.String())),
+		newNDJSONImportReader(strings.NewReader(lines.String())),
+	} {
+		pairs, skipped := readImport(t, r)
+		require.Len(t, pairs, 2)
+		assert.Equal(t, importPair{key: "a", value: "1"}, pairs["a"])
+		assert.Equal(t, time.Minute, pairs["b"].ttl)
+		assert.Equal(t, []string{"c"}, skipped)
+	}
+}
+
+func TestHTTPTransport_Export(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := newTestStore(t)
+	require.NoError(t, s.SetValue("app/a", "1"))
+	require.NoError(t, s.SetValue("other", "2"))
+
+	h := &HTTPTransport{agent: &Agent{config: DefaultConfig(), Store: s}, Engine: gin.New()}
+	h.APIRoutes(h.Engine.Group("/"))
+
+	w := httptest.NewRecorder()
+	h.Engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/kv/export?prefix=app/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var exported []exportedPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &exported))
+	require.Len(t, exported, 1)
+	assert.Equal(t, "app/a", exported[0].Key)
+	assert.Equal(t, "1", exported[0].Value)
+}
@@ -1,19 +1,25 @@
 package taskvault
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
-	metrics "github.com/hashicorp/go-metrics"
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 	"go.uber.org/zap"
 )
 
 const (
-	barrierWriteTimeout = 2 * time.Minute
+	// refreshCoalesceWindow is how long member events are collected before
+	// they are reconciled together, so a burst of joins or failures costs one
+	// pass per member instead of one per event.
+	refreshCoalesceWindow = 500 * time.Millisecond
 )
 
 func (a *Agent) monitorLeadership() {
@@ -59,24 +65,51 @@ func (a *Agent) monitorLeadership() {
 
 func (a *Agent) leaderLoop(stopCh chan struct{}) {
 	var refreshCh chan serf.Member
+	var coalesce <-chan time.Time
+	pending := make(map[string]serf.Member)
+	failedSince := make(map[string]time.Time)
+
+	expiry := time.NewTicker(a.config.ExpiryInterval)
+	defer expiry.Stop()
+	defer a.leaderReady.Store(false)
+
+	// The hooks run once per term, after the first barrier.
+	var hooks *leaderHookRun
+	defer func() { hooks.stop() }()
+
+	if a.config.AntiEntropyInterval > 0 {
+		go a.antiEntropyLoop(stopCh)
+	}
 
 REFRESH:
 	refreshCh = nil
-	interval := time.After(a.config.RefreshInterval)
+	// A full refresh covers every member, queued events are not needed.
+	coalesce = nil
+	clear(pending)
+	interval := time.After(time.Duration(a.refreshInterval.Load()))
 
 	start := time.Now()
-	barrier := a.raft.Barrier(barrierWriteTimeout)
-	if err := barrier.Error(); err != nil {
+	if stopped, err := a.waitBarrier(stopCh); stopped {
+		return
+	} else if err != nil {
 		a.logger.Error("taskvault: failed to wait for barrier", zap.Error(err))
 		goto WAIT
 	}
 	metrics.MeasureSince([]string{"taskvault", "leader", "barrier"}, start)
+	a.leaderReady.Store(true)
+	if hooks == nil {
+		hooks = a.leaderHooks.start()
+	}
 
 	if err := a.Refresh(); err != nil {
 		a.logger.Error("failed to ", zap.Error(err))
 		goto WAIT
 	}
 
+	if a.config.CleanupDeadServers {
+		a.pruneDeadServers(failedSince)
+	}
+
 	refreshCh = a.refreshCh
 
 	select {
@@ -94,14 +127,174 @@ WAIT:
 			return
 		case <-interval:
 			goto REFRESH
+		case <-a.reloadCh:
+			goto REFRESH
+		case <-expiry.C:
+			a.reapExpiredPairs()
+			a.reapExpiredSessions()
 		case member := <-refreshCh:
-			if err := a.RefreshMember(member); err != nil {
-				a.logger.Error("taskvault: failed to Refresh member", zap.Error(err))
+			// Only the latest event of a member matters.
+			pending[member.Name] = member
+			if coalesce == nil {
+				coalesce = time.After(refreshCoalesceWindow)
+			}
+		case <-coalesce:
+			coalesce = nil
+			for name, member := range pending {
+				if err := a.RefreshMember(member); err != nil {
+					a.logger.Error("taskvault: failed to Refresh member", zap.Error(err))
+				}
+				delete(pending, name)
 			}
 		}
 	}
 }
 
+// waitBarrier issues a barrier and waits for it, stopped is true when
+// leadership or the agent ended first. The leader loop then returns at once
+// instead of waiting out the barrier timeout.
+func (a *Agent) waitBarrier(stopCh chan struct{}) (stopped bool, err error) {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- a.raft.Barrier(a.config.RaftBarrierTimeout).Error()
+	}()
+
+	select {
+	case err := <-errCh:
+		return false, err
+	case <-stopCh:
+		return true, nil
+	case <-a.shutdowner:
+		return true, nil
+	}
+}
+
+// reapExpiredPairs replicates the deletion of every pair whose TTL passed, so
+// followers drop them at the same log index as the leader.
+func (a *Agent) reapExpiredPairs() {
+	defer metrics.MeasureSince(
+		[]string{"taskvault", "leader", "reap_expired"}, time.Now(),
+	)
+
+	pairs, err := a.Store.ExpiredPairs(time.Now())
+	if err != nil {
+		a.logger.Error("taskvault: failed to list expired pairs", zap.Error(err))
+		return
+	}
+
+	for _, pair := range pairs {
+		err := a.applyExpirePair(context.Background(), pair)
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			a.logger.Error("taskvault: failed to expire pair",
+				zap.String("key", pair.Key),
+				zap.Error(err),
+			)
+			return
+		}
+	}
+}
+
+// pruneDeadServers removes servers that stayed failed in serf for longer than
+// DeadServerTimeout from the raft configuration. failedSince keeps, across
+// calls, when each member was first seen failed.
+func (a *Agent) pruneDeadServers(failedSince map[string]time.Time) {
+	dead := deadServers(a.serf.Members(), failedSince, time.Now(), a.config.DeadServerTimeout)
+	if len(dead) == 0 {
+		return
+	}
+
+	configFuture := a.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		a.logger.Error("taskvault: failed to get raft configuration", zap.Error(err))
+		return
+	}
+
+	remove, err := planPrune(configFuture.Configuration().Servers, dead)
+	if err != nil {
+		a.logger.Warnf("taskvault: %s", err)
+		return
+	}
+
+	for _, server := range remove {
+		future := a.raft.RemoveServer(server.ID, 0, 0)
+		if err := future.Error(); err != nil {
+			a.logger.Error("taskvault: failed to remove dead server",
+				zap.String("server", string(server.ID)),
+				zap.Error(err),
+			)
+			return
+		}
+		delete(failedSince, string(server.ID))
+		metrics.IncrCounter([]string{"taskvault", "leader", "dead_servers_removed"}, 1)
+		a.logger.Infof("taskvault: removed dead server %s", server.ID)
+	}
+}
+
+// deadServers returns the servers among members that were failed for at
+// least timeout at now. A member seen failed for the first time is recorded
+// in failedSince, members that recovered or are gone are forgotten.
+func deadServers(
+	members []serf.Member, failedSince map[string]time.Time,
+	now time.Time, timeout time.Duration,
+) map[raft.ServerID]bool {
+	dead := make(map[raft.ServerID]bool)
+	known := make(map[string]bool)
+	for _, m := range members {
+		known[m.Name] = true
+		if m.Status != serf.StatusFailed {
+			delete(failedSince, m.Name)
+			continue
+		}
+
+		parts := toServerPart(m)
+		if parts == nil {
+			continue
+		}
+		since, ok := failedSince[m.Name]
+		if !ok {
+			failedSince[m.Name] = now
+			continue
+		}
+		if now.Sub(since) >= timeout {
+			dead[raft.ServerID(parts.ID)] = true
+		}
+	}
+	for name := range failedSince {
+		if !known[name] {
+			delete(failedSince, name)
+		}
+	}
+	return dead
+}
+
+// planPrune returns the dead servers to remove from servers. Voters are only
+// removed while the healthy ones remain a majority, so quorum is never lost,
+// otherwise nothing is removed.
+func planPrune(servers []raft.Server, dead map[raft.ServerID]bool) ([]raft.Server, error) {
+	voters, deadVoters := 0, 0
+	var remove []raft.Server
+	for _, server := range servers {
+		if server.Suffrage == raft.Voter {
+			voters++
+		}
+		if !dead[server.ID] {
+			continue
+		}
+		if server.Suffrage == raft.Voter {
+			deadVoters++
+		}
+		remove = append(remove, server)
+	}
+
+	if deadVoters*2 >= voters {
+		return nil, fmt.Errorf(
+			"not removing %d dead voters out of %d, it would risk quorum",
+			deadVoters, voters,
+		)
+	}
+	return remove, nil
+}
+
 func (a *Agent) Refresh() error {
 	defer metrics.MeasureSince(
 		[]string{"taskvault", "leader", "Refresh"}, time.Now(),
@@ -127,24 +320,88 @@ func (a *Agent) RefreshMember(member serf.Member) error {
 		}, time.Now(),
 	)
 
-	var err error
-	switch member.Status {
-	case serf.StatusAlive:
-		err = a.addRaftPeer(member, parts)
-	case serf.StatusLeft:
-		err = a.removeRaftPeer(member, parts)
-	}
-	if err != nil {
-		a.logger.Error("failed to Refresh member", zap.Error(err), zap.Any("member", member))
+	configFuture := a.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		a.logger.Error("taskvault: failed to get raft configuration", zap.Error(err))
 		return err
 	}
+
+	for _, op := range a.planMember(member, parts, configFuture.Configuration().Servers) {
+		if err := a.reconcile(op); err != nil {
+			a.logger.Error("failed to Refresh member", zap.Error(err), zap.Any("member", member))
+			return err
+		}
+	}
 	return nil
 }
 
-func (a *Agent) addRaftPeer(m serf.Member, parts *ServerParts) error {
-	members := a.serf.Members()
+// ReconcileAction is a change Refresh makes to the raft configuration.
+type ReconcileAction int
+
+const (
+	ReconcileAddVoter ReconcileAction = iota
+	ReconcileAddNonvoter
+	ReconcileRemoveServer
+)
+
+// ReconcileOp is a single raft configuration change for a serf member.
+type ReconcileOp struct {
+	Action  ReconcileAction
+	Member  string
+	ID      raft.ServerID
+	Address raft.ServerAddress
+}
+
+// PlanReconcile returns the raft configuration changes Refresh would make
+// with the current serf members, in order, without making them. Dead servers
+// pruned by CleanupDeadServers are not part of the plan. Only the leader
+// reconciles, so other nodes return raft.ErrNotLeader.
+func (a *Agent) PlanReconcile() ([]ReconcileOp, error) {
+	if !a.IsLeader() {
+		return nil, raft.ErrNotLeader
+	}
+
+	configFuture := a.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return nil, err
+	}
+
+	// Every op is applied to a copy of the configuration, the way Refresh
+	// would see it when it moves on to the next member.
+	servers := slices.Clone(configFuture.Configuration().Servers)
+	var plan []ReconcileOp
+	for _, member := range a.serf.Members() {
+		parts := toServerPart(member)
+		if parts == nil {
+			continue
+		}
+
+		for _, op := range a.planMember(member, parts, servers) {
+			servers = simulateReconcile(servers, op)
+			plan = append(plan, op)
+		}
+	}
+
+	return plan, nil
+}
+
+// planMember returns the changes that bring member in line with servers.
+func (a *Agent) planMember(m serf.Member, parts *ServerParts, servers []raft.Server) []ReconcileOp {
+	switch m.Status {
+	case serf.StatusAlive:
+		return a.planAddPeer(m, parts, servers)
+	case serf.StatusLeft, StatusReap:
+		// A reaped member is gone from serf, a later Refresh never sees it
+		// again, so it is removed now.
+		return a.planRemovePeer(m, parts, servers)
+	default:
+		return nil
+	}
+}
+
+func (a *Agent) planAddPeer(m serf.Member, parts *ServerParts, servers []raft.Server) []ReconcileOp {
 	if parts.Bootstrap {
-		for _, member := range members {
+		for _, member := range a.serf.Members() {
 			parts := toServerPart(member)
 			if parts == nil {
 				continue
@@ -161,15 +418,11 @@ func (a *Agent) addRaftPeer(m serf.Member, parts *ServerParts) error {
 		}
 	}
 
-	addr := (&net.TCPAddr{IP: m.Addr, Port: parts.Port}).String()
-	configFuture := a.raft.GetConfiguration()
-	if err := configFuture.Error(); err != nil {
-		a.logger.Error("taskvault: failed to get raft configuration", zap.Error(err))
-		return err
-	}
+	addr := raft.ServerAddress(parts.RaftAddr.String())
+	id := raft.ServerID(parts.ID)
 
 	if m.Name == a.config.NodeName {
-		if l := len(configFuture.Configuration().Servers); l < 3 {
+		if len(servers) < 3 {
 			a.logger.Debug(
 				"taskvault: Skipping self join check",
 				zap.String("peer", m.Name),
@@ -178,35 +431,45 @@ func (a *Agent) addRaftPeer(m serf.Member, parts *ServerParts) error {
 		}
 	}
 
-	for _, server := range configFuture.Configuration().Servers {
-		if server.Address == raft.ServerAddress(addr) || server.ID == raft.ServerID(parts.ID) {
-			if server.Address == raft.ServerAddress(addr) && server.ID == raft.ServerID(parts.ID) {
+	var ops []ReconcileOp
+	known := false
+	for _, server := range servers {
+		if server.Address == addr || server.ID == id {
+			if server.Address == addr && server.ID == id {
+				// A learner, or a non-voter restarted without the
+				// non_voter tag, is promoted once it caught up. Voters are
+				// never demoted automatically.
+				if server.Suffrage == raft.Nonvoter && !parts.NonVoter && a.caughtUp(server) {
+					known = true
+					break
+				}
 				return nil
 			}
-			if server.Address == raft.ServerAddress(addr) {
-				future := a.raft.RemoveServer(server.ID, 0, 0)
-				if err := future.Error(); err != nil {
-					return fmt.Errorf(
-						"error removing server %q: %s",
-						server.Address,
-						err,
-					)
-				}
+			if server.Address == addr {
+				ops = append(ops, ReconcileOp{
+					Action:  ReconcileRemoveServer,
+					Member:  m.Name,
+					ID:      server.ID,
+					Address: server.Address,
+				})
 			}
 		}
 	}
 
-	addFuture := a.raft.AddVoter(
-		raft.ServerID(parts.ID), raft.ServerAddress(addr), 0, 0,
-	)
-	if err := addFuture.Error(); err != nil {
-		return err
+	action := ReconcileAddVoter
+	if parts.NonVoter || (!known && a.config.RaftPromotionLag > 0) {
+		action = ReconcileAddNonvoter
 	}
 
-	return nil
+	return append(ops, ReconcileOp{
+		Action:  action,
+		Member:  m.Name,
+		ID:      id,
+		Address: addr,
+	})
 }
 
-func (a *Agent) removeRaftPeer(m serf.Member, parts *ServerParts) error {
+func (a *Agent) planRemovePeer(m serf.Member, parts *ServerParts, servers []raft.Server) []ReconcileOp {
 	if m.Name == a.config.NodeName {
 		a.logger.Warn(
 			"removing self should be done by follower", "name",
@@ -215,20 +478,107 @@ func (a *Agent) removeRaftPeer(m serf.Member, parts *ServerParts) error {
 		return nil
 	}
 
+	for _, server := range servers {
+		if server.ID == raft.ServerID(parts.ID) {
+			return []ReconcileOp{{
+				Action:  ReconcileRemoveServer,
+				Member:  m.Name,
+				ID:      server.ID,
+				Address: server.Address,
+			}}
+		}
+	}
+
+	return nil
+}
+
+// caughtUp reports whether the log of server is at most RaftPromotionLag
+// entries behind the leader's. Without a lag every server has caught up.
+func (a *Agent) caughtUp(server raft.Server) bool {
+	if a.config.RaftPromotionLag == 0 {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), raftStatusTimeout)
+	defer cancel()
+
+	stats, err := a.GRPCClient.RaftStats(ctx, a.rpcAddr(server.ID, server.Address))
+	if err != nil {
+		a.logger.With(zap.Error(err), zap.String("server", string(server.ID))).
+			Warn("taskvault: can not check whether learner caught up")
+		return false
+	}
+	index, err := strconv.ParseUint(stats["last_log_index"], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	last := a.raft.LastIndex()
+	if index < last && last-index > a.config.RaftPromotionLag {
+		a.logger.With(
+			zap.String("server", string(server.ID)),
+			zap.Uint64("index", index),
+			zap.Uint64("leader_index", last),
+		).Debug("taskvault: learner is still catching up")
+		return false
+	}
+	return true
+}
+
+func (a *Agent) removeRaftPeer(m serf.Member, parts *ServerParts) error {
 	configFuture := a.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
 		return err
 	}
 
-	for _, server := range configFuture.Configuration().Servers {
-		if server.ID == raft.ServerID(parts.ID) {
-			future := a.raft.RemoveServer(raft.ServerID(parts.ID), 0, 0)
-			if err := future.Error(); err != nil {
-				return err
-			}
-			break
+	for _, op := range a.planRemovePeer(m, parts, configFuture.Configuration().Servers) {
+		if err := a.reconcile(op); err != nil {
+			return err
 		}
 	}
-
 	return nil
 }
+
+// reconcile makes the raft configuration change described by op.
+func (a *Agent) reconcile(op ReconcileOp) error {
+	switch op.Action {
+	case ReconcileAddVoter:
+		return a.raft.AddVoter(op.ID, op.Address, 0, 0).Error()
+	case ReconcileAddNonvoter:
+		return a.raft.AddNonvoter(op.ID, op.Address, 0, 0).Error()
+	case ReconcileRemoveServer:
+		if err := a.raft.RemoveServer(op.ID, 0, 0).Error(); err != nil {
+			return fmt.Errorf("error removing server %q: %s", op.Address, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("taskvault: unknown reconcile action %d", op.Action)
+	}
+}
+
+// simulateReconcile returns servers as raft leaves them after op.
+func simulateReconcile(servers []raft.Server, op ReconcileOp) []raft.Server {
+	i := slices.IndexFunc(servers, func(s raft.Server) bool { return s.ID == op.ID })
+
+	switch op.Action {
+	case ReconcileRemoveServer:
+		if i >= 0 {
+			servers = slices.Delete(servers, i, i+1)
+		}
+	case ReconcileAddVoter, ReconcileAddNonvoter:
+		suffrage := raft.Voter
+		if op.Action == ReconcileAddNonvoter {
+			suffrage = raft.Nonvoter
+		}
+		if i < 0 {
+			return append(servers, raft.Server{Suffrage: suffrage, ID: op.ID, Address: op.Address})
+		}
+		servers[i].Address = op.Address
+		// Adding a voter as a non-voter does not demote it.
+		if servers[i].Suffrage != raft.Voter {
+			servers[i].Suffrage = suffrage
+		}
+	}
+
+	return servers
+}
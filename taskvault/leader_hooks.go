@@ -0,0 +1,75 @@
+package taskvault
+
+import (
+	"context"
+	"sync"
+)
+
+// leaderHooks holds the callbacks embedders run on the leader.
+type leaderHooks struct {
+	lock     sync.Mutex
+	acquired []func(ctx context.Context)
+	lost     []func()
+}
+
+// leaderHookRun is one term worth of acquired callbacks.
+type leaderHookRun struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	lost   []func()
+}
+
+// OnLeaderAcquired registers fn to run in its own goroutine every time this
+// node becomes the leader, once the state of the previous terms is applied.
+// ctx is cancelled when leadership is lost. A new term does not start the
+// callbacks until those of the previous one returned, so fn never runs
+// twice at the same time; it must return soon after ctx is done.
+func (a *Agent) OnLeaderAcquired(fn func(ctx context.Context)) {
+	a.leaderHooks.lock.Lock()
+	defer a.leaderHooks.lock.Unlock()
+
+	a.leaderHooks.acquired = append(a.leaderHooks.acquired, fn)
+}
+
+// OnLeaderLost registers fn to run when this node loses the leadership it
+// ran the OnLeaderAcquired callbacks for, after all of them returned.
+// Callbacks run one after the other in the order they were registered.
+func (a *Agent) OnLeaderLost(fn func()) {
+	a.leaderHooks.lock.Lock()
+	defer a.leaderHooks.lock.Unlock()
+
+	a.leaderHooks.lost = append(a.leaderHooks.lost, fn)
+}
+
+// start runs the acquired callbacks registered so far.
+func (h *leaderHooks) start() *leaderHookRun {
+	h.lock.Lock()
+	acquired := h.acquired
+	lost := h.lost
+	h.lock.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &leaderHookRun{cancel: cancel, lost: lost}
+	for _, fn := range acquired {
+		run.wg.Add(1)
+		go func() {
+			defer run.wg.Done()
+			fn(ctx)
+		}()
+	}
+	return run
+}
+
+// stop cancels the callbacks of the term, waits for them and runs the lost
+// callbacks. It does nothing for a term that never started them.
+func (r *leaderHookRun) stop() {
+	if r == nil {
+		return
+	}
+	r.cancel()
+	r.wg.Wait()
+
+	for _, fn := range r.lost {
+		fn()
+	}
+}
@@ -0,0 +1,136 @@
+package taskvault
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// leaderObservations buffers raft leader observations for observeLeader,
+// raft drops them when the buffer is full.
+const leaderObservations = 64
+
+// LeaderEvent describes the raft leader as seen by this node. LeaderID is
+// empty while no leader is known.
+type LeaderEvent struct {
+	LeaderID string
+	// LeaderAddr is the gRPC address of the leader.
+	LeaderAddr string
+	// IsLeader reports whether this node is the leader.
+	IsLeader bool
+}
+
+// leaderHub hands the latest leadership state to every subscriber. Unlike
+// watchHub nobody is dropped: a subscriber that did not read the previous
+// event only gets the latest one, leadership is a state and not a log.
+type leaderHub struct {
+	lock     sync.Mutex
+	current  LeaderEvent
+	watchers map[chan LeaderEvent]struct{}
+	closed   bool
+}
+
+func newLeaderHub() *leaderHub {
+	return &leaderHub{
+		watchers: make(map[chan LeaderEvent]struct{}),
+	}
+}
+
+// subscribe sends the current state right away, then every change until ctx
+// is done or the hub is closed.
+func (h *leaderHub) subscribe(ctx context.Context) <-chan LeaderEvent {
+	ch := make(chan LeaderEvent, 1)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	ch <- h.current
+	h.watchers[ch] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if _, ok := h.watchers[ch]; ok {
+			delete(h.watchers, ch)
+			close(ch)
+		}
+	}()
+
+	return ch
+}
+
+func (h *leaderHub) publish(ev LeaderEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.current = ev
+	for ch := range h.watchers {
+		// Replace an event that was not read yet.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- ev
+	}
+}
+
+func (h *leaderHub) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.closed = true
+	for ch := range h.watchers {
+		delete(h.watchers, ch)
+		close(ch)
+	}
+}
+
+// observeLeader publishes the leader changes raft observes until the agent
+// stops. Every node observes them, not only the leader.
+func (a *Agent) observeLeader() {
+	obsCh := make(chan raft.Observation, leaderObservations)
+	observer := raft.NewObserver(obsCh, false, func(o *raft.Observation) bool {
+		_, ok := o.Data.(raft.LeaderObservation)
+		return ok
+	})
+	a.raft.RegisterObserver(observer)
+	defer a.raft.DeregisterObserver(observer)
+	defer a.leaders.close()
+
+	publish := func(addr raft.ServerAddress, id raft.ServerID) {
+		a.leaders.publish(LeaderEvent{
+			LeaderID:   string(id),
+			LeaderAddr: a.rpcAddr(id, addr),
+			IsLeader:   id == raft.ServerID(a.config.NodeName),
+		})
+	}
+	// Raft may have found its leader before the observer was registered.
+	publish(a.raft.LeaderWithID())
+
+	for {
+		select {
+		case o := <-obsCh:
+			lo := o.Data.(raft.LeaderObservation)
+			publish(lo.LeaderAddr, lo.LeaderID)
+		case <-a.shutdowner:
+			return
+		}
+	}
+}
+
+// WatchLeader streams the leadership state of the cluster as seen by this
+// node until ctx is done, starting with the current one. Intermediate states
+// are skipped for a subscriber that reads too slowly, the last one always
+// arrives. The channel is closed when the subscription or the agent ends.
+func (a *Agent) WatchLeader(ctx context.Context) (<-chan LeaderEvent, error) {
+	if a.leaders == nil {
+		return nil, ErrWatchUnavailable
+	}
+
+	return a.leaders.subscribe(ctx), nil
+}
@@ -0,0 +1,168 @@
+package taskvault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/danluki/taskvault/pkg/types"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// ErrLockHeld is returned when the lock is held by another holder, it is
+	// wrapped by *LockHeldError.
+	ErrLockHeld = errors.New("lock is held by another holder")
+
+	// ErrLockNotHeld is returned when releasing a lock the holder does not
+	// hold, because it expired or was never acquired.
+	ErrLockNotHeld = errors.New("lock is not held by this holder")
+
+	ErrInvalidLock = errors.New("invalid lock")
+)
+
+// LockHeldError reports who holds the lock that could not be acquired.
+type LockHeldError struct {
+	Key    string
+	Holder string
+}
+
+func (e *LockHeldError) Error() string {
+	return fmt.Sprintf("lock %q is held by %q", e.Key, e.Holder)
+}
+
+func (e *LockHeldError) Unwrap() error {
+	return ErrLockHeld
+}
+
+// A lock is a pair whose value is the ID of its holder and whose expiry is
+// the end of the lease. liveLock returns the pair of a lock that was not
+// released and did not expire at now.
+func (d *taskvaultFSM) liveLock(key string, now time.Time) (*types.Pair, error) {
+	pair, err := d.store.GetPair(key, ReadOptions{IncludeExpired: true})
+	if errors.Is(err, ErrKeyNotFound) || (err == nil && pairExpired(pair, now)) {
+		return nil, nil
+	}
+	return pair, err
+}
+
+// applyLockAcquire takes the lock for the holder when it is free, or renews
+// the lease when the holder already has it. The lease is counted from the
+// time the leader appended the entry, so every replica expires it alike.
+func (d *taskvaultFSM) applyLockAcquire(buf []byte, index uint64, appendedAt time.Time) interface{} {
+	var cmd types.LockCommand
+	if err := proto.Unmarshal(buf, &cmd); err != nil {
+		return err
+	}
+
+	current, err := d.liveLock(cmd.Key, appendedAt)
+	if err != nil {
+		return err
+	}
+	if current != nil && current.Value != cmd.Holder {
+		return &LockHeldError{Key: cmd.Key, Holder: current.Value}
+	}
+
+	pair := &types.Pair{
+		Key:         cmd.Key,
+		Value:       cmd.Holder,
+		ExpiresAt:   appendedAt.Add(time.Duration(cmd.TtlSeconds) * time.Second).UnixNano(),
+		ModifyIndex: index,
+		ModifyTime:  modifyTime(appendedAt),
+	}
+	if err := d.store.SetPair(pair); err != nil {
+		return err
+	}
+	d.watches.publish(putEvent(pair, index))
+
+	return pair
+}
+
+// applyLockRelease deletes the lock if the holder still has it.
+func (d *taskvaultFSM) applyLockRelease(buf []byte, index uint64, appendedAt time.Time) interface{} {
+	var cmd types.LockCommand
+	if err := proto.Unmarshal(buf, &cmd); err != nil {
+		return err
+	}
+
+	current, err := d.liveLock(cmd.Key, appendedAt)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Value != cmd.Holder {
+		return ErrLockNotHeld
+	}
+
+	if err := d.store.DeletePair(cmd.Key); err != nil {
+		return err
+	}
+	d.watches.publish(Event{Type: EventDelete, Key: cmd.Key, ModifyIndex: index})
+
+	return nil
+}
+
+func checkLock(key, holder string) error {
+	if key == "" {
+		return fmt.Errorf("%w: the key must not be empty", ErrInvalidLock)
+	}
+	if holder == "" {
+		return fmt.Errorf("%w: the holder must not be empty", ErrInvalidLock)
+	}
+	return nil
+}
+
+// AcquireLock takes the lock on key for holder for ttl, or renews the lease
+// when holder already has it. It returns the lock pair, whose ModifyIndex
+// can serve as a fencing token, or a *LockHeldError. A lock that is not
+// renewed expires with its lease, so a holder that dies does not keep it.
+func (a *Agent) AcquireLock(ctx context.Context, key, holder string, ttl time.Duration) (*types.Pair, error) {
+	if err := checkLock(key, holder); err != nil {
+		return nil, err
+	}
+	if ttl < time.Second {
+		return nil, fmt.Errorf("%w: the ttl must be at least a second", ErrInvalidLock)
+	}
+	if err := a.config.checkPairSize(key, holder); err != nil {
+		return nil, err
+	}
+
+	resp, err := a.apply(ctx, LockAcquireType, &types.LockCommand{
+		Key:        key,
+		Holder:     holder,
+		TtlSeconds: int64(ttl / time.Second),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch r := resp.(type) {
+	case error:
+		return nil, r
+	case *types.Pair:
+		return r, nil
+	default:
+		return nil, fmt.Errorf("agent: unexpected lock response: %v", resp)
+	}
+}
+
+// ReleaseLock releases the lock on key if holder has it, ErrLockNotHeld is
+// returned otherwise.
+func (a *Agent) ReleaseLock(ctx context.Context, key, holder string) error {
+	if err := checkLock(key, holder); err != nil {
+		return err
+	}
+
+	resp, err := a.apply(ctx, LockReleaseType, &types.LockCommand{
+		Key:    key,
+		Holder: holder,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err, ok := resp.(error); ok {
+		return err
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package taskvault
 import (
 	"io"
 	"os"
+	"strings"
 	"sync"
 
 	"github.com/gin-gonic/gin"
@@ -10,21 +11,44 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
+const (
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+)
+
 var zapOnce sync.Once
 
 func InitLogger(logLevel string, node string) *zap.SugaredLogger {
-	var zapLogger *zap.Logger
-	var err error
-
 	level := zapcore.InfoLevel
 	if parsedLevel, err := zapcore.ParseLevel(logLevel); err == nil {
 		level = parsedLevel
 	}
 
+	return newLogger(zap.NewAtomicLevelAt(level), node, LogFormatConsole, "")
+}
+
+// newLogger builds a logger whose level can be changed later through the
+// given atomic level. It writes to file, or to stdout when file is empty,
+// in the console or JSON format.
+func newLogger(atomicLevel zap.AtomicLevel, node, format, file string) *zap.SugaredLogger {
+	var zapLogger *zap.Logger
+	var err error
+
+	// Colors are for terminals only.
+	encodeLevel := zapcore.CapitalColorLevelEncoder
+	if format == LogFormatJSON || file != "" {
+		encodeLevel = zapcore.CapitalLevelEncoder
+	}
+	output := "stdout"
+	if file != "" {
+		output = file
+	}
+
+	level := atomicLevel.Level()
 	cfg := zap.Config{
-		Level:       zap.NewAtomicLevelAt(level),
+		Level:       atomicLevel,
 		Development: level == zapcore.DebugLevel,
-		Encoding:    "console",
+		Encoding:    format,
 		EncoderConfig: zapcore.EncoderConfig{
 			TimeKey:       "time",
 			LevelKey:      "level",
@@ -33,11 +57,11 @@ func InitLogger(logLevel string, node string) *zap.SugaredLogger {
 			MessageKey:    "msg",
 			StacktraceKey: "stacktrace",
 			LineEnding:    zapcore.DefaultLineEnding,
-			EncodeLevel:   zapcore.CapitalColorLevelEncoder,
+			EncodeLevel:   encodeLevel,
 			EncodeTime:    zapcore.ISO8601TimeEncoder,
 			EncodeCaller:  zapcore.ShortCallerEncoder,
 		},
-		OutputPaths:      []string{"stdout"},
+		OutputPaths:      []string{output},
 		ErrorOutputPaths: []string{"stderr"},
 	}
 
@@ -60,3 +84,23 @@ func InitLogger(logLevel string, node string) *zap.SugaredLogger {
 
 	return sugar
 }
+
+// componentLogger tags the entries of a subsystem with its name.
+func (a *Agent) componentLogger(component string) *zap.SugaredLogger {
+	return a.logger.With("component", component)
+}
+
+// logWriter feeds the line based logs of raft and serf into a zap logger at
+// debug level, so they share its format and output.
+type logWriter struct {
+	logger *zap.SugaredLogger
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line != "" {
+			w.logger.Debug(line)
+		}
+	}
+	return len(p), nil
+}
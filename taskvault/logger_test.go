@@ -0,0 +1,38 @@
+package taskvault
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestLogger_JSONFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "taskvault.log")
+	a := &Agent{logger: newLogger(zap.NewAtomicLevelAt(zap.DebugLevel), "n1", LogFormatJSON, file)}
+
+	a.componentLogger("fsm").Infow("applied", "index", 7)
+	(&logWriter{logger: a.componentLogger("raft")}).Write([]byte("[INFO] raft: entering leader state\n"))
+	require.NoError(t, a.logger.Sync())
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var entry map[string]any
+	require.NoError(t, dec.Decode(&entry))
+	assert.Equal(t, "applied", entry["msg"])
+	assert.Equal(t, "INFO", entry["level"])
+	assert.Equal(t, "n1", entry["node"])
+	assert.Equal(t, "fsm", entry["component"])
+	assert.Equal(t, float64(7), entry["index"])
+
+	require.NoError(t, dec.Decode(&entry))
+	assert.Equal(t, "[INFO] raft: entering leader state", entry["msg"])
+	assert.Equal(t, "raft", entry["component"])
+}
@@ -0,0 +1,64 @@
+package taskvault
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// maintenanceTag marks a member in maintenance, its value is the reason.
+const maintenanceTag = "maintenance"
+
+func memberMaintenance(m serf.Member) (bool, string) {
+	reason, ok := m.Tags[maintenanceTag]
+	return ok, reason
+}
+
+// SetMaintenance puts the node in maintenance, or takes it out. A node in
+// maintenance reports itself as not serving to health checks, so clients
+// route away from it, and a leader hands its leadership to another voter.
+// It keeps replicating raft, the cluster does not lose a voter. The state is
+// gossiped as a serf tag and does not survive a restart.
+func (a *Agent) SetMaintenance(enabled bool, reason string) error {
+	err := a.updateTags(func(tags map[string]string) {
+		if enabled {
+			tags[maintenanceTag] = reason
+		} else {
+			delete(tags, maintenanceTag)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	a.logger.Info("agent: maintenance changed",
+		zap.Bool("enabled", enabled),
+		zap.String("reason", reason),
+	)
+
+	if enabled && a.IsLeader() {
+		if err := a.LeadershipTransfer(""); err != nil {
+			a.logger.Warn("agent: can not hand over leadership for maintenance", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// InMaintenance reports whether the local node is in maintenance.
+func (a *Agent) InMaintenance() bool {
+	if a.serf == nil {
+		return false
+	}
+	enabled, _ := memberMaintenance(a.serf.LocalMember())
+	return enabled
+}
+
+// maintenanceMembers returns the names of the members in maintenance.
+func (a *Agent) maintenanceMembers() map[string]bool {
+	members := make(map[string]bool)
+	for _, m := range a.serf.Members() {
+		if enabled, _ := memberMaintenance(m); enabled {
+			members[m.Name] = true
+		}
+	}
+	return members
+}
@@ -0,0 +1,82 @@
+package taskvault
+
+import (
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/prometheus"
+)
+
+const metricsInterval = 5 * time.Second
+
+var (
+	prometheusSinkOnce sync.Once
+	prometheusSink     *prometheus.PrometheusSink
+	prometheusSinkErr  error
+)
+
+// setupMetrics installs the global go-metrics sink. Raft and serf report
+// through the same global, so their metrics are scraped next to ours. With
+// Prometheus disabled metrics are discarded.
+func (a *Agent) setupMetrics() error {
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+
+	var sink metrics.MetricSink = &metrics.BlackholeSink{}
+	if a.config.EnablePrometheus {
+		// The sink registers itself with the default Prometheus registry,
+		// which only accepts it once per process.
+		prometheusSinkOnce.Do(func() {
+			prometheusSink, prometheusSinkErr = prometheus.NewPrometheusSink()
+		})
+		if prometheusSinkErr != nil {
+			return prometheusSinkErr
+		}
+		sink = prometheusSink
+	}
+
+	_, err := metrics.NewGlobal(conf, sink)
+	return err
+}
+
+// emitMetrics periodically publishes gauges describing the node until the
+// agent stops.
+func (a *Agent) emitMetrics() {
+	ticker := time.NewTicker(metricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Follower 0, Candidate 1, Leader 2, Shutdown 3.
+			metrics.SetGauge([]string{"taskvault", "raft", "state"}, float32(a.raft.State()))
+
+			// Also sampled here, eventLoop does not while it is stuck.
+			a.observeSerfQueue()
+
+			if n, err := a.Store.Len(); err == nil {
+				metrics.SetGauge([]string{"taskvault", "store", "keys"}, float32(n))
+			}
+			metrics.SetGauge([]string{"taskvault", "sessions"}, float32(a.sessions.len()))
+
+			type memberKey struct{ status, dc string }
+			counts := make(map[memberKey]int)
+			for _, m := range a.serf.Members() {
+				counts[memberKey{m.Status.String(), m.Tags["dc"]}]++
+			}
+			for k, n := range counts {
+				metrics.SetGaugeWithLabels(
+					[]string{"taskvault", "serf", "members"}, float32(n),
+					[]metrics.Label{
+						{Name: "status", Value: k.status},
+						{Name: "datacenter", Value: k.dc},
+					},
+				)
+			}
+
+		case <-a.shutdowner:
+			return
+		}
+	}
+}
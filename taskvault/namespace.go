@@ -0,0 +1,281 @@
+package taskvault
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/danluki/taskvault/pkg/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// namespacePrefix is where the keys of namespaces live: key k of namespace
+// ns is stored as _ns/ns/k. The FSM only sees these fully qualified keys,
+// the prefix is added and removed at the gRPC boundary for callers with a
+// namespace token. Cluster-wide tokens see the whole keyspace.
+const namespacePrefix = "_ns/"
+
+var ErrInvalidNamespace = errors.New("invalid namespace")
+
+// namespacedMethods are the RPCs a namespace token may call, the key value
+// API without the calls that span the whole keyspace or the cluster, and
+// GetLeader to route writes. Sessions are shared by all namespaces, a caller
+// reaches a session of another namespace only by knowing its random ID.
+var namespacedMethods = map[string]bool{
+	"/types.Taskvault/GetLeader":      true,
+	"/types.Taskvault/CreateValue":    true,
+	"/types.Taskvault/GetValue":       true,
+	"/types.Taskvault/UpdateValue":    true,
+	"/types.Taskvault/DeleteValue":    true,
+	"/types.Taskvault/GetPair":        true,
+	"/types.Taskvault/StatPair":       true,
+	"/types.Taskvault/ListPairs":      true,
+	"/types.Taskvault/ListKeys":       true,
+	"/types.Taskvault/Count":          true,
+	"/types.Taskvault/CompareAndSwap": true,
+	"/types.Taskvault/Increment":      true,
+	"/types.Taskvault/Txn":            true,
+	"/types.Taskvault/Watch":          true,
+	"/types.Taskvault/AcquireLock":    true,
+	"/types.Taskvault/ReleaseLock":    true,
+	"/types.Taskvault/CreateSession":  true,
+	"/types.Taskvault/RenewSession":   true,
+	"/types.Taskvault/DestroySession": true,
+}
+
+func parseNamespaceToken(entry string) (string, string, error) {
+	ns, token, ok := strings.Cut(entry, "=")
+	if !ok || token == "" {
+		return "", "", fmt.Errorf("%w: %q is not namespace=token", ErrInvalidNamespace, entry)
+	}
+	if ns == "" || strings.Contains(ns, "/") {
+		return "", "", fmt.Errorf("%w: %q must be non empty and without slashes", ErrInvalidNamespace, ns)
+	}
+	return ns, token, nil
+}
+
+// tokenNamespace returns the namespace of the bearer token in an
+// authorization header value, ok is false when it is no namespace token.
+func (c *Config) tokenNamespace(header string) (string, bool) {
+	token, ok := strings.CutPrefix(header, bearerPrefix)
+	if !ok {
+		return "", false
+	}
+	for _, entry := range c.ACLNamespaceTokens {
+		ns, t, err := parseNamespaceToken(entry)
+		if err == nil && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return ns, true
+		}
+	}
+	return "", false
+}
+
+// callNamespace returns the namespace of the caller, empty for callers with
+// a cluster-wide token.
+func (grpcs *GRPCServer) callNamespace(ctx context.Context) string {
+	config := grpcs.agent.config
+	if len(config.ACLNamespaceTokens) == 0 {
+		return ""
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(authMetadataKey) {
+		if config.validToken(v) {
+			return ""
+		}
+		if ns, ok := config.tokenNamespace(v); ok {
+			return ns
+		}
+	}
+	return ""
+}
+
+func qualifyKey(ns, key string) string {
+	return namespacePrefix + ns + "/" + key
+}
+
+func unqualifyKey(ns, key string) string {
+	return strings.TrimPrefix(key, namespacePrefix+ns+"/")
+}
+
+// scopeRequest moves the keys and prefixes of a request into the namespace.
+func scopeRequest(ns string, req interface{}) error {
+	key := func(k *string) error {
+		if *k == "" {
+			return status.Error(codes.InvalidArgument, "key is required")
+		}
+		*k = qualifyKey(ns, *k)
+		return nil
+	}
+	prefix := func(p *string) {
+		*p = qualifyKey(ns, *p)
+	}
+
+	switch r := req.(type) {
+	case *types.CreateValueRequest:
+		return key(&r.Key)
+	case *types.GetValueRequest:
+		return key(&r.Key)
+	case *types.UpdateValueRequest:
+		return key(&r.Key)
+	case *types.DeleteValueRequest:
+		return key(&r.Key)
+	case *types.GetPairRequest:
+		return key(&r.Key)
+	case *types.StatPairRequest:
+		return key(&r.Key)
+	case *types.CompareAndSwapRequest:
+		return key(&r.Key)
+	case *types.IncrementRequest:
+		return key(&r.Key)
+	case *types.AcquireLockRequest:
+		return key(&r.Key)
+	case *types.ReleaseLockRequest:
+		return key(&r.Key)
+	case *types.TxnRequest:
+		for _, op := range r.Ops {
+			if op.Pair == nil {
+				continue
+			}
+			if err := key(&op.Pair.Key); err != nil {
+				return err
+			}
+		}
+	case *types.ListPairsRequest:
+		prefix(&r.Prefix)
+		if r.ContinueToken != "" {
+			tok, err := decodeContinueToken(r.ContinueToken)
+			if err != nil {
+				return status.Error(codes.InvalidArgument, err.Error())
+			}
+			tok.after = qualifyKey(ns, tok.after)
+			r.ContinueToken = encodeContinueToken(tok)
+		}
+	case *types.ListKeysRequest:
+		prefix(&r.Prefix)
+	case *types.CountRequest:
+		prefix(&r.Prefix)
+	case *types.WatchRequest:
+		prefix(&r.Prefix)
+	}
+	return nil
+}
+
+// unscopeResponse returns a copy of resp with the namespace removed from its
+// keys. The original may be shared with the FSM, it is never modified.
+func unscopeResponse(ns string, resp interface{}) interface{} {
+	msg, ok := resp.(proto.Message)
+	if !ok {
+		return resp
+	}
+
+	pair := func(p *types.Pair) {
+		if p != nil {
+			p.Key = unqualifyKey(ns, p.Key)
+		}
+	}
+
+	switch r := proto.Clone(msg).(type) {
+	case *types.CreateValueResponse:
+		r.Key = unqualifyKey(ns, r.Key)
+		return r
+	case *types.UpdateValueResponse:
+		r.Key = unqualifyKey(ns, r.Key)
+		return r
+	case *types.DeleteValueResponse:
+		r.Key = unqualifyKey(ns, r.Key)
+		return r
+	case *types.GetPairResponse:
+		pair(r.Pair)
+		return r
+	case *types.PairMeta:
+		r.Key = unqualifyKey(ns, r.Key)
+		return r
+	case *types.CompareAndSwapResponse:
+		pair(r.Pair)
+		return r
+	case *types.IncrementResponse:
+		pair(r.Pair)
+		return r
+	case *types.AcquireLockResponse:
+		pair(r.Pair)
+		return r
+	case *types.ListPairsResponse:
+		for _, p := range r.Pairs {
+			pair(p)
+		}
+		if r.ContinueToken != "" {
+			if tok, err := decodeContinueToken(r.ContinueToken); err == nil {
+				tok.after = unqualifyKey(ns, tok.after)
+				r.ContinueToken = encodeContinueToken(tok)
+			}
+		}
+		return r
+	case *types.ListKeysResponse:
+		for i, k := range r.Keys {
+			r.Keys[i] = unqualifyKey(ns, k)
+		}
+		return r
+	case *types.WatchEvent:
+		r.Key = unqualifyKey(ns, r.Key)
+		return r
+	}
+	return resp
+}
+
+func (grpcs *GRPCServer) unaryNamespaceInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	ns := grpcs.callNamespace(ctx)
+	if ns == "" {
+		return handler(ctx, req)
+	}
+
+	if err := scopeRequest(ns, req); err != nil {
+		return nil, err
+	}
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return unscopeResponse(ns, resp), nil
+}
+
+func (grpcs *GRPCServer) streamNamespaceInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	ns := grpcs.callNamespace(ss.Context())
+	if ns == "" {
+		return handler(srv, ss)
+	}
+	return handler(srv, &namespacedStream{ServerStream: ss, ns: ns})
+}
+
+// namespacedStream scopes the messages of a stream to a namespace.
+type namespacedStream struct {
+	grpc.ServerStream
+	ns string
+}
+
+func (s *namespacedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return scopeRequest(s.ns, m)
+}
+
+func (s *namespacedStream) SendMsg(m interface{}) error {
+	return s.ServerStream.SendMsg(unscopeResponse(s.ns, m))
+}
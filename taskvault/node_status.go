@@ -0,0 +1,86 @@
+package taskvault
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+)
+
+// NodeStatus reports the health of every serf member as seen by this node,
+// which is meant to be the leader: uptime and serf protocol come from
+// gossip, the time since a server last heard from the leader and whether it
+// is reachable at all come from asking it for its raft stats.
+func (a *Agent) NodeStatus(ctx context.Context) ([]*types.MemberStatus, error) {
+	future := a.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	roles := make(map[raft.ServerID]types.RaftRole)
+	for _, server := range future.Configuration().Servers {
+		roles[server.ID] = raftRoleToProto(server.Suffrage)
+	}
+	_, leaderID := a.raft.LeaderWithID()
+
+	now := time.Now()
+	members := a.serf.Members()
+	statuses := make([]*types.MemberStatus, len(members))
+
+	var wg sync.WaitGroup
+	for i, m := range members {
+		status := &types.MemberStatus{
+			Name:         m.Name,
+			Addr:         net.JoinHostPort(m.Addr.String(), strconv.Itoa(int(m.Port))),
+			Status:       m.Status.String(),
+			RaftRole:     roles[raft.ServerID(m.Name)],
+			Leader:       raft.ServerID(m.Name) == leaderID,
+			SerfProtocol: uint32(m.ProtocolCur),
+		}
+		status.Maintenance, status.MaintenanceReason = memberMaintenance(m)
+		if started, err := strconv.ParseInt(m.Tags["started"], 10, 64); err == nil {
+			status.UptimeSeconds = int64(now.Sub(time.Unix(started, 0)) / time.Second)
+		}
+		statuses[i] = status
+
+		if m.Name == a.config.NodeName {
+			status.Reachable = true
+			status.LastContact = a.RaftStats()["last_contact"]
+			continue
+		}
+
+		parts := toServerPart(m)
+		if parts == nil {
+			status.Error = "not a server"
+			continue
+		}
+		if m.Status != serf.StatusAlive {
+			status.Error = "member is " + m.Status.String()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, raftStatusTimeout)
+			defer cancel()
+
+			stats, err := a.GRPCClient.RaftStats(ctx, parts.RPCAddr.String())
+			if err != nil {
+				status.Error = err.Error()
+				return
+			}
+			status.Reachable = true
+			status.LastContact = stats["last_contact"]
+		}()
+	}
+	wg.Wait()
+
+	return statuses, nil
+}
@@ -0,0 +1,168 @@
+package taskvault
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// QuorumStatus tells whether this node is on the side of the cluster that
+// can commit writes.
+type QuorumStatus struct {
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason,omitempty"`
+	Leader  string `json:"leader"`
+	// Voters is the size of the raft configuration, Reachable the number
+	// of voters the leader heartbeats. Followers only know the former.
+	Voters    int `json:"voters"`
+	Reachable int `json:"reachable,omitempty"`
+	// LastContact is the time since a follower last heard from the leader.
+	LastContact string `json:"last_contact,omitempty"`
+}
+
+// heartbeatFailures holds the voters the leader fails to heartbeat, with
+// the last time it reached them.
+type heartbeatFailures struct {
+	lock    sync.Mutex
+	failing map[raft.ServerID]time.Time
+}
+
+func (f *heartbeatFailures) set(id raft.ServerID, lastContact time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.failing == nil {
+		f.failing = make(map[raft.ServerID]time.Time)
+	}
+	f.failing[id] = lastContact
+}
+
+func (f *heartbeatFailures) clear(id raft.ServerID) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.failing, id)
+}
+
+func (f *heartbeatFailures) reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.failing = nil
+}
+
+func (f *heartbeatFailures) has(id raft.ServerID) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	_, ok := f.failing[id]
+	return ok
+}
+
+// observeHeartbeats records the followers the leader can not reach until
+// the agent stops. The failures of a past term are forgotten on every
+// leader change.
+func (a *Agent) observeHeartbeats() {
+	obsCh := make(chan raft.Observation, leaderObservations)
+	observer := raft.NewObserver(obsCh, false, func(o *raft.Observation) bool {
+		switch o.Data.(type) {
+		case raft.FailedHeartbeatObservation, raft.ResumedHeartbeatObservation, raft.LeaderObservation:
+			return true
+		}
+		return false
+	})
+	a.raft.RegisterObserver(observer)
+	defer a.raft.DeregisterObserver(observer)
+
+	for {
+		select {
+		case o := <-obsCh:
+			switch data := o.Data.(type) {
+			case raft.FailedHeartbeatObservation:
+				a.heartbeats.set(data.PeerID, data.LastContact)
+			case raft.ResumedHeartbeatObservation:
+				a.heartbeats.clear(data.PeerID)
+			case raft.LeaderObservation:
+				a.heartbeats.reset()
+			}
+		case <-a.shutdowner:
+			return
+		}
+	}
+}
+
+// QuorumStatus reports whether a quorum of voters is reachable from this
+// node. The leader counts the voters it heartbeats, a follower trusts the
+// leader while it heard from it within the heartbeat timeout. During a
+// partition the minority side is unhealthy: its followers lose the leader
+// and a leader cut off from the majority stops counting it.
+func (a *Agent) QuorumStatus() QuorumStatus {
+	if a.raft == nil {
+		return QuorumStatus{Reason: "raft is not running"}
+	}
+
+	_, leaderID := a.raft.LeaderWithID()
+	status := QuorumStatus{Leader: string(leaderID)}
+
+	future := a.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		status.Reason = err.Error()
+		return status
+	}
+	var voters []raft.ServerID
+	for _, server := range future.Configuration().Servers {
+		if server.Suffrage == raft.Voter {
+			voters = append(voters, server.ID)
+		}
+	}
+	status.Voters = len(voters)
+
+	switch a.raft.State() {
+	case raft.Leader:
+		for _, id := range voters {
+			if !a.heartbeats.has(id) {
+				status.Reachable++
+			}
+		}
+		switch {
+		case status.Reachable <= len(voters)/2:
+			status.Reason = "no quorum of voters reachable"
+		case !a.leaderReady.Load():
+			status.Reason = "leader has not committed in its term yet"
+		default:
+			status.Healthy = true
+		}
+
+	case raft.Follower:
+		if leaderID == "" {
+			status.Reason = "no leader"
+			return status
+		}
+		since := time.Since(a.raft.LastContact())
+		status.LastContact = since.String()
+		if since > a.heartbeatTimeout() {
+			status.Reason = "no contact with the leader"
+			return status
+		}
+		status.Healthy = true
+
+	default:
+		status.Reason = "no leader"
+	}
+
+	return status
+}
+
+// QuorumHealthy reports whether writes through this node can be committed,
+// see QuorumStatus.
+func (a *Agent) QuorumHealthy() bool {
+	return a.QuorumStatus().Healthy
+}
+
+// heartbeatTimeout is the effective raft heartbeat timeout.
+func (a *Agent) heartbeatTimeout() time.Duration {
+	rc := raft.DefaultConfig()
+	a.config.tuneRaft(rc)
+	return rc.HeartbeatTimeout
+}
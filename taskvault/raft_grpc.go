@@ -1,16 +1,37 @@
 package taskvault
 
 import (
+	"crypto/tls"
+	"errors"
+	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
 	"go.uber.org/zap"
 )
 
+// raftTLSByte is written by a dialer before the TLS handshake. Plain raft
+// connections start with an rpc type and gRPC ones with a TLS record or the
+// HTTP/2 preface, so the byte is never ambiguous on the shared port.
+const raftTLSByte byte = 0xfe
+
+var ErrRaftPlaintext = errors.New("raft: plaintext connection rejected")
+
 type RaftLayer struct {
 	ln     net.Listener
 	logger *zap.SugaredLogger
+
+	// advertise, when set, is reported by Addr instead of the listener
+	// address, which may be 0.0.0.0 or a container address behind NAT.
+	advertise net.Addr
+
+	// incoming terminates TLS for peers that announce it and outgoing, when
+	// set, makes every dial use TLS. strict refuses plaintext peers.
+	incoming *tls.Config
+	outgoing *tls.Config
+	strict   bool
 }
 
 var _ raft.StreamLayer = (*RaftLayer)(nil)
@@ -19,9 +40,16 @@ func NewRaftLayer(logger *zap.SugaredLogger) *RaftLayer {
 	return &RaftLayer{logger: logger}
 }
 
-func NewTLSRaftLayer(logger *zap.SugaredLogger) *RaftLayer {
+func NewTLSRaftLayer(
+	logger *zap.SugaredLogger,
+	incoming, outgoing *tls.Config,
+	strict bool,
+) *RaftLayer {
 	return &RaftLayer{
-		logger: logger,
+		logger:   logger,
+		incoming: incoming,
+		outgoing: outgoing,
+		strict:   strict,
 	}
 }
 
@@ -29,6 +57,12 @@ func (t *RaftLayer) Open(l net.Listener) {
 	t.ln = l
 }
 
+// Advertise makes the transport announce addr, raft stores it as the
+// address of this server in the cluster configuration.
+func (t *RaftLayer) Advertise(addr net.Addr) {
+	t.advertise = addr
+}
+
 func (t *RaftLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
 	dialer := &net.Dialer{Timeout: timeout}
 
@@ -36,23 +70,135 @@ func (t *RaftLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Co
 	var conn net.Conn
 
 	conn, err = dialer.Dial("tcp", string(addr))
+	if err != nil || t.outgoing == nil {
+		return conn, err
+	}
+
+	if _, err = conn.Write([]byte{raftTLSByte}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conf := t.outgoing
+	if conf.ServerName == "" {
+		host, _, err := net.SplitHostPort(string(addr))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conf = conf.Clone()
+		conf.ServerName = host
+	}
 
-	return conn, err
+	tlsConn := tls.Client(conn, conf)
+	if timeout > 0 {
+		_ = tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err = tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
 }
 
 func (t *RaftLayer) Accept() (net.Conn, error) {
 	c, err := t.ln.Accept()
 	if err != nil {
 		t.logger.Error(err)
+		return c, err
+	}
+
+	if t.incoming == nil && !t.strict {
+		return c, nil
 	}
 
-	return c, err
+	return &raftConn{Conn: c, layer: t}, nil
 }
 
 func (t *RaftLayer) Close() error {
+	if t.ln == nil {
+		return nil
+	}
 	return t.ln.Close()
 }
 
 func (t *RaftLayer) Addr() net.Addr {
+	if t.advertise != nil {
+		return t.advertise
+	}
 	return t.ln.Addr()
 }
+
+// raftConn decides between TLS and plaintext on the first read or write, so
+// a slow peer never blocks the transport's accept loop.
+type raftConn struct {
+	net.Conn
+	layer *RaftLayer
+
+	once sync.Once
+	conn net.Conn
+	err  error
+}
+
+func (c *raftConn) negotiate() error {
+	c.once.Do(func() {
+		c.conn, c.err = c.sniff()
+		if c.err != nil && !errors.Is(c.err, io.EOF) {
+			c.layer.logger.With(
+				zap.Error(c.err),
+				zap.Stringer("remote", c.RemoteAddr()),
+			).Warn("raft: Rejecting connection")
+		}
+	})
+	return c.err
+}
+
+func (c *raftConn) sniff() (net.Conn, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(c.Conn, b[:]); err != nil {
+		return nil, err
+	}
+
+	if b[0] == raftTLSByte {
+		if c.layer.incoming == nil {
+			return nil, errors.New("raft: TLS requested but not configured")
+		}
+		return tls.Server(c.Conn, c.layer.incoming), nil
+	}
+
+	if c.layer.strict {
+		return nil, ErrRaftPlaintext
+	}
+	return &prefixConn{Conn: c.Conn, prefix: b[:]}, nil
+}
+
+func (c *raftConn) Read(p []byte) (int, error) {
+	if err := c.negotiate(); err != nil {
+		return 0, err
+	}
+	return c.conn.Read(p)
+}
+
+func (c *raftConn) Write(p []byte) (int, error) {
+	if err := c.negotiate(); err != nil {
+		return 0, err
+	}
+	return c.conn.Write(p)
+}
+
+// prefixConn replays bytes consumed while sniffing the connection.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,79 @@
+package taskvault
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/hashicorp/raft"
+)
+
+// raftStatusTimeout bounds how long RaftStatus waits for a single peer.
+const raftStatusTimeout = 5 * time.Second
+
+// RaftStats returns the local raft statistics.
+func (a *Agent) RaftStats() map[string]string {
+	return a.raft.Stats()
+}
+
+// RaftStatus describes the raft configuration as seen by this node. Every
+// server reports its own indexes and the time since it last heard from the
+// leader, so lagging followers stand out. Unreachable peers carry an error.
+func (a *Agent) RaftStatus(ctx context.Context) (*types.RaftStatusResponse, error) {
+	future := a.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	leaderAddr, leaderID := a.raft.LeaderWithID()
+	status := &types.RaftStatusResponse{
+		Leader: string(leaderID),
+		Stats:  a.RaftStats(),
+	}
+
+	servers := future.Configuration().Servers
+	status.Servers = make([]*types.RaftPeerStatus, len(servers))
+
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		peer := &types.RaftPeerStatus{
+			Id:      string(server.ID),
+			Address: string(server.Address),
+			Role:    raftRoleToProto(server.Suffrage),
+			Leader:  server.Address == leaderAddr,
+		}
+		status.Servers[i] = peer
+
+		if server.ID == raft.ServerID(a.config.NodeName) {
+			fillPeerStats(peer, status.Stats)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, raftStatusTimeout)
+			defer cancel()
+
+			stats, err := a.GRPCClient.RaftStats(ctx, a.rpcAddr(server.ID, server.Address))
+			if err != nil {
+				peer.Error = err.Error()
+				return
+			}
+			fillPeerStats(peer, stats)
+		}()
+	}
+	wg.Wait()
+
+	return status, nil
+}
+
+func fillPeerStats(peer *types.RaftPeerStatus, stats map[string]string) {
+	peer.LastLogIndex, _ = strconv.ParseUint(stats["last_log_index"], 10, 64)
+	peer.CommitIndex, _ = strconv.ParseUint(stats["commit_index"], 10, 64)
+	peer.AppliedIndex, _ = strconv.ParseUint(stats["applied_index"], 10, 64)
+	peer.LastContact = stats["last_contact"]
+}
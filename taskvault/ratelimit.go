@@ -0,0 +1,213 @@
+package taskvault
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/danluki/taskvault/pkg/types"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	// rateLimitIdle is how long a client keeps its buckets after its last
+	// call.
+	rateLimitIdle = 10 * time.Minute
+
+	// rateLimitMaxClients bounds the clients tracked at once. Past it the
+	// client seen last the longest ago is forgotten.
+	rateLimitMaxClients = 16384
+)
+
+// rateLimiter keeps a token bucket per client, one for reads and one for
+// writes. A zero rate leaves that kind of call unlimited.
+type rateLimiter struct {
+	reads, writes           rate.Limit
+	readsBurst, writesBurst int
+
+	lock      sync.Mutex
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+type clientLimiter struct {
+	reads, writes *rate.Limiter
+	lastSeen      time.Time
+}
+
+func newRateLimiter(c *Config) *rateLimiter {
+	if c.RateLimitReads <= 0 && c.RateLimitWrites <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		reads:       rate.Limit(c.RateLimitReads),
+		writes:      rate.Limit(c.RateLimitWrites),
+		readsBurst:  c.RateLimitReadsBurst,
+		writesBurst: c.RateLimitWritesBurst,
+		clients:     make(map[string]*clientLimiter),
+	}
+}
+
+func (l *rateLimiter) allow(client string, write bool, now time.Time) bool {
+	limit := l.reads
+	if write {
+		limit = l.writes
+	}
+	if limit <= 0 {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, c := range l.clients {
+			if now.Sub(c.lastSeen) > rateLimitIdle {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	c, ok := l.clients[client]
+	if !ok {
+		if len(l.clients) >= rateLimitMaxClients {
+			l.evictOldest()
+		}
+		c = &clientLimiter{
+			reads:  rate.NewLimiter(l.reads, max(l.readsBurst, 1)),
+			writes: rate.NewLimiter(l.writes, max(l.writesBurst, 1)),
+		}
+		l.clients[client] = c
+	}
+	c.lastSeen = now
+
+	if write {
+		return c.writes.AllowN(now, 1)
+	}
+	return c.reads.AllowN(now, 1)
+}
+
+// evictOldest forgets the client seen last the longest ago. Must be called
+// with the lock held.
+func (l *rateLimiter) evictOldest() {
+	var (
+		oldest string
+		seen   time.Time
+	)
+	for k, c := range l.clients {
+		if oldest == "" || c.lastSeen.Before(seen) {
+			oldest, seen = k, c.lastSeen
+		}
+	}
+	delete(l.clients, oldest)
+}
+
+// rateLimitKey identifies the caller by its token when it is a valid one, by
+// its IP otherwise, so that made up tokens do not get buckets of their own.
+// Authenticated calls from cluster members, forwarded writes and internal
+// RPCs, are not limited: their clients were limited where they connected.
+func (grpcs *GRPCServer) rateLimitKey(ctx context.Context) (string, bool) {
+	config := grpcs.agent.config
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var header string
+	if tokens := md.Get(authMetadataKey); len(tokens) > 0 {
+		header = tokens[0]
+	}
+
+	var ip net.IP
+	p, _ := peer.FromContext(ctx)
+	if p != nil {
+		if addr, ok := p.Addr.(*net.TCPAddr); ok {
+			ip = addr.IP
+		}
+	}
+
+	if ip != nil && grpcs.agent.serf != nil && (config.validToken(header) || verifiedPeer(p)) {
+		for _, m := range grpcs.agent.serf.Members() {
+			if m.Addr.Equal(ip) {
+				return "", false
+			}
+		}
+	}
+
+	if config.validToken(header) {
+		return "token:" + strings.TrimPrefix(header, bearerPrefix), true
+	}
+	if _, ok := config.tokenNamespace(header); ok {
+		return "token:" + strings.TrimPrefix(header, bearerPrefix), true
+	}
+	if ip == nil {
+		return "", false
+	}
+	return "ip:" + ip.String(), true
+}
+
+// verifiedPeer reports whether the caller presented a client certificate
+// signed by the cluster CA.
+func verifiedPeer(p *peer.Peer) bool {
+	if p == nil {
+		return false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	return ok && len(info.State.VerifiedChains) > 0
+}
+
+func (grpcs *GRPCServer) rateLimit(ctx context.Context, method string) error {
+	if grpcs.limiter == nil || strings.HasPrefix(method, "/grpc.health.v1.Health/") {
+		return nil
+	}
+	client, ok := grpcs.rateLimitKey(ctx)
+	if !ok {
+		return nil
+	}
+
+	write := writeMethods[method]
+	if grpcs.limiter.allow(client, write, time.Now()) {
+		return nil
+	}
+
+	kind := "read"
+	if write {
+		kind = "write"
+	}
+	metrics.IncrCounterWithLabels([]string{"grpc", "rate_limited"}, 1,
+		[]metrics.Label{{Name: "kind", Value: kind}},
+	)
+	return reasonError(
+		codes.ResourceExhausted, types.ErrorReason_REASON_RATE_LIMITED, kind+" rate limit exceeded",
+	)
+}
+
+func (grpcs *GRPCServer) unaryRateLimitInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if err := grpcs.rateLimit(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (grpcs *GRPCServer) streamRateLimitInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if err := grpcs.rateLimit(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,95 @@
+package taskvault
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert.Nil(t, newRateLimiter(DefaultConfig()))
+
+	c := DefaultConfig()
+	c.RateLimitWrites = 1
+	c.RateLimitWritesBurst = 2
+	l := newRateLimiter(c)
+
+	now := time.Now()
+	assert.True(t, l.allow("a", true, now))
+	assert.True(t, l.allow("a", true, now))
+	assert.False(t, l.allow("a", true, now))
+
+	// Clients and kinds have their own buckets, reads are not limited here.
+	assert.True(t, l.allow("b", true, now))
+	assert.True(t, l.allow("a", false, now))
+
+	// The bucket refills at the configured rate.
+	assert.True(t, l.allow("a", true, now.Add(time.Second)))
+	assert.False(t, l.allow("a", true, now.Add(time.Second)))
+
+	// Idle clients are forgotten.
+	l.allow("b", true, now.Add(rateLimitIdle+2*time.Minute))
+	assert.Len(t, l.clients, 1)
+
+	// Past the cap the client seen last the longest ago is forgotten.
+	later := now.Add(2 * rateLimitIdle)
+	for i := 0; i < rateLimitMaxClients; i++ {
+		l.allow(fmt.Sprint(i), true, later.Add(time.Duration(i)))
+	}
+	assert.Len(t, l.clients, rateLimitMaxClients)
+	assert.NotContains(t, l.clients, "b")
+	l.allow("c", true, later.Add(time.Second))
+	assert.Len(t, l.clients, rateLimitMaxClients)
+	assert.NotContains(t, l.clients, "0")
+}
+
+func TestGRPCServer_RateLimitKey(t *testing.T) {
+	c := DefaultConfig()
+	c.ACLTokens = []string{"secret"}
+	grpcs := &GRPCServer{agent: &Agent{config: c}}
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000},
+	})
+	withToken := func(token string) context.Context {
+		return metadata.NewIncomingContext(ctx, metadata.Pairs(authMetadataKey, bearerPrefix+token))
+	}
+
+	key, ok := grpcs.rateLimitKey(withToken("secret"))
+	assert.True(t, ok)
+	assert.Equal(t, "token:secret", key)
+
+	// Tokens that are not valid count against the IP of the caller.
+	key, ok = grpcs.rateLimitKey(withToken("bogus"))
+	assert.True(t, ok)
+	assert.Equal(t, "ip:10.0.0.1", key)
+}
+
+func TestGRPCServer_RateLimitKind(t *testing.T) {
+	c := DefaultConfig()
+	c.RateLimitWrites = 1
+	c.RateLimitWritesBurst = 1
+	grpcs := &GRPCServer{agent: &Agent{config: c}, limiter: newRateLimiter(c)}
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000},
+	})
+
+	assert.NoError(t, grpcs.rateLimit(ctx, "/types.Taskvault/CreateValue"))
+	err := grpcs.rateLimit(ctx, "/types.Taskvault/ForceLeave")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// Calls that change nothing are reads, even those not open to anonymous
+	// readers.
+	for _, method := range []string{"/types.Taskvault/GetPair", "/types.Taskvault/RaftStatus"} {
+		assert.NoError(t, grpcs.rateLimit(ctx, method), method)
+	}
+}
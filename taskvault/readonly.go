@@ -0,0 +1,81 @@
+package taskvault
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// readOnlyTag marks standby replicas in serf.
+const readOnlyTag = "read_only"
+
+var ErrReadOnly = errors.New("node is a read-only replica")
+
+// writeMethods are the RPCs a read-only replica rejects: the writes to the
+// keyspace and the changes to the cluster it would forward to the leader.
+// Calls about the node itself, like maintenance or tags, stay allowed.
+var writeMethods = map[string]bool{
+	"/types.Taskvault/CreateValue":        true,
+	"/types.Taskvault/UpdateValue":        true,
+	"/types.Taskvault/DeleteValue":        true,
+	"/types.Taskvault/CompareAndSwap":     true,
+	"/types.Taskvault/Increment":          true,
+	"/types.Taskvault/Txn":                true,
+	"/types.Taskvault/Restore":            true,
+	"/types.Taskvault/AcquireLock":        true,
+	"/types.Taskvault/ReleaseLock":        true,
+	"/types.Taskvault/CreateSession":      true,
+	"/types.Taskvault/RenewSession":       true,
+	"/types.Taskvault/DestroySession":     true,
+	"/types.Taskvault/RaftRemovePeerByID": true,
+	"/types.Taskvault/ForceLeave":         true,
+	"/types.Taskvault/LeadershipTransfer": true,
+}
+
+// nonVoter reports whether the node joins raft without a vote.
+func (c *Config) nonVoter() bool {
+	return c.NonVoter || c.ReadOnly
+}
+
+func (grpcs *GRPCServer) checkReadOnly(method string) error {
+	if grpcs.agent.config.ReadOnly && writeMethods[method] {
+		return status.Error(codes.FailedPrecondition, ErrReadOnly.Error())
+	}
+	return nil
+}
+
+func (grpcs *GRPCServer) unaryReadOnlyInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if err := grpcs.checkReadOnly(info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (grpcs *GRPCServer) streamReadOnlyInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if err := grpcs.checkReadOnly(info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// rejectReadOnly guards the HTTP write routes of a read-only replica.
+func (h *HTTPTransport) rejectReadOnly(c *gin.Context) {
+	if h.agent.config.ReadOnly {
+		_ = c.AbortWithError(http.StatusForbidden, ErrReadOnly)
+	}
+}
@@ -0,0 +1,144 @@
+package taskvault
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Reload applies the part of newConfig that is safe to change at runtime:
+// the log level and the leader refresh interval. With TLS enabled it also
+// reads the certificate and key files again, for rotated certificates; when
+// they fail to load the error is logged and the old certificate kept. Other
+// changed fields only take effect after a restart, they are reported with a
+// warning.
+func (a *Agent) Reload(newConfig *Config) error {
+	level, err := zapcore.ParseLevel(newConfig.LogLevel)
+	if err != nil {
+		return fmt.Errorf("agent: invalid log-level %q", newConfig.LogLevel)
+	}
+	if newConfig.RefreshInterval <= 0 {
+		return fmt.Errorf("agent: invalid refresh interval %s", newConfig.RefreshInterval)
+	}
+
+	if a.keyPair != nil {
+		if err := a.keyPair.reload(); err != nil {
+			a.logger.With(zap.Error(err)).Error("agent: tls certificate not reloaded")
+		} else {
+			a.logger.With(
+				zap.Time("not_after", a.keyPair.certificate().Leaf.NotAfter),
+			).Info("agent: tls certificate reloaded")
+		}
+	}
+
+	for _, field := range a.config.restartRequired(newConfig) {
+		a.logger.Warnf("agent: %s can not be changed at runtime, restart to apply it", field)
+	}
+
+	a.logLevel.SetLevel(level)
+	a.refreshInterval.Store(int64(newConfig.RefreshInterval))
+	select {
+	case a.reloadCh <- struct{}{}:
+	default:
+	}
+
+	a.logger.With(
+		zap.String("log_level", level.String()),
+		zap.Duration("refresh_interval", newConfig.RefreshInterval),
+	).Info("agent: configuration reloaded")
+
+	return nil
+}
+
+// restartRequired lists the fields that differ in newConfig but are only
+// read at startup. Addresses are normalized first, as they were on start.
+func (c *Config) restartRequired(newConfig *Config) []string {
+	nc := *newConfig
+	_ = nc.normalizeAddrs()
+	if nc.AdvertiseRPCPort == 0 {
+		nc.AdvertiseRPCPort = nc.RPCPort
+	}
+	if nc.AdvertiseRaftPort == 0 {
+		nc.AdvertiseRaftPort = nc.RaftPort
+	}
+
+	fields := []struct {
+		name    string
+		changed bool
+	}{
+		{"node-name", c.NodeName != nc.NodeName},
+		{"datacenter", c.Datacenter != nc.Datacenter},
+		{"bind-addr", c.BindAddr != nc.BindAddr},
+		{"advertise-addr", c.AdvertiseAddr != nc.AdvertiseAddr},
+		{"http-addr", c.HTTPAddr != nc.HTTPAddr},
+		{"enable-http", c.EnableHTTP != nc.EnableHTTP},
+		{"health-addr", c.HealthAddr != nc.HealthAddr},
+		{"cors-allowed-origins", !slices.Equal(c.CORSAllowedOrigins, nc.CORSAllowedOrigins)},
+		{"rpc-port", c.RPCPort != nc.RPCPort},
+		{"advertise-rpc-port", c.AdvertiseRPCPort != nc.AdvertiseRPCPort},
+		{"separate-listeners", c.SeparateListeners != nc.SeparateListeners},
+		{"raft-port", c.RaftPort != nc.RaftPort},
+		{"advertise-raft-port", c.AdvertiseRaftPort != nc.AdvertiseRaftPort},
+		{"data-dir", c.DataDir != nc.DataDir},
+		{"raft-dir", c.RaftDir != nc.RaftDir},
+		{"store-dir", c.StoreDir != nc.StoreDir},
+		{"snapshot-dir", c.SnapshotDir != nc.SnapshotDir},
+		{"log-format", c.LogFormat != nc.LogFormat},
+		{"log-file", c.LogFile != nc.LogFile},
+		{"tracing-endpoint", c.TracingEndpoint != nc.TracingEndpoint},
+		{"store-backend", c.StoreBackend != nc.StoreBackend},
+		{"tags", !maps.Equal(c.Tags, nc.Tags)},
+		{"profile", c.Profile != nc.Profile},
+		{"encrypt", c.EncryptKey != nc.EncryptKey},
+		{"encrypt-keys", !slices.Equal(c.EncryptKeys, nc.EncryptKeys)},
+		{"cert-file", c.CertFile != nc.CertFile},
+		{"key-file", c.KeyFile != nc.KeyFile},
+		{"ca-file", c.CAFile != nc.CAFile},
+		{"non-voter", c.NonVoter != nc.NonVoter},
+		{"read-only", c.ReadOnly != nc.ReadOnly},
+		{"enable-reflection", c.EnableReflection != nc.EnableReflection},
+		{"max-key-size", c.MaxKeySize != nc.MaxKeySize},
+		{"max-value-size", c.MaxValueSize != nc.MaxValueSize},
+		{"grpc-max-recv-msg-size", c.GRPCMaxRecvMsgSize != nc.GRPCMaxRecvMsgSize},
+		{"grpc-max-send-msg-size", c.GRPCMaxSendMsgSize != nc.GRPCMaxSendMsgSize},
+		{"grpc-keepalive-time", c.GRPCKeepaliveTime != nc.GRPCKeepaliveTime},
+		{"grpc-keepalive-timeout", c.GRPCKeepaliveTimeout != nc.GRPCKeepaliveTimeout},
+		{"grpc-keepalive-min-time", c.GRPCKeepaliveMinTime != nc.GRPCKeepaliveMinTime},
+		{"grpc-drain-timeout", c.GRPCDrainTimeout != nc.GRPCDrainTimeout},
+		{"rpc-match-timeout", c.RPCMatchTimeout != nc.RPCMatchTimeout},
+		{"apply-queue-depth", c.ApplyQueueDepth != nc.ApplyQueueDepth},
+		{"grpc-compression", c.GRPCCompression != nc.GRPCCompression},
+		{"rate-limit-reads", c.RateLimitReads != nc.RateLimitReads},
+		{"rate-limit-reads-burst", c.RateLimitReadsBurst != nc.RateLimitReadsBurst},
+		{"rate-limit-writes", c.RateLimitWrites != nc.RateLimitWrites},
+		{"rate-limit-writes-burst", c.RateLimitWritesBurst != nc.RateLimitWritesBurst},
+		{"raft-multiplier", c.RaftMultiplier != nc.RaftMultiplier},
+		{"raft-heartbeat-timeout", c.HeartbeatTimeout != nc.HeartbeatTimeout},
+		{"raft-election-timeout", c.ElectionTimeout != nc.ElectionTimeout},
+		{"raft-commit-timeout", c.CommitTimeout != nc.CommitTimeout},
+		{"raft-snapshot-retain", c.SnapshotRetain != nc.SnapshotRetain},
+		{"raft-snapshot-interval", c.SnapshotInterval != nc.SnapshotInterval},
+		{"raft-snapshot-threshold", c.SnapshotThreshold != nc.SnapshotThreshold},
+		{"raft-no-sync", c.RaftNoSync != nc.RaftNoSync},
+		{"raft-promotion-lag", c.RaftPromotionLag != nc.RaftPromotionLag},
+		{"raft-barrier-timeout", c.RaftBarrierTimeout != nc.RaftBarrierTimeout},
+		{"anti-entropy-interval", c.AntiEntropyInterval != nc.AntiEntropyInterval},
+		{"serf-reconnect-timeout", c.SerfReconnectTimeout != nc.SerfReconnectTimeout},
+		{"serf-tombstone-timeout", c.SerfTombstoneTimeout != nc.SerfTombstoneTimeout},
+		{"serf-coalesce-period", c.SerfCoalescePeriod != nc.SerfCoalescePeriod},
+		{"serf-quiescent-period", c.SerfQuiescentPeriod != nc.SerfQuiescentPeriod},
+		{"serf-user-coalesce-period", c.SerfUserCoalescePeriod != nc.SerfUserCoalescePeriod},
+		{"serf-user-quiescent-period", c.SerfUserQuiescentPeriod != nc.SerfUserQuiescentPeriod},
+	}
+
+	var changed []string
+	for _, f := range fields {
+		if f.changed {
+			changed = append(changed, f.name)
+		}
+	}
+	return changed
+}
@@ -1,24 +1,52 @@
 package taskvault
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"os"
 	"strings"
 	"time"
 
-	discover "github.com/hashicorp/go-discover"
-	discoverk8s "github.com/hashicorp/go-discover/provider/k8s"
 	"go.uber.org/zap"
 )
 
+// ErrRetryJoinExhausted is returned once retry-max join attempts failed.
+var ErrRetryJoinExhausted = errors.New("retry join exhausted")
+
+// RetryJoinAttemptError reports a failed join attempt that will be retried
+// after Next. It is sent on RetryJoinCh for progress only, the agent keeps
+// trying.
+type RetryJoinAttemptError struct {
+	Attempt int
+	Next    time.Duration
+	Err     error
+}
+
+func (e *RetryJoinAttemptError) Error() string {
+	return fmt.Sprintf("join attempt %d failed, retrying in %s: %v", e.Attempt, e.Next, e.Err)
+}
+
+func (e *RetryJoinAttemptError) Unwrap() error {
+	return e.Err
+}
+
 func (a *Agent) retryJoinLAN() {
 	r := &retryJoiner{
 		cluster:     "LAN",
 		addrs:       a.config.RetryJoin,
 		maxAttempts: a.config.RetryJoinMaxAttempts,
 		interval:    a.config.RetryJoinInterval,
+		maxInterval: a.config.RetryJoinMaxInterval,
 		join:        a.JoinLAN,
+		progress: func(err error) {
+			// Progress is dropped when nobody is listening.
+			select {
+			case a.retryJoinCh <- err:
+			default:
+			}
+		},
 	}
 	if err := r.retryJoin(a.logger); err != nil {
 		a.retryJoinCh <- err
@@ -32,9 +60,31 @@ type retryJoiner struct {
 
 	maxAttempts int
 
-	interval time.Duration
+	// interval is the wait after the first failed attempt, it doubles after
+	// every failure up to maxInterval.
+	interval    time.Duration
+	maxInterval time.Duration
 
 	join func([]string) (int, error)
+
+	progress func(error)
+}
+
+// backoff returns the wait after the given failed attempt, jittered by up
+// to a quarter either way so restarted nodes do not retry in lockstep.
+func (r *retryJoiner) backoff(attempt int) time.Duration {
+	d := r.interval
+	for i := 1; i < attempt && d < r.maxInterval; i++ {
+		d *= 2
+	}
+	if r.maxInterval > 0 && d > r.maxInterval {
+		d = r.maxInterval
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	return d - d/4 + rand.N(d/2+1)
 }
 
 func (r *retryJoiner) retryJoin(logger *zap.SugaredLogger) error {
@@ -42,20 +92,6 @@ func (r *retryJoiner) retryJoin(logger *zap.SugaredLogger) error {
 		return nil
 	}
 
-	providers := make(map[string]discover.Provider)
-	for k, v := range discover.Providers {
-		providers[k] = v
-	}
-	providers["k8s"] = &discoverk8s.Provider{}
-
-	disco, err := discover.New(
-		discover.WithUserAgent(UserAgent()),
-		discover.WithProviders(providers),
-	)
-	if err != nil {
-		return err
-	}
-
 	logger.Info("agent: Joining cluster...", zap.String("cluster", r.cluster))
 	attempt := 0
 	for {
@@ -65,13 +101,19 @@ func (r *retryJoiner) retryJoin(logger *zap.SugaredLogger) error {
 		for _, addr := range r.addrs {
 			switch {
 			case strings.Contains(addr, "provider="):
-				servers, _ := disco.Addrs(
+				servers, err := discoverAddrs(
 					addr,
 					log.New(
 						os.Stdout, "",
 						log.LstdFlags|log.Lshortfile,
 					),
 				)
+				if err != nil {
+					logger.Warn("agent: Discovery failed",
+						zap.String("cluster", r.cluster),
+						zap.Error(err),
+					)
+				}
 
 				addrs = append(addrs, servers...)
 				logger.Infof(
@@ -89,7 +131,8 @@ func (r *retryJoiner) retryJoin(logger *zap.SugaredLogger) error {
 		}
 
 		if len(addrs) > 0 {
-			n, err := r.join(addrs)
+			var n int
+			n, err = r.join(addrs)
 			if err == nil {
 				logger.Infof(
 					"agent: Join %s completed. Synced with %d initial agents",
@@ -105,17 +148,23 @@ func (r *retryJoiner) retryJoin(logger *zap.SugaredLogger) error {
 		}
 
 		attempt++
-		if r.maxAttempts > 0 && attempt > r.maxAttempts {
+		if r.maxAttempts > 0 && attempt >= r.maxAttempts {
 			return fmt.Errorf(
-				"agent: max join %s retry exhausted, exiting", r.cluster,
+				"agent: %w: %s join failed %d times, last error: %v",
+				ErrRetryJoinExhausted, r.cluster, attempt, err,
 			)
 		}
 
+		next := r.backoff(attempt)
 		logger.Warn("agent: Join failed",
 			zap.String("cluster", r.cluster),
+			zap.Int("attempt", attempt),
 			zap.Error(err),
-			zap.Duration("retry_interval", r.interval),
+			zap.Duration("retry_interval", next),
 		)
-		time.Sleep(r.interval)
+		if r.progress != nil {
+			r.progress(&RetryJoinAttemptError{Attempt: attempt, Next: next, Err: err})
+		}
+		time.Sleep(next)
 	}
 }
@@ -0,0 +1,54 @@
+package taskvault
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRetryJoiner_Backoff(t *testing.T) {
+	r := &retryJoiner{interval: time.Second, maxInterval: 10 * time.Second}
+
+	for attempt, want := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		5: 10 * time.Second,
+		9: 10 * time.Second,
+	} {
+		d := r.backoff(attempt)
+		assert.GreaterOrEqual(t, d, want*3/4, "attempt %d", attempt)
+		assert.LessOrEqual(t, d, want*5/4, "attempt %d", attempt)
+	}
+}
+
+func TestRetryJoiner_MaxAttempts(t *testing.T) {
+	var progress []error
+	joins := 0
+	r := &retryJoiner{
+		cluster:     "LAN",
+		addrs:       []string{"127.0.0.1:1"},
+		maxAttempts: 3,
+		interval:    time.Millisecond,
+		maxInterval: time.Millisecond,
+		join: func([]string) (int, error) {
+			joins++
+			return 0, errors.New("connection refused")
+		},
+		progress: func(err error) { progress = append(progress, err) },
+	}
+
+	err := r.retryJoin(zap.NewNop().Sugar())
+	require.ErrorIs(t, err, ErrRetryJoinExhausted)
+	assert.ErrorContains(t, err, "connection refused")
+	assert.Equal(t, 3, joins)
+
+	require.Len(t, progress, 2)
+	var attemptErr *RetryJoinAttemptError
+	require.ErrorAs(t, progress[1], &attemptErr)
+	assert.Equal(t, 2, attemptErr.Attempt)
+}
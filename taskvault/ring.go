@@ -0,0 +1,36 @@
+package taskvault
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+
+	"github.com/danluki/taskvault/pkg/ring"
+	"github.com/hashicorp/serf/serf"
+)
+
+// RingMembers returns the alive servers of the cluster ordered by node name,
+// the input of ring.New for clients sharding keys across the cluster. Every
+// call reads the current serf membership, so a client rebuilding its ring
+// from it follows joins and failures.
+func (a *Agent) RingMembers() []ring.Member {
+	members := []ring.Member{}
+	for _, m := range a.serf.Members() {
+		if m.Status != serf.StatusAlive {
+			continue
+		}
+		parts := toServerPart(m)
+		if parts == nil {
+			continue
+		}
+		members = append(members, ring.Member{
+			ID:   parts.ID,
+			Addr: parts.RPCAddr.String(),
+			Tags: maps.Clone(m.Tags),
+		})
+	}
+	slices.SortFunc(members, func(a, b ring.Member) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return members
+}
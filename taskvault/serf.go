@@ -1,6 +1,7 @@
 package taskvault
 
 import (
+	"sort"
 	"strings"
 	"time"
 
@@ -23,11 +24,11 @@ func (a *Agent) nodeJoin(me serf.MemberEvent, checkBootstrap bool) {
 		}
 
 		a.serverLookup.AddServer(parts)
+	}
 
-		if checkBootstrap {
-			if a.config.BootstrapExpect != 0 {
-				a.maybeBootstrap()
-			}
+	if checkBootstrap {
+		if a.config.BootstrapExpect != 0 && !a.config.nonVoter() {
+			a.maybeBootstrap()
 		}
 	}
 }
@@ -51,25 +52,48 @@ func (a *Agent) maybeBootstrap() {
 		return
 	}
 
+	// Only alive servers that announce the same expect tag count towards
+	// the quorum to bootstrap.
 	members := a.serf.Members()
 	var servers []ServerParts
-	voters := 0
 	for _, member := range members {
 		parts := toServerPart(member)
-		if parts == nil {
+		if parts == nil || member.Status != serf.StatusAlive {
 			continue
 		}
-		if parts.Expect != 0 && parts.Expect != a.config.BootstrapExpect {
+		if parts.Bootstrap {
+			a.logger.Warnf("agent: %s is in bootstrap mode, not bootstrapping", parts.Name)
 			return
 		}
-		if parts.Bootstrap {
+		// Read replicas are added by the leader once the cluster is up.
+		if parts.NonVoter || parts.Expect == 0 {
+			continue
+		}
+		if parts.Expect != a.config.BootstrapExpect {
+			a.logger.Errorf(
+				"agent: %s expects %d servers but this node expects %d, not bootstrapping",
+				parts.Name, parts.Expect, a.config.BootstrapExpect,
+			)
 			return
 		}
-		voters++
 		servers = append(servers, *parts)
 	}
 
-	if voters < a.config.BootstrapExpect {
+	if len(servers) < a.config.BootstrapExpect {
+		a.logger.Infof(
+			"agent: waiting for servers to bootstrap, have %d, expect %d",
+			len(servers), a.config.BootstrapExpect,
+		)
+		return
+	}
+
+	// Every server sees the same members, the one with the lowest ID
+	// bootstraps and the others join the configuration it replicates.
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].ID < servers[j].ID
+	})
+	if servers[0].ID != a.config.NodeName {
+		a.logger.Infof("agent: expected servers found, %s bootstraps the cluster", servers[0].Name)
 		return
 	}
 
@@ -110,7 +134,7 @@ func (a *Agent) maybeBootstrap() {
 	var addrs []string
 
 	for _, server := range servers {
-		addr := server.Addr.String()
+		addr := server.RaftAddr.String()
 		addrs = append(addrs, addr)
 		id := raft.ServerID(server.ID)
 		suffrage := raft.Voter
@@ -133,7 +157,7 @@ func (a *Agent) maybeBootstrap() {
 	a.config.BootstrapExpect = 0
 }
 
-func (a *Agent) nodeFailed(me serf.MemberEvent) {
+func (a *Agent) nodeLeave(me serf.MemberEvent) {
 	for _, m := range me.Members {
 		parts := toServerPart(m)
 		if parts == nil {
@@ -145,6 +169,10 @@ func (a *Agent) nodeFailed(me serf.MemberEvent) {
 	}
 }
 
+// reapEvent queues the members of an event for the leader to reconcile with
+// raft right away instead of on the next refresh interval. Members of a reap
+// event are marked StatusReap, the leader loop then removes them from the
+// raft configuration like members that left.
 func (a *Agent) reapEvent(me serf.MemberEvent) {
 	if !a.IsLeader() {
 		return
@@ -23,17 +23,25 @@ func NewServerLookup() *ServerLookup {
 
 var _ raft.ServerAddressProvider = (*ServerLookup)(nil)
 
+// AddServer adds or updates server. A server that comes back with a new
+// address, like a rescheduled pod, replaces its stale entry.
 func (sl *ServerLookup) AddServer(server *ServerParts) {
 	sl.lock.Lock()
 	defer sl.lock.Unlock()
-	sl.addressToServer[raft.ServerAddress(server.RPCAddr.String())] = server
+	if old, ok := sl.idToServer[raft.ServerID(server.ID)]; ok {
+		delete(sl.addressToServer, raft.ServerAddress(old.RaftAddr.String()))
+	}
+	sl.addressToServer[raft.ServerAddress(server.RaftAddr.String())] = server
 	sl.idToServer[raft.ServerID(server.ID)] = server
 }
 
 func (sl *ServerLookup) RemoveServer(server *ServerParts) {
 	sl.lock.Lock()
 	defer sl.lock.Unlock()
-	delete(sl.addressToServer, raft.ServerAddress(server.RPCAddr.String()))
+	if old, ok := sl.idToServer[raft.ServerID(server.ID)]; ok {
+		delete(sl.addressToServer, raft.ServerAddress(old.RaftAddr.String()))
+	}
+	delete(sl.addressToServer, raft.ServerAddress(server.RaftAddr.String()))
 	delete(sl.idToServer, raft.ServerID(server.ID))
 }
 
@@ -42,9 +50,9 @@ func (sl *ServerLookup) ServerAddr(id raft.ServerID) (raft.ServerAddress, error)
 	defer sl.lock.RUnlock()
 	svr, ok := sl.idToServer[id]
 	if !ok {
-		return "", fmt.Errorf("Could not find address for server id %v", id)
+		return "", fmt.Errorf("%w %q", ErrUnknownServer, id)
 	}
-	return raft.ServerAddress(svr.RPCAddr.String()), nil
+	return raft.ServerAddress(svr.RaftAddr.String()), nil
 }
 
 func (sl *ServerLookup) Server(addr raft.ServerAddress) *ServerParts {
@@ -0,0 +1,71 @@
+package taskvault
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerLookup_AddressChange(t *testing.T) {
+	lookup := NewServerLookup()
+
+	_, err := lookup.ServerAddr("node2")
+	assert.ErrorIs(t, err, ErrUnknownServer)
+
+	// node2 is known at a stale address, then comes back on a new one.
+	stale := &ServerParts{
+		ID:       "node2",
+		RaftAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1},
+	}
+	lookup.AddServer(stale)
+
+	trans2, err := raft.NewTCPTransport("127.0.0.1:0", nil, 1, time.Second, io.Discard)
+	require.NoError(t, err)
+	defer trans2.Close()
+
+	newAddr, err := net.ResolveTCPAddr("tcp", string(trans2.LocalAddr()))
+	require.NoError(t, err)
+	lookup.AddServer(&ServerParts{
+		ID:       "node2",
+		RaftAddr: newAddr,
+	})
+	assert.Nil(t, lookup.Server(raft.ServerAddress(stale.RaftAddr.String())))
+	assert.Len(t, lookup.Servers(), 1)
+
+	addr, err := lookup.ServerAddr("node2")
+	require.NoError(t, err)
+	assert.Equal(t, trans2.LocalAddr(), addr)
+
+	trans1, err := raft.NewTCPTransportWithConfig("127.0.0.1:0", nil, &raft.NetworkTransportConfig{
+		ServerAddressProvider: lookup,
+		MaxPool:               1,
+		Timeout:               time.Second,
+	})
+	require.NoError(t, err)
+	defer trans1.Close()
+
+	go func() {
+		rpc := <-trans2.Consumer()
+		rpc.Respond(&raft.AppendEntriesResponse{Success: true}, nil)
+	}()
+
+	// The raft configuration still holds the stale address, the lookup
+	// sends the RPC to the new one.
+	var resp raft.AppendEntriesResponse
+	err = trans1.AppendEntries(
+		"node2", raft.ServerAddress(stale.RaftAddr.String()),
+		&raft.AppendEntriesRequest{}, &resp,
+	)
+	require.NoError(t, err)
+	assert.True(t, resp.Success)
+
+	lookup.RemoveServer(stale)
+	_, err = lookup.ServerAddr("node2")
+	assert.ErrorIs(t, err, ErrUnknownServer)
+	assert.Empty(t, lookup.Servers())
+}
@@ -0,0 +1,289 @@
+package taskvault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/hashicorp/go-uuid"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// ErrSessionNotFound is returned for sessions that were destroyed or
+	// whose TTL passed without a renewal.
+	ErrSessionNotFound = errors.New("session not found")
+
+	ErrInvalidSession = errors.New("invalid session")
+)
+
+// sessionTable holds the sessions of the FSM. The FSM changes it while
+// applying logs, the leader reads it to find expired sessions.
+type sessionTable struct {
+	lock     sync.RWMutex
+	sessions map[string]*types.Session
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{
+		sessions: make(map[string]*types.Session),
+	}
+}
+
+// live returns the session unless it expired at now.
+func (t *sessionTable) live(id string, now time.Time) (*types.Session, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	s, ok := t.sessions[id]
+	if !ok || (!now.IsZero() && s.ExpiresAt <= now.UnixNano()) {
+		return nil, false
+	}
+	return s, true
+}
+
+// check fails unless id is empty or names a live session, pairs can only be
+// attached to those.
+func (t *sessionTable) check(id string, now time.Time) error {
+	if id == "" {
+		return nil
+	}
+	if _, ok := t.live(id, now); !ok {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	return nil
+}
+
+func (t *sessionTable) get(id string) (*types.Session, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	s, ok := t.sessions[id]
+	return s, ok
+}
+
+func (t *sessionTable) put(s *types.Session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.sessions[s.Id] = s
+}
+
+func (t *sessionTable) delete(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.sessions, id)
+}
+
+// expired returns the sessions whose TTL passed at now.
+func (t *sessionTable) expired(now time.Time) []*types.Session {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var expired []*types.Session
+	for _, s := range t.sessions {
+		if s.ExpiresAt <= now.UnixNano() {
+			expired = append(expired, s)
+		}
+	}
+	return expired
+}
+
+// all returns the sessions ordered by ID, so snapshots are stable.
+func (t *sessionTable) all() []*types.Session {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return slices.SortedFunc(maps.Values(t.sessions), func(a, b *types.Session) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+}
+
+func (t *sessionTable) restore(sessions []*types.Session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	clear(t.sessions)
+	for _, s := range sessions {
+		t.sessions[s.Id] = s
+	}
+}
+
+func (t *sessionTable) len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return len(t.sessions)
+}
+
+// applySessionCreate starts a session, it expires TTL after the time the
+// leader appended the entry unless it is renewed.
+func (d *taskvaultFSM) applySessionCreate(buf []byte, index uint64, appendedAt time.Time) interface{} {
+	var s types.Session
+	if err := proto.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+	if _, ok := d.sessions.get(s.Id); ok {
+		return fmt.Errorf("fsm: session %s already exists", s.Id)
+	}
+
+	s.CreateIndex = index
+	s.ExpiresAt = appendedAt.Add(time.Duration(s.TtlSeconds) * time.Second).UnixNano()
+	d.sessions.put(&s)
+
+	return &s
+}
+
+func (d *taskvaultFSM) applySessionRenew(buf []byte, appendedAt time.Time) interface{} {
+	var req types.RenewSessionRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		return err
+	}
+
+	current, ok := d.sessions.live(req.Id, appendedAt)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, req.Id)
+	}
+
+	// Sessions are shared with the leader's sweep, they are replaced rather
+	// than changed in place.
+	s := proto.Clone(current).(*types.Session)
+	s.ExpiresAt = appendedAt.Add(time.Duration(s.TtlSeconds) * time.Second).UnixNano()
+	d.sessions.put(s)
+
+	return s
+}
+
+// applySessionDestroy removes the session and deletes every pair attached to
+// it. Expiry sweeps pass the expiry the leader observed, a session renewed in
+// the meantime survives.
+func (d *taskvaultFSM) applySessionDestroy(buf []byte, index uint64) interface{} {
+	var req types.DestroySessionRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		return err
+	}
+
+	s, ok := d.sessions.get(req.Id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, req.Id)
+	}
+	if req.ExpiresAt != 0 && s.ExpiresAt != req.ExpiresAt {
+		return nil
+	}
+	d.sessions.delete(req.Id)
+
+	// Sessions are not indexed in the store, finding their pairs takes a
+	// full scan.
+	pairs, err := d.store.AllPairs()
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		if pair.Session != req.Id {
+			continue
+		}
+		if err := d.store.DeletePair(pair.Key); err != nil {
+			return err
+		}
+		d.watches.publish(Event{Type: EventDelete, Key: pair.Key, ModifyIndex: index})
+	}
+
+	return nil
+}
+
+// CreateSession starts a session that lives for ttl after its last renewal.
+// Pairs written with the session ID are deleted when it is destroyed or
+// expires.
+func (a *Agent) CreateSession(ctx context.Context, ttl time.Duration) (*types.Session, error) {
+	if ttl < time.Second {
+		return nil, fmt.Errorf("%w: the ttl must be at least a second", ErrInvalidSession)
+	}
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.apply(ctx, SessionCreateType, &types.Session{
+		Id:         id,
+		TtlSeconds: int64(ttl / time.Second),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessionResponse(resp)
+}
+
+// RenewSession extends the session by its TTL, counted from now.
+func (a *Agent) RenewSession(ctx context.Context, id string) (*types.Session, error) {
+	if id == "" {
+		return nil, fmt.Errorf("%w: the id must not be empty", ErrInvalidSession)
+	}
+
+	resp, err := a.apply(ctx, SessionRenewType, &types.RenewSessionRequest{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	return sessionResponse(resp)
+}
+
+// DestroySession ends the session and deletes its pairs.
+func (a *Agent) DestroySession(ctx context.Context, id string) error {
+	if id == "" {
+		return fmt.Errorf("%w: the id must not be empty", ErrInvalidSession)
+	}
+	return a.applyDestroySession(ctx, &types.DestroySessionRequest{Id: id})
+}
+
+func (a *Agent) applyDestroySession(ctx context.Context, req *types.DestroySessionRequest) error {
+	resp, err := a.apply(ctx, SessionDestroyType, req)
+	if err != nil {
+		return err
+	}
+
+	if err, ok := resp.(error); ok {
+		return err
+	}
+	return nil
+}
+
+func sessionResponse(resp interface{}) (*types.Session, error) {
+	switch r := resp.(type) {
+	case error:
+		return nil, r
+	case *types.Session:
+		return r, nil
+	default:
+		return nil, fmt.Errorf("agent: unexpected session response: %v", resp)
+	}
+}
+
+// reapExpiredSessions replicates the destruction of every session whose TTL
+// passed, which deletes their pairs on every replica.
+func (a *Agent) reapExpiredSessions() {
+	defer metrics.MeasureSince(
+		[]string{"taskvault", "leader", "reap_sessions"}, time.Now(),
+	)
+
+	for _, s := range a.sessions.expired(time.Now()) {
+		err := a.applyDestroySession(context.Background(), &types.DestroySessionRequest{
+			Id:        s.Id,
+			ExpiresAt: s.ExpiresAt,
+		})
+		if err != nil && !errors.Is(err, ErrSessionNotFound) {
+			a.logger.Error("taskvault: failed to expire session",
+				zap.String("session", s.Id),
+				zap.Error(err),
+			)
+			return
+		}
+	}
+}
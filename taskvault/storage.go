@@ -2,21 +2,95 @@ package taskvault
 
 import (
 	"io"
+	"os"
+	"path/filepath"
+	"time"
 
+	"github.com/danluki/taskvault/pkg/types"
 	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
 )
 
+// Consistency controls how fresh a read served by the agent must be.
+type Consistency int
+
+const (
+	// Stale reads are served from the local store, even on followers and
+	// even while no leader is known.
+	Stale Consistency = iota
+	// Linearizable reads are served by the leader after a raft barrier,
+	// so they observe every write committed before the read started.
+	Linearizable
+	// ReadIndex reads give the same guarantee as Linearizable ones, but the
+	// leader confirms its leadership with a heartbeat round instead of
+	// writing a barrier to the log.
+	ReadIndex
+)
+
+type ReadOptions struct {
+	Consistency Consistency
+
+	// IncludeExpired returns pairs whose TTL passed but that were not swept
+	// by the leader yet. It is meant for the FSM, not for API reads.
+	IncludeExpired bool
+}
+
 type SyncraStorage interface {
 	GetValue(key string) (string, error)
+	GetPair(key string, opts ReadOptions) (*types.Pair, error)
 	UpdateValue(key string, value string) error
 	SetValue(key string, value string) error
-	DeleteValue(key string) error
+	SetPair(pair *types.Pair) error
+	DeletePair(key string) error
+	Txn(ops []*types.TxnOp) error
 	GetAllValues() ([]Pair, error)
+	ListPairs(prefix string) ([]*types.Pair, error)
+	ScanPairs(prefix, after string, limit int) ([]*types.Pair, error)
+	ListKeys(prefix string) ([]string, error)
+	Count(prefix string) (int, error)
+	ExpiredPairs(now time.Time) ([]*types.Pair, error)
+	AllPairs() ([]*types.Pair, error)
+	Len() (int, error)
 	Shutdown() error
 	Snapshot(w io.WriteCloser) error
 	Restore(r io.ReadCloser) error
 }
 
+// fsmSnapshotter is implemented by stores that can hand raft a consistent
+// view of their pairs natively, instead of a copy taken on the FSM goroutine.
+type fsmSnapshotter interface {
+	FSMSnapshot() (raft.FSMSnapshot, error)
+}
+
+// restoredExpirer is implemented by stores that restore snapshots whose TTLs
+// are relative, the FSM hands them the time of the next entry to count from.
+type restoredExpirer interface {
+	expireRestored(now time.Time) error
+}
+
+const (
+	StoreBackendMemory = "memory"
+	StoreBackendBolt   = "bolt"
+)
+
+// newStorage builds the store selected by the store-backend option.
+func newStorage(c *Config, logger *zap.SugaredLogger) (SyncraStorage, error) {
+	switch c.StoreBackend {
+	case StoreBackendBolt:
+		path := c.storePath()
+		if err := os.MkdirAll(path.dir, 0o700); err != nil {
+			return nil, path.error(err)
+		}
+		s, err := NewBoltStore(filepath.Join(path.dir, "store.db"), logger)
+		if err != nil {
+			return nil, path.error(err)
+		}
+		return s, nil
+	default:
+		return NewStore(logger)
+	}
+}
+
 type RaftStore interface {
 	raft.StableStore
 	raft.LogStore
@@ -1,23 +1,140 @@
 package taskvault
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
+	"time"
 
+	"github.com/danluki/taskvault/pkg/types"
 	"github.com/tidwall/buntdb"
 	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
 )
 
+var (
+	ErrKeyNotFound     = errors.New("key not found")
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+)
+
+// snapshotMagic starts every snapshot, it is followed by length delimited
+// types.Pair records so snapshots do not depend on the storage engine.
+var snapshotMagic = []byte("TVSNAP1\n")
+
+func writeSnapshot(w io.Writer, pairs []*types.Pair) error {
+	_, err := streamSnapshot(w, func(emit func(*types.Pair) error) error {
+		for _, pair := range pairs {
+			if err := emit(pair); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// streamSnapshot writes the header and every pair that each emits to w, and
+// returns the number of pairs written.
+func streamSnapshot(w io.Writer, each func(emit func(*types.Pair) error) error) (int, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(snapshotMagic); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err := each(func(pair *types.Pair) error {
+		n++
+		_, err := protodelim.MarshalTo(bw, pair)
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, bw.Flush()
+}
+
+// snapshotBufferSize is the read buffer of restores, larger than the bufio
+// default to cut the number of reads from the snapshot stream.
+const snapshotBufferSize = 64 << 10
+
+// snapshotUnmarshal lifts the default 4MiB limit, a snapshot must restore
+// whatever the FSM accepted.
+var snapshotUnmarshal = protodelim.UnmarshalOptions{MaxSize: -1}
+
+// readSnapshot consumes the magic header written by writeSnapshot and calls
+// fn for every pair that follows it.
+func readSnapshot(br *bufio.Reader, fn func(*types.Pair) error) error {
+	head := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, head); err != nil || !bytes.Equal(head, snapshotMagic) {
+		return fmt.Errorf("%w: missing header", ErrInvalidSnapshot)
+	}
+
+	for {
+		pair := &types.Pair{}
+		err := snapshotUnmarshal.UnmarshalFrom(br, pair)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+
+		if err := fn(pair); err != nil {
+			return err
+		}
+	}
+}
+
+// Store keeps every pair encoded as a types.Pair so metadata such as the
+// expiry time is persisted next to the value and travels with snapshots.
 type Store struct {
 	db *buntdb.DB
 
+	// restoredTTLs are the TTLs of the last legacy snapshot restored, they
+	// are only relative until expireRestored. Restore and expireRestored both
+	// run on the FSM goroutine.
+	restoredTTLs map[string]time.Duration
+
 	logger *zap.SugaredLogger
 }
 
 var _ SyncraStorage = (*Store)(nil)
 
-func (s *Store) DeleteValue(key string) error {
+func encodePair(pair *types.Pair) (string, error) {
+	b, err := proto.Marshal(pair)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func decodePair(key, v string) (*types.Pair, error) {
+	pair := &types.Pair{}
+	if err := proto.Unmarshal([]byte(v), pair); err != nil {
+		return nil, err
+	}
+	pair.Key = key
+	return pair, nil
+}
+
+// pairExpired reports whether the pair carries an expiry that already passed.
+func pairExpired(pair *types.Pair, now time.Time) bool {
+	return pair.ExpiresAt != 0 && pair.ExpiresAt <= now.UnixNano()
+}
+
+// DeletePair removes the key, returning ErrKeyNotFound when it was absent so
+// callers can tell a no-op apart from a real deletion.
+func (s *Store) DeletePair(key string) error {
 	err := s.db.Update(func(tx *buntdb.Tx) error {
 		_, err := tx.Delete(key)
+		if errors.Is(err, buntdb.ErrNotFound) {
+			return ErrKeyNotFound
+		}
 		return err
 	})
 
@@ -26,15 +143,28 @@ func (s *Store) DeleteValue(key string) error {
 
 func (s *Store) GetAllValues() ([]Pair, error) {
 	var pairs []Pair
+	now := time.Now()
 
 	err := s.db.View(func(tx *buntdb.Tx) error {
+		var derr error
 		err := tx.Ascend("", func(k, v string) bool {
+			pair, err := decodePair(k, v)
+			if err != nil {
+				derr = err
+				return false
+			}
+			if pairExpired(pair, now) {
+				return true
+			}
 			pairs = append(pairs, Pair{
 				Key:   k,
-				Value: v,
+				Value: pair.Value,
 			})
 			return true
 		})
+		if derr != nil {
+			return derr
+		}
 
 		return err
 	})
@@ -43,41 +173,363 @@ func (s *Store) GetAllValues() ([]Pair, error) {
 }
 
 func (s *Store) GetValue(key string) (string, error) {
-	var value string
+	pair, err := s.GetPair(key, ReadOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	return pair.Value, nil
+}
+
+// GetPair reads the pair from the local database. Consistency is enforced by
+// the agent before the store is consulted, so the store itself always serves
+// its current state. Expired pairs that were not swept yet are reported as
+// missing unless IncludeExpired is set.
+func (s *Store) GetPair(key string, opts ReadOptions) (*types.Pair, error) {
+	var pair *types.Pair
 
 	err := s.db.View(func(tx *buntdb.Tx) error {
 		v, err := tx.Get(key)
 		if err != nil {
+			if errors.Is(err, buntdb.ErrNotFound) {
+				return ErrKeyNotFound
+			}
 			return err
 		}
 
-		value = v
+		pair, err = decodePair(key, v)
+		if err != nil {
+			return err
+		}
+
+		if !opts.IncludeExpired && pairExpired(pair, time.Now()) {
+			pair = nil
+			return ErrKeyNotFound
+		}
 
 		return nil
 	})
 
-	return value, err
+	return pair, err
+}
+
+// ListPairs returns every live pair whose key starts with prefix, in
+// lexicographic key order.
+func (s *Store) ListPairs(prefix string) ([]*types.Pair, error) {
+	return s.ScanPairs(prefix, "", 0)
+}
+
+// ScanPairs returns up to limit live pairs under prefix whose key sorts
+// strictly after the given key. A zero limit returns every match.
+func (s *Store) ScanPairs(prefix, after string, limit int) ([]*types.Pair, error) {
+	var pairs []*types.Pair
+	err := s.ascendLive(prefix, after, func(pair *types.Pair) bool {
+		pairs = append(pairs, pair)
+		return limit <= 0 || len(pairs) < limit
+	})
+
+	return pairs, err
+}
+
+// ListKeys returns the keys of the live pairs under prefix in key order.
+func (s *Store) ListKeys(prefix string) ([]string, error) {
+	var keys []string
+	err := s.ascendLive(prefix, "", func(pair *types.Pair) bool {
+		keys = append(keys, pair.Key)
+		return true
+	})
+
+	return keys, err
+}
+
+// Count returns how many live pairs are stored under prefix.
+func (s *Store) Count(prefix string) (int, error) {
+	n := 0
+	err := s.ascendLive(prefix, "", func(*types.Pair) bool {
+		n++
+		return true
+	})
+
+	return n, err
+}
+
+// ascendLive calls fn in key order with every pair under prefix that did not
+// expire and sorts after the given key, until fn returns false.
+func (s *Store) ascendLive(prefix, after string, fn func(*types.Pair) bool) error {
+	now := time.Now()
+
+	pivot := prefix
+	if after > pivot {
+		pivot = after
+	}
+
+	return s.db.View(func(tx *buntdb.Tx) error {
+		var derr error
+		err := tx.AscendGreaterOrEqual("", pivot, func(k, v string) bool {
+			if !strings.HasPrefix(k, prefix) {
+				return false
+			}
+			if after != "" && k <= after {
+				return true
+			}
+
+			pair, err := decodePair(k, v)
+			if err != nil {
+				derr = err
+				return false
+			}
+			if pairExpired(pair, now) {
+				return true
+			}
+
+			return fn(pair)
+		})
+		if derr != nil {
+			return derr
+		}
+
+		return err
+	})
+}
+
+// AllPairs returns every stored pair in key order, including expired pairs
+// that were not swept yet.
+func (s *Store) AllPairs() ([]*types.Pair, error) {
+	var pairs []*types.Pair
+
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		var derr error
+		err := tx.Ascend("", func(k, v string) bool {
+			pair, err := decodePair(k, v)
+			if err != nil {
+				derr = err
+				return false
+			}
+			pairs = append(pairs, pair)
+			return true
+		})
+		if derr != nil {
+			return derr
+		}
+
+		return err
+	})
+
+	return pairs, err
+}
+
+// ExpiredPairs returns every pair whose expiry is at or before now.
+func (s *Store) ExpiredPairs(now time.Time) ([]*types.Pair, error) {
+	var pairs []*types.Pair
+
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		var derr error
+		err := tx.Ascend("", func(k, v string) bool {
+			pair, err := decodePair(k, v)
+			if err != nil {
+				derr = err
+				return false
+			}
+			if pairExpired(pair, now) {
+				pairs = append(pairs, pair)
+			}
+			return true
+		})
+		if derr != nil {
+			return derr
+		}
+
+		return err
+	})
+
+	return pairs, err
 }
 
+// Len returns the number of stored keys, including expired pairs that were
+// not swept yet.
+func (s *Store) Len() (int, error) {
+	var n int
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		n, err = tx.Len()
+		return err
+	})
+	return n, err
+}
+
+// Restore replaces the whole content of the store with the snapshot read
+// from r. Snapshots written before snapshotMagic existed are raw buntdb
+// dumps and are still accepted, see restoreLegacy.
 func (s *Store) Restore(r io.ReadCloser) error {
-	return s.db.Load(r)
+	br := bufio.NewReaderSize(r, snapshotBufferSize)
+	head, err := br.Peek(len(snapshotMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	s.restoredTTLs = nil
+	if !bytes.Equal(head, snapshotMagic) {
+		return s.restoreLegacy(br)
+	}
+
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		if err := tx.DeleteAll(); err != nil {
+			return err
+		}
+
+		return readSnapshot(br, func(pair *types.Pair) error {
+			v, err := encodePair(pair)
+			if err != nil {
+				return err
+			}
+			_, _, err = tx.Set(pair.Key, v, nil)
+			return err
+		})
+	})
+}
+
+// restoreLegacy loads a raw buntdb dump, whose values are the plain strings
+// stored before pairs were. They are converted to pairs on the way in, an
+// expiry set in the dump is kept, see expireRestored.
+func (s *Store) restoreLegacy(r io.Reader) error {
+	legacy, err := buntdb.Open(":memory:")
+	if err != nil {
+		return err
+	}
+	defer legacy.Close()
+	if err := legacy.Load(r); err != nil {
+		return err
+	}
+
+	// The dump keeps whole seconds left, counted from when it is loaded.
+	// Replicas load it at different times, so the pairs only get an expiry
+	// once the next applied entry gives a time they all agree on.
+	ttls := make(map[string]time.Duration)
+	err = s.db.Update(func(tx *buntdb.Tx) error {
+		if err := tx.DeleteAll(); err != nil {
+			return err
+		}
+
+		return legacy.View(func(ltx *buntdb.Tx) error {
+			var setErr error
+			err := ltx.Ascend("", func(key, value string) bool {
+				if ttl, _ := ltx.TTL(key); ttl > 0 {
+					ttls[key] = ttl.Round(time.Second)
+				}
+				var v string
+				if v, setErr = encodePair(&types.Pair{Key: key, Value: value}); setErr == nil {
+					_, _, setErr = tx.Set(key, v, nil)
+				}
+				return setErr == nil
+			})
+			if err != nil {
+				return err
+			}
+			return setErr
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if len(ttls) > 0 {
+		s.restoredTTLs = ttls
+	}
+	return nil
+}
+
+// expireRestored gives the pairs of a legacy snapshot their expiry, counted
+// from now, the time the first entry after the restore was appended at.
+func (s *Store) expireRestored(now time.Time) error {
+	if len(s.restoredTTLs) == 0 {
+		return nil
+	}
+	ttls := s.restoredTTLs
+	s.restoredTTLs = nil
+
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		for key, ttl := range ttls {
+			v, err := tx.Get(key)
+			if errors.Is(err, buntdb.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			pair, err := decodePair(key, v)
+			if err != nil {
+				return err
+			}
+			pair.ExpiresAt = now.Add(ttl).UnixNano()
+			if v, err = encodePair(pair); err != nil {
+				return err
+			}
+			if _, _, err := tx.Set(key, v, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (s *Store) SetValue(key string, value string) error {
-	err := s.db.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(key, value, nil)
+	return s.SetPair(&types.Pair{
+		Key:   key,
+		Value: value,
+	})
+}
+
+func (s *Store) SetPair(pair *types.Pair) error {
+	v, err := encodePair(pair)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(pair.Key, v, nil)
 		return err
 	})
 
 	return err
 }
 
+// Txn applies the operations in order within a single buntdb transaction, so
+// either all of them are stored or none is. Deleting a missing key is a no-op.
+func (s *Store) Txn(ops []*types.TxnOp) error {
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		for _, op := range ops {
+			switch op.Type {
+			case types.TxnOpType_TXN_SET:
+				v, err := encodePair(op.Pair)
+				if err != nil {
+					return err
+				}
+				if _, _, err := tx.Set(op.Pair.Key, v, nil); err != nil {
+					return err
+				}
+			case types.TxnOpType_TXN_DELETE:
+				if _, err := tx.Delete(op.Pair.Key); err != nil && !errors.Is(err, buntdb.ErrNotFound) {
+					return err
+				}
+			default:
+				return fmt.Errorf("store: unknown txn op %d", op.Type)
+			}
+		}
+		return nil
+	})
+}
+
 func (s *Store) Shutdown() error {
 	return s.db.Close()
 }
 
+// Snapshot writes every stored pair, expired ones included, to w.
 func (s *Store) Snapshot(w io.WriteCloser) error {
-	return s.db.Save(w)
+	pairs, err := s.AllPairs()
+	if err != nil {
+		return err
+	}
+
+	return writeSnapshot(w, pairs)
 }
 
 func (s *Store) UpdateValue(key string, value string) error {
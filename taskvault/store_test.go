@@ -0,0 +1,176 @@
+package taskvault
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/danluki/taskvault/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/buntdb"
+	"go.uber.org/zap"
+)
+
+func newTestStore(t *testing.T) *Store {
+	s, err := NewStore(zap.NewNop().Sugar())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Shutdown() })
+	return s
+}
+
+func TestStore_GetPair(t *testing.T) {
+	s := newTestStore(t)
+
+	_, err := s.GetPair("missing", ReadOptions{})
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	require.NoError(t, s.SetValue("foo", "bar"))
+
+	pair, err := s.GetPair("foo", ReadOptions{Consistency: Stale})
+	require.NoError(t, err)
+	assert.Equal(t, "foo", pair.Key)
+	assert.Equal(t, "bar", pair.Value)
+}
+
+func TestStore_Expiry(t *testing.T) {
+	s := newTestStore(t)
+
+	past := time.Now().Add(-time.Minute).UnixNano()
+	future := time.Now().Add(time.Hour).UnixNano()
+	require.NoError(t, s.SetPair(&types.Pair{Key: "old", Value: "v", ExpiresAt: past}))
+	require.NoError(t, s.SetPair(&types.Pair{Key: "new", Value: "v", ExpiresAt: future}))
+
+	_, err := s.GetPair("old", ReadOptions{})
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	pair, err := s.GetPair("old", ReadOptions{IncludeExpired: true})
+	require.NoError(t, err)
+	assert.Equal(t, past, pair.ExpiresAt)
+
+	expired, err := s.ExpiredPairs(time.Now())
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+	assert.Equal(t, "old", expired[0].Key)
+
+	all, err := s.GetAllValues()
+	require.NoError(t, err)
+	assert.Equal(t, []Pair{{Key: "new", Value: "v"}}, all)
+}
+
+func TestStore_SnapshotKeepsExpiry(t *testing.T) {
+	s := newTestStore(t)
+
+	future := time.Now().Add(time.Hour).UnixNano()
+	require.NoError(t, s.SetPair(&types.Pair{Key: "foo", Value: "bar", ExpiresAt: future}))
+
+	r, w := io.Pipe()
+	go func() {
+		_ = w.CloseWithError(s.Snapshot(w))
+	}()
+
+	restored := newTestStore(t)
+	require.NoError(t, restored.Restore(r))
+
+	pair, err := restored.GetPair("foo", ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "bar", pair.Value)
+	assert.Equal(t, future, pair.ExpiresAt)
+}
+
+func TestStore_RestoreLegacy(t *testing.T) {
+	// A dump of the store from before snapshotMagic, with raw values.
+	legacy, err := buntdb.Open(":memory:")
+	require.NoError(t, err)
+	defer legacy.Close()
+	require.NoError(t, legacy.Update(func(tx *buntdb.Tx) error {
+		if _, _, err := tx.Set("foo", "bar", nil); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("tmp", "v", &buntdb.SetOptions{Expires: true, TTL: time.Hour})
+		return err
+	}))
+	var dump bytes.Buffer
+	require.NoError(t, legacy.Save(&dump))
+	replica := newTestStore(t)
+	require.NoError(t, replica.Restore(io.NopCloser(bytes.NewReader(dump.Bytes()))))
+
+	s := newTestStore(t)
+	require.NoError(t, s.SetValue("gone", "v"))
+	require.NoError(t, s.Restore(io.NopCloser(&dump)))
+
+	pair, err := s.GetPair("foo", ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "bar", pair.Value)
+	assert.Zero(t, pair.ExpiresAt)
+
+	// The expiry counts from the next applied entry, not from the restore.
+	pair, err = s.GetPair("tmp", ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "v", pair.Value)
+	assert.Zero(t, pair.ExpiresAt)
+
+	appendedAt := time.Now()
+	require.NoError(t, s.expireRestored(appendedAt))
+	require.NoError(t, s.expireRestored(appendedAt.Add(time.Minute)))
+	pair, err = s.GetPair("tmp", ReadOptions{})
+	require.NoError(t, err)
+	assert.InDelta(t, appendedAt.Add(time.Hour).UnixNano(), pair.ExpiresAt, float64(time.Second))
+
+	// Another replica that restored the same dump agrees on it.
+	require.NoError(t, replica.expireRestored(appendedAt))
+	other, err := replica.GetPair("tmp", ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, pair.ExpiresAt, other.ExpiresAt)
+
+	_, err = s.GetPair("gone", ReadOptions{})
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestStore_ScanPairs(t *testing.T) {
+	s := newTestStore(t)
+
+	for _, k := range []string{"a", "config/b/x", "config/a/2", "config/a/1", "config/c", "d"} {
+		require.NoError(t, s.SetValue(k, k))
+	}
+
+	keys := func(pairs []*types.Pair) (ks []string) {
+		for _, p := range pairs {
+			ks = append(ks, p.Key)
+		}
+		return
+	}
+
+	pairs, err := s.ListPairs("config/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"config/a/1", "config/a/2", "config/b/x", "config/c"}, keys(pairs))
+
+	pairs, err = s.ScanPairs("config/", "config/a/2", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"config/b/x", "config/c"}, keys(pairs))
+}
+
+func TestStore_ListKeysAndCount(t *testing.T) {
+	s := newTestStore(t)
+
+	for _, k := range []string{"a", "config/b", "config/a", "d"} {
+		require.NoError(t, s.SetValue(k, k))
+	}
+	require.NoError(t, s.SetPair(&types.Pair{
+		Key:       "config/expired",
+		ExpiresAt: time.Now().Add(-time.Second).UnixNano(),
+	}))
+
+	keys, err := s.ListKeys("config/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"config/a", "config/b"}, keys)
+
+	n, err := s.Count("config/")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = s.Count("")
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+}
@@ -0,0 +1,57 @@
+package taskvault
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sdReadyPollInterval is how often a starting agent checks whether it can
+// tell systemd it is ready.
+const sdReadyPollInterval = 250 * time.Millisecond
+
+// sdNotify sends state to systemd when the agent runs as a Type=notify
+// service, it is a no-op without NOTIFY_SOCKET. Abstract sockets, starting
+// with @, are handled by the net package.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notifyReady sends READY=1 once the node has joined serf and knows a raft
+// leader, so units ordered after this one start when it can serve.
+func (a *Agent) notifyReady() {
+	ticker := time.NewTicker(sdReadyPollInterval)
+	defer ticker.Stop()
+
+	for {
+		switch a.Health() {
+		case HealthServing, HealthMaintenance:
+			if err := sdNotify("READY=1"); err != nil {
+				a.logger.With(zap.Error(err)).Warn("agent: failed to notify systemd")
+			}
+			return
+		case HealthShuttingDown:
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-a.shutdowner:
+			return
+		}
+	}
+}
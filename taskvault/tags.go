@@ -0,0 +1,74 @@
+package taskvault
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+)
+
+var ErrInvalidTag = errors.New("invalid tag")
+
+// reservedTags are the serf tags the agent sets itself, other nodes rely on
+// them to find and reconcile servers.
+var reservedTags = map[string]bool{
+	"version":   true,
+	"rpc_addr":  true,
+	"raft_addr": true,
+	"port":      true,
+	"bootstrap": true,
+	"expect":    true,
+	"non_voter": true,
+	"raft_vsn":  true,
+	"dc":        true,
+	"started":   true,
+
+	httpAddrTag:    true,
+	maintenanceTag: true,
+	readOnlyTag:    true,
+}
+
+func checkTagKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: the key must not be empty", ErrInvalidTag)
+	}
+	if reservedTags[key] {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidTag, key)
+	}
+	return nil
+}
+
+// SetTag sets a custom tag on the local serf member, it is gossiped to the
+// rest of the cluster. Reserved tags can not be changed.
+func (a *Agent) SetTag(key, value string) error {
+	if err := checkTagKey(key); err != nil {
+		return err
+	}
+
+	return a.updateTags(func(tags map[string]string) {
+		tags[key] = value
+	})
+}
+
+// DeleteTag removes a custom tag from the local serf member. Deleting a tag
+// that is not set is a no-op.
+func (a *Agent) DeleteTag(key string) error {
+	if err := checkTagKey(key); err != nil {
+		return err
+	}
+
+	return a.updateTags(func(tags map[string]string) {
+		delete(tags, key)
+	})
+}
+
+// updateTags applies fn to a copy of the local tags and gossips the result,
+// serf replaces the whole set at once.
+func (a *Agent) updateTags(fn func(map[string]string)) error {
+	a.tagsLock.Lock()
+	defer a.tagsLock.Unlock()
+
+	tags := maps.Clone(a.serf.LocalMember().Tags)
+	fn(tags)
+
+	return a.serf.SetTags(tags)
+}
@@ -0,0 +1,169 @@
+package taskvault
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+var ErrTLSIncomplete = errors.New("tls: cert-file and key-file must be set together")
+
+// TLSEnabled reports whether the node serves RPC over TLS.
+func (c *Config) TLSEnabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+func (c *Config) checkTLS() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return ErrTLSIncomplete
+	}
+	if c.CAFile != "" && !c.TLSEnabled() {
+		return errors.New("tls: ca-file requires cert-file and key-file")
+	}
+	if (c.RaftTLS || c.RaftTLSStrict) && !c.TLSEnabled() {
+		return errors.New("tls: raft-tls requires cert-file and key-file")
+	}
+	return nil
+}
+
+// keyPair is the node certificate loaded from cert-file and key-file. TLS
+// configs built on it fetch the certificate on every handshake, so after a
+// reload new connections use the new certificate while open ones stay up.
+type keyPair struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+func loadKeyPair(certFile, keyFile string) (*keyPair, error) {
+	pair := &keyPair{certFile: certFile, keyFile: keyFile}
+	if err := pair.reload(); err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+// reload reads the files again. On error the previous certificate is kept.
+func (k *keyPair) reload() error {
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls: loading key pair: %w", err)
+	}
+	k.cert.Store(&cert)
+	return nil
+}
+
+func (k *keyPair) certificate() *tls.Certificate {
+	return k.cert.Load()
+}
+
+func (k *keyPair) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return k.certificate(), nil
+}
+
+func (k *keyPair) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return k.certificate(), nil
+}
+
+// newRaftLayer builds the raft stream layer matching the TLS settings.
+func (c *Config) newRaftLayer(logger *zap.SugaredLogger, pair *keyPair) (*RaftLayer, error) {
+	if !c.TLSEnabled() {
+		return NewRaftLayer(logger), nil
+	}
+
+	incoming, err := c.incomingTLSConfig(pair)
+	if err != nil {
+		return nil, err
+	}
+
+	var outgoing *tls.Config
+	if c.RaftTLS {
+		outgoing, err = c.outgoingTLSConfig(pair)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewTLSRaftLayer(logger, incoming, outgoing, c.RaftTLSStrict), nil
+}
+
+func loadCAPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("tls: reading CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls: no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// IncomingTLSConfig builds the server side configuration. When a CA is
+// configured every client must present a certificate signed by it.
+func (c *Config) IncomingTLSConfig() (*tls.Config, error) {
+	if err := c.checkTLS(); err != nil {
+		return nil, err
+	}
+
+	pair, err := loadKeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return c.incomingTLSConfig(pair)
+}
+
+func (c *Config) incomingTLSConfig(pair *keyPair) (*tls.Config, error) {
+	conf := &tls.Config{
+		GetCertificate: pair.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if c.CAFile != "" {
+		pool, err := loadCAPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, nil
+}
+
+// OutgoingTLSConfig builds the client side configuration. The node presents
+// its own certificate so that peers requiring mTLS accept it, and verifies
+// servers against the configured CA, or the system roots without one.
+func (c *Config) OutgoingTLSConfig() (*tls.Config, error) {
+	if err := c.checkTLS(); err != nil {
+		return nil, err
+	}
+
+	pair, err := loadKeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return c.outgoingTLSConfig(pair)
+}
+
+func (c *Config) outgoingTLSConfig(pair *keyPair) (*tls.Config, error) {
+	conf := &tls.Config{
+		GetClientCertificate: pair.getClientCertificate,
+		MinVersion:           tls.VersionTLS12,
+	}
+
+	if c.CAFile != "" {
+		pool, err := loadCAPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+
+	return conf, nil
+}
@@ -0,0 +1,195 @@
+package taskvault
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// writeTestPKI writes a CA and a node certificate signed by it into dir and
+// returns a config pointing at them.
+func writeTestPKI(t *testing.T, dir string) *Config {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "taskvault-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	write := func(name, typ string, b []byte) string {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0o600))
+		return p
+	}
+
+	return &Config{
+		CAFile:   write("ca.pem", "CERTIFICATE", caDER),
+		CertFile: write("node.pem", "CERTIFICATE", der),
+		KeyFile:  write("node-key.pem", "EC PRIVATE KEY", keyDER),
+	}
+}
+
+func TestTLS_MutualAuth(t *testing.T) {
+	c := writeTestPKI(t, t.TempDir())
+
+	in, err := c.IncomingTLSConfig()
+	require.NoError(t, err)
+	require.Equal(t, tls.RequireAndVerifyClientCert, in.ClientAuth)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", in)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	out, err := c.OutgoingTLSConfig()
+	require.NoError(t, err)
+	conn, err := tls.Dial("tcp", ln.Addr().String(), out)
+	require.NoError(t, err)
+	conn.Close()
+
+	// Without a client certificate the server must reject the handshake.
+	anon := out.Clone()
+	anon.GetClientCertificate = nil
+	conn, err = tls.Dial("tcp", ln.Addr().String(), anon)
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	require.Error(t, err)
+}
+
+func TestTLS_ReloadKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	c := writeTestPKI(t, dir)
+
+	pair, err := loadKeyPair(c.CertFile, c.KeyFile)
+	require.NoError(t, err)
+	old, err := pair.getCertificate(nil)
+	require.NoError(t, err)
+
+	// The rotated certificate is picked up by the next handshake.
+	writeTestPKI(t, dir)
+	require.NoError(t, pair.reload())
+	cert, err := pair.getCertificate(nil)
+	require.NoError(t, err)
+	require.NotEqual(t, old.Certificate, cert.Certificate)
+
+	// A half written rotation keeps the current certificate.
+	require.NoError(t, os.WriteFile(c.KeyFile, []byte("garbage"), 0o600))
+	require.Error(t, pair.reload())
+	kept, err := pair.getClientCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, cert, kept)
+}
+
+func TestTLS_Incomplete(t *testing.T) {
+	c := &Config{CertFile: "node.pem"}
+	require.ErrorIs(t, c.checkTLS(), ErrTLSIncomplete)
+
+	c = &Config{CAFile: "ca.pem"}
+	require.Error(t, c.checkTLS())
+}
+
+func TestRaftLayer_TLS(t *testing.T) {
+	c := writeTestPKI(t, t.TempDir())
+	c.RaftTLS = true
+	c.RaftTLSStrict = true
+
+	pair, err := loadKeyPair(c.CertFile, c.KeyFile)
+	require.NoError(t, err)
+	layer, err := c.newRaftLayer(zap.NewNop().Sugar(), pair)
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	layer.Open(ln)
+	defer layer.Close()
+
+	go func() {
+		for {
+			conn, err := layer.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	addr := raft.ServerAddress(ln.Addr().String())
+
+	conn, err := layer.Dial(addr, time.Second)
+	require.NoError(t, err)
+	_, ok := conn.(*tls.Conn)
+	require.True(t, ok)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+	conn.Close()
+
+	// Strict mode closes plaintext peers without answering.
+	plain, err := NewRaftLayer(zap.NewNop().Sugar()).Dial(addr, time.Second)
+	require.NoError(t, err)
+	defer plain.Close()
+	_, err = plain.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(plain, buf)
+	require.Error(t, err)
+}
@@ -0,0 +1,174 @@
+package taskvault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// tracer records spans through the global otel TracerProvider. It is a no-op
+// until TracingEndpoint is set or the program embedding the agent registers a
+// provider and a propagator with otel.SetTracerProvider and
+// otel.SetTextMapPropagator.
+var tracer = otel.Tracer("github.com/danluki/taskvault/taskvault")
+
+// otlpExporter installs a global TracerProvider exporting to an OTLP
+// collector and returns the function flushing and stopping it. It is only
+// set in binaries built with the tracing_otlp tag, see tracing_otlp.go.
+var otlpExporter func(endpoint *url.URL, nodeName string) (func(context.Context) error, error)
+
+// validateTracingEndpoint checks that endpoint is an http or https URL and
+// that this binary can export to it.
+func validateTracingEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("tracing-endpoint %q must be an http:// or https:// URL", endpoint)
+	}
+	if otlpExporter == nil {
+		return errors.New("tracing-endpoint needs a binary built with the tracing_otlp tag")
+	}
+	return nil
+}
+
+// setupTracing exports spans to TracingEndpoint, if set, and propagates the
+// W3C trace context and baggage through gRPC metadata.
+func (a *Agent) setupTracing() error {
+	if a.config.TracingEndpoint == "" {
+		return nil
+	}
+	if err := validateTracingEndpoint(a.config.TracingEndpoint); err != nil {
+		return err
+	}
+	u, _ := url.Parse(a.config.TracingEndpoint)
+	stop, err := otlpExporter(u, a.config.NodeName)
+	if err != nil {
+		return err
+	}
+	a.stopTracing = stop
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+	return nil
+}
+
+// metadataCarrier lets the otel propagator read and write gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startServerSpan continues the trace of the caller, if any, for method.
+func startServerSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md.Copy()))
+
+	return tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("rpc.method", method)),
+	)
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+func unaryTracingInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (resp interface{}, err error) {
+	ctx, span := startServerSpan(ctx, info.FullMethod)
+	defer func() { endSpan(span, err) }()
+
+	return handler(ctx, req)
+}
+
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func streamTracingInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) (err error) {
+	ctx, span := startServerSpan(ss.Context(), info.FullMethod)
+	defer func() { endSpan(span, err) }()
+
+	return handler(srv, &tracedServerStream{ServerStream: ss, ctx: ctx})
+}
+
+// tracingDialOptions propagate the trace context of every outgoing call, so
+// a write forwarded to the leader shows up in the trace of the follower.
+func tracingDialOptions() []grpc.DialOption {
+	withTrace := func(ctx context.Context) context.Context {
+		md, ok := metadata.FromOutgoingContext(ctx)
+		if !ok {
+			md = metadata.MD{}
+		} else {
+			md = md.Copy()
+		}
+		otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+		return metadata.NewOutgoingContext(ctx, md)
+	}
+
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(
+			ctx context.Context,
+			method string,
+			req, reply interface{},
+			cc *grpc.ClientConn,
+			invoker grpc.UnaryInvoker,
+			opts ...grpc.CallOption,
+		) error {
+			return invoker(withTrace(ctx), method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(
+			ctx context.Context,
+			desc *grpc.StreamDesc,
+			cc *grpc.ClientConn,
+			method string,
+			streamer grpc.Streamer,
+			opts ...grpc.CallOption,
+		) (grpc.ClientStream, error) {
+			return streamer(withTrace(ctx), desc, cc, method, opts...)
+		}),
+	}
+}
@@ -0,0 +1,31 @@
+package taskvault
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgent_SetupTracing(t *testing.T) {
+	c := DefaultConfig()
+	c.DataDir = t.TempDir()
+	c.TracingEndpoint = "http://127.0.0.1:4317"
+	a := NewAgent(c)
+
+	err := a.setupTracing()
+	if otlpExporter == nil {
+		// Without the tracing_otlp tag the endpoint is refused, not ignored.
+		assert.ErrorContains(t, err, "tracing_otlp")
+		assert.ErrorContains(t, a.Start(), "tracing_otlp")
+		return
+	}
+
+	require.NoError(t, err)
+	require.NotNil(t, a.stopTracing)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = a.stopTracing(ctx)
+}
@@ -12,13 +12,16 @@ import (
 type ServerParts struct {
 	Name         string
 	ID           string
+	Datacenter   string
 	Port         int
 	Bootstrap    bool
+	NonVoter     bool
 	Expect       int
 	RaftVersion  int
 	BuildVersion *version.Version
 	Addr         net.Addr
 	RPCAddr      net.Addr
+	RaftAddr     net.Addr
 	Status       serf.MemberStatus
 }
 
@@ -72,14 +75,32 @@ func toServerPart(m serf.Member) *ServerParts {
 	parts := &ServerParts{
 		Name:         m.Name,
 		ID:           m.Name,
+		Datacenter:   m.Tags["dc"],
 		Port:         port,
 		Bootstrap:    bootstrap,
+		NonVoter:     m.Tags["non_voter"] == "1",
 		Expect:       expect,
 		Addr:         &net.TCPAddr{IP: m.Addr, Port: port},
 		RPCAddr:      &net.TCPAddr{IP: rpcIP, Port: port},
+		RaftAddr:     &net.TCPAddr{IP: m.Addr, Port: port},
 		BuildVersion: buildVersion,
 		Status:       m.Status,
 	}
 
+	if tag := m.Tags["raft_addr"]; tag != "" {
+		if addr, err := net.ResolveTCPAddr("tcp", tag); err == nil {
+			parts.RaftAddr = addr
+		}
+	}
+
 	return parts
 }
+
+// raftAddr is the address of m in the raft configuration. Members of older
+// releases share it with gRPC and only set rpc_addr.
+func raftAddr(m serf.Member) string {
+	if addr := m.Tags["raft_addr"]; addr != "" {
+		return addr
+	}
+	return m.Tags["rpc_addr"]
+}
@@ -0,0 +1,144 @@
+package taskvault
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/danluki/taskvault/pkg/types"
+)
+
+var ErrWatchUnavailable = errors.New("watch: raft is not set up")
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+	// EventResync is the last event of a subscription that fell behind or
+	// whose node restored a snapshot. The subscriber has to re-read the
+	// keys it cares about and watch again.
+	EventResync
+)
+
+type Event struct {
+	Type        EventType
+	Key         string
+	Value       string
+	ModifyIndex uint64
+	ContentType string
+	Flags       uint64
+}
+
+// putEvent is the event of writing pair at index.
+func putEvent(pair *types.Pair, index uint64) Event {
+	return Event{
+		Type:        EventPut,
+		Key:         pair.Key,
+		Value:       pair.Value,
+		ModifyIndex: index,
+		ContentType: pair.ContentType,
+		Flags:       pair.Flags,
+	}
+}
+
+// watchBuffer is how many events a subscriber may lag behind before it is
+// dropped with an EventResync.
+const watchBuffer = 128
+
+type watcher struct {
+	prefix string
+	ch     chan Event
+}
+
+// watchHub fans FSM changes out to subscribers. Publishing never blocks the
+// FSM: a subscriber whose buffer is full is dropped instead.
+type watchHub struct {
+	lock     sync.Mutex
+	watchers map[*watcher]struct{}
+
+	// deleteIndex is the index of the last deletion. Deleted keys leave no
+	// ModifyIndex behind, blocking queries use it instead.
+	deleteIndex atomic.Uint64
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// subscribe registers a watcher for keys under prefix until ctx is done.
+func (h *watchHub) subscribe(ctx context.Context, prefix string) <-chan Event {
+	// One slot stays free for the EventResync sent when dropping.
+	w := &watcher{
+		prefix: prefix,
+		ch:     make(chan Event, watchBuffer+1),
+	}
+
+	h.lock.Lock()
+	h.watchers[w] = struct{}{}
+	h.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if _, ok := h.watchers[w]; ok {
+			delete(h.watchers, w)
+			close(w.ch)
+		}
+	}()
+
+	return w.ch
+}
+
+// drop ends a subscription with an EventResync. Callers hold the lock.
+func (h *watchHub) drop(w *watcher) {
+	delete(h.watchers, w)
+	w.ch <- Event{Type: EventResync}
+	close(w.ch)
+}
+
+func (h *watchHub) publish(ev Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if ev.Type == EventDelete && ev.ModifyIndex > h.deleteIndex.Load() {
+		h.deleteIndex.Store(ev.ModifyIndex)
+	}
+
+	for w := range h.watchers {
+		if !strings.HasPrefix(ev.Key, w.prefix) {
+			continue
+		}
+		if len(w.ch) >= watchBuffer {
+			h.drop(w)
+			continue
+		}
+		w.ch <- ev
+	}
+}
+
+// resync drops every subscriber, used when the whole state was replaced.
+func (h *watchHub) resync() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for w := range h.watchers {
+		h.drop(w)
+	}
+}
+
+// Watch streams changes to keys under prefix, as applied by the local FSM,
+// until ctx is done. ModifyIndex is the raft index of the change. The channel
+// is closed when the subscription ends.
+func (a *Agent) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	if a.watches == nil {
+		return nil, ErrWatchUnavailable
+	}
+
+	return a.watches.subscribe(ctx, prefix), nil
+}